@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const tokenIDColumn = "token_id"
+
+var jsonNumberRe = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// Attribute is an OpenSea style trait of a token.
+type Attribute struct {
+	TraitType string      `json:"trait_type"`
+	Value     interface{} `json:"value"`
+}
+
+// attributeTable holds the attributes of every token read from a CSV file
+// with a token_id column and one column per trait type.
+type attributeTable struct {
+	traits []string
+	rows   map[int][]string
+	// numeric columns have their values emitted as JSON numbers
+	numeric []bool
+	// rarity are the scores by index added as the rarityTrait attribute,
+	// see SetRarity
+	rarity      map[int]float64
+	rarityTrait string
+	// rarityIndex are the token indexes by row, see --shuffle-seed
+	rarityIndex map[int]int
+}
+
+func readAttributes(path string) (*attributeTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading %v: %v", path, err)
+	}
+	idColumn := -1
+	for i, name := range header {
+		if strings.TrimSpace(name) == tokenIDColumn {
+			idColumn = i
+		}
+	}
+	if idColumn < 0 {
+		return nil, fmt.Errorf("%v has no %v column", path, tokenIDColumn)
+	}
+
+	table := &attributeTable{rows: make(map[int][]string)}
+	var columns []int
+	for i, name := range header {
+		if i != idColumn {
+			table.traits = append(table.traits, strings.TrimSpace(name))
+			columns = append(columns, i)
+		}
+	}
+	table.numeric = make([]bool, len(columns))
+	for i := range table.numeric {
+		table.numeric[i] = true
+	}
+
+	for row := 2; ; row++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %v: %v", path, err)
+		}
+
+		index, err := strconv.Atoi(strings.TrimSpace(record[idColumn]))
+		if err != nil || index < 0 {
+			return nil, fmt.Errorf("%v row %v: invalid %v %q", path, row, tokenIDColumn, record[idColumn])
+		}
+		if _, ok := table.rows[index]; ok {
+			return nil, fmt.Errorf("%v row %v: duplicate %v %v", path, row, tokenIDColumn, index)
+		}
+
+		values := make([]string, len(columns))
+		for i, column := range columns {
+			values[i] = strings.TrimSpace(record[column])
+			if values[i] == "" {
+				continue
+			}
+			if !jsonNumberRe.MatchString(values[i]) {
+				table.numeric[i] = false
+			}
+		}
+		table.rows[index] = values
+	}
+	return table, nil
+}
+
+// Attributes returns the attributes of the token index, skipping empty
+// cells, and whether the table has a row for it.
+func (t *attributeTable) Attributes(index int) ([]Attribute, bool) {
+	values, ok := t.rows[index]
+	if !ok {
+		return nil, false
+	}
+
+	var attributes []Attribute
+	for i, value := range values {
+		if value == "" {
+			continue
+		}
+		attr := Attribute{TraitType: t.traits[i], Value: value}
+		if t.numeric[i] {
+			attr.Value = json.Number(value)
+		}
+		attributes = append(attributes, attr)
+	}
+	if score, ok := t.rarity[index]; ok && t.rarityTrait != "" {
+		attributes = append(attributes, Attribute{TraitType: t.rarityTrait, Value: score})
+	}
+	return attributes, true
+}
+
+// Check returns the tokens without a row and the rows without a token.
+func (t *attributeTable) Check(tokens []*token) (missing, extra []int) {
+	seen := make(map[int]bool)
+	for _, tok := range tokens {
+		seen[tok.SourceIndex] = true
+		if _, ok := t.rows[tok.SourceIndex]; !ok {
+			missing = append(missing, tok.SourceIndex)
+		}
+	}
+	for index := range t.rows {
+		if !seen[index] {
+			extra = append(extra, index)
+		}
+	}
+	sort.Ints(extra)
+	return missing, extra
+}
+
+// formatIndexes formats indexes for a message, e.g. "1, 5, 7".
+func formatIndexes(indexes []int) string {
+	str := make([]string, len(indexes))
+	for i, index := range indexes {
+		str[i] = strconv.Itoa(index)
+	}
+	return strings.Join(str, ", ")
+}
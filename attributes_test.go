@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestFile writes data to a file named name in a temporary directory
+// and returns its path.
+func writeTestFile(t *testing.T, name, data string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestReadAttributes(t *testing.T) {
+	tests := []struct {
+		name string
+		csv  string
+		// want are the attributes of the tokens by index, as JSON
+		want map[int]string
+		err  string
+	}{
+		{
+			name: "strings and numbers",
+			csv:  "token_id,Background,Level\n1,Blue,3\n2,Red,10\n",
+			want: map[int]string{
+				1: `[{"trait_type":"Background","value":"Blue"},{"trait_type":"Level","value":3}]`,
+				2: `[{"trait_type":"Background","value":"Red"},{"trait_type":"Level","value":10}]`,
+			},
+		},
+		{
+			name: "a column with a string isn't numeric",
+			csv:  "token_id,Size\n1,3\n2,large\n",
+			want: map[int]string{
+				1: `[{"trait_type":"Size","value":"3"}]`,
+				2: `[{"trait_type":"Size","value":"large"}]`,
+			},
+		},
+		{
+			name: "token_id anywhere, spaces trimmed, empty cells skipped",
+			csv:  "Eyes , token_id ,Hat\n Green ,1,\n,2, Cap \n",
+			want: map[int]string{
+				1: `[{"trait_type":"Eyes","value":"Green"}]`,
+				2: `[{"trait_type":"Hat","value":"Cap"}]`,
+			},
+		},
+		{
+			name: "decimal and exponent numbers",
+			csv:  "token_id,Weight\n1,0.5\n2,-1e3\n",
+			want: map[int]string{
+				1: `[{"trait_type":"Weight","value":0.5}]`,
+				2: `[{"trait_type":"Weight","value":-1e3}]`,
+			},
+		},
+		{name: "no token_id column", csv: "id,Eyes\n1,Green\n", err: "has no token_id column"},
+		{name: "invalid token_id", csv: "token_id,Eyes\nx,Green\n", err: `row 2: invalid token_id "x"`},
+		{name: "negative token_id", csv: "token_id,Eyes\n-1,Green\n", err: `row 2: invalid token_id "-1"`},
+		{name: "duplicate token_id", csv: "token_id,Eyes\n1,Green\n1,Blue\n", err: "row 3: duplicate token_id 1"},
+		{name: "uneven row", csv: "token_id,Eyes\n1,Green,extra\n", err: "wrong number of fields"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table, err := readAttributes(writeTestFile(t, "attributes.csv", tt.csv))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for index, want := range tt.want {
+				attributes, ok := table.Attributes(index)
+				if !ok {
+					t.Fatalf("no row for %v", index)
+				}
+				got, err := json.Marshal(attributes)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != want {
+					t.Errorf("attributes of %v are %s, want %s", index, got, want)
+				}
+			}
+			if _, ok := table.Attributes(99); ok {
+				t.Errorf("a row for 99, which the file hasn't")
+			}
+		})
+	}
+}
+
+func TestAttributesCheck(t *testing.T) {
+	table, err := readAttributes(writeTestFile(t, "attributes.csv", "token_id,Eyes\n1,Green\n2,Blue\n5,Red\n4,Red\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the rows are those of the files, whatever the shuffled index
+	tokens := []*token{{Index: 2, SourceIndex: 1}, {Index: 1, SourceIndex: 2}, {Index: 3, SourceIndex: 3}}
+	missing, extra := table.Check(tokens)
+	if formatIndexes(missing) != "3" || formatIndexes(extra) != "4, 5" {
+		t.Errorf("missing %v and extra %v, want 3 and 4, 5", missing, extra)
+	}
+}
+
+func TestMetadataAttributes(t *testing.T) {
+	table, err := readAttributes(writeTestFile(t, "attributes.csv", "token_id,Eyes,Level\n7,Green,2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok := &token{Index: 1, SourceIndex: 7, Filename: "7.png"}
+	for _, tt := range []struct {
+		standard string
+		want     string
+	}{
+		{erc721, `{"image":"ipfs://SAMPLE-CID","attributes":[{"trait_type":"Eyes","value":"Green"},{"trait_type":"Level","value":2}]}`},
+		{erc1155, `{"image":"ipfs://SAMPLE-CID","decimals":0,"properties":{"Eyes":"Green","Level":2}}`},
+	} {
+		got, err := renderMetadata(tok, metadataOptions{Prefix: "ipfs://", Attributes: table, Standard: tt.standard, Format: compact})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%v: got %s, want %s", tt.standard, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// auditEntry is a file of the manifest of --audit.
+type auditEntry struct {
+	Name string
+	Cid  cid.Cid
+	// SHA256 is the recorded checksum of the file, if any, and Size its
+	// recorded size, -1 if unknown
+	SHA256 string
+	Size   int64
+	// URI is the URI of the metadata of the file, if any
+	URI string
+}
+
+// auditResult is the outcome of the audit of an entry.
+type auditResult struct {
+	Name     string   `json:"name"`
+	Cid      string   `json:"cid"`
+	Pass     bool     `json:"pass"`
+	Failures []string `json:"failures,omitempty"`
+	Attempts int      `json:"attempts"`
+	// transient is whether a failure may pass when checked again, such as
+	// a timeout, unlike a CID not pinned or a checksum not matching, err
+	// the first error of such a failure
+	transient bool
+	err       error
+}
+
+// auditor checks the entries of a manifest against the API, and the
+// gateway of gatewayPrefix if not empty.
+type auditor struct {
+	up            *uploader.Uploader
+	client        *http.Client
+	gatewayPrefix string
+	// gateways are the prefixes of more gateways the files are fetched
+	// from, such as public ones
+	gateways   []string
+	imageField string
+	// retries is how many times an entry failing transiently is checked
+	// again, as long as budget allows
+	retries int
+	budget  *retryBudget
+}
+
+// readAuditManifest reads the entries of a --checksums CSV file, of a
+// --mapping JSON file written with keys, or of a --manifest file, with a
+// CID.
+func readAuditManifest(path string, keys []mappingKey) ([]*auditEntry, error) {
+	if strings.HasSuffix(strings.ToLower(path), ".csv") {
+		return readAuditChecksums(path)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		return readManifestJSON(path, data)
+	}
+	var mapping jsonObject
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		return nil, fmt.Errorf("%v is not a --mapping file: %v", path, err)
+	}
+	// the fields by name, the key of the mapping being keys[0]
+	names := make(map[string]string)
+	for _, k := range keys[1:] {
+		names[k.Field] = k.Name
+	}
+	field := func(key string, entry map[string]interface{}, f string) string {
+		if keys[0].Field == f {
+			return key
+		}
+		s, _ := entry[names[f]].(string)
+		return s
+	}
+	if keys[0].Field != "cid" && names["cid"] == "" {
+		return nil, fmt.Errorf("the --mapping-keys of %v have no cid field", path)
+	}
+
+	var entries []*auditEntry
+	for _, key := range mapping.keys {
+		var entry map[string]interface{}
+		if err := json.Unmarshal(mapping.values[key], &entry); err != nil {
+			return nil, fmt.Errorf("%v: the entry %v is not an object", path, key)
+		}
+		c, err := cid.Decode(field(key, entry, "cid"))
+		if err != nil {
+			return nil, fmt.Errorf("%v: the entry %v has an invalid CID", path, key)
+		}
+		name := field(key, entry, "file")
+		if name == "" {
+			name = key
+		}
+		entries = append(entries, &auditEntry{Name: name, Cid: c, URI: field(key, entry, "uri"), Size: -1})
+	}
+	return entries, nil
+}
+
+// readManifestJSON reads the entries of a --manifest JSON file with a CID,
+// named after their path.
+func readManifestJSON(path string, data []byte) ([]*auditEntry, error) {
+	var records []outputRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("%v is not a --manifest file: %v", path, err)
+	}
+	var entries []*auditEntry
+	for i, r := range records {
+		if r.Cid == "" {
+			continue
+		}
+		c, err := cid.Decode(r.Cid)
+		if err != nil {
+			return nil, fmt.Errorf("%v: the record %v has an invalid CID", path, i)
+		}
+		entries = append(entries, &auditEntry{Name: r.Path, Cid: c, Size: r.Size})
+	}
+	return entries, nil
+}
+
+// readMetadataDir reads the entries of a directory of metadata files, the
+// CIDs being those of their imageField, named after the files.
+func readMetadataDir(dir, imageField string) ([]*auditEntry, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*auditEntry
+	for _, info := range infos {
+		// _metadata.json is the array of --combined-json
+		if info.IsDir() || strings.HasPrefix(info.Name(), "_") || !strings.HasSuffix(strings.ToLower(info.Name()), ".json") {
+			continue
+		}
+		name := filepath.Join(dir, info.Name())
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var meta map[string]interface{}
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return nil, fmt.Errorf("%v: invalid JSON: %v", name, err)
+		}
+		image := metadataField(meta, imageField)
+		c, ok := urlCID(image)
+		if !ok {
+			return nil, fmt.Errorf("%v: the %v %q has no CID", name, imageField, image)
+		}
+		entries = append(entries, &auditEntry{Name: name, Cid: c, Size: -1})
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%v has no metadata file", dir)
+	}
+	return entries, nil
+}
+
+// readAuditChecksums reads the entries of a --checksums CSV file, or of a
+// --manifest one, with a CID.
+func readAuditChecksums(path string) ([]*auditEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading %v: %v", path, err)
+	}
+	manifest := strings.Join(header, ",") == strings.Join(manifestHeader, ",")
+	if !manifest && !uploader.IsChecksumHeader(header) {
+		return nil, fmt.Errorf("%v is not a --checksums or --manifest file", path)
+	}
+	// the columns of the name, size and CID
+	nameCol, sizeCol, cidCol := 0, 1, 2
+	if manifest {
+		sizeCol, cidCol = 3, 2
+	}
+	var entries []*auditEntry
+	for row := 2; ; row++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %v: %v", path, err)
+		}
+		if record[cidCol] == "" {
+			continue
+		}
+		c, err := cid.Decode(record[cidCol])
+		if err != nil {
+			return nil, fmt.Errorf("%v row %v: invalid CID %q", path, row, record[cidCol])
+		}
+		size, err := strconv.ParseInt(record[sizeCol], 10, 64)
+		if err != nil {
+			size = -1
+		}
+		e := &auditEntry{Name: record[nameCol], Cid: c, Size: size}
+		if !manifest {
+			e.SHA256 = record[3]
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// addChecksums sets the SHA-256 and size of the entries from the
+// --checksums entries with the same CID.
+func addChecksums(entries, sums []*auditEntry) {
+	byCid := make(map[cid.Cid]*auditEntry)
+	for _, sum := range sums {
+		byCid[sum.Cid] = sum
+	}
+	for _, e := range entries {
+		sum, ok := byCid[e.Cid]
+		if !ok {
+			continue
+		}
+		if e.SHA256 == "" {
+			e.SHA256 = sum.SHA256
+		}
+		if e.Size < 0 {
+			e.Size = sum.Size
+		}
+	}
+}
+
+// sampleEntries returns n of entries picked at random, in their order, or
+// all of them if n isn't less.
+func sampleEntries(entries []*auditEntry, n int, rnd *rand.Rand) []*auditEntry {
+	if n <= 0 || n >= len(entries) {
+		return entries
+	}
+	picked := rnd.Perm(len(entries))[:n]
+	sort.Ints(picked)
+	sample := make([]*auditEntry, n)
+	for i, j := range picked {
+		sample[i] = entries[j]
+	}
+	return sample
+}
+
+// auditEntries returns the results of the audit of entries, checking up to
+// workers entries at a time.
+func auditEntries(ctx context.Context, a *auditor, entries []*auditEntry, workers int) []auditResult {
+	results := make([]auditResult, len(entries))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, workers)
+
+dispatch:
+	for i, e := range entries {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			for j := i; j < len(entries); j++ {
+				results[j] = auditResult{Name: entries[j].Name, Cid: entries[j].Cid.String(), Failures: []string{ctx.Err().Error()}}
+			}
+			break dispatch
+		}
+		wg.Add(1)
+		go func(r *auditResult, e *auditEntry) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			*r = a.Audit(ctx, e)
+		}(&results[i], e)
+	}
+	wg.Wait()
+	return results
+}
+
+// Audit checks e, again up to a.retries times while it fails transiently
+// and the retry budget allows.
+func (a *auditor) Audit(ctx context.Context, e *auditEntry) auditResult {
+	var res auditResult
+	for attempt := 0; attempt <= a.retries; attempt++ {
+		if attempt > 0 {
+			if !a.budget.Retry() {
+				break
+			}
+			select {
+			case <-time.After(time.Duration(attempt) * time.Second):
+			case <-ctx.Done():
+				return res
+			}
+		}
+		res = a.check(ctx, e)
+		res.Attempts = attempt + 1
+		a.budget.Attempt(res.err)
+		if res.Pass || !res.transient || ctx.Err() != nil {
+			break
+		}
+	}
+	return res
+}
+
+// check checks that the CID of e is pinned, and with gateways that its
+// content can be fetched from each of them with the recorded SHA-256, and
+// that its metadata parses and links to it.
+func (a *auditor) check(ctx context.Context, e *auditEntry) auditResult {
+	res := auditResult{Name: e.Name, Cid: e.Cid.String()}
+	pinned, err := a.up.IsPinned(ctx, e.Cid)
+	switch {
+	case err != nil:
+		res.Failures = append(res.Failures, fmt.Sprintf("checking the pin: %v", err))
+		res.transient, res.err = true, err
+	case !pinned:
+		res.Failures = append(res.Failures, "not pinned")
+	}
+
+	gateways := a.gateways
+	if a.gatewayPrefix != "" {
+		gateways = append([]string{a.gatewayPrefix}, gateways...)
+	}
+	for _, prefix := range gateways {
+		sum, err := a.fetchSHA256(ctx, prefix+e.Cid.String())
+		switch {
+		case err != nil:
+			res.Failures = append(res.Failures, fmt.Sprintf("fetching the file from %v: %v", strings.TrimSuffix(prefix, "/ipfs/"), err))
+			if !res.transient {
+				res.transient, res.err = true, err
+			}
+		case e.SHA256 != "" && sum != e.SHA256:
+			res.Failures = append(res.Failures, fmt.Sprintf("the SHA-256 of the file from %v doesn't match the checksum", strings.TrimSuffix(prefix, "/ipfs/")))
+		}
+	}
+	if a.gatewayPrefix != "" && e.URI != "" {
+		if err := a.checkMetadata(ctx, e); err != nil {
+			res.Failures = append(res.Failures, fmt.Sprintf("metadata %v: %v", e.URI, err))
+			if !res.transient {
+				res.transient, res.err = true, err
+			}
+		}
+	}
+	res.Pass = len(res.Failures) == 0
+	return res
+}
+
+func (a *auditor) fetchSHA256(ctx context.Context, url string) (string, error) {
+	body, err := a.get(ctx, url)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checkMetadata fetches the metadata of e and checks that its image field
+// links to the CID of e.
+func (a *auditor) checkMetadata(ctx context.Context, e *auditEntry) error {
+	url := e.URI
+	if strings.HasPrefix(url, "ipfs://") {
+		url = a.gatewayPrefix + strings.TrimPrefix(url, "ipfs://")
+	}
+	body, err := a.get(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	var meta map[string]interface{}
+	if err := json.NewDecoder(body).Decode(&meta); err != nil {
+		return fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	image := metadataField(meta, a.imageField)
+	if image == "" {
+		return fmt.Errorf("no %v", a.imageField)
+	}
+	c, ok := urlCID(image)
+	if !ok || !c.Equals(e.Cid) {
+		return fmt.Errorf("the %v %v doesn't link to %v", a.imageField, image, e.Cid)
+	}
+	return nil
+}
+
+// metadataField returns the string of the field of meta, dots nesting it,
+// or an empty one.
+func metadataField(meta map[string]interface{}, field string) string {
+	var value interface{} = meta
+	for _, key := range strings.Split(field, ".") {
+		obj, _ := value.(map[string]interface{})
+		value = obj[key]
+	}
+	s, _ := value.(string)
+	return s
+}
+
+func (a *auditor) get(ctx context.Context, url string) (io.ReadCloser, error) {
+	return httpGet(ctx, a.client, url)
+}
+
+// httpGet returns the body of url, or an error unless its status is OK.
+func httpGet(ctx context.Context, client *http.Client, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%v: %w", resp.Status, uploader.ErrAuthFailed)
+	case resp.StatusCode != http.StatusOK:
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%v", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// urlCID returns the CID of an ipfs:// or gateway URL, the first segment of
+// its path which is one.
+func urlCID(s string) (cid.Cid, bool) {
+	s = strings.TrimPrefix(s, "ipfs://")
+	if i := strings.IndexAny(s, "?#"); i >= 0 {
+		s = s[:i]
+	}
+	for _, segment := range strings.Split(s, "/") {
+		// the subdomain gateways put it in the host
+		for _, label := range strings.Split(segment, ".") {
+			if c, err := cid.Decode(label); err == nil {
+				return c, true
+			}
+		}
+	}
+	return cid.Undef, false
+}
+
+// runVerify runs verify, checking that the CIDs of --audit are still pinned.
+func runVerify(o *commonOptions) error {
+	if len(o.args) != 0 {
+		return &usageError{"parameter --audit takes no path argument"}
+	}
+	keys, err := parseMappingKeys(*mappingKeysFlag)
+	if err != nil {
+		return &usageError{err.Error()}
+	}
+	if *auditWorkers <= 0 || *auditRetries < 0 {
+		return &usageError{"parameter --audit-workers must be positive and --audit-retries not negative"}
+	}
+	var entries []*auditEntry
+	if info, statErr := os.Stat(*auditPath); statErr == nil && info.IsDir() {
+		entries, err = readMetadataDir(*auditPath, *imageField)
+	} else {
+		entries, err = readStatManifest(*auditPath, keys)
+	}
+	if err == nil && *auditChecksums != "" {
+		var sums []*auditEntry
+		sums, err = readAuditChecksums(*auditChecksums)
+		addChecksums(entries, sums)
+	}
+	if err != nil {
+		return &usageError{err.Error()}
+	}
+	a := &auditor{imageField: *imageField, retries: *auditRetries}
+	for _, base := range *auditGateways {
+		if u, err := url.Parse(base); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return &usageError{fmt.Sprintf("parameter --audit-gateway-urls: %v is not an http(s) URL", base)}
+		}
+		prefix, _ := gatewayPrefix("", base)
+		a.gateways = append(a.gateways, prefix)
+	}
+	if *auditGateway {
+		a.gatewayPrefix, err = gatewayPrefix(*gatewaySubdomain, *gatewayBase)
+		if err != nil {
+			return &usageError{fmt.Sprintf("parameter --audit-gateway: %v", err)}
+		}
+	}
+	ctx, cancel := signalContext()
+	defer cancel()
+	a.up, a.client, err = o.newUploaderFromFlags(ctx)
+	if err != nil {
+		return err
+	}
+
+	sample := sampleEntries(entries, *auditSample, rand.New(rand.NewSource(time.Now().UnixNano())))
+	retries, err := parseRetryBudget(*retryBudgetFlag, len(sample))
+	if err != nil {
+		return &usageError{err.Error()}
+	}
+
+	a.budget = newRetryBudget(retries, cancel)
+	results := auditEntries(ctx, a, sample, *auditWorkers)
+	failed := 0
+	for _, res := range results {
+		if res.Pass {
+			_, _ = fmt.Fprintln(os.Stdout, fmt.Sprintf("PASS %v %v", res.Name, res.Cid))
+		} else {
+			failed++
+			_, _ = fmt.Fprintln(os.Stdout, fmt.Sprintf("FAIL %v %v: %v", res.Name, res.Cid, strings.Join(res.Failures, ", ")))
+		}
+	}
+	if *auditJSON != "" {
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err == nil {
+			err = uploader.WriteFileAtomic(*auditJSON, data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	used, denied := a.budget.Used()
+	logs.Info(fmt.Sprintf("%v of %v files checked failed, %v files in %v, %v", failed, len(sample), len(entries), *auditPath, a.budget), "failed", failed, "checked", len(sample), "retries", used, "retries_denied", denied)
+	switch err := a.budget.Err(); {
+	case err != nil:
+		return err
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case failed > 0:
+		return &exitError{exitFailed}
+	}
+	return nil
+}
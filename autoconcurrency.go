@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// autoInterval is the window over which the throughput is measured
+	autoInterval = 2 * time.Second
+	// autoGain is the gain in throughput a higher concurrency must bring to
+	// be kept
+	autoGain = 1.1
+	// autoFailureRate is the share of failed or throttled responses of a
+	// window halving the concurrency
+	autoFailureRate = 0.05
+	// autoHold is the number of windows the concurrency is held after it
+	// is lowered, before probing a higher one again
+	autoHold = 10
+)
+
+// autoConcurrency bounds the requests in flight for --concurrency auto, to
+// a limit tuned by hill climbing between min and max: every window it
+// compares the responses completed with those of the previous window. It
+// doubles the limit from min until the first setback, then raises it by one
+// while the throughput grows by a tenth, goes back to the previous limit
+// once it doesn't, and halves it when the endpoint throttles or fails the
+// requests.
+type autoConcurrency struct {
+	min, max int
+	interval time.Duration
+	// onChange is called with every new limit and the reason for it
+	onChange func(limit int, reason string)
+
+	mu       sync.Mutex
+	limit    int
+	inFlight int
+	// changed is closed when a slot may have been freed
+	changed chan struct{}
+
+	// the responses of the current window
+	windowStart time.Time
+	completed   int
+	failed      int
+
+	// throughput is the responses a second of the previous window
+	throughput float64
+	// raised is set when the previous window raised the limit from
+	// previous
+	raised   bool
+	previous int
+	// settled is set after the first setback, the limit then growing by one
+	settled bool
+	// hold is the number of windows left before probing a higher limit
+	hold int
+}
+
+func newAutoConcurrency(min, max int, onChange func(limit int, reason string)) *autoConcurrency {
+	return &autoConcurrency{
+		min:         min,
+		max:         max,
+		interval:    autoInterval,
+		onChange:    onChange,
+		limit:       min,
+		changed:     make(chan struct{}),
+		windowStart: time.Now(),
+	}
+}
+
+// Limit returns the requests allowed in flight.
+func (c *autoConcurrency) Limit() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.limit
+}
+
+// acquire waits for a request to be allowed in flight.
+func (c *autoConcurrency) acquire(ctx context.Context) error {
+	for {
+		c.mu.Lock()
+		if c.inFlight < c.limit {
+			c.inFlight++
+			c.mu.Unlock()
+			return nil
+		}
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// done releases the slot of a request, answered with status or failed with
+// err, and tunes the limit once a window is over.
+func (c *autoConcurrency) done(status int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inFlight--
+	c.signal()
+	if errors.Is(err, context.Canceled) {
+		// the run is over, not the endpoint
+		return
+	}
+	c.completed++
+	if err != nil || status == 429 || status >= 500 {
+		c.failed++
+	}
+	if elapsed := time.Since(c.windowStart); elapsed >= c.interval {
+		c.adjust(c.completed, c.failed, elapsed)
+		c.completed, c.failed, c.windowStart = 0, 0, time.Now()
+	}
+}
+
+// signal wakes the requests waiting for a slot.
+func (c *autoConcurrency) signal() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// adjust tunes the limit after a window of elapsed, in which completed
+// responses were received and failed of them failed or were throttled.
+func (c *autoConcurrency) adjust(completed, failed int, elapsed time.Duration) {
+	throughput := float64(completed) / elapsed.Seconds()
+	raised := c.raised
+	c.raised = false
+	limit, reason := c.limit, ""
+	switch {
+	case completed > 0 && float64(failed)/float64(completed) > autoFailureRate:
+		limit = c.limit / 2
+		reason = fmt.Sprintf("%v of %v responses failed or were throttled", failed, completed)
+		c.settled, c.hold = true, autoHold
+	case raised && throughput < c.throughput*autoGain:
+		limit = c.previous
+		reason = fmt.Sprintf("%.1f responses a second at %v, not 10%% more than at %v", throughput, c.limit, c.previous)
+		c.settled, c.hold = true, autoHold
+	case c.hold > 0:
+		c.hold--
+	case c.limit < c.max:
+		limit = c.limit + 1
+		if !c.settled {
+			limit = c.limit * 2
+		}
+		reason = fmt.Sprintf("probing, %.1f responses a second at %v", throughput, c.limit)
+		c.raised, c.previous = true, c.limit
+	}
+	c.throughput = throughput
+
+	if limit < c.min {
+		limit = c.min
+	}
+	if limit > c.max {
+		limit = c.max
+	}
+	if limit == c.limit {
+		c.raised = false
+		return
+	}
+	c.limit = limit
+	c.signal()
+	if c.onChange != nil {
+		c.onChange(limit, reason)
+	}
+}
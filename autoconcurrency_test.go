@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// simulateEndpoint runs windows of a second against an endpoint serving
+// capacity requests at once in 100ms each, and throttling the requests over
+// it, and returns the limits of c after every window.
+func simulateEndpoint(c *autoConcurrency, capacity, windows int) []int {
+	var limits []int
+	for i := 0; i < windows; i++ {
+		served, throttled := c.limit, 0
+		if served > capacity {
+			served, throttled = capacity, c.limit-capacity
+		}
+		c.adjust(10*(served+throttled), 10*throttled, time.Second)
+		limits = append(limits, c.limit)
+	}
+	return limits
+}
+
+func TestAutoConcurrency(t *testing.T) {
+	tests := []struct {
+		name     string
+		min, max int
+		capacity int
+		// the limit must settle between low and high, probing at most one
+		// more from time to time
+		low, high int
+	}{
+		{"below max", 1, 32, 12, 9, 12},
+		{"max", 1, 8, 100, 8, 8},
+		{"min", 4, 32, 2, 4, 4},
+		{"single", 1, 32, 1, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newAutoConcurrency(tt.min, tt.max, nil)
+			limits := simulateEndpoint(c, tt.capacity, 100)
+			for i, limit := range limits {
+				if limit < tt.min || limit > tt.max {
+					t.Fatalf("window %v set the limit to %v, out of %v-%v", i, limit, tt.min, tt.max)
+				}
+			}
+			// the most frequent limit once settled
+			count := make(map[int]int)
+			settled := 0
+			for i, limit := range limits[50:] {
+				if limit < tt.low || limit > tt.high+1 {
+					t.Fatalf("window %v set the limit to %v, want %v-%v: %v", i+50, limit, tt.low, tt.high, limits)
+				}
+				if count[limit]++; count[limit] > count[settled] {
+					settled = limit
+				}
+			}
+			if settled < tt.low || settled > tt.high {
+				t.Errorf("the limit settled at %v, want %v-%v: %v", settled, tt.low, tt.high, limits)
+			}
+		})
+	}
+}
+
+func TestAutoConcurrencyLimitsRequests(t *testing.T) {
+	var changes []int
+	c := newAutoConcurrency(1, 4, func(limit int, reason string) { changes = append(changes, limit) })
+	if err := c.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("acquired a second slot of a limit of 1: %v", err)
+	}
+
+	// raising the limit lets a waiting request in
+	acquired := make(chan error)
+	go func() { acquired <- c.acquire(context.Background()) }()
+	c.mu.Lock()
+	c.adjust(10, 0, time.Second)
+	c.mu.Unlock()
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the waiting request wasn't let in once the limit was raised")
+	}
+	if len(changes) != 1 || changes[0] != 2 {
+		t.Errorf("the limit changed to %v, want [2]", changes)
+	}
+}
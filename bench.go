@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	ipfsFiles "github.com/ipfs/go-ipfs-files"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// benchNearBest is the fraction of the best throughput the recommended
+// concurrency must reach, the lowest such level being recommended.
+const benchNearBest = 0.9
+
+// errEnoughSamples stops the walk of benchSamples.
+var errEnoughSamples = errors.New("enough samples")
+
+// benchReport is the outcome of bench.
+type benchReport struct {
+	Samples     int          `json:"samples"`
+	Bytes       int64        `json:"bytes"`
+	Levels      []benchLevel `json:"levels"`
+	Recommended int          `json:"recommended_concurrency"`
+}
+
+// benchLevel is the upload of every sample at a concurrency.
+type benchLevel struct {
+	Concurrency    int     `json:"concurrency"`
+	Failed         int     `json:"failed"`
+	ErrorRate      float64 `json:"error_rate"`
+	Seconds        float64 `json:"seconds"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+}
+
+// benchSamples returns the local paths and total size of up to n regular
+// files under root, or root itself if it is a file, without the excluded
+// local paths.
+func benchSamples(root string, n int, excluded map[string]bool) (paths []string, size int64, err error) {
+	err = uploader.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != root && (strings.HasPrefix(info.Name(), ".") || excluded[filepath.Clean(p)]) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if len(paths) == n {
+			return errEnoughSamples
+		}
+		if info.Mode().IsRegular() {
+			paths = append(paths, p)
+			size += info.Size()
+		}
+		return nil
+	})
+	if err == errEnoughSamples {
+		err = nil
+	}
+	return paths, size, err
+}
+
+// bench uploads every sample, of size bytes in all, at every concurrency
+// level, each sample being a request of its own, and returns the
+// throughput of every level and the recommended concurrency.
+func bench(ctx context.Context, up *uploader.Uploader, samples []string, size int64, levels []int) (*benchReport, error) {
+	report := &benchReport{Samples: len(samples), Bytes: size}
+	for _, level := range levels {
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		var failed int
+		next := make(chan string)
+
+		start := time.Now()
+		for i := 0; i < level; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for path := range next {
+					if err := benchUpload(ctx, up, path); err != nil {
+						mu.Lock()
+						failed++
+						mu.Unlock()
+					}
+				}
+			}()
+		}
+		for _, path := range samples {
+			next <- path
+		}
+		close(next)
+		wg.Wait()
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		seconds := time.Since(start).Seconds()
+		report.Levels = append(report.Levels, benchLevel{
+			Concurrency:    level,
+			Failed:         failed,
+			ErrorRate:      float64(failed) / float64(len(samples)),
+			Seconds:        seconds,
+			BytesPerSecond: float64(size) / seconds,
+		})
+	}
+	report.Recommended = recommendConcurrency(report.Levels)
+	return report, nil
+}
+
+func benchUpload(ctx context.Context, up *uploader.Uploader, path string) error {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	file, err := ipfsFiles.NewSerialFile(path, false, stat)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, _, err = up.Add(ctx, file, nil)
+	return err
+}
+
+// recommendConcurrency returns the lowest concurrency within benchNearBest
+// of the best throughput among the levels with the lowest error rate.
+func recommendConcurrency(levels []benchLevel) int {
+	lowest := 1.0
+	for _, l := range levels {
+		if l.ErrorRate < lowest {
+			lowest = l.ErrorRate
+		}
+	}
+	var best float64
+	for _, l := range levels {
+		if l.ErrorRate == lowest && l.BytesPerSecond > best {
+			best = l.BytesPerSecond
+		}
+	}
+	recommended := 0
+	for _, l := range levels {
+		if l.ErrorRate == lowest && l.BytesPerSecond >= best*benchNearBest && (recommended == 0 || l.Concurrency < recommended) {
+			recommended = l.Concurrency
+		}
+	}
+	return recommended
+}
+
+// Write writes the report as JSON to path.
+func (r *benchReport) Write(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return uploader.WriteFileAtomic(path, data)
+}
+
+// parseBenchLevels parses a comma separated list of concurrencies.
+func parseBenchLevels(s string) ([]int, error) {
+	var levels []int
+	for _, item := range strings.Split(s, ",") {
+		level, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil || level < 1 {
+			return nil, fmt.Errorf("invalid concurrency %q", strings.TrimSpace(item))
+		}
+		levels = append(levels, level)
+	}
+	return levels, nil
+}
+
+// printBenchReport writes r as a table to w.
+func printBenchReport(w io.Writer, r *benchReport) {
+	_, _ = fmt.Fprintf(w, "Uploaded %v samples of %v at every concurrency\n", r.Samples, formatBytes(float64(r.Bytes)))
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "Concurrency\tThroughput\tErrors\tTime")
+	for _, l := range r.Levels {
+		_, _ = fmt.Fprintf(tw, "%v\t%v/s\t%.0f%%\t%.1fs\n", l.Concurrency, formatBytes(l.BytesPerSecond), l.ErrorRate*100, l.Seconds)
+	}
+	_ = tw.Flush()
+	_, _ = fmt.Fprintf(w, "Recommended concurrency: %v\n", r.Recommended)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// runCheck runs check, verifying the files of --verify-checksums.
+func runCheck() error {
+	changed, total, err := uploader.VerifyChecksums(*verifyChecksumsPath)
+	if err != nil {
+		return &usageError{err.Error()}
+	}
+	for _, c := range changed {
+		logs.Info(c)
+	}
+	if len(changed) > 0 {
+		logs.Error(fmt.Sprintf("%v of %v files changed", len(changed), total))
+		return &exitError{exitFailed}
+	}
+	logs.Info(fmt.Sprintf("%v files unchanged", total))
+	return nil
+}
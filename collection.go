@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// collectionConfig is the --collection-metadata file, in YAML or JSON. Image
+// is a local file uploaded with the collection, relative to the file, or a
+// URL used as is.
+type collectionConfig struct {
+	Name                 string `yaml:"name"`
+	Description          string `yaml:"description"`
+	Image                string `yaml:"image"`
+	ExternalLink         string `yaml:"external_link"`
+	SellerFeeBasisPoints int    `yaml:"seller_fee_basis_points"`
+	FeeRecipient         string `yaml:"fee_recipient"`
+}
+
+// CollectionMetadata is the collection level metadata OpenSea reads from
+// the contractURI of the contract, followed by the royalty fields.
+type CollectionMetadata struct {
+	Name         string `json:"name"`
+	Description  string `json:"description,omitempty"`
+	Image        string `json:"image,omitempty"`
+	ExternalLink string `json:"external_link,omitempty"`
+}
+
+// collectionMetadataName is the name of the collection metadata written to
+// the --out directory.
+const collectionMetadataName = "collection.json"
+
+// readCollectionConfig reads and checks the --collection-metadata file at
+// path.
+func readCollectionConfig(path string) (*collectionConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c collectionConfig
+	if err := yaml.UnmarshalStrict(data, &c); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	if c.Name == "" {
+		return nil, fmt.Errorf("%v: the collection has no name", path)
+	}
+	if err := checkRoyalty(c.SellerFeeBasisPoints, c.FeeRecipient); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	if c.Image != "" && !c.HasImageURL() {
+		if !filepath.IsAbs(c.Image) {
+			c.Image = filepath.Join(filepath.Dir(path), c.Image)
+		}
+		stat, err := os.Stat(c.Image)
+		if err != nil {
+			return nil, err
+		}
+		if !stat.Mode().IsRegular() {
+			return nil, errors.New("the collection image must be a file")
+		}
+	}
+	return &c, nil
+}
+
+// HasImageURL reports whether the image is a URL rather than a local file.
+func (c *collectionConfig) HasImageURL() bool {
+	return strings.Contains(c.Image, "://")
+}
+
+// Render returns the collection metadata with the image URL and the
+// royalty r, laid out by format. The royalty of the file is used if r is
+// nil.
+func (c *collectionConfig) Render(image string, r *royalty, format jsonFormat) ([]byte, error) {
+	data, err := json.Marshal(CollectionMetadata{
+		Name:         c.Name,
+		Description:  c.Description,
+		Image:        image,
+		ExternalLink: c.ExternalLink,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if r == nil && c.SellerFeeBasisPoints > 0 {
+		r = &royalty{
+			BPS:            c.SellerFeeBasisPoints,
+			Recipient:      c.FeeRecipient,
+			BPSField:       "seller_fee_basis_points",
+			RecipientField: "fee_recipient",
+		}
+	}
+	if r != nil {
+		doc, err := readJSONObject(data)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.Set(doc); err != nil {
+			return nil, err
+		}
+		if data, err = json.Marshal(doc); err != nil {
+			return nil, err
+		}
+	}
+	return format.Apply(data)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	flag "github.com/spf13/pflag"
+)
+
+// command is a subcommand of the CLI. Most run one of the modes of the
+// flags, e.g. stat sets --stat to its first argument, so that a command is
+// added by listing it here and the flags keep working on their own.
+type command struct {
+	Name    string
+	Args    string
+	Summary string
+	// Flag is the flag of the mode set to the first argument, none for
+	// upload and the commands handled by name
+	Flag string
+	// Prefixes are those of the flags the command takes besides the common
+	// ones, listed by its help
+	Prefixes []string
+	// UploadFlags is set for the commands running an upload, which take
+	// every flag of upload but the modes of the other commands
+	UploadFlags bool
+	// Sets are the boolean flags the command sets, e.g. --upload-metadata
+	// for publish
+	Sets []string
+}
+
+// metadataPrefixes are those of the flags of the metadata, listed by the
+// help of the commands writing it.
+var metadataPrefixes = []string{"out", "uri-list", "mapping", "upload-", "name", "description", "external-url", "metadata-", "json-", "standard", "attributes-csv", "extra-fields", "royalty-", "collection-metadata", "locales", "merge-json", "image-field", "combined-json"}
+
+// apiPrefixes are those of the flags of the commands calling the API,
+// bounding its requests.
+var apiPrefixes = []string{"concurrency", "concurrency-", "rate-limit", "ratelimit-", "max-idle-conns", "keepalive", "mock-fail-rate"}
+
+// dagPrefixes are those of the flags of the DAG of the files added, and
+// filterPrefixes of the flags picking the files of a directory.
+var (
+	dagPrefixes    = []string{"cid-version", "hash", "chunker", "raw-leaves"}
+	filterPrefixes = []string{"include", "exclude", "ignore-hidden"}
+)
+
+// modeFlags are the flags running a mode without a command of their own,
+// besides the Flag of the commands.
+var modeFlags = []string{"state-export", "state-query", "render-sample"}
+
+// prefixes returns the prefixes of lists together.
+func prefixes(lists ...[]string) []string {
+	var all []string
+	for _, l := range lists {
+		all = append(all, l...)
+	}
+	return all
+}
+
+// commands are the subcommands, upload being the default.
+var commands = []*command{
+	{Name: "upload", Args: "<path>...", Summary: "upload a file, directory, archive, S3 prefix or - for the standard input, or several files and directories each on its own"},
+	{Name: "verify", Args: "<manifest>", Summary: "check that the CIDs of a manifest are still pinned", Flag: "audit", Prefixes: prefixes([]string{"audit-", "mapping-keys", "image-field", "retry-budget", "gateway-"}, apiPrefixes)},
+	{Name: "check", Args: "<checksums.csv>", Summary: "check that the files of a manifest didn't change since", Flag: "verify-checksums"},
+	{Name: "stat", Args: "<manifest>", Summary: "report the sizes of the DAGs of the CIDs of a manifest", Flag: "stat", Prefixes: prefixes([]string{"stat-", "mapping-keys"}, apiPrefixes)},
+	{Name: "restore", Args: "<manifest>", Summary: "download the files of a manifest", Flag: "restore", Prefixes: prefixes([]string{"restore-", "mapping-keys", "retry-budget", "gateway-"}, apiPrefixes)},
+	{Name: "sync", Args: "<checksums.csv> <dir>", Summary: "upload the files of a directory changed since its manifest", Flag: "sync", Prefixes: prefixes([]string{"sync-", "strip-exif", "hedge-after", "pin"}, dagPrefixes, metadataPrefixes, apiPrefixes)},
+	{Name: "gc", Args: "<manifest>", Summary: "unpin the CIDs the tool pinned which the manifest no longer references", Flag: "gc", Prefixes: prefixes([]string{"gc-", "state", "yes", "mapping-keys", "cache-file", "no-cache"}, apiPrefixes)},
+	{Name: "publish", Args: "<path> --out <dir>", Summary: "upload the files, write their metadata to --out, upload it and print the base URI to set on the contract", Prefixes: metadataPrefixes, Sets: []string{"upload-metadata"}, UploadFlags: true},
+	{Name: "metadata", Args: "<checksums.csv> <path>", Summary: "write the metadata of the files with the CIDs of their manifest, without uploading them again", Flag: "cids-from", Prefixes: metadataPrefixes, UploadFlags: true},
+	{Name: "car", Args: "<file.car> <path>", Summary: "pack a file or directory into a CAR file, without uploading it", Flag: "car", Prefixes: prefixes([]string{"wrap"}, dagPrefixes, filterPrefixes)},
+	{Name: "import", Args: "<file.car>", Summary: "upload a CAR file", Flag: "car-import", Prefixes: prefixes([]string{"pin"}, apiPrefixes)},
+	{Name: "pin", Args: "ls | add <cid>... | rm <cid>...", Summary: "list, pin or unpin CIDs on --url", Prefixes: prefixes([]string{"state", "cache-file", "no-cache"}, apiPrefixes)},
+	{Name: "bench", Args: "<samples> <path>", Summary: "upload samples of the path at several concurrencies and recommend one", Flag: "bench", Prefixes: prefixes([]string{"bench-"}, dagPrefixes, filterPrefixes, apiPrefixes)},
+	{Name: "serve", Args: "<address>", Summary: "serve an HTTP API to upload files", Flag: "serve", Prefixes: prefixes([]string{"serve-", "pin"}, dagPrefixes, apiPrefixes)},
+	{Name: "help", Args: "[command]", Summary: "print the help of a command"},
+}
+
+// commonPrefixes are those of the flags of every command, listed by the
+// help of the commands.
+var commonPrefixes = []string{"id", "secret", "auth-bearer", "header", "config", "profile", "url", "provider", "mock", "proxy", "ca-cert", "client-", "insecure-skip-verify", "connect-timeout", "idle-timeout", "log-format", "verbose", "no-preflight", "request-id-header"}
+
+// flagAliases are other names of the flags, by alias, accepted but not
+// listed by the help.
+var flagAliases = map[string]string{"merge-metadata": "merge-json"}
+
+// normalizeFlag makes the aliases of flagAliases set their flag.
+func normalizeFlag(fs *flag.FlagSet, name string) flag.NormalizedName {
+	if f, ok := flagAliases[name]; ok {
+		name = f
+	}
+	return flag.NormalizedName(name)
+}
+
+func lookupCommand(name string) *command {
+	for _, c := range commands {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// parseCommand returns the command of the arguments of the process and the
+// arguments left, the command being upload if they don't start with one.
+func parseCommand(args []string) (*command, []string) {
+	if len(args) > 0 {
+		if c := lookupCommand(args[0]); c != nil {
+			return c, args[1:]
+		}
+	}
+	return commands[0], args
+}
+
+// apply sets the flags of c, and the flag of its mode to the first of the
+// positional arguments args, and returns the others.
+func (c *command) apply(fs *flag.FlagSet, args []string) ([]string, error) {
+	for _, name := range c.Sets {
+		if err := fs.Set(name, "true"); err != nil {
+			return nil, fmt.Errorf("%v: %v", c.Name, err)
+		}
+	}
+	if c.Flag == "" {
+		return args, nil
+	}
+	if fs.Changed(c.Flag) {
+		return nil, fmt.Errorf("parameter --%v is set by the %v command", c.Flag, c.Name)
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("usage: %v %v %v [options]", filepath.Base(os.Args[0]), c.Name, c.Args)
+	}
+	if err := fs.Set(c.Flag, args[0]); err != nil {
+		return nil, fmt.Errorf("%v %v: %v", c.Name, args[0], err)
+	}
+	return args[1:], nil
+}
+
+// checkFlags returns an error naming the first flag set in fs which c
+// doesn't take: the mode of another command, or a flag of another command.
+// Upload, the default command, takes every flag, the modes being run by
+// their flags without a command too.
+func (c *command) checkFlags(fs *flag.FlagSet) error {
+	if c == commands[0] || c.Name == "help" {
+		return nil
+	}
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if err != nil || f.Name == c.Flag {
+			return
+		}
+		if mode := modeCommand(f.Name); mode != "" {
+			err = fmt.Errorf("parameter --%v runs %v, it can't be used with the %v command", f.Name, mode, c.Name)
+			return
+		}
+		if !c.UploadFlags && !hasFlagPrefix(f.Name, c.Prefixes) && !hasFlagPrefix(f.Name, commonPrefixes) {
+			err = fmt.Errorf("parameter --%v doesn't apply to the %v command, see %v help %v", f.Name, c.Name, filepath.Base(os.Args[0]), c.Name)
+		}
+	})
+	return err
+}
+
+// modeCommand returns what the flag name runs if it is a mode: its command,
+// or the mode of modeFlags, "" otherwise.
+func modeCommand(name string) string {
+	for _, c := range commands {
+		if c.Flag == name {
+			return "the " + c.Name + " command"
+		}
+	}
+	for _, mode := range modeFlags {
+		if mode == name {
+			return "a mode of its own"
+		}
+	}
+	return ""
+}
+
+// printUsage writes the help of c, the commands and every flag for upload.
+func printUsage(w io.Writer, fs *flag.FlagSet, c *command) {
+	name := filepath.Base(os.Args[0])
+	if c.Name == "upload" || c.Name == "help" {
+		_, _ = fmt.Fprintf(w, "Usage: %v [command] [options] <path>\n\nCommands:\n", name)
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		for _, c := range commands {
+			_, _ = fmt.Fprintf(tw, "  %v %v\t%v\n", c.Name, c.Args, c.Summary)
+		}
+		_ = tw.Flush()
+		_, _ = fmt.Fprintf(w, "\nThe command defaults to upload. Options:\n%v", fs.FlagUsages())
+		return
+	}
+
+	_, _ = fmt.Fprintf(w, "Usage: %v %v %v [options]\n\n%v.\n", name, c.Name, c.Args, strings.ToUpper(c.Summary[:1])+c.Summary[1:])
+	if c.Flag != "" {
+		_, _ = fmt.Fprintf(w, "It is the same as --%v.\n", c.Flag)
+	}
+	own := flag.NewFlagSet(c.Name, flag.ContinueOnError)
+	common := flag.NewFlagSet("common", flag.ContinueOnError)
+	fs.VisitAll(func(f *flag.Flag) {
+		switch {
+		case f.Name == c.Flag || f.Hidden:
+		case hasFlagPrefix(f.Name, c.Prefixes):
+			own.AddFlag(f)
+		case hasFlagPrefix(f.Name, commonPrefixes):
+			common.AddFlag(f)
+		}
+	})
+	if own.HasFlags() {
+		_, _ = fmt.Fprintf(w, "\nOptions:\n%v", own.FlagUsages())
+	}
+	_, _ = fmt.Fprintf(w, "\nCommon options:\n%v\nRun %v --help for every option.\n", common.FlagUsages(), name)
+}
+
+// hasFlagPrefix reports whether name is one of prefixes, or starts with one
+// of those ending with a dash.
+func hasFlagPrefix(name string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if name == p || (strings.HasSuffix(p, "-") && strings.HasPrefix(name, p)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	flag "github.com/spf13/pflag"
+)
+
+func TestFlagAliases(t *testing.T) {
+	for alias, name := range flagAliases {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		value := fs.String(name, "", "")
+		fs.SetNormalizeFunc(normalizeFlag)
+		if err := fs.Parse([]string{"--" + alias, "dir"}); err != nil {
+			t.Fatalf("--%v: %v", alias, err)
+		}
+		if *value != "dir" || !fs.Changed(name) {
+			t.Errorf("--%v dir set --%v to %q", alias, name, *value)
+		}
+	}
+}
+
+func TestCheckFlags(t *testing.T) {
+	tests := []struct {
+		command string
+		args    []string
+		wantErr bool
+	}{
+		{"upload", []string{"--audit", "sums.csv", "--out", "meta"}, false},
+		{"pin", []string{"--mock", "--concurrency", "2", "--state", "state.json"}, false},
+		{"pin", []string{"--mock", "--out", "meta"}, true},
+		{"pin", []string{"--bwlimit", "1KB/s"}, true},
+		{"pin", []string{"--audit", "sums.csv"}, true},
+		{"stat", []string{"--state-query", "cid"}, true},
+		{"sync", []string{"--sync-mode", "mtime", "--out", "meta", "--cid-version", "1"}, false},
+		{"sync", []string{"--bwlimit", "1KB/s"}, true},
+		{"publish", []string{"--out", "meta", "--bwlimit", "1KB/s"}, false},
+		{"publish", []string{"--stat", "sums.csv"}, true},
+		{"help", []string{"--out", "meta"}, false},
+	}
+	for _, tt := range tests {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.Bool("mock", false, "")
+		for _, name := range []string{"audit", "out", "concurrency", "state", "bwlimit", "state-query", "sync-mode", "cid-version", "stat"} {
+			fs.String(name, "", "")
+		}
+		if err := fs.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+		if err := lookupCommand(tt.command).checkFlags(fs); (err != nil) != tt.wantErr {
+			t.Errorf("%v %q returned %v, want an error %v", tt.command, tt.args, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+)
+
+// Environment variables of the credentials, read unless --id and --secret
+// are set.
+const (
+	envProjectID     = "IPFS_UPLOAD_PROJECT_ID"
+	envProjectSecret = "IPFS_UPLOAD_PROJECT_SECRET"
+)
+
+// configFile is the --config file, profiles of options by name, e.g.
+//
+//	default: prod
+//	profiles:
+//	  prod:
+//	    id: ...
+//	    secret: ...
+//	  local:
+//	    provider: kubo
+//	    url: http://127.0.0.1:5001
+type configFile struct {
+	// Default is the profile used without --profile
+	Default  string                            `yaml:"default"`
+	Profiles map[string]map[string]interface{} `yaml:"profiles"`
+}
+
+// defaultConfigFile returns the --config file read when not set.
+func defaultConfigFile() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".ipfs-upload", "config.yaml"), nil
+}
+
+// applyConfig sets the flags of fs not set on the command line from the
+// environment variables of the credentials, then from the profile of the
+// --config file at path: name, or its default profile if empty. A missing
+// file is only an error if required, as when --config or --profile is set.
+func applyConfig(fs *flag.FlagSet, path, name string, required bool) error {
+	for flagName, env := range map[string]string{"id": envProjectID, "secret": envProjectSecret} {
+		if value := os.Getenv(env); value != "" && !fs.Changed(flagName) {
+			if err := fs.Set(flagName, value); err != nil {
+				return fmt.Errorf("%v: %v", env, err)
+			}
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !required {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0077 != 0 {
+		logs.Warn(fmt.Sprintf("%v is readable by other users, run chmod 600 %v", path, path))
+	}
+	var config configFile
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	if name == "" {
+		name = config.Default
+	}
+	if name == "" {
+		return nil
+	}
+	profile, ok := config.Profiles[name]
+	if !ok {
+		return fmt.Errorf("%v has no profile %v", path, name)
+	}
+
+	// the options are set in order, for the errors to be the same on every
+	// run
+	keys := make([]string, 0, len(profile))
+	for key := range profile {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		f := fs.Lookup(key)
+		if f == nil || key == "config" || key == "profile" {
+			return fmt.Errorf("%v: profile %v: unknown option %v", path, name, key)
+		}
+		if fs.Changed(key) {
+			continue
+		}
+		// the flags repeated rather than comma separated, such as --header,
+		// are set once per item of a list
+		values := []string{configValue(profile[key])}
+		if items, ok := profile[key].([]interface{}); ok && f.Value.Type() == "stringArray" {
+			values = values[:0]
+			for _, item := range items {
+				values = append(values, fmt.Sprint(item))
+			}
+		}
+		for _, value := range values {
+			if err := fs.Set(key, value); err != nil {
+				return fmt.Errorf("%v: profile %v: %v: %v", path, name, key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configValue returns the value of a flag from a YAML value, the items of
+// a list being joined by commas.
+func configValue(v interface{}) string {
+	if items, ok := v.([]interface{}); ok {
+		values := make([]string, len(items))
+		for i, item := range items {
+			values[i] = fmt.Sprint(item)
+		}
+		return strings.Join(values, ",")
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// The exit codes of a run, documented in the Readme. Like the --porcelain
+// format, they keep their meaning within a major version.
+const (
+	exitSuccess = 0
+	// the upload, or some of its files, failed
+	exitFailed = 1
+	// invalid parameters or input files, before anything was uploaded
+	exitUsage       = 2
+	exitAuthFailed  = 3
+	exitUnreachable = 4
+	// interrupted by SIGINT or SIGTERM
+	exitInterrupted = 5
+	// a request timed out
+	exitDeadline = 6
+	// the files were uploaded but not their metadata
+	exitMetadataFailed = 7
+)
+
+// usageError is an error of the parameters or of the input files, exiting
+// with exitUsage.
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+// exitError ends a run with code, its failure being logged already.
+type exitError struct {
+	code int
+}
+
+func (e *exitError) Error() string {
+	return "exit status " + strconv.Itoa(e.code)
+}
+
+// exitCode returns the exit code of a run failing with err, after a signal
+// if interrupted.
+func exitCode(err error, interrupted bool) int {
+	var netErr net.Error
+	var usage *usageError
+	var exit *exitError
+	switch {
+	case err == nil:
+		return exitSuccess
+	case errors.As(err, &exit):
+		return exit.code
+	case errors.As(err, &usage):
+		return exitUsage
+	case interrupted:
+		return exitInterrupted
+	case errors.Is(err, uploader.ErrAuthFailed), errors.Is(err, uploader.ErrProxyAuthFailed), uploader.ErrorClass(err) == uploader.ClassForbidden:
+		return exitAuthFailed
+	case errors.Is(err, uploader.ErrUnreachable), uploader.IsConnectError(err):
+		return exitUnreachable
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return exitDeadline
+	}
+	return exitFailed
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	cmds "github.com/ipfs/go-ipfs-cmds"
+	httpapi "github.com/ipfs/go-ipfs-http-client"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// timeoutError is a net.Error timing out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		interrupted bool
+		want        int
+	}{
+		{"success", nil, false, exitSuccess},
+		{"success interrupted", nil, true, exitSuccess},
+		{"usage", &usageError{"parameter --output must be text, porcelain, json or ndjson"}, false, exitUsage},
+		{"wrapped usage", fmt.Errorf("parameter --profile: %w", &usageError{"no such profile"}), false, exitUsage},
+		{"usage interrupted", &usageError{"parameter --id is required"}, true, exitUsage},
+		{"logged failure", &exitError{exitFailed}, false, exitFailed},
+		{"logged metadata failure", &exitError{exitMetadataFailed}, true, exitMetadataFailed},
+		{"interrupted", context.Canceled, true, exitInterrupted},
+		{"interrupted while unreachable", uploader.ErrUnreachable, true, exitInterrupted},
+		{"authentication", uploader.ErrAuthFailed, false, exitAuthFailed},
+		{"wrapped authentication", fmt.Errorf("preflight: %w", uploader.ErrAuthFailed), false, exitAuthFailed},
+		{"proxy authentication", uploader.ErrProxyAuthFailed, false, exitAuthFailed},
+		{"forbidden", &httpapi.Error{Code: cmds.ErrForbidden}, false, exitAuthFailed},
+		{"unreachable", uploader.ErrUnreachable, false, exitUnreachable},
+		{"connection refused", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, false, exitUnreachable},
+		{"deadline", context.DeadlineExceeded, false, exitDeadline},
+		{"timeout", &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, false, exitDeadline},
+		{"server error", &httpapi.Error{Code: cmds.ErrNormal, Message: "fake failure"}, false, exitFailed},
+		{"TLS", uploader.ErrTLS, false, exitFailed},
+		{"other", errors.New("disk full"), false, exitFailed},
+	}
+	for _, tt := range tests {
+		if got := exitCode(tt.err, tt.interrupted); got != tt.want {
+			t.Errorf("%v: exitCode(%v, %v) = %v, want %v", tt.name, tt.err, tt.interrupted, got, tt.want)
+		}
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-upload-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{"nft/1.png": "one"})
+	unauthorized := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer unauthorized.Close()
+
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"success", []string{"--mock", "nft"}, exitSuccess},
+		{"failure", []string{"--mock", "--mock-fail-rate", "1", "nft"}, exitFailed},
+		{"usage", []string{"--mock", "--output", "xml", "nft"}, exitUsage},
+		{"missing path", []string{"--mock", "missing"}, exitUsage},
+		{"authentication", []string{"--url", unauthorized.URL, "--id", "id", "--secret", "secret", "nft"}, exitAuthFailed},
+		{"unreachable", []string{"--url", "http://127.0.0.1:1", "--id", "id", "--secret", "secret", "nft"}, exitUnreachable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, code := runMain(t, dir, append([]string{"--no-cache"}, tt.args...)...); code != tt.want {
+				t.Errorf("exited with %v, want %v", code, tt.want)
+			}
+		})
+	}
+}
+
+func TestUploadInterrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-upload-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{"nft/1.png": "one"})
+	// the API passes the preflight check, then never answers the upload
+	// until the test ends
+	done := make(chan struct{})
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v0/version" {
+			_, _ = w.Write([]byte(`{"Version":"test"}`))
+			return
+		}
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer api.Close()
+	defer close(done)
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), mainEnv+"=1", mainEnv+"_ARGS=--no-cache --url "+api.URL+" --id id --secret secret nft", "HOME="+dir)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Wait()
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != exitInterrupted {
+		t.Errorf("the upload exited with %v, want %v", err, exitInterrupted)
+	}
+}
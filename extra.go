@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// extraFields are the static fields of --extra-fields merged into every
+// metadata document.
+type extraFields struct {
+	doc *jsonObject
+	// Override makes the extra fields win over the generated ones on
+	// conflict
+	Override bool
+}
+
+// readExtraFields reads the --extra-fields file at path, a JSON object or a
+// YAML mapping if its extension is .yaml or .yml.
+func readExtraFields(path string, override bool) (*extraFields, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var m yaml.MapSlice
+		if err := yaml.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+		// the JSON keeps the order of the keys of the mapping
+		data, err = json.Marshal(yamlToJSON(m))
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+	}
+	doc, err := readJSONObject(data)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return &extraFields{doc: doc, Override: override}, nil
+}
+
+// yamlToJSON converts the mappings of a YAML value to jsonObject values.
+func yamlToJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		var o jsonObject
+		for _, item := range v {
+			// the errors are of values which can't be marshaled, which YAML
+			// doesn't produce
+			_ = o.Set(fmt.Sprint(item.Key), yamlToJSON(item.Value))
+		}
+		return o
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, item := range v {
+			values[i] = yamlToJSON(item)
+		}
+		return values
+	default:
+		return v
+	}
+}
+
+// Merge deep merges the extra fields into doc. The keys missing from doc
+// are appended in the order of the file, the other ones keep their
+// position. An object and a value which isn't an object at the same key
+// fail the merge.
+func (e *extraFields) Merge(doc *jsonObject) error {
+	return mergeObject(doc, e.doc, e.Override, "")
+}
+
+func mergeObject(dst, src *jsonObject, override bool, path string) error {
+	for _, key := range src.keys {
+		keyPath := key
+		if path != "" {
+			keyPath = path + "." + key
+		}
+		value := src.values[key]
+		existing, ok := dst.values[key]
+		if !ok {
+			if err := dst.Set(key, value); err != nil {
+				return err
+			}
+			continue
+		}
+		srcObject, dstObject := isJSONObject(value), isJSONObject(existing)
+		switch {
+		case srcObject && dstObject:
+			var child, extra jsonObject
+			if err := json.Unmarshal(existing, &child); err != nil {
+				return err
+			}
+			if err := json.Unmarshal(value, &extra); err != nil {
+				return err
+			}
+			if err := mergeObject(&child, &extra, override, keyPath); err != nil {
+				return err
+			}
+			if err := dst.Set(key, child); err != nil {
+				return err
+			}
+		case srcObject != dstObject:
+			return fmt.Errorf("%v is an object on one side only", keyPath)
+		case override:
+			if err := dst.Set(key, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isJSONObject reports whether the JSON value raw is an object.
+func isJSONObject(raw json.RawMessage) bool {
+	s := strings.TrimSpace(string(raw))
+	return strings.HasPrefix(s, "{")
+}
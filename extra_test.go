@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestExtraFieldsMerge(t *testing.T) {
+	const doc = `{"name":"#1","image":"ipfs://x","properties":{"a":1},"attributes":[{"trait_type":"Eyes","value":"Green"}]}`
+	tests := []struct {
+		name     string
+		file     string
+		data     string
+		override bool
+		want     string
+		err      string
+	}{
+		{
+			name: "json appended in order",
+			file: "extra.json",
+			data: `{"seller_fee_basis_points": 500, "fee_recipient": "0xabc"}`,
+			want: `{"name":"#1","image":"ipfs://x","properties":{"a":1},"attributes":[{"trait_type":"Eyes","value":"Green"}],"seller_fee_basis_points":500,"fee_recipient":"0xabc"}`,
+		},
+		{
+			name: "yaml in order",
+			file: "extra.yaml",
+			data: "z: 1\na: two\nlist: [1, b]\n",
+			want: `{"name":"#1","image":"ipfs://x","properties":{"a":1},"attributes":[{"trait_type":"Eyes","value":"Green"}],"z":1,"a":"two","list":[1,"b"]}`,
+		},
+		{
+			name: "objects merged deep",
+			file: "extra.yml",
+			data: "properties:\n  b: 2\n  nested:\n    c: 3\n",
+			want: `{"name":"#1","image":"ipfs://x","properties":{"a":1,"b":2,"nested":{"c":3}},"attributes":[{"trait_type":"Eyes","value":"Green"}]}`,
+		},
+		{
+			name: "generated fields win",
+			file: "extra.json",
+			data: `{"name": "extra", "properties": {"a": 2}, "attributes": []}`,
+			want: doc,
+		},
+		{
+			name:     "extra fields win with override",
+			file:     "extra.json",
+			data:     `{"name": "extra", "properties": {"a": 2}, "attributes": []}`,
+			override: true,
+			want:     `{"name":"extra","image":"ipfs://x","properties":{"a":2},"attributes":[]}`,
+		},
+		{
+			name: "object against a value",
+			file: "extra.json",
+			data: `{"properties": {"b": {"c": 1}}, "name": {"en": "x"}}`,
+			err:  "name is an object on one side only",
+		},
+		{
+			name: "nested object against a value",
+			file: "extra.json",
+			data: `{"properties": {"a": {"c": 1}}}`,
+			err:  "properties.a is an object on one side only",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			extra, err := readExtraFields(writeTestFile(t, tt.file, tt.data), tt.override)
+			if err != nil {
+				t.Fatal(err)
+			}
+			merged, err := readJSONObject([]byte(doc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = extra.Merge(merged)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := json.Marshal(merged)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadExtraFieldsError(t *testing.T) {
+	for file, data := range map[string]string{
+		"list.json":  `[1, 2]`,
+		"bad.json":   `{"a": `,
+		"list.yaml":  "- 1\n- 2\n",
+		"bad.yml":    "a: [1\n",
+		"yaml.json":  "a: 1\n",
+		"scalar.yml": "just a string\n",
+	} {
+		if _, err := readExtraFields(writeTestFile(t, file, data), false); err == nil {
+			t.Errorf("read %v %q", file, data)
+		}
+	}
+}
+
+func TestRenderExtraFields(t *testing.T) {
+	extra, err := readExtraFields(writeTestFile(t, "extra.json", `{"description": "static", "properties": {"creator": "me"}}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok := &token{Index: 1, SourceIndex: 1, Filename: "1.png", Width: 2, Height: 3}
+	got, err := renderMetadata(tok, metadataOptions{Prefix: "ipfs://", Name: "#{index}", Dimensions: "properties", Extra: extra, Format: compact})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"name":"#1","image":"ipfs://SAMPLE-CID","properties":{"width":2,"height":3,"creator":"me"},"description":"static"}`; string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	extra, err = readExtraFields(writeTestFile(t, "extra.json", `{"name": {"en": "x"}}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := renderMetadata(tok, metadataOptions{Prefix: "ipfs://", Name: "#{index}", Extra: extra, Format: compact}); err == nil || !strings.Contains(err.Error(), "merging the --extra-fields into the metadata of 1") {
+		t.Errorf("got error %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// ignoreFile is the file of a directory listing more --exclude patterns.
+const ignoreFile = ".ipfsignore"
+
+// filterPattern is a pattern of --include or --exclude: a glob matching
+// the name of the files, or their path relative to the uploaded directory
+// if it has a slash, or a regular expression of that path if it starts with
+// re:.
+type filterPattern struct {
+	glob string
+	re   *regexp.Regexp
+	// anchored patterns match the whole path rather than the name
+	anchored bool
+	// dir patterns end with a slash and match directories only
+	dir bool
+}
+
+func parseFilterPattern(s string) (filterPattern, error) {
+	if strings.HasPrefix(s, "re:") {
+		re, err := regexp.Compile(s[len("re:"):])
+		if err != nil {
+			return filterPattern{}, fmt.Errorf("invalid pattern %q: %v", s, err)
+		}
+		return filterPattern{re: re}, nil
+	}
+	p := filterPattern{dir: strings.HasSuffix(s, "/")}
+	p.glob = strings.TrimSuffix(s, "/")
+	p.anchored = strings.Contains(p.glob, "/")
+	p.glob = strings.TrimPrefix(p.glob, "/")
+	if _, err := path.Match(p.glob, ""); err != nil || p.glob == "" {
+		return filterPattern{}, fmt.Errorf("invalid pattern %q", s)
+	}
+	return p, nil
+}
+
+// match reports whether the pattern matches the file or directory at rel,
+// slash separated.
+func (p filterPattern) match(rel string, dir bool) bool {
+	if p.re != nil {
+		return p.re.MatchString(rel)
+	}
+	if p.dir && !dir {
+		return false
+	}
+	name := rel
+	if !p.anchored {
+		name = path.Base(rel)
+	}
+	ok, _ := path.Match(p.glob, name)
+	return ok
+}
+
+// fileFilter selects the files of the upload of a directory with the
+// patterns of --include and --exclude, and the ones of its .ipfsignore.
+type fileFilter struct {
+	include []filterPattern
+	exclude []filterPattern
+}
+
+func newFileFilter(include, exclude []string) (*fileFilter, error) {
+	f := &fileFilter{}
+	for _, s := range include {
+		p, err := parseFilterPattern(s)
+		if err != nil {
+			return nil, err
+		}
+		f.include = append(f.include, p)
+	}
+	for _, s := range exclude {
+		p, err := parseFilterPattern(s)
+		if err != nil {
+			return nil, err
+		}
+		f.exclude = append(f.exclude, p)
+	}
+	return f, nil
+}
+
+// readIgnoreFile returns the patterns of the .ipfsignore file at path, one
+// per line, none if there is no such file. Lines starting with # are
+// comments.
+func readIgnoreFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		if text != "" && !strings.HasPrefix(text, "#") {
+			patterns = append(patterns, text)
+		}
+	}
+	return patterns, scanner.Err()
+}
+
+// empty reports whether the filter keeps every file.
+func (f *fileFilter) empty() bool {
+	return len(f.include) == 0 && len(f.exclude) == 0
+}
+
+// excluded reports whether the file or directory at rel is left out: a
+// directory if it matches --exclude, a file if it also matches none of the
+// --include patterns when there are some.
+func (f *fileFilter) excluded(rel string, dir bool) bool {
+	for _, p := range f.exclude {
+		if p.match(rel, dir) {
+			return true
+		}
+	}
+	if dir || len(f.include) == 0 {
+		return false
+	}
+	for _, p := range f.include {
+		if p.match(rel, dir) {
+			return false
+		}
+	}
+	return true
+}
+
+// excludedPaths returns the local paths of the files and directories under
+// root the filter leaves out, those below the excluded directories
+// included, and the number of files among them.
+func (f *fileFilter) excludedPaths(root string, includeHidden bool) (map[string]bool, int, error) {
+	paths := make(map[string]bool)
+	var files int
+	err := uploader.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == root {
+			return nil
+		}
+		if !includeHidden && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		parent := paths[filepath.Dir(p)]
+		if parent || rel == ignoreFile || f.excluded(rel, info.IsDir()) {
+			paths[p] = true
+			if !info.IsDir() {
+				files++
+			}
+		}
+		return nil
+	})
+	return paths, files, err
+}
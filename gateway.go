@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+)
+
+var subdomainRe = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// gatewayURL returns the URL of c on the Infura dedicated gateway named
+// subdomain.
+func gatewayURL(subdomain string, c cid.Cid) string {
+	return fmt.Sprintf("https://%v.infura-ipfs.io/ipfs/%v", subdomain, c)
+}
+
+// gatewayPrefix returns the prefix of the gateway URLs of CIDs, on base,
+// e.g. https://gateway.example, or else on the dedicated gateway named
+// subdomain.
+func gatewayPrefix(subdomain, base string) (string, error) {
+	switch {
+	case base != "":
+		return strings.TrimSuffix(base, "/") + "/ipfs/", nil
+	case subdomain != "":
+		return fmt.Sprintf("https://%v.infura-ipfs.io/ipfs/", subdomain), nil
+	default:
+		return "", errors.New("gateway URLs require --gateway-subdomain or --gateway-url")
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// gcCandidate is a pin of the tool which --gc may remove.
+type gcCandidate struct {
+	Cid cid.Cid
+	// Source is how the tool knows it pinned the CID
+	Source string
+	Dir    bool
+}
+
+// readSyncReport reads a --sync-report file.
+func readSyncReport(path string) (*uploader.SyncReport, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r uploader.SyncReport
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("%v is not a --sync-report file: %v", path, err)
+	}
+	return &r, nil
+}
+
+// gcCandidates returns the CIDs the tool pinned to endpoint: the ones
+// state, if not nil, recorded pinned there, the directories only if dirs,
+// and the ones superseded in the --sync-report files reports by path.
+func gcCandidates(state *uploader.State, endpoint string, dirs bool, reports map[string]*uploader.SyncReport) map[cid.Cid]gcCandidate {
+	candidates := make(map[cid.Cid]gcCandidate)
+	if state != nil {
+		for hash, e := range state.Entries {
+			c, err := cid.Decode(e.CID)
+			if err != nil || !e.PinnedTo(endpoint) || (e.Kind == "directory" && !dirs) {
+				continue
+			}
+			candidates[c] = gcCandidate{Cid: c, Source: fmt.Sprintf("%v %v of --state", e.Kind, hash), Dir: e.Kind == "directory"}
+		}
+	}
+	for path, r := range reports {
+		for _, change := range r.Changes {
+			c, err := cid.Decode(change.Superseded)
+			if err != nil {
+				continue
+			}
+			if _, ok := candidates[c]; !ok {
+				candidates[c] = gcCandidate{Cid: c, Source: fmt.Sprintf("superseded %v of %v", change.Path, path)}
+			}
+		}
+	}
+	return candidates
+}
+
+// referencedCIDs returns the CIDs of entries, with the CIDs of their
+// metadata URIs.
+func referencedCIDs(entries []*auditEntry) map[cid.Cid]bool {
+	refs := make(map[cid.Cid]bool)
+	for _, e := range entries {
+		refs[e.Cid] = true
+		if c, ok := urlCID(e.URI); ok {
+			refs[c] = true
+		}
+	}
+	return refs
+}
+
+// gcUnpinned removes endpoint from the entries of s with one of the CIDs
+// unpinned, so that they aren't reused as if still stored there.
+func gcUnpinned(s *uploader.State, endpoint string, unpinned map[cid.Cid]bool) {
+	for _, e := range s.Entries {
+		c, err := cid.Decode(e.CID)
+		if err != nil || !unpinned[c] {
+			continue
+		}
+		e.Endpoints = removeString(e.Endpoints, endpoint)
+		e.Pinned = removeString(e.Pinned, endpoint)
+	}
+}
+
+// recordUnpinned removes the CIDs unpinned from endpoint from the --state
+// file at statePath if set, and from the CID cache at cacheFile, or its
+// default, unless noCache, so that their content isn't reused as if still
+// pinned. The cache names the endpoint of --mock mock. The failures are only
+// warned about, the CIDs being unpinned.
+func recordUnpinned(statePath, cacheFile string, noCache bool, endpoint string, mock bool, unpinned map[cid.Cid]bool) {
+	if len(unpinned) == 0 {
+		return
+	}
+	if statePath != "" {
+		if err := uploader.UpdateState(statePath, func(s *uploader.State) { gcUnpinned(s, endpoint, unpinned) }); err != nil {
+			logs.Warn(fmt.Sprintf("recording the unpinned CIDs in %v: %v", statePath, err))
+		}
+	}
+	if noCache {
+		return
+	}
+	var err error
+	if cacheFile == "" {
+		cacheFile, err = uploader.DefaultCacheFile()
+	}
+	if mock {
+		endpoint = "mock"
+	}
+	if err == nil {
+		err = uploader.ForgetUnpinned(cacheFile, endpoint, unpinned)
+	}
+	if err != nil {
+		logs.Warn(fmt.Sprintf("removing the unpinned CIDs from the cache: %v", err))
+	}
+}
+
+func removeString(list []string, s string) []string {
+	kept := []string{}
+	for _, item := range list {
+		if item != s {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+// runGC runs gc, unpinning the CIDs --gc no longer references.
+func runGC(o *commonOptions) error {
+	if len(o.args) != 0 {
+		return &usageError{"parameter --gc takes no path argument"}
+	}
+	if *statePath == "" && len(*gcSuperseded) == 0 {
+		return &usageError{"parameter --gc requires --state or --gc-superseded, which record the CIDs the tool pinned"}
+	}
+	if !*gcYes && !*gcDryRun && !isTerminal(os.Stdin) {
+		return &usageError{"parameter --gc requires --yes or --gc-dry-run when the standard input isn't a terminal"}
+	}
+	keys, err := parseMappingKeys(*mappingKeysFlag)
+	if err != nil {
+		return &usageError{err.Error()}
+	}
+	var entries []*auditEntry
+	for _, manifest := range append([]string{*gcPath}, *gcKeep...) {
+		more, err := readStatManifest(manifest, keys)
+		if err != nil {
+			return &usageError{err.Error()}
+		}
+		entries = append(entries, more...)
+	}
+	var state *uploader.State
+	if *statePath != "" {
+		if state, err = uploader.ReadState(*statePath); err != nil {
+			return &usageError{err.Error()}
+		}
+	}
+	reports := make(map[string]*uploader.SyncReport)
+	for _, path := range *gcSuperseded {
+		if reports[path], err = readSyncReport(path); err != nil {
+			return &usageError{err.Error()}
+		}
+	}
+	ctx, cancel := signalContext()
+	defer cancel()
+	up, _, err := o.newUploaderFromFlags(ctx)
+	if err != nil {
+		return err
+	}
+
+	pins, err := up.Pins(ctx)
+	if err != nil {
+		return fmt.Errorf("listing the pins: %w", err)
+	}
+	refs := referencedCIDs(entries)
+	candidates := gcCandidates(state, *api, *gcDirs, reports)
+	var unpin []gcCandidate
+	ours, kept, keptDirs := 0, 0, 0
+	for _, c := range pins {
+		candidate, ok := candidates[c]
+		switch {
+		case !ok:
+		case refs[c]:
+			ours++
+			kept++
+			if candidate.Dir {
+				keptDirs++
+			}
+		default:
+			ours++
+			unpin = append(unpin, candidate)
+		}
+	}
+	// a --checksums CSV file has the CIDs of the files only, which
+	// would leave the root of the current upload unreferenced
+	if *gcDirs && keptDirs == 0 {
+		for _, candidate := range unpin {
+			if candidate.Dir {
+				return &usageError{"parameter --gc-dirs requires manifests with the root CIDs of the uploads to keep, such as a --uri-list or a --mapping with uris, none of the directories being referenced"}
+			}
+		}
+	}
+	verb := "UNPIN"
+	if *gcDryRun {
+		verb = "WOULD UNPIN"
+	}
+	for _, candidate := range unpin {
+		_, _ = fmt.Fprintf(os.Stdout, "%v %v (%v)\n", verb, candidate.Cid, candidate.Source)
+	}
+	logs.Info(fmt.Sprintf("%v pins on %v, %v pinned by the tool, %v still referenced, %v no longer referenced", len(pins), *api, ours, kept, len(unpin)),
+		"pins", len(pins), "ours", ours, "referenced", kept, "unreferenced", len(unpin))
+	if *gcDryRun || len(unpin) == 0 {
+		return nil
+	}
+	if !*gcYes {
+		_, _ = fmt.Fprintf(os.Stderr, "Unpin these %v CIDs from %v? [y/N] ", len(unpin), *api)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			logs.Info("Nothing unpinned")
+			return nil
+		}
+	}
+
+	unpinned := make(map[cid.Cid]bool)
+	failed := 0
+	for _, candidate := range unpin {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := up.Unpin(ctx, candidate.Cid); err != nil {
+			failed++
+			_, _ = fmt.Fprintf(os.Stdout, "FAILED %v: %v\n", candidate.Cid, err)
+			continue
+		}
+		unpinned[candidate.Cid] = true
+		_, _ = fmt.Fprintf(os.Stdout, "UNPINNED %v\n", candidate.Cid)
+	}
+	recordUnpinned(*statePath, *cacheFile, *noCache, *api, *mock, unpinned)
+	logs.Info(fmt.Sprintf("Unpinned %v of %v CIDs from %v", len(unpinned), len(unpin), *api), "unpinned", len(unpinned), "failed", failed)
+	switch {
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case failed > 0:
+		return &exitError{exitFailed}
+	}
+	return nil
+}
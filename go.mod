@@ -3,8 +3,22 @@ module github.com/INFURA/ipfs-upload-client
 go 1.15
 
 require (
+	github.com/aws/aws-sdk-go v1.44.334
+	github.com/ipfs/go-cid v0.0.7
+	github.com/ipfs/go-ipfs-chunker v0.0.1
+	github.com/ipfs/go-ipfs-cmds v0.3.0
 	github.com/ipfs/go-ipfs-files v0.0.8
 	github.com/ipfs/go-ipfs-http-client v0.1.0
+	github.com/ipfs/go-ipld-format v0.2.0
+	github.com/ipfs/go-merkledag v0.4.0
+	github.com/ipfs/go-unixfs v0.2.4
 	github.com/ipfs/interface-go-ipfs-core v0.5.0
+	github.com/multiformats/go-multihash v0.0.15
+	github.com/prometheus/client_golang v1.11.0
 	github.com/spf13/pflag v1.0.5
+	github.com/xeipuuv/gojsonschema v1.2.0
+	golang.org/x/image v0.0.0-20210628002857-a66eb6448b8d
+	golang.org/x/sync v0.0.0-20220722155255-886fb9371eb4
+	golang.org/x/time v0.0.0-20210723032227-1f47c861a9ac
+	gopkg.in/yaml.v2 v2.3.0
 )
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// fileRule links the file named <index><Suffix> of a token from the Field
+// of its metadata, e.g. _hires.png=properties.hi_res.
+type fileRule struct {
+	Suffix string
+	Field  string
+}
+
+// tokenFile is a file of a token with several files.
+type tokenFile struct {
+	Field string
+	File  *token
+}
+
+// parseFileRules parses a comma separated list of suffix=field rules.
+func parseFileRules(str string) ([]fileRule, error) {
+	var rules []fileRule
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(str, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || !validFieldPath(parts[1]) {
+			return nil, fmt.Errorf("invalid --map rule %q, expected suffix=field", item)
+		}
+		suffix := strings.ToLower(parts[0])
+		if seen[suffix] {
+			return nil, fmt.Errorf("duplicate --map suffix %v", parts[0])
+		}
+		seen[suffix] = true
+		rules = append(rules, fileRule{Suffix: suffix, Field: parts[1]})
+	}
+	return rules, nil
+}
+
+// matchRule returns the rule with the longest suffix name ends with after
+// a token index, so that 7_hires.png matches _hires.png rather than .png.
+func matchRule(name string, rules []fileRule) (int, int, bool) {
+	lower := strings.ToLower(name)
+	best := -1
+	index := 0
+	for i, rule := range rules {
+		if !strings.HasSuffix(lower, rule.Suffix) {
+			continue
+		}
+		n, ok := parseIndex(name[:len(name)-len(rule.Suffix)])
+		if ok && (best < 0 || len(rule.Suffix) > len(rules[best].Suffix)) {
+			best, index = i, n
+		}
+	}
+	return index, best, best >= 0
+}
+
+// scanGroups walks root like scanTokens but collects the files matching
+// rules into one token per index, sorted by index. The files of a token
+// are in the order of rules and the first one stands for the token.
+func scanGroups(root string, rules []fileRule, includeHidden bool, excluded map[string]bool) ([]*token, error) {
+	var tokens []*token
+	members := make(map[int][]*token)
+
+	err := walkFiles(root, includeHidden, excluded, func(f *token) error {
+		index, rule, ok := matchRule(f.Filename, rules)
+		if !ok {
+			return nil
+		}
+		f.Index = index
+		f.SourceIndex = index
+		f.MIMEType = detectMIMEType(f.LocalPath)
+
+		files, ok := members[index]
+		if !ok {
+			files = make([]*token, len(rules))
+			members[index] = files
+			tokens = append(tokens, &token{Index: index})
+		}
+		if other := files[rule]; other != nil {
+			return fmt.Errorf("files %v and %v both match %v of token %v", other.Path, f.Path, rules[rule].Suffix, index)
+		}
+		files[rule] = f
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range tokens {
+		for i, f := range members[t.Index] {
+			if f != nil {
+				t.Files = append(t.Files, tokenFile{Field: rules[i].Field, File: f})
+			}
+		}
+		first := *t.Files[0].File
+		first.Files = t.Files
+		*t = first
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Index < tokens[j].Index })
+	return tokens, nil
+}
+
+// missingFiles returns the names of the files expected by rules which
+// tokens don't have, e.g. 7_hires.png.
+func missingFiles(tokens []*token, rules []fileRule) []string {
+	var missing []string
+	for _, t := range tokens {
+		have := make(map[string]bool)
+		for _, f := range t.Files {
+			have[f.Field] = true
+		}
+		for _, rule := range rules {
+			if !have[rule.Field] {
+				missing = append(missing, fmt.Sprintf("%v%v", t.SourceIndex, rule.Suffix))
+			}
+		}
+	}
+	return missing
+}
@@ -0,0 +1,134 @@
+// Package preview scales images down into the previews of --thumbnails.
+package preview
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+const previewJPEGQuality = 85
+
+// Preview is the preview of an image written by Write.
+type Preview struct {
+	// Path is the preview written, empty if the image is small enough to be
+	// its own preview
+	Path string
+	// NotImage reports whether the file isn't an image, without a preview
+	NotImage bool
+}
+
+// Write writes a copy of every image of paths scaled down to size
+// pixels on its longest side to dir, using up to workers goroutines, and
+// returns the previews in the order of paths. The preview of paths[i] is
+// named names[i], with the extension .jpg for the JPEG images, which stay
+// JPEG, and .png for the others. The first failure, or the cancellation of
+// ctx, stops dispatching the other images.
+func Write(ctx context.Context, paths, names []string, dir string, size, workers int) ([]Preview, error) {
+	previews := make([]Preview, len(paths))
+	err := forEach(ctx, len(paths), workers, func(i int) error {
+		p, err := writePreview(paths[i], filepath.Join(dir, names[i]), size)
+		if err == image.ErrFormat {
+			previews[i].NotImage = true
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("generating the preview of %v: %v", paths[i], err)
+		}
+		previews[i].Path = p
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return previews, nil
+}
+
+// forEach calls fn with every index up to n, on up to workers goroutines.
+// The first error of fn, or the cancellation of ctx, stops dispatching the
+// other indexes.
+func forEach(ctx context.Context, n, workers int, fn func(i int) error) error {
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(workers)
+	for i := 0; i < n; i++ {
+		if gctx.Err() != nil {
+			break
+		}
+		i := i
+		// Go waits for a worker, by which time a failure may have
+		// cancelled the others
+		g.Go(func() error {
+			if gctx.Err() != nil {
+				return nil
+			}
+			return fn(i)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// writePreview writes the preview of the image at path to dst with its
+// extension and returns its path, or "" if the image is small enough
+// already.
+func writePreview(path, dst string, size int) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	src, format, err := image.Decode(f)
+	_ = f.Close()
+	if err != nil {
+		return "", err
+	}
+
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= size && height <= size {
+		return "", nil
+	}
+	if width >= height {
+		width, height = size, maxInt(1, height*size/width)
+	} else {
+		width, height = maxInt(1, width*size/height), size
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), src, bounds, draw.Src, nil)
+
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		dst += ".jpg"
+		err = jpeg.Encode(&buf, scaled, &jpeg.Options{Quality: previewJPEGQuality})
+	} else {
+		dst += ".png"
+		err = png.Encode(&buf, scaled)
+	}
+	if err == nil {
+		err = uploader.WriteFileAtomic(dst, buf.Bytes())
+	}
+	if err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,155 @@
+package preview
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The tests of the worker pool are meant to be run with -race as well.
+
+func TestForEach(t *testing.T) {
+	failure := errors.New("fake failure")
+	tests := []struct {
+		name    string
+		n       int
+		workers int
+		// failAt is the index failing, -1 for none, cancelAt the one
+		// cancelling the run
+		failAt   int
+		cancelAt int
+		err      error
+		// calls is the number of indexes fn is called with, -1 for any
+		calls int32
+	}{
+		{"all", 50, 4, -1, -1, nil, 50},
+		{"single worker", 10, 1, -1, -1, nil, 10},
+		{"more workers than indexes", 3, 8, -1, -1, nil, 3},
+		{"failure", 50, 4, 10, -1, failure, -1},
+		{"failure stops dispatch", 50, 1, 2, -1, failure, 3},
+		{"cancelled", 50, 4, -1, 10, context.Canceled, -1},
+		{"cancelled stops dispatch", 50, 1, -1, 2, context.Canceled, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var calls, running, most int32
+			done := make([]bool, tt.n)
+			err := forEach(ctx, tt.n, tt.workers, func(i int) error {
+				atomic.AddInt32(&calls, 1)
+				n := atomic.AddInt32(&running, 1)
+				defer atomic.AddInt32(&running, -1)
+				for {
+					m := atomic.LoadInt32(&most)
+					if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+				switch i {
+				case tt.failAt:
+					return failure
+				case tt.cancelAt:
+					cancel()
+				}
+				done[i] = true
+				return nil
+			})
+
+			if !errors.Is(err, tt.err) || (err == nil) != (tt.err == nil) {
+				t.Fatalf("returned %v, want %v", err, tt.err)
+			}
+			if most > int32(tt.workers) {
+				t.Errorf("%v indexes were processed at once by %v workers", most, tt.workers)
+			}
+			if tt.calls >= 0 && calls != tt.calls {
+				t.Errorf("fn was called %v times, want %v", calls, tt.calls)
+			}
+			if err != nil {
+				return
+			}
+			for i, ok := range done {
+				if !ok {
+					t.Fatalf("the index %v wasn't done", i)
+				}
+			}
+		})
+	}
+}
+
+func TestWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-upload-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "2.png"), []byte("not an image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	previewDir := filepath.Join(dir, "previews")
+	if err := os.Mkdir(previewDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// large images get a preview, small ones are their own, and the other
+	// files are skipped
+	var paths, names []string
+	for i, width := range []int{64, 8, 0, 32, 64} {
+		p := filepath.Join(dir, strconv.Itoa(i)+".png")
+		paths, names = append(paths, p), append(names, strconv.Itoa(i))
+		if width == 0 {
+			continue
+		}
+		f, err := os.Create(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = png.Encode(f, image.NewRGBA(image.Rect(0, 0, width, width/2)))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	previews, err := Write(context.Background(), paths, names, previewDir, 16, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []Preview{
+		{Path: filepath.Join(previewDir, "0.png")},
+		{},
+		{NotImage: true},
+		{Path: filepath.Join(previewDir, "3.png")},
+		{Path: filepath.Join(previewDir, "4.png")},
+	} {
+		if previews[i] != want {
+			t.Errorf("the preview %v is %+v, want %+v", i, previews[i], want)
+		}
+	}
+	f, err := os.Open(previews[0].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	config, err := png.DecodeConfig(f)
+	if err != nil || config.Width != 16 || config.Height != 8 {
+		t.Errorf("the preview is %vx%v (%v), want 16x8", config.Width, config.Height, err)
+	}
+
+	// a missing image fails the run
+	paths, names = append(paths, filepath.Join(dir, "5.png")), append(names, "5")
+	if _, err := Write(context.Background(), paths, names, previewDir, 16, 2); err == nil {
+		t.Error("a missing image didn't fail the previews")
+	}
+}
@@ -0,0 +1,353 @@
+// Package strip removes the embedded metadata of JPEG, PNG and WebP
+// images, for --strip-exif.
+package strip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	ipfsFiles "github.com/ipfs/go-ipfs-files"
+)
+
+var (
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+	// pngMetadataChunks are the ancillary PNG chunks holding text, EXIF and
+	// timestamps
+	pngMetadataChunks = map[string]bool{"tEXt": true, "zTXt": true, "iTXt": true, "eXIf": true, "tIME": true}
+)
+
+// JPEG markers of the segments holding EXIF and XMP (APP1), IPTC (APP13)
+// and comments. ICC profiles (APP2) and Adobe color transforms (APP14)
+// change how the image looks and are kept.
+const (
+	jpegAPP1  = 0xe1
+	jpegAPP13 = 0xed
+	jpegCOM   = 0xfe
+	jpegSOS   = 0xda
+)
+
+// exifHeader starts the APP1 segments of EXIF, followed by a TIFF header
+// and its first IFD.
+var exifHeader = []byte("Exif\x00\x00")
+
+// exifOrientation is the tag of the orientation of the image, which the
+// viewers apply to display it upright, and exifShort the type of its value.
+const (
+	exifOrientation = 0x0112
+	exifShort       = 3
+)
+
+// WebP VP8X flags of the EXIF and XMP chunks.
+const (
+	webpEXIFFlag = 0x08
+	webpXMPFlag  = 0x04
+)
+
+// ErrCorruptImage is returned for the images Metadata can't parse.
+var ErrCorruptImage = errors.New("corrupt image")
+
+// Supported reports whether Metadata handles the files named name.
+func Supported(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".webp":
+		return true
+	}
+	return false
+}
+
+// Metadata returns the image data of the file named name without its
+// embedded metadata. The image itself is copied as is, not decoded.
+func Metadata(name string, data []byte) ([]byte, error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg":
+		return stripJPEG(data)
+	case ".png":
+		return stripPNG(data)
+	case ".webp":
+		return stripWebP(data)
+	}
+	return data, nil
+}
+
+func stripJPEG(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, ErrCorruptImage
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+
+	oriented := false
+	for i := 2; ; {
+		// markers may be preceded by fill bytes
+		for i < len(data) && data[i] == 0xff && i+1 < len(data) && data[i+1] == 0xff {
+			i++
+		}
+		if i+4 > len(data) || data[i] != 0xff {
+			return nil, ErrCorruptImage
+		}
+		marker := data[i+1]
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return nil, ErrCorruptImage
+		}
+		if marker == jpegSOS {
+			// the entropy coded data follows until the end of the image
+			out.Write(data[i:])
+			return out.Bytes(), nil
+		}
+		switch {
+		case marker == jpegAPP1:
+			// the orientation is kept, the image being displayed sideways
+			// otherwise
+			if o, order, ok := jpegOrientation(data[i+4 : i+2+length]); ok && !oriented {
+				out.Write(orientationSegment(o, order))
+				oriented = true
+			}
+		case marker != jpegAPP13 && marker != jpegCOM:
+			out.Write(data[i : i+2+length])
+		}
+		i += 2 + length
+	}
+}
+
+// jpegOrientation returns the orientation of the EXIF APP1 segment data and
+// its byte order, if it has one other than upright.
+func jpegOrientation(data []byte) (uint16, binary.ByteOrder, bool) {
+	if !bytes.HasPrefix(data, exifHeader) {
+		return 0, nil, false
+	}
+	tiff := data[len(exifHeader):]
+	if len(tiff) < 8 {
+		return 0, nil, false
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, nil, false
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0, nil, false
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for e := ifd + 2; e+12 <= len(tiff) && entries > 0; e, entries = e+12, entries-1 {
+		if order.Uint16(tiff[e:]) != exifOrientation {
+			continue
+		}
+		o := order.Uint16(tiff[e+8:])
+		if order.Uint16(tiff[e+2:]) != exifShort || order.Uint32(tiff[e+4:]) != 1 || o < 2 || o > 8 {
+			return 0, nil, false
+		}
+		return o, order, true
+	}
+	return 0, nil, false
+}
+
+// orientationSegment returns an EXIF APP1 segment holding the orientation
+// o alone, in byte order.
+func orientationSegment(o uint16, order binary.ByteOrder) []byte {
+	tiff := make([]byte, 8+2+12+4)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	// a single entry, the orientation, and no next IFD
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], exifOrientation)
+	order.PutUint16(tiff[12:], exifShort)
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], o)
+
+	segment := []byte{0xff, jpegAPP1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(2+len(exifHeader)+len(tiff)))
+	segment = append(segment, exifHeader...)
+	return append(segment, tiff...)
+}
+
+func stripPNG(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, ErrCorruptImage
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngSignature)
+
+	for i := len(pngSignature); i < len(data); {
+		if i+8 > len(data) {
+			return nil, ErrCorruptImage
+		}
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		// length, type, data and CRC
+		end := i + 12 + length
+		if length < 0 || end > len(data) || end < i {
+			return nil, ErrCorruptImage
+		}
+		if !pngMetadataChunks[string(data[i+4:i+8])] {
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+	return out.Bytes(), nil
+}
+
+func stripWebP(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, ErrCorruptImage
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:12])
+
+	vp8x := -1
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, ErrCorruptImage
+		}
+		fourCC := string(data[i : i+4])
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		// chunks are padded to an even size
+		end := i + 8 + size + size%2
+		if size < 0 || end > len(data) || end < i {
+			return nil, ErrCorruptImage
+		}
+		if fourCC != "EXIF" && fourCC != "XMP " {
+			if fourCC == "VP8X" && size > 0 {
+				vp8x = out.Len()
+			}
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+
+	stripped := out.Bytes()
+	if vp8x >= 0 {
+		stripped[vp8x+8] &^= webpEXIFFlag | webpXMPFlag
+	}
+	binary.LittleEndian.PutUint32(stripped[4:], uint32(len(stripped)-8))
+	return stripped, nil
+}
+
+// Stripper removes the embedded metadata of the images of the upload. An
+// image which can't be parsed is uploaded as is, passed to Warn, or fails
+// the upload if Strict.
+type Stripper struct {
+	Strict bool
+	// Warn is called with the images uploaded as is and the reason, if not
+	// nil
+	Warn func(path string, err error)
+}
+
+// Wrap returns node, read from the local path, with the metadata of every
+// image below it stripped.
+func (s *Stripper) Wrap(node ipfsFiles.Node, path string) ipfsFiles.Node {
+	switch n := node.(type) {
+	case *ipfsFiles.Symlink:
+		return n
+	case ipfsFiles.Directory:
+		return &stripDirectory{Directory: n, stripper: s, path: path}
+	case ipfsFiles.File:
+		if !Supported(path) {
+			return n
+		}
+		return &File{File: n, stripper: s, path: path}
+	default:
+		return n
+	}
+}
+
+// File is an image of a Stripper, reading the whole image on first use to
+// strip it.
+type File struct {
+	ipfsFiles.File
+	stripper *Stripper
+	path     string
+	reader   *bytes.Reader
+	// Stripped reports whether the metadata was stripped, once read
+	Stripped bool
+}
+
+func (f *File) load() error {
+	if f.reader != nil {
+		return nil
+	}
+	data, err := ioutil.ReadAll(f.File)
+	if err != nil {
+		return err
+	}
+	stripped, err := Metadata(f.path, data)
+	if err != nil {
+		if f.stripper.Strict {
+			return fmt.Errorf("stripping the metadata of %v: %v", f.path, err)
+		}
+		if f.stripper.Warn != nil {
+			f.stripper.Warn(f.path, err)
+		}
+		stripped = data
+	} else {
+		f.Stripped = true
+	}
+	f.reader = bytes.NewReader(stripped)
+	return nil
+}
+
+func (f *File) Read(p []byte) (int, error) {
+	if err := f.load(); err != nil {
+		return 0, err
+	}
+	return f.reader.Read(p)
+}
+
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	if err := f.load(); err != nil {
+		return 0, err
+	}
+	return f.reader.Seek(offset, whence)
+}
+
+func (f *File) Size() (int64, error) {
+	if err := f.load(); err != nil {
+		return 0, err
+	}
+	return f.reader.Size(), nil
+}
+
+type stripDirectory struct {
+	ipfsFiles.Directory
+	stripper *Stripper
+	path     string
+}
+
+func (d *stripDirectory) Entries() ipfsFiles.DirIterator {
+	return &stripIterator{DirIterator: d.Directory.Entries(), stripper: d.stripper, path: d.path}
+}
+
+type stripIterator struct {
+	ipfsFiles.DirIterator
+	stripper *Stripper
+	path     string
+}
+
+func (it *stripIterator) Node() ipfsFiles.Node {
+	return it.stripper.Wrap(it.DirIterator.Node(), filepath.Join(it.path, it.Name()))
+}
+
+// ReadFile returns the content of the image at path without its metadata,
+// as a Stripper reads it.
+func ReadFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Metadata(path, data)
+}
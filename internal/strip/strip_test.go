@@ -0,0 +1,89 @@
+package strip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testEXIF returns an EXIF APP1 segment with the orientation o, unless 0,
+// and the Make tag, in byte order.
+func testEXIF(o uint16, order binary.ByteOrder) []byte {
+	var tiff bytes.Buffer
+	if order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+	_ = binary.Write(&tiff, order, uint16(42))
+	_ = binary.Write(&tiff, order, uint32(8))
+	entries := uint16(1)
+	if o != 0 {
+		entries++
+	}
+	_ = binary.Write(&tiff, order, entries)
+	// Make, 4 ASCII bytes held in the entry
+	_ = binary.Write(&tiff, order, []uint16{0x010f, 2})
+	_ = binary.Write(&tiff, order, uint32(4))
+	tiff.WriteString("Cam\x00")
+	if o != 0 {
+		_ = binary.Write(&tiff, order, []uint16{exifOrientation, exifShort})
+		_ = binary.Write(&tiff, order, uint32(1))
+		_ = binary.Write(&tiff, order, []uint16{o, 0})
+	}
+	_ = binary.Write(&tiff, order, uint32(0))
+
+	segment := []byte{0xff, jpegAPP1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(2+len(exifHeader)+tiff.Len()))
+	segment = append(segment, exifHeader...)
+	return append(segment, tiff.Bytes()...)
+}
+
+func TestStripJPEGOrientation(t *testing.T) {
+	app0 := []byte{0xff, 0xe0, 0, 6, 'J', 'F', 'I', 'F'}
+	comment := []byte{0xff, jpegCOM, 0, 5, 'c', 'o', 'm'}
+	scan := []byte{0xff, jpegSOS, 0, 2, 1, 2, 3, 0xff, 0xd9}
+
+	tests := []struct {
+		name  string
+		o     uint16
+		order binary.ByteOrder
+	}{
+		{"no orientation", 0, binary.BigEndian},
+		{"upright", 1, binary.BigEndian},
+		{"rotated big endian", 6, binary.BigEndian},
+		{"rotated little endian", 8, binary.LittleEndian},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var image []byte
+			image = append(image, 0xff, 0xd8)
+			image = append(image, app0...)
+			image = append(image, testEXIF(tt.o, tt.order)...)
+			image = append(image, comment...)
+			image = append(image, scan...)
+
+			stripped, err := stripJPEG(image)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []byte
+			want = append(want, 0xff, 0xd8)
+			want = append(want, app0...)
+			if tt.o > 1 {
+				want = append(want, orientationSegment(tt.o, tt.order)...)
+			}
+			want = append(want, scan...)
+			if !bytes.Equal(stripped, want) {
+				t.Fatalf("stripJPEG() = %x, want %x", stripped, want)
+			}
+			if tt.o > 1 {
+				segment := orientationSegment(tt.o, tt.order)
+				o, order, ok := jpegOrientation(segment[4:])
+				if !ok || o != tt.o || order != tt.order {
+					t.Errorf("the orientation kept is %v %v %v, want %v %v", o, order, ok, tt.o, tt.order)
+				}
+			}
+		})
+	}
+}
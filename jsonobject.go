@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// jsonObject is a JSON object which keeps the order of its keys, so that
+// existing documents can be modified without reordering them.
+type jsonObject struct {
+	keys   []string
+	values map[string]json.RawMessage
+}
+
+func (o *jsonObject) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return errors.New("not a JSON object")
+	}
+
+	o.keys = nil
+	o.values = make(map[string]json.RawMessage)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key := tok.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return err
+		}
+		if _, ok := o.values[key]; !ok {
+			o.keys = append(o.keys, key)
+		}
+		o.values[key] = value
+	}
+	_, err = dec.Token()
+	return err
+}
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(o.values[key])
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Set sets key to value, keeping the position of an existing key and
+// appending a new one.
+func (o *jsonObject) Set(key string, value interface{}) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if o.values == nil {
+		o.values = make(map[string]json.RawMessage)
+	}
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = raw
+	return nil
+}
+
+// Delete removes key.
+func (o *jsonObject) Delete(key string) {
+	if _, ok := o.values[key]; !ok {
+		return
+	}
+	delete(o.values, key)
+	for i, k := range o.keys {
+		if k == key {
+			o.keys = append(o.keys[:i], o.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// SetPath sets the value at the dot separated path, e.g. properties.image,
+// creating the missing objects along it and keeping their other keys.
+func (o *jsonObject) SetPath(path string, value interface{}) error {
+	return o.setPath(strings.Split(path, "."), 0, value)
+}
+
+func (o *jsonObject) setPath(keys []string, i int, value interface{}) error {
+	if i == len(keys)-1 {
+		return o.Set(keys[i], value)
+	}
+
+	var child jsonObject
+	if raw, ok := o.values[keys[i]]; ok {
+		if err := json.Unmarshal(raw, &child); err != nil {
+			return fmt.Errorf("%v is not a JSON object", strings.Join(keys[:i+1], "."))
+		}
+	}
+	if err := child.setPath(keys, i+1, value); err != nil {
+		return err
+	}
+	return o.Set(keys[i], child)
+}
+
+// validFieldPath reports whether path is a dot separated path without empty
+// keys.
+func validFieldPath(path string) bool {
+	for _, key := range strings.Split(path, ".") {
+		if key == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// readJSONObject reads the JSON object in data.
+func readJSONObject(data []byte) (*jsonObject, error) {
+	var o jsonObject
+	if err := json.Unmarshal(data, &o); err != nil {
+		return nil, fmt.Errorf("invalid JSON object: %v", err)
+	}
+	return &o, nil
+}
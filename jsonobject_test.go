@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestJSONObjectSetPath(t *testing.T) {
+	tests := []struct {
+		doc, path string
+		want      string
+		err       bool
+	}{
+		{`{}`, "image", `{"image":"x"}`, false},
+		{`{"b":1,"image":"old","a":2}`, "image", `{"b":1,"image":"x","a":2}`, false},
+		{`{"z":0}`, "properties.image", `{"z":0,"properties":{"image":"x"}}`, false},
+		{`{"properties":{"b":1,"a":2}}`, "properties.image", `{"properties":{"b":1,"a":2,"image":"x"}}`, false},
+		{`{"properties":{"image":"old","a":2}}`, "properties.image", `{"properties":{"image":"x","a":2}}`, false},
+		{`{"properties":[1]}`, "properties.image", "", true},
+		{`{"properties":{"files":"flat"}}`, "properties.files.image", "", true},
+	}
+	for _, tt := range tests {
+		doc, err := readJSONObject([]byte(tt.doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = doc.SetPath(tt.path, "x")
+		if (err != nil) != tt.err {
+			t.Errorf("setting %v in %v: error %v", tt.path, tt.doc, err)
+			continue
+		}
+		if tt.err {
+			continue
+		}
+		got, err := json.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("setting %v in %v gave %s, want %s", tt.path, tt.doc, got, tt.want)
+		}
+	}
+}
+
+func TestValidFieldPath(t *testing.T) {
+	for path, want := range map[string]bool{
+		"image":            true,
+		"properties.image": true,
+		"a.b.c":            true,
+		"":                 false,
+		".image":           false,
+		"image.":           false,
+		"a..b":             false,
+	} {
+		if got := validFieldPath(path); got != want {
+			t.Errorf("validFieldPath(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestReadJSONObject(t *testing.T) {
+	for _, data := range []string{`[1]`, `"s"`, `{"a":`, ``} {
+		if _, err := readJSONObject([]byte(data)); err == nil {
+			t.Errorf("read %q as a JSON object", data)
+		}
+	}
+	// the keys keep their order, a duplicate key its first position
+	doc, err := readJSONObject([]byte(`{"b":1,"a":2,"b":3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != `{"b":3,"a":2}` {
+		t.Errorf("got %s", got)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ipfsFiles "github.com/ipfs/go-ipfs-files"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// Localization is the ERC-1155 localization block of the metadata, URI
+// being the template of the localized files with {id} and {locale}.
+type Localization struct {
+	URI     string   `json:"uri"`
+	Default string   `json:"default"`
+	Locales []string `json:"locales"`
+}
+
+// localizedStrings are the translated fields of a token, empty if missing.
+type localizedStrings struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// localization writes a copy of the metadata per locale besides the
+// default one, e.g. 7.ja.json, with the translated name and description.
+type localization struct {
+	// Locales are the locales of --locales, the first being the default one
+	Locales []string
+	// Strings are the translations by locale and token index
+	Strings map[string]map[int]localizedStrings
+	// Root is the CID of the directory of the localized files once uploaded
+	Root string
+}
+
+// readLocalizations reads the translations of every locale but the first
+// one from dir, in <locale>.csv files with token_id, name and description
+// columns or <locale>.json files mapping the index to the name and
+// description.
+func readLocalizations(dir string, locales []string) (*localization, error) {
+	loc := &localization{Locales: locales, Strings: make(map[string]map[int]localizedStrings)}
+	for _, locale := range locales[1:] {
+		csvPath := filepath.Join(dir, locale+".csv")
+		jsonPath := filepath.Join(dir, locale+".json")
+		var err error
+		if _, statErr := os.Stat(csvPath); statErr == nil {
+			loc.Strings[locale], err = readLocalizedCSV(csvPath)
+		} else if _, statErr := os.Stat(jsonPath); statErr == nil {
+			loc.Strings[locale], err = readLocalizedJSON(jsonPath)
+		} else {
+			err = fmt.Errorf("%v has no %v.csv or %v.json", dir, locale, locale)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return loc, nil
+}
+
+func readLocalizedCSV(path string) (map[int]localizedStrings, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading %v: %v", path, err)
+	}
+	columns := map[string]int{tokenIDColumn: -1, "name": -1, "description": -1}
+	for i, name := range header {
+		if _, ok := columns[strings.TrimSpace(name)]; ok {
+			columns[strings.TrimSpace(name)] = i
+		}
+	}
+	if columns[tokenIDColumn] < 0 {
+		return nil, fmt.Errorf("%v has no %v column", path, tokenIDColumn)
+	}
+	value := func(record []string, column string) string {
+		if i := columns[column]; i >= 0 && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	strs := make(map[int]localizedStrings)
+	for row := 2; ; row++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %v: %v", path, err)
+		}
+		index, ok := parseIndex(value(record, tokenIDColumn))
+		if !ok {
+			return nil, fmt.Errorf("%v row %v: invalid %v %q", path, row, tokenIDColumn, value(record, tokenIDColumn))
+		}
+		strs[index] = localizedStrings{Name: value(record, "name"), Description: value(record, "description")}
+	}
+	return strs, nil
+}
+
+func readLocalizedJSON(path string) (map[int]localizedStrings, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var byKey map[string]localizedStrings
+	if err := json.Unmarshal(data, &byKey); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	strs := make(map[int]localizedStrings)
+	for key, s := range byKey {
+		index, ok := parseIndex(key)
+		if !ok {
+			return nil, fmt.Errorf("%v: invalid index %q", path, key)
+		}
+		strs[index] = s
+	}
+	return strs, nil
+}
+
+// Missing returns the tokens missing a translated name or description, by
+// locale, which fall back to the default locale.
+func (l *localization) Missing(tokens []*token, opts metadataOptions) []string {
+	var missing []string
+	for _, locale := range l.Locales[1:] {
+		var indexes []int
+		for _, t := range tokens {
+			s := l.Strings[locale][t.SourceIndex]
+			if (opts.Name != "" && s.Name == "") || (opts.Description != "" && s.Description == "") {
+				indexes = append(indexes, t.SourceIndex)
+			}
+		}
+		if len(indexes) > 0 {
+			missing = append(missing, fmt.Sprintf("%v: %v", locale, formatIndexes(indexes)))
+		}
+	}
+	return missing
+}
+
+// Block returns the localization block of the default metadata, opts
+// naming the files after {id}.
+func (l *localization) Block(opts metadataOptions) *Localization {
+	root := l.Root
+	if root == "" {
+		root = sampleCID
+	}
+	return &Localization{
+		URI:     "ipfs://" + root + "/" + localizedName(opts.FileTemplate, "{locale}"),
+		Default: l.Locales[0],
+		Locales: l.Locales,
+	}
+}
+
+// Options returns the options of the metadata of t in locale.
+func (l *localization) Options(t *token, locale string, opts metadataOptions) metadataOptions {
+	s := l.Strings[locale][t.SourceIndex]
+	if s.Name != "" {
+		opts.Name = s.Name
+	}
+	if s.Description != "" {
+		opts.Description = s.Description
+	}
+	opts.Localization = nil
+	return opts
+}
+
+// Names returns the names of the localized files of tokens.
+func (l *localization) Names(tokens []*token, opts metadataOptions) []string {
+	var names []string
+	for _, t := range tokens {
+		for _, locale := range l.Locales[1:] {
+			names = append(names, localizedName(metadataName(t, opts), locale))
+		}
+	}
+	return names
+}
+
+// Write writes the localized files of tokens to dir.
+func (l *localization) Write(dir string, tokens []*token, opts metadataOptions) error {
+	for _, t := range tokens {
+		for _, locale := range l.Locales[1:] {
+			data, err := renderMetadata(t, l.Options(t, locale, opts))
+			if err != nil {
+				return err
+			}
+			name := filepath.Join(dir, localizedName(metadataName(t, opts), locale))
+			if err := uploader.WriteFileAtomic(name, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// localizedName inserts the locale before the extension of the metadata
+// file name, e.g. 7.ja.json.
+func localizedName(name, locale string) string {
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + locale + ext
+}
+
+// namedFiles returns the files named names in dir as a directory.
+func namedFiles(dir string, names []string) (ipfsFiles.Directory, error) {
+	files := make(map[string]ipfsFiles.Node)
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		stat, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		file, err := ipfsFiles.NewSerialFile(path, false, stat)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = file
+	}
+	return ipfsFiles.NewMapDirectory(files), nil
+}
+
+// localeList splits the --locales list.
+func localeList(s string) []string {
+	var locales []string
+	for _, locale := range strings.Split(s, ",") {
+		if locale = strings.TrimSpace(locale); locale != "" {
+			locales = append(locales, locale)
+		}
+	}
+	return locales
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formats of --log-format: the messages as they are for the humans, or a
+// JSON object per line with the attributes of the records.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logLevel is the severity of a record, named like the levels of log/slog.
+type logLevel string
+
+const (
+	levelInfo  logLevel = "INFO"
+	levelWarn  logLevel = "WARN"
+	levelError logLevel = "ERROR"
+)
+
+// logger writes the diagnostics of the run to the standard error, a whole
+// line at a time whatever the goroutine. Like log/slog, the records have a
+// message and attributes given as key and value pairs; the text format only
+// writes the messages, prefixing the warnings with WARNING, while the JSON
+// format writes the time, level, message and attributes of the records, the
+// field names being those of log/slog.
+type logger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+	// attrs are the attributes of every record, such as the run ID
+	attrs []interface{}
+	// status is the line of --progress bar, redrawn under the messages
+	status string
+}
+
+// logs is the logger of the run, writing text until --log-format is read.
+var logs = newLogger(os.Stderr, logFormatText)
+
+func newLogger(w io.Writer, format string) *logger {
+	return &logger{w: w, format: format}
+}
+
+// With adds attributes to every record written from now on.
+func (l *logger) With(args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.attrs = append(l.attrs, args...)
+}
+
+// clearLine moves to the start of the line and erases it.
+const clearLine = "\r\033[K"
+
+// Status replaces the status line displayed under the messages, erasing it
+// if empty. It is only drawn in text, for a terminal.
+func (l *logger) Status(s string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.format == logFormatJSON || (s == "" && l.status == "") {
+		return
+	}
+	l.status = s
+	_, _ = io.WriteString(l.w, clearLine+s)
+}
+
+func (l *logger) Info(msg string, args ...interface{}) {
+	l.log(levelInfo, msg, args)
+}
+
+func (l *logger) Warn(msg string, args ...interface{}) {
+	l.log(levelWarn, msg, args)
+}
+
+func (l *logger) Error(msg string, args ...interface{}) {
+	l.log(levelError, msg, args)
+}
+
+func (l *logger) log(level logLevel, msg string, args []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.format != logFormatJSON {
+		if level == levelWarn {
+			msg = "WARNING: " + msg
+		}
+		if l.status != "" {
+			msg = clearLine + msg + "\n" + l.status
+		} else {
+			msg += "\n"
+		}
+		_, _ = io.WriteString(l.w, msg)
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("{")
+	writeLogField(&b, "time", time.Now().UTC().Format(time.RFC3339Nano))
+	writeLogField(&b, "level", string(level))
+	writeLogField(&b, "msg", msg)
+	attrs := append(append([]interface{}{}, l.attrs...), args...)
+	for i := 0; i+1 < len(attrs); i += 2 {
+		writeLogField(&b, fmt.Sprint(attrs[i]), attrs[i+1])
+	}
+	b.WriteString("}\n")
+	_, _ = io.WriteString(l.w, b.String())
+}
+
+// writeLogField writes a field of a JSON record, the errors and durations
+// as strings and milliseconds.
+func writeLogField(b *strings.Builder, key string, value interface{}) {
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case time.Duration:
+		value = milliseconds(v)
+	case fmt.Stringer:
+		value = v.String()
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(value))
+	}
+	name, _ := json.Marshal(key)
+	if b.Len() > 1 {
+		b.WriteString(",")
+	}
+	b.Write(name)
+	b.WriteString(":")
+	b.Write(data)
+}
@@ -2,128 +2,761 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/ipfs/go-cid"
 	ipfsFiles "github.com/ipfs/go-ipfs-files"
-	httpapi "github.com/ipfs/go-ipfs-http-client"
-	coreiface "github.com/ipfs/interface-go-ipfs-core"
-	caopts "github.com/ipfs/interface-go-ipfs-core/options"
-	ipfsPath "github.com/ipfs/interface-go-ipfs-core/path"
 	flag "github.com/spf13/pflag"
+
+	"github.com/INFURA/ipfs-upload-client/internal/strip"
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
 )
 
-const infuraAPI = "https://ipfs.infura.io:5001"
+const preflightTimeout = 30 * time.Second
 
-func main() {
-	projectId := flag.String("id", "", "your Infura ProjectID")
-	projectSecret := flag.String("secret", "", "your Infura ProjectSecret")
-	api := flag.String("url", infuraAPI, "the API URL")
-	pin := flag.Bool("pin", true, "whether or not to pin the data")
-	verbose := flag.Bool("verbose", false, "whether or not to print full upload information")
+// The flags of the commands, parsed by main.
+var (
+	projectId              = flag.String("id", "", "your Infura ProjectID, IPFS_UPLOAD_PROJECT_ID if not set")
+	projectSecret          = flag.String("secret", "", "your Infura ProjectSecret, or the API token of a provider taking a bearer token such as filebase, IPFS_UPLOAD_PROJECT_SECRET if not set")
+	configPath             = flag.String("config", "", "the YAML file of the --profile options, ~/.ipfs-upload/config.yaml if not set")
+	authBearer             = flag.String("auth-bearer", "", "a token sent as Authorization: Bearer in place of --id and --secret, whatever the provider, e.g. for a node behind a proxy")
+	headerFlags            = flag.StringArray("header", nil, "a header 'Key: Value' sent with every API request, repeatable, an Authorization header replacing the credentials")
+	profileName            = flag.String("profile", "", "the profile of --config whose options apply unless set on the command line, its default one if not set")
+	providerName           = flag.String("provider", "infura", "the service to upload to: infura, filebase, or kubo for a node of your own, with the IPFS API, pinata, or web3storage and nftstorage taking CARs, setting its --url and how --id and --secret are sent")
+	api                    = flag.String("url", uploader.DefaultAPI, "the API URL, the one of --provider by default; without --provider, a node of your own taking no credentials unless --id or --secret is set, or the service of its host")
+	pin                    = flag.Bool("pin", true, "whether or not to pin the data")
+	pinRemote              = flag.Bool("pin-remote", false, "after the upload, pin its roots on a remote pinning service implementing the IPFS Pinning Service API, waiting for them to be pinned")
+	pinEndpoint            = flag.String("pin-endpoint", "", "the URL of the Pinning Service API of --pin-remote, e.g. https://api.pinata.cloud/psa")
+	pinToken               = flag.String("pin-token", "", "the access token of the pinning service of --pin-remote")
+	pinPoll                = flag.Duration("pin-poll", 5*time.Second, "how often --pin-remote polls the status of the pins")
+	pinTimeout             = flag.Duration("pin-timeout", time.Hour, "how long --pin-remote waits for the pins to be pinned")
+	verbose                = flag.Bool("verbose", false, "whether or not to print full upload information")
+	proxy                  = flag.String("proxy", "", "the proxy URL, overrides HTTPS_PROXY/HTTP_PROXY")
+	caCert                 = flag.String("ca-cert", "", "path to a PEM bundle of additional trusted CA certificates")
+	clientCert             = flag.String("client-cert", "", "path to a PEM client certificate for mutual TLS")
+	clientKey              = flag.String("client-key", "", "path to the PEM private key of --client-cert")
+	insecureSkipVerify     = flag.Bool("insecure-skip-verify", false, "INSECURE: do not verify the server TLS certificate")
+	maxIdleConns           = flag.Int("max-idle-conns", 16, "the number of idle connections kept open to the API host, at least --concurrency")
+	concurrencyFlag        = flag.String("concurrency", "0", "the most API requests in flight at once, whatever the command, and the default of --stat-workers, --restore-workers and --sync-workers, 0 for no limit, or auto to tune it between --concurrency-min and --concurrency-max from the throughput and the errors")
+	concurrencyMin         = flag.Int("concurrency-min", 1, "the least API requests in flight of --concurrency auto")
+	concurrencyMax         = flag.Int("concurrency-max", 32, "the most API requests in flight of --concurrency auto, and then the default of the workers")
+	rateLimit              = flag.Float64("rate-limit", 0, "the most API requests a second, e.g. the rate limit of your plan, 0 for no limit")
+	idleTimeout            = flag.Duration("idle-timeout", 90*time.Second, "how long an idle connection is kept open")
+	keepAlive              = flag.Duration("keepalive", 30*time.Second, "the TCP keep-alive interval, negative to disable")
+	connectTimeout         = flag.Duration("connect-timeout", 10*time.Second, "the timeout to connect to the API, independent of the transfer time")
+	bwLimit                = flag.String("bwlimit", "", "limit the upload bandwidth, e.g. 20MB/s")
+	readers                = flag.Int("readers", 4, "the number of goroutines reading small files ahead of the upload, 0 to disable")
+	readBuffer             = flag.String("read-buffer", "64MB", "the memory budget for files read ahead of the upload")
+	streamThreshold        = flag.String("stream-threshold", "1MB", "files larger than this are streamed from disk instead of read ahead")
+	gatewaySubdomain       = flag.String("gateway-subdomain", "", "the subdomain of your Infura dedicated gateway, to print gateway URLs")
+	gatewayBase            = flag.String("gateway-url", "", "the base URL of the gateway of --metadata-url-style and --uri-format gateway, instead of the dedicated gateway, e.g. https://gateway.example")
+	noPreflight            = flag.Bool("no-preflight", false, "skip the credentials and endpoint check made before uploading")
+	metricsAddr            = flag.String("metrics-addr", "", "serve Prometheus metrics on this address, e.g. :9090")
+	notifyURL              = flag.String("notify-url", "", "the webhook URL to POST a JSON summary to at the end of the run")
+	notifyTemplate         = flag.String("notify-template", "", "path to a Go template of the webhook payload, e.g. for Slack")
+	notifyOn               = flag.String("notify-on", "always", "when to send the notification: always, success or failure")
+	quotaLimitHeader       = flag.String("ratelimit-limit-header", "X-RateLimit-Limit", "the response header reporting the rate limit")
+	quotaRemainingHeader   = flag.String("ratelimit-remaining-header", "X-RateLimit-Remaining", "the response header reporting the remaining requests")
+	quotaResetHeader       = flag.String("ratelimit-reset-header", "X-RateLimit-Reset", "the response header reporting when the rate limit resets")
+	quotaWarn              = flag.Float64("ratelimit-warn", 10, "warn when less than this percentage of the rate limit remains")
+	out                    = flag.String("out", "", "write the ERC-721 metadata of the files named after a number to this directory")
+	metadataURLStyle       = flag.String("metadata-url-style", "custom", "the URLs of the metadata: ipfs for ipfs://<cid>, gateway for the gateway URL, custom for --prefix")
+	prefix                 = flag.String("prefix", "ipfs://", "the prefix of the CID in the metadata image URL, or a template with {cid}, {index}, {id} for the hex ERC-1155 id and {filename}")
+	nameTemplate           = flag.String("name-template", "", "the metadata name, e.g. \"Cool Cat #{index}\"")
+	description            = flag.String("description", "", "the metadata description")
+	externalURL            = flag.String("external-url", "", "the metadata external_url")
+	attributesCSV          = flag.String("attributes-csv", "", "a CSV file with a token_id column and one column per trait type, to add attributes to the metadata")
+	allowMissingAttributes = flag.Bool("allow-missing-attributes", false, "only warn about files without a row in --attributes-csv")
+	metadataTemplate       = flag.String("metadata-template", "", "a Go template file rendering the metadata JSON instead of the built-in fields")
+	renderSample           = flag.Int("render-sample", 0, "print the metadata of the file with this token index, without uploading anything")
+	mergeJSON              = flag.String("merge-json", "", "a directory of existing <index>.json metadata to set the image URL of, instead of generating the metadata")
+	groupByIndex           = flag.Bool("group-by-index", false, "write one metadata per index for the files sharing it, linked from the fields set by --map")
+	fileMap                = flag.String("map", "", "the comma separated suffix=field rules of --group-by-index, e.g. .png=image,.mp4=animation_url,_hires.png=properties.hi_res")
+	allowIncompleteGroups  = flag.Bool("allow-incomplete-groups", false, "only warn about the files of a --map rule missing for an index")
+	thumbnailDir           = flag.String("thumbnail-dir", "", "a directory of images, named after a number like the files, uploaded too and used as the image of the video and audio files")
+	imageField             = flag.String("image-field", "image", "the field of the metadata holding the image URL, dots nest it, e.g. properties.image")
+	jsonExtension          = flag.String("json-extension", ".json", "the extension of the metadata files, empty to name them after the index only")
+	uriList                = flag.String("uri-list", "", "write the URIs of the files named after a number to this file, one per line in index order with MISSING for the gaps")
+	uriFormat              = flag.String("uri-format", "ipfs", "the URIs of --uri-list: ipfs for ipfs://<cid>, gateway for the --gateway-subdomain URL, path for ipfs://<root>/<path>, prefix for the --prefix URL")
+	placeholder            = flag.String("placeholder", "", "a file uploaded too and used as the image of every token in the metadata, to reveal the actual files later")
+	uploadMetadata         = flag.Bool("upload-metadata", false, "upload the --out directory after writing it and print its baseURI")
+	jsonNameTemplate       = flag.String("json-name-template", "", "the name of the metadata files, with {index}, {index:05d} for zero padding, {id} for the hex ERC-1155 id and {filename}, e.g. token-{index}.json")
+	jsonIndent             = flag.Int("json-indent", 2, "the number of spaces indenting the metadata JSON")
+	jsonCompact            = flag.Bool("json-compact", false, "write the metadata JSON on a single line")
+	jsonNewline            = flag.Bool("json-newline", false, "end the metadata files with a newline")
+	validate               = flag.Bool("validate-metadata", false, "check the metadata against the ERC-721 JSON schema, or --metadata-schema, before writing it")
+	validateWarn           = flag.Bool("validate-warn", false, "only warn about metadata not matching the schema")
+	schemaPath             = flag.String("metadata-schema", "", "a JSON schema file for --validate-metadata instead of the bundled ERC-721 one")
+	checksums              = flag.String("checksums", "", "write the size, CID and SHA-256 of every uploaded file to this CSV file")
+	verifyChecksumsPath    = flag.String("verify-checksums", "", "check that the files of a --checksums CSV file didn't change since, without uploading anything")
+	stripEXIF              = flag.Bool("strip-exif", false, "upload the JPEG, PNG and WebP images without their EXIF, XMP, IPTC and text metadata, leaving the files untouched")
+	strict                 = flag.Bool("strict", false, "fail on images --strip-exif can't parse instead of uploading them as is")
+	standard               = flag.String("standard", erc721, "the metadata standard, erc721 or erc1155 with decimals and the attributes as properties")
+	decimals               = flag.Int("decimals", 0, "the decimals of the ERC-1155 metadata")
+	hexIDs                 = flag.Bool("hex-ids", false, "name the ERC-1155 metadata files after the 64 character hex id clients substitute for {id}")
+	locales                = flag.String("locales", "", "the locales of the ERC-1155 metadata, the default one first, e.g. en,ja")
+	localizedDir           = flag.String("localized-dir", "", "the directory of the <locale>.csv or <locale>.json names and descriptions of --locales")
+	traitReportPath        = flag.String("trait-report", "", "print the distribution of the --attributes-csv traits and write it as JSON to this file, with the likely mistakes")
+	traitCount             = flag.String("trait-count", "", "the expected number of traits of a token for --trait-report, e.g. 3-5")
+	provenancePath         = flag.String("provenance", "", "write the per file SHA-256 and the provenance hash of the files named after a number, in index order, to this JSON file")
+	collectionMetadata     = flag.String("collection-metadata", "", "a YAML or JSON file with the name, description, image, external_link, seller_fee_basis_points and fee_recipient of the collection, to write and upload its contractURI metadata after the metadata")
+	royaltyBPS             = flag.Int("royalty-bps", 0, "the royalty of the collection in basis points, e.g. 500 for 5%, written to the --collection-metadata and with --token-royalty to every metadata")
+	royaltyRecipient       = flag.String("royalty-recipient", "", "the address receiving the --royalty-bps, 0x and 40 hex characters")
+	royaltyBPSField        = flag.String("royalty-bps-field", "seller_fee_basis_points", "the field of the --royalty-bps, dots nest it")
+	royaltyRecipientField  = flag.String("royalty-recipient-field", "fee_recipient", "the field of the --royalty-recipient, dots nest it")
+	tokenRoyalty           = flag.Bool("token-royalty", false, "add the royalty to the metadata of every token too, for the marketplaces reading it there")
+	rarityAttribute        = flag.String("rarity-attribute", "", "add the rarity score of the --attributes-csv traits to the metadata as this numeric attribute, e.g. \"Rarity Score\"")
+	rarityMethodName       = flag.String("rarity-method", "statistical", "how the rarity is scored: statistical sums the inverse frequency of the trait values of a token")
+	rarityCSV              = flag.String("rarity-csv", "", "write the rarity score and rank of every token to this CSV file")
+	combinedJSON           = flag.Bool("combined-json", false, "write the array of the metadata of every token to "+combinedMetadataName+" in --out too")
+	mappingPath            = flag.String("mapping", "", "write the uploaded files named after a number to this JSON file, keyed and shaped by --mapping-keys")
+	mappingKeysFlag        = flag.String("mapping-keys", "tokenId,file,cid,url", "the fields of --mapping, the first one keying it, among tokenId, sourceIndex, id, file, source, cid, url, metadata and uri, renamed with field=name")
+	uploadJSON             = flag.String("upload-json", "", "upload the metadata written to --out: directory like --upload-metadata, or individual to upload every file on its own for a per token tokenURI")
+	inputSchema            = flag.String("input-schema", "", "a JSON schema file the --merge-json documents must match before merging")
+	inputSchemaWarn        = flag.Bool("input-schema-warn", false, "only warn about --merge-json documents not matching --input-schema")
+	shuffleSeed            = flag.String("shuffle-seed", "", "permute the token indexes of the files named after a number with this seed, e.g. 0xdeadbeef, for an assignment fixed in advance")
+	skipIDsFlag            = flag.String("skip-ids", "", "leave the files named after these token ids out of the upload, the metadata and the URI list, e.g. 1,7,100-110")
+	skipIDsFile            = flag.String("skip-ids-file", "", "a file listing token ids to skip like --skip-ids, on any number of lines")
+	includeFlag            = flag.StringArray("include", nil, "upload only the files of the directory matching this glob, e.g. '*.png', matched against the path if it has a slash, or re: and a regular expression of the path, repeatable")
+	excludeFlag            = flag.StringArray("exclude", nil, "leave the files and directories matching this glob out of the upload, e.g. 'draft_*', like --include, repeatable, along with the ones listed in the .ipfsignore file of the directory")
+	ignoreHidden           = flag.Bool("ignore-hidden", true, "leave the files and directories whose name starts with a dot out of the upload")
+	extraFieldsPath        = flag.String("extra-fields", "", "a JSON or YAML file of static fields deep merged into every metadata, the generated fields winning on conflict")
+	extraFieldsOverride    = flag.Bool("extra-fields-override", false, "make the --extra-fields win over the generated fields on conflict")
+	mock                   = flag.Bool("mock", false, "upload to an in-process fake of the API instead of --url, with CIDs derived from the content, for testing without network")
+	mockFailRate           = flag.Float64("mock-fail-rate", 0, "the fraction of the --mock uploads failing with a server error, e.g. 0.1")
+	cidVersion             = flag.Int("cid-version", 0, "the version of the CIDs, 0 or 1, 1 being implied by a --hash other than sha2-256 and storing the files in raw leaves unless --raw-leaves=false")
+	hashFunction           = flag.String("hash", "sha2-256", "the multihash function of the CIDs, e.g. blake2b-256")
+	chunkerName            = flag.String("chunker", "size-262144", "how the files are split into blocks: size-<bytes>, rabin, rabin-<min>-<avg>-<max>, or buzhash, which --only-hash and --car can't use")
+	rawLeaves              = flag.Bool("raw-leaves", false, "store the data of the files in raw blocks rather than UnixFS nodes, the default with --cid-version 1")
+	onlyHash               = flag.Bool("only-hash", false, "compute the CIDs locally like ipfs add -n, writing the metadata and outputs as if uploaded, without sending anything to --url")
+	benchSampleCount       = flag.Int("bench", 0, "instead of uploading, upload this many files of the path unpinned at every --bench-levels concurrency and recommend one, 0 to disable")
+	benchLevelsFlag        = flag.String("bench-levels", "1,2,4,8,16", "the concurrencies of --bench")
+	benchJSON              = flag.String("bench-json", "", "write the --bench results as JSON to this file")
+	statePath              = flag.String("state", "", "a file recording the uploads of every run by content, to reuse the CIDs of a directory or file uploaded before to the same endpoint instead of uploading it again")
+	stateExport            = flag.Bool("state-export", false, "write the uploads recorded in --state as CSV to the standard output, without uploading anything")
+	stateQuery             = flag.String("state-query", "", "print the uploads recorded in --state with this content hash or CID as JSON, without uploading anything")
+	serveAddr              = flag.String("serve", "", "instead of uploading a path, serve an HTTP API to upload files and the directories of --serve-root on this address, e.g. :8799")
+	serveToken             = flag.String("serve-token", "", "the bearer token of the --serve requests, IPFS_UPLOAD_SERVE_TOKEN if empty")
+	serveRoot              = flag.String("serve-root", ".", "the directory the paths of the --serve jobs are relative to")
+	serveJobs              = flag.String("serve-jobs", "", "a file keeping the --serve jobs across restarts")
+	serveShutdownTimeout   = flag.Duration("serve-shutdown-timeout", 30*time.Second, "how long the --serve uploads in progress are waited for on shutdown before being cancelled")
+	stdin                  = flag.Bool("stdin", false, "upload the standard input as a file instead of a path, like the path -")
+	stdinName              = flag.String("name", "", "the file name of the --stdin upload, which the metadata is indexed by, e.g. 42.png")
+	auditPath              = flag.String("audit", "", "check that the files of a --checksums CSV file or a --mapping JSON file, read with --mapping-keys, are still pinned on --url, without uploading anything")
+	auditChecksums         = flag.String("audit-checksums", "", "a --checksums CSV file with the SHA-256 of the files of an --audit mapping, matched by CID")
+	auditGateway           = flag.Bool("audit-gateway", false, "with --audit, fetch the files and metadata from the gateway of --gateway-url or --gateway-subdomain and check their SHA-256 and image CID")
+	auditSample            = flag.Int("audit-sample", 0, "with --audit, check this many files picked at random, 0 for all of them")
+	auditJSON              = flag.String("audit-json", "", "write the --audit report as JSON to this file")
+	auditGateways          = flag.StringSlice("audit-gateway-urls", nil, "with --audit, more gateways to fetch every file from, such as public ones, e.g. https://ipfs.io,https://dweb.link")
+	auditWorkers           = flag.Int("audit-workers", 8, "how many files --audit checks at a time")
+	auditRetries           = flag.Int("audit-retries", 2, "how many times --audit checks again a file failing with a network error or a timeout")
+	statPath               = flag.String("stat", "", "report the blocks, DAG size and cumulative size on --url of the CIDs of a --checksums CSV file, a --mapping JSON file, read with --mapping-keys, or a list of CIDs or ipfs:// URIs such as --uri-list, without uploading anything")
+	statSample             = flag.Int("stat-sample", 0, "with --stat, report this many CIDs picked at random, 0 for all of them")
+	statWorkers            = flag.Int("stat-workers", 8, "how many CIDs --stat queries at a time")
+	statTimeout            = flag.Duration("stat-timeout", 30*time.Second, "how long --stat waits for the sizes of a CID before reporting it missing, as a node may look for the CIDs it doesn't have")
+	statJSON               = flag.String("stat-json", "", "write the --stat report as JSON to this file")
+	restoreManifest        = flag.String("restore", "", "download the files of a --checksums CSV file, a --mapping JSON file, read with --mapping-keys, or a list of CIDs or ipfs:// URIs such as --uri-list from --url to --restore-dir, checking them against their SHA-256 or CID, without uploading anything")
+	restoreDir             = flag.String("restore-dir", ".", "the directory --restore writes the files to, named as in the manifest")
+	restoreChecksums       = flag.String("restore-checksums", "", "a --checksums CSV file with the SHA-256 of the files of a --restore mapping, matched by CID")
+	restoreIDs             = flag.String("restore-ids", "", "with --restore, only download the files named after these token ids, e.g. 1,7,100-110")
+	restoreSkipExisting    = flag.Bool("restore-skip-existing", false, "with --restore, keep the files already in --restore-dir with the recorded content instead of downloading them again")
+	restoreGateway         = flag.Bool("restore-gateway", false, "with --restore, download the files the API fails to return from the gateway of --gateway-url or --gateway-subdomain")
+	restoreWorkers         = flag.Int("restore-workers", 8, "how many files --restore downloads at a time")
+	restoreRetries         = flag.Int("restore-retries", 3, "how many times --restore tries again a failed download")
+	retryBudgetFlag        = flag.String("retry-budget", "", "the most retries of --audit or --restore across all the files, a number or a percentage of the files such as 10%, no limit if empty")
+	restoreTimeout         = flag.Duration("restore-timeout", 5*time.Minute, "how long --restore waits for a download")
+	restoreJSON            = flag.String("restore-json", "", "write the --restore report as JSON to this file")
+	gcPath                 = flag.String("gc", "", "unpin from --url the CIDs the tool pinned, as recorded by --state or --gc-superseded, which a --checksums CSV file, a --mapping JSON file, read with --mapping-keys, or a list of CIDs or ipfs:// URIs no longer references, without uploading anything")
+	gcKeep                 = flag.StringSlice("gc-keep", nil, "more manifests whose CIDs --gc keeps pinned, such as the ones of a previous reveal")
+	gcSuperseded           = flag.StringSlice("gc-superseded", nil, "--sync-report files whose superseded CIDs --gc unpins unless still referenced")
+	gcDirs                 = flag.Bool("gc-dirs", false, "with --gc, also unpin the directories recorded by --state which the manifests don't reference, such as the roots of previous uploads")
+	gcDryRun               = flag.Bool("gc-dry-run", false, "with --gc, only print the CIDs which would be unpinned")
+	gcYes                  = flag.Bool("yes", false, "unpin the CIDs of --gc without asking for a confirmation")
+	cacheFile              = flag.String("cache-file", "", "the file caching the CIDs of the uploaded files by path, size and modification time, to reuse them when nothing changed, in the user cache directory if empty")
+	noCache                = flag.Bool("no-cache", false, "don't use nor update the --cache-file")
+	cacheMode              = flag.String("cache-mode", uploader.CacheModeMtime, "how the --cache-file tells the unchanged files: mtime by their size and modification time, hash by their SHA-256, hashing again the files whose modification time changed")
+	reportPath             = flag.String("report", "", "write the configuration, timings and files of the run as JSON to this file, whatever its outcome")
+	porcelainOut           = flag.Bool("porcelain", false, "write a tab separated line per uploaded file to the standard output, in a format stable within a major version, and nothing else")
+	manifestPath           = flag.String("manifest", "", "write the path, token index, CID, size and status of every file uploaded or failed to this .csv or .json file, as they are uploaded")
+	manifestInterval       = flag.Duration("manifest-interval", 10*time.Second, "how often --manifest is written while uploading, 0 to only write it once the upload completes")
+	outputFormat           = flag.String("output", outputText, "what the standard output gets: text, the root CID, porcelain, like --porcelain, json, an array of the uploaded files once done, or ndjson, a JSON object per file as it is added")
+	logFormat              = flag.String("log-format", logFormatText, "the format of the messages on the standard error: text, or json for a JSON object per line with the level and the attributes of the message")
+	progressFlag           = flag.String("progress", progressAuto, "how the progress of the upload is shown: bar, redrawn in place, plain, a line every --progress-interval, none, or auto for a bar on a terminal and plain lines otherwise, as in CI")
+	progressInterval       = flag.Duration("progress-interval", 30*time.Second, "how often --progress plain writes a line")
+	quiet                  = flag.Bool("quiet", false, "don't show the progress, for the scripts, the same as --progress none")
+	mediaType              = flag.Bool("media-type", false, "add the MIME type of the file to the metadata as media_type")
+	dimensions             = flag.String("dimensions", "", "add the width and height of the images to the metadata \"attributes\" or \"properties\"")
+	previewSize            = flag.Int("thumbnails", 0, "upload a copy of the images scaled down to this many pixels on their longest side and link it from --preview-field, 0 to disable")
+	previewField           = flag.String("preview-field", "image_preview", "the field of the metadata holding the URL of the --thumbnails copy, dots nest it")
+	previewWorkers         = flag.Int("thumbnail-workers", 0, "the number of images scaled down at once for --thumbnails, 0 for the number of CPUs")
+	cidsFrom               = flag.String("cids-from", "", "write the metadata with the CIDs recorded in a --checksums CSV file instead of uploading the files again")
+	wrap                   = flag.Bool("wrap", false, "upload a single file inside a directory, the root CID linking to it by name as ipfs://<root>/<name>")
+	syncPath               = flag.String("sync", "", "only upload the files of the directory added or changed since a --checksums CSV file, replaced by the updated one, and report the removed ones")
+	syncOut                = flag.String("sync-out", "", "write the manifest updated by --sync to this file instead of replacing it")
+	syncMode               = flag.String("sync-mode", uploader.CacheModeHash, "how --sync tells the unchanged files: hash by their SHA-256, mtime by their size and modification time being older than the manifest, hashing the others")
+	syncWorkers            = flag.Int("sync-workers", 4, "how many files --sync uploads at a time")
+	syncCheckpoint         = flag.Duration("sync-checkpoint", 10*time.Second, "how often --sync writes the manifest while uploading, for a run interrupted even by a crash to resume from it, 0 to only write it at the end")
+	syncReportPath         = flag.String("sync-report", "", "write the files --sync added, changed and removed, with their new and superseded CIDs, as JSON to this file")
+	syncMetadata           = flag.Bool("sync-metadata", false, "after --sync, write the metadata to --out with the CIDs of the updated manifest like --cids-from, uploading it with --upload-metadata or --upload-json")
+	hedgeAfter             = flag.String("hedge-after", "", "upload a file lagging behind the others of --sync or of several paths a second time in parallel, keeping the first to complete: a multiple of the median duration of the files such as 2x-median, or a duration such as 1m")
+	carPath                = flag.String("car", "", "pack the file or directory into a CAR file at this path, printing its root CID, the one the upload would get, without uploading anything nor credentials")
+	carImport              = flag.String("car-import", "", "upload the CAR file at this path with dag/import, all its blocks at once, pinning its roots with --pin, instead of a file or directory")
+	requestIDHeader        = flag.String("request-id-header", "X-Request-Id", "the header carrying the request ID sent with every API call")
+)
 
-	flag.Parse()
+// commonOptions are what the options of every command resolve to, once
+// checked by main.
+type commonOptions struct {
+	// args are the arguments of the command left once its mode flag is set
+	args     []string
+	provider uploader.Provider
+	headers  http.Header
+	dag      uploader.DAGOptions
+	client   clientOptions
+	// auto adjusts the requests allowed at once with --concurrency auto
+	auto *autoConcurrency
+}
 
-	if *projectId == "" {
-		_, _ = fmt.Fprintln(os.Stderr, "parameter --id is required")
-		os.Exit(1)
+// newUploaderFromFlags returns the uploader of the API of the flags, or of
+// the fake API of --mock, and its HTTP client. The credentials and the
+// endpoint are checked first within ctx, unless --no-preflight or
+// --only-hash is set.
+func (o *commonOptions) newUploaderFromFlags(ctx context.Context) (*uploader.Uploader, *http.Client, error) {
+	if *mock {
+		fake := uploader.NewFakeAPI(*mockFailRate)
+		atExit = append(atExit, fake.Close)
+		*api = fake.URL
+	} else if msg := missingCredentials(o.provider, *projectId, *projectSecret); msg != "" && !*onlyHash {
+		return nil, nil, &usageError{msg}
 	}
-	if *projectSecret == "" {
-		_, _ = fmt.Fprintln(os.Stderr, "parameter --secret is required")
-		os.Exit(1)
+	client, via, err := o.newAPIClient()
+	if err != nil {
+		return nil, nil, err
 	}
-
-	httpClient := &http.Client{}
-	client, err := httpapi.NewURLApiWithClient(*api, httpClient)
+	up, err := uploader.New(uploader.Options{
+		Provider:      o.provider,
+		API:           *api,
+		ProjectID:     *projectId,
+		ProjectSecret: *projectSecret,
+		Headers:       o.headers,
+		HTTPClient:    client,
+		Pin:           *pin,
+		OnlyHash:      *onlyHash,
+		DAG:           o.dag,
+	})
 	if err != nil {
-		_, _ = fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		return nil, nil, &usageError{err.Error()}
 	}
-	client.Headers.Add("Authorization", "Basic "+basicAuth(*projectId, *projectSecret))
-
-	args := flag.Args()
-	if len(args) != 1 {
-		_, _ = fmt.Fprintln(os.Stderr, "file or directory path required as an argument")
-		os.Exit(1)
+	if *noPreflight || *onlyHash {
+		if *verbose {
+			logs.Info(fmt.Sprintf("Using %v", via))
+		}
+		return up, client, nil
 	}
-	path := args[0]
-
-	stat, err := os.Lstat(path)
+	preflightCtx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+	version, err := up.Preflight(preflightCtx)
 	if err != nil {
-		_, _ = fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		return nil, nil, describePreflightError(err, via, "")
 	}
+	if *verbose {
+		logEndpoint(version, via)
+	}
+	return up, client, nil
+}
 
-	// also support directory
-	file, err := ipfsFiles.NewSerialFile(path, false, stat)
+// newAPIClient returns the HTTP client of the API and how it reaches --url,
+// through a proxy or directly, warning if --insecure-skip-verify is set.
+func (o *commonOptions) newAPIClient() (*http.Client, string, error) {
+	client, err := newHTTPClient(o.client)
+	if err != nil {
+		return nil, "", &usageError{err.Error()}
+	}
+	if *insecureSkipVerify {
+		logs.Warn("TLS certificate verification is disabled, the connection is vulnerable to interception")
+	}
+	proxyURL, err := proxyFor(client, *api)
 	if err != nil {
-		_, _ = fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		return nil, "", &usageError{err.Error()}
 	}
+	if proxyURL != nil {
+		return client, fmt.Sprintf("proxy %v", proxyURL.Redacted()), nil
+	}
+	return client, "direct connection", nil
+}
 
-	// trap Ctrl+C and call cancel on the context
+// describePreflightError returns err of the preflight check with what to
+// check, still matching its sentinels. via is how the API is reached and
+// requests describes the requests sent, if known.
+func describePreflightError(err error, via, requests string) error {
+	where := via
+	if requests != "" {
+		where += ", " + requests
+	}
+	switch code := exitCode(err, interrupted()); {
+	case errors.Is(err, uploader.ErrProxyAuthFailed):
+		return fmt.Errorf("%w, check the credentials of the proxy (%v)", err, where)
+	case code == exitAuthFailed:
+		return fmt.Errorf("%w for project %v (%v)", uploader.ErrAuthFailed, *projectId, where)
+	case errors.Is(err, uploader.ErrTLS):
+		return fmt.Errorf("%w, set --ca-cert to trust the certificate of the endpoint (%v)", err, where)
+	default:
+		return fmt.Errorf("%w (%v)", err, where)
+	}
+}
+
+// logEndpoint reports the endpoint passing the preflight check, with its
+// version if known, and how it is reached.
+func logEndpoint(version, via string) {
+	if version != "" {
+		via = fmt.Sprintf("version %v, %v", version, via)
+	}
+	logs.Info(fmt.Sprintf("Endpoint OK (%v)", via))
+}
+
+// signalled is set once a signal cancelled the context of signalContext.
+var signalled int32
+
+// interrupted reports whether a signal cancelled the run, which then exits
+// with exitInterrupted whatever the error.
+func interrupted() bool {
+	return atomic.LoadInt32(&signalled) == 1
+}
+
+// signalContext returns a context cancelled by SIGINT or SIGTERM, and the
+// function cancelling it, which stops catching them.
+func signalContext() (context.Context, context.CancelFunc) {
 	ctx, cancel := context.WithCancel(context.Background())
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	defer func() {
-		signal.Stop(c)
-		cancel()
-	}()
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		select {
-		case <-c:
+		case <-stop:
+			atomic.StoreInt32(&signalled, 1)
 			cancel()
 		case <-ctx.Done():
 		}
 	}()
+	return ctx, func() {
+		signal.Stop(stop)
+		cancel()
+	}
+}
 
-	var res ipfsPath.Resolved
-	errCh := make(chan error, 1)
-	events := make(chan interface{}, 8)
-	start := time.Now()
+// newStripper returns the Stripper of --strip-exif and --strict, warning
+// about the images uploaded as is.
+func newStripper() *strip.Stripper {
+	return &strip.Stripper{Strict: *strict, Warn: func(path string, err error) {
+		logs.Warn(fmt.Sprintf("can't strip the metadata of %v, uploading it as is: %v", path, err))
+	}}
+}
 
-	go func() {
-		var err error
-		defer close(events)
-		res, err = client.Unixfs().Add(ctx, file, caopts.Unixfs.Pin(*pin), caopts.Unixfs.Progress(true), caopts.Unixfs.Events(events))
-		errCh <- err
-	}()
+func main() {
+	err := run()
+	var exit *exitError
+	if err != nil && !errors.As(err, &exit) {
+		logs.Error(err.Error())
+	}
+	os.Exit(exitCode(err, interrupted()))
+}
 
-	for event := range events {
-		output, ok := event.(*coreiface.AddEvent)
-		if !ok {
-			panic("unknown event type")
+// run runs the command of the arguments, its failure being logged by main
+// unless an exitError.
+func run() error {
+	var err error
+	cmd, cmdArgs := parseCommand(os.Args[1:])
+	flag.Usage = func() { printUsage(os.Stderr, flag.CommandLine, cmd) }
+	flag.CommandLine.SetNormalizeFunc(normalizeFlag)
+	_ = flag.CommandLine.Parse(cmdArgs)
+	// the flags of the command line only, the profile holding those of
+	// every command
+	if err := cmd.checkFlags(flag.CommandLine); err != nil {
+		return &usageError{err.Error()}
+	}
+
+	// the options not set on the command line may come from the environment
+	// and the profile
+	configRequired := *configPath != "" || *profileName != ""
+	if *configPath == "" {
+		if *configPath, err = defaultConfigFile(); err != nil && configRequired {
+			return &usageError{fmt.Sprintf("parameter --profile: %v", err)}
+		}
+	}
+	if err := applyConfig(flag.CommandLine, *configPath, *profileName, configRequired); err != nil {
+		return &usageError{err.Error()}
+	}
+
+	switch *logFormat {
+	case logFormatText, logFormatJSON:
+		logs = newLogger(os.Stderr, *logFormat)
+	default:
+		return &usageError{"parameter --log-format must be text or json"}
+	}
+	// the command sets the flag of its mode to its first argument, the
+	// others being the arguments of the mode
+	args, err := cmd.apply(flag.CommandLine, flag.Args())
+	if err != nil {
+		return &usageError{err.Error()}
+	}
+	if cmd.Name == "help" {
+		help := commands[0]
+		if len(args) > 0 {
+			if help = lookupCommand(args[0]); help == nil {
+				return &usageError{fmt.Sprintf("unknown command %v", args[0])}
+			}
+		}
+		printUsage(os.Stdout, flag.CommandLine, help)
+		return nil
+	}
+	if cmd.Name == "publish" && *out == "" {
+		return &usageError{fmt.Sprintf("usage: %v publish %v [options]", filepath.Base(os.Args[0]), cmd.Args)}
+	}
+	switch *progressFlag {
+	case progressAuto, progressPlain, progressBar, progressNone:
+	default:
+		return &usageError{"parameter --progress must be auto, plain, bar or none"}
+	}
+	if *quiet {
+		if flag.CommandLine.Changed("progress") && *progressFlag != progressNone {
+			return &usageError{"parameters --quiet and --progress can't be used together"}
+		}
+		*progressFlag = progressNone
+	}
+	if *progressInterval <= 0 {
+		return &usageError{"parameter --progress-interval must be positive"}
+	}
+
+	provider, err := uploader.LookupProvider(*providerName)
+	if err != nil {
+		return &usageError{err.Error()}
+	}
+	if !flag.CommandLine.Changed("url") {
+		*api = provider.API
+	} else if !flag.CommandLine.Changed("provider") {
+		// --url alone is a node of your own, taking no credentials unless
+		// given, or a provider known by its host
+		if known, ok := uploader.ProviderForURL(*api); ok {
+			provider = known
+		} else if *projectId == "" && *projectSecret == "" {
+			provider = uploader.Providers["kubo"]
+		}
+	}
+	apiHeaders, err := parseHeaders(*headerFlags)
+	if err != nil {
+		return &usageError{fmt.Sprintf("parameter --header: %v", err)}
+	}
+	switch {
+	case *authBearer != "" && apiHeaders.Get("Authorization") != "":
+		return &usageError{"parameters --auth-bearer and --header Authorization can't be used together"}
+	case *authBearer != "":
+		provider.Auth = uploader.AuthBearer
+		*projectSecret = *authBearer
+	case apiHeaders.Get("Authorization") != "":
+		provider.Auth = uploader.AuthNone
+	}
+	// the DAG options of the uploads, the defaults of the API unless set
+	dagOpts := uploader.DAGOptions{CidVersion: *cidVersion, Hash: *hashFunction, Chunker: *chunkerName}
+	if flag.CommandLine.Changed("raw-leaves") {
+		dagOpts.RawLeaves = rawLeaves
+	}
+	if flag.CommandLine.Changed("cid-version") && *cidVersion == 0 && *hashFunction != "sha2-256" {
+		return &usageError{"parameter --hash requires --cid-version 1, CIDv0 being sha2-256 only"}
+	}
+	if err := dagOpts.Validate(*onlyHash || *carPath != ""); err != nil {
+		return &usageError{fmt.Sprintf("parameters --cid-version, --hash and --chunker: %v", err)}
+	}
+	if dagOpts.String() != "" && *statePath != "" {
+		return &usageError{"parameter --state can't be used with --cid-version, --hash, --chunker or --raw-leaves, its CIDs being of the default DAG"}
+	}
+
+	switch {
+	case *mock && flag.CommandLine.Changed("url"):
+		return &usageError{"parameters --mock and --url can't be used together"}
+	case *mock && (*mockFailRate < 0 || *mockFailRate > 1):
+		return &usageError{"parameter --mock-fail-rate must be between 0 and 1"}
+	case !*mock && flag.CommandLine.Changed("mock-fail-rate"):
+		return &usageError{"parameter --mock-fail-rate requires --mock"}
+	}
+
+	if *gatewaySubdomain != "" && !subdomainRe.MatchString(*gatewaySubdomain) {
+		return &usageError{"parameter --gateway-subdomain must be a subdomain name, e.g. my-project"}
+	}
+
+	if *verifyChecksumsPath != "" {
+		return runCheck()
+	}
+
+	if *gatewayBase != "" {
+		if u, err := url.Parse(*gatewayBase); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return &usageError{"parameter --gateway-url must be an http or https URL, e.g. https://gateway.example"}
+		}
+	}
+
+	switch *outputFormat {
+	case outputText, outputPorcelain, outputJSON, outputNDJSON:
+	default:
+		return &usageError{"parameter --output must be text, porcelain, json or ndjson"}
+	}
+	if *porcelainOut {
+		if flag.CommandLine.Changed("output") && *outputFormat != outputPorcelain {
+			return &usageError{"parameters --porcelain and --output can't be used together"}
 		}
+		*outputFormat = outputPorcelain
+	}
+	if (*outputFormat != outputText || *manifestPath != "") && (*stateExport || *stateQuery != "" || flag.CommandLine.Changed("render-sample") || *benchSampleCount > 0 || *serveAddr != "" || *auditPath != "" || *statPath != "" || *restoreManifest != "" || *syncPath != "" || *gcPath != "" || *carPath != "" || *carImport != "") {
+		return &usageError{"parameters --porcelain, --output and --manifest can't be used with --state-export, --state-query, --render-sample, --bench, --serve, --audit, --stat, --restore, --sync or --gc, which write something else"}
+	}
+
+	if *stateExport || *stateQuery != "" {
+		return runStateQuery()
+	}
 
-		if output.Path != nil && output.Name != "" {
-			if *verbose {
-				_, _ = fmt.Fprintln(os.Stderr, fmt.Sprintf("Added %v %v | Bytes: %v | Size: %v", output.Name, output.Path, output.Bytes, output.Size))
-			} else {
-				_, _ = fmt.Fprintln(os.Stderr, fmt.Sprintf("Added %v", output.Name))
+	// concurrency is the requests allowed at once, the most of them for
+	// --concurrency auto
+	var concurrency int
+	var auto *autoConcurrency
+	if *concurrencyFlag == "auto" {
+		if *concurrencyMin < 1 || *concurrencyMax < *concurrencyMin {
+			return &usageError{"parameters --concurrency-min and --concurrency-max must be at least 1, --concurrency-max at least --concurrency-min"}
+		}
+		concurrency = *concurrencyMax
+		auto = newAutoConcurrency(*concurrencyMin, *concurrencyMax, func(limit int, reason string) {
+			logs.Info(fmt.Sprintf("Concurrency set to %v, %v", limit, reason), "concurrency", limit)
+		})
+	} else if n, err := strconv.Atoi(*concurrencyFlag); err == nil {
+		concurrency = n
+	} else {
+		return &usageError{"parameter --concurrency must be a number or auto"}
+	}
+	if concurrency < 0 || *rateLimit < 0 {
+		return &usageError{"parameters --concurrency and --rate-limit must not be negative"}
+	}
+	// the workers of the commands default to the requests allowed at once,
+	// and so do the connections kept open
+	if concurrency > 0 {
+		for name, workers := range map[string]*int{"audit-workers": auditWorkers, "stat-workers": statWorkers, "restore-workers": restoreWorkers, "sync-workers": syncWorkers} {
+			if !flag.CommandLine.Changed(name) {
+				*workers = concurrency
 			}
 		}
+		if !flag.CommandLine.Changed("max-idle-conns") && *maxIdleConns < concurrency {
+			*maxIdleConns = concurrency
+		}
 	}
+	clientOpts := clientOptions{
+		Proxy:              *proxy,
+		CACert:             *caCert,
+		ClientCert:         *clientCert,
+		ClientKey:          *clientKey,
+		InsecureSkipVerify: *insecureSkipVerify,
 
-	if err := <-errCh; err != nil {
-		_, _ = fmt.Fprintln(os.Stderr, err)
-		exit(start, 1)
+		MaxIdleConnsPerHost: *maxIdleConns,
+		IdleConnTimeout:     *idleTimeout,
+		KeepAlive:           *keepAlive,
+		ConnectTimeout:      *connectTimeout,
+
+		Concurrency:       concurrency,
+		AutoConcurrency:   auto,
+		RequestsPerSecond: *rateLimit,
+	}
+	o := &commonOptions{
+		args:     args,
+		provider: provider,
+		headers:  apiHeaders,
+		dag:      dagOpts,
+		client:   clientOpts,
+		auto:     auto,
 	}
 
-	_, _ = fmt.Fprintln(os.Stdout, res.Cid().String())
-	exit(start, 0)
+	switch {
+	case *serveAddr != "":
+		return runServe(o)
+	case *auditPath != "":
+		return runVerify(o)
+	case *statPath != "":
+		return runStat(o)
+	case *restoreManifest != "":
+		return runRestore(o)
+	case *gcPath != "":
+		return runGC(o)
+	case *carImport != "":
+		return runImport(o)
+	case cmd.Name == "pin":
+		return runPin(o)
+	default:
+		return runUpload(o)
+	}
+}
+
+// runImport runs import, uploading the CAR file of --car-import.
+func runImport(o *commonOptions) error {
+	if len(o.args) != 0 {
+		return &usageError{"parameter --car-import takes no path argument"}
+	}
+	car, err := os.Open(*carImport)
+	if err == nil {
+		_, err = uploader.NewCARReader(car)
+	}
+	if err != nil {
+		return &usageError{fmt.Sprintf("parameter --car-import: %v", err)}
+	}
+	if _, err := car.Seek(0, io.SeekStart); err != nil {
+		return &usageError{err.Error()}
+	}
+	ctx, cancel := signalContext()
+	defer cancel()
+	up, _, err := o.newUploaderFromFlags(ctx)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	roots, err := up.ImportCAR(ctx, car)
+	_ = car.Close()
+	if err != nil {
+		code := exitCode(err, interrupted())
+		logs.Error(fmt.Sprintf("importing %v: %v", *carImport, err), "exit_code", code)
+		return &exitError{code}
+	}
+	for _, root := range roots {
+		_, _ = fmt.Fprintln(os.Stdout, root.String())
+	}
+	logs.Info(time.Since(start).String())
+	return nil
 }
 
-func exit(start time.Time, exitCode int) {
+// runPin runs pin ls, add and rm.
+func runPin(o *commonOptions) error {
+	if len(o.args) == 0 || (o.args[0] == "ls") != (len(o.args) == 1) || (o.args[0] != "ls" && o.args[0] != "add" && o.args[0] != "rm") {
+		return &usageError{"usage: pin ls | add <cid>... | rm <cid>..."}
+	}
+	var cids []cid.Cid
+	for _, arg := range o.args[1:] {
+		c, ok := urlCID(arg)
+		if !ok {
+			return &usageError{fmt.Sprintf("%v is neither a CID nor an ipfs:// URI", arg)}
+		}
+		cids = append(cids, c)
+	}
+	ctx, cancel := signalContext()
+	defer cancel()
+	up, _, err := o.newUploaderFromFlags(ctx)
+	if err != nil {
+		return err
+	}
+
+	if o.args[0] == "ls" {
+		pins, err := up.Pins(ctx)
+		if err != nil {
+			return err
+		}
+		for _, c := range pins {
+			_, _ = fmt.Fprintln(os.Stdout, c.String())
+		}
+		return nil
+	}
+	var failed int
+	unpinned := make(map[cid.Cid]bool)
+	for _, c := range cids {
+		if o.args[0] == "add" {
+			err = up.Pin(ctx, c)
+		} else {
+			err = up.Unpin(ctx, c)
+		}
+		if err != nil {
+			failed++
+			logs.Error(fmt.Sprintf("%v: %v", c, err), "cid", c)
+			continue
+		}
+		if o.args[0] == "rm" {
+			unpinned[c] = true
+		}
+		_, _ = fmt.Fprintln(os.Stdout, c.String())
+	}
+	recordUnpinned(*statePath, *cacheFile, *noCache, *api, *mock, unpinned)
+	switch {
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case failed > 0:
+		return &exitError{exitFailed}
+	}
+	return nil
+}
+
+// runCAR runs car, packing path into the CAR file of --car.
+func runCAR(o *commonOptions, path string, stat os.FileInfo, filtered map[string]bool) error {
+	if *out != "" || *uriList != "" || *mappingPath != "" || *checksums != "" || *statePath != "" || *cidsFrom != "" || *syncPath != "" || *stripEXIF || *thumbnailDir != "" {
+		return &usageError{"parameter --car can't be used with --out, --uri-list, --mapping, --checksums, --state, --cids-from, --sync, --strip-exif or --thumbnails, it only packs the files"}
+	}
+	file, err := uploader.NewFileNode(path, !*ignoreHidden, stat)
+	if err != nil {
+		return &usageError{err.Error()}
+	}
+	if len(filtered) > 0 {
+		file = newSkipper(nil, filtered).Wrap(file, path)
+	}
+	if *wrap {
+		file = ipfsFiles.NewMapDirectory(map[string]ipfsFiles.Node{filepath.Base(path): file})
+	}
+	start := time.Now()
+	root, err := uploader.WriteCAR(context.Background(), file, *carPath, o.dag)
+	if err != nil {
+		logs.Error(err.Error())
+		return &exitError{exitFailed}
+	}
+	_, _ = fmt.Fprintln(os.Stdout, root.String())
+	logs.Info(fmt.Sprintf("Wrote the CAR of %v to %v", path, *carPath))
+	logs.Info(time.Since(start).String())
+	return nil
+}
+
+// atExit holds functions run by finish before terminating the process.
+var atExit []func()
+
+// report is the report of --report, written by finish.
+var report *runReport
+
+// finish ends the run started at start with exitCode, writing the report
+// and running atExit, and returns the exitError of a failure.
+func finish(start time.Time, exitCode int) error {
 	duration := time.Since(start)
-	_, _ = fmt.Fprintln(os.Stderr, duration)
-	os.Exit(exitCode)
+	logs.Status("")
+	logs.Info(duration.String(), "duration_ms", duration, "exit_code", exitCode)
+	if err := report.Write(exitCode); err != nil {
+		logs.Warn(fmt.Sprintf("writing the report to %v: %v", report.path, err))
+	}
+	for _, f := range atExit {
+		f()
+	}
+	if exitCode != exitSuccess {
+		return &exitError{exitCode}
+	}
+	return nil
 }
 
-func basicAuth(projectId, projectSecret string) string {
-	auth := projectId + ":" + projectSecret
-	return base64.StdEncoding.EncodeToString([]byte(auth))
+// sortAdded sorts the names of the files of a directory in the order they
+// are added: by name in every directory, a directory after its files.
+func sortAdded(names []string) {
+	sort.Slice(names, func(i, j int) bool {
+		a, b := strings.Split(names[i], "/"), strings.Split(names[j], "/")
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) > len(b)
+	})
 }
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mainEnv makes the test binary run main, so that the tests can run the
+// command as a process of its own.
+const mainEnv = "IPFS_UPLOAD_TEST_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(mainEnv) == "1" {
+		os.Args = append([]string{"ipfs-upload-client"}, strings.Fields(os.Getenv(mainEnv+"_ARGS"))...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs the command with args in dir, and returns its standard
+// output and exit code.
+func runMain(t *testing.T, dir string, args ...string) (string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), mainEnv+"=1", mainEnv+"_ARGS="+strings.Join(args, " "), "HOME="+dir)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return stdout.String(), exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stdout.String(), 0
+}
+
+// writeFiles writes the files of content, by path relative to dir.
+func writeFiles(t *testing.T, dir string, content map[string]string) {
+	t.Helper()
+	for name, data := range content {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// porcelainFiles returns the status, filename and CID columns of the rows
+// of a --porcelain output, the others depending on the upload.
+func porcelainFiles(t *testing.T, out string) []string {
+	t.Helper()
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) == 0 || lines[0] != porcelainHeader {
+		t.Fatalf("no porcelain header in %q", out)
+	}
+	var files []string
+	for _, line := range lines[1:] {
+		cols := strings.Split(line, "\t")
+		if len(cols) != 7 {
+			t.Fatalf("row %q has %v columns", line, len(cols))
+		}
+		files = append(files, cols[0]+" "+cols[2]+" "+cols[3])
+	}
+	return files
+}
+
+// manifestRows returns the rows of the --manifest CSV file at path, without
+// its header.
+func manifestRows(t *testing.T, path string) [][]string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) == 0 || strings.Join(rows[0], ",") != strings.Join(manifestHeader, ",") {
+		t.Fatalf("no manifest header in %v", path)
+	}
+	return rows[1:]
+}
+
+func TestReusedFilesOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-upload-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{"nft/1.png": "one", "nft/2.png": "two", "nft/sub/3.png": "three"})
+
+	var outputs [2][]string
+	for i := range outputs {
+		manifest := filepath.Join(dir, "manifest.csv")
+		_ = os.Remove(manifest)
+		out, code := runMain(t, dir, "--mock", "--cache-file", filepath.Join(dir, "cache.json"), "--output", "porcelain", "--manifest", manifest, "nft")
+		if code != exitSuccess {
+			t.Fatalf("run %v exited with %v", i+1, code)
+		}
+		outputs[i] = porcelainFiles(t, out)
+		if rows := manifestRows(t, manifest); len(rows) != len(outputs[i]) {
+			t.Errorf("run %v wrote %v rows to the manifest, want %v", i+1, len(rows), len(outputs[i]))
+		}
+	}
+	if len(outputs[0]) != 5 {
+		t.Fatalf("the first run wrote %v rows, want 5: %q", len(outputs[0]), outputs[0])
+	}
+	want := strings.Replace(strings.Join(outputs[0], "\n"), "added ", "cached ", -1)
+	if strings.Join(outputs[1], "\n") != want {
+		t.Errorf("the run reusing the cache wrote\n%v\nwant\n%v", strings.Join(outputs[1], "\n"), want)
+	}
+}
+
+func TestReportOnEarlyExit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-upload-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{"nft/1.png": "one"})
+
+	tests := []struct {
+		name string
+		args []string
+		code int
+	}{
+		{"preflight", []string{"--url", "http://127.0.0.1:1", "--id", "id", "--secret", "secret"}, exitUnreachable},
+		{"usage", []string{"--mock", "--bench", "1", "--bench-levels", "x"}, exitUsage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := filepath.Join(dir, tt.name+".json")
+			_, code := runMain(t, dir, append(tt.args, "--no-cache", "--report", report, "nft")...)
+			if code != tt.code {
+				t.Fatalf("exited with %v, want %v", code, tt.code)
+			}
+			data, err := ioutil.ReadFile(report)
+			if err != nil {
+				t.Fatalf("no report: %v", err)
+			}
+			var doc struct {
+				ExitCode int    `json:"exit_code"`
+				Status   string `json:"status"`
+			}
+			if err := json.Unmarshal(data, &doc); err != nil {
+				t.Fatal(err)
+			}
+			if doc.ExitCode != tt.code || doc.Status != "failure" {
+				t.Errorf("the report has exit code %v and status %v, want %v and failure", doc.ExitCode, doc.Status, tt.code)
+			}
+		})
+	}
+}
+
+func TestVerifyInterrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-upload-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{"uris.txt": "ipfs://QmXSecgzcmQwxphsqUFQaqmU6wCgELQNtv8jc9WDRbvCUv\n"})
+	// the API never answers, until the test ends
+	done := make(chan struct{})
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer api.Close()
+	defer close(done)
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), mainEnv+"=1", mainEnv+"_ARGS=verify --url "+api.URL+" --id id --secret secret uris.txt")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Wait()
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != exitInterrupted {
+		t.Errorf("verify exited with %v, want %v", err, exitInterrupted)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// manifestHeader are the columns of a --manifest CSV file.
+var manifestHeader = []string{"path", "index", "cid", "size", "status", "attempts", "duration_ms", "error"}
+
+// manifest writes the files of the upload, added or failed, to a CSV or
+// JSON file as they are uploaded, at most every interval, and once the
+// upload completes.
+type manifest struct {
+	path string
+	// json is whether the file is written as a JSON array of outputRecord
+	// rather than CSV
+	json bool
+	// rows collects the records, named and indexed as with --output
+	rows     *porcelain
+	interval time.Duration
+	last     time.Time
+}
+
+// newManifest returns the manifest written to path, the format being told
+// by its extension, .csv or .json.
+func newManifest(path, root string, interval time.Duration) (*manifest, error) {
+	m := &manifest{path: path, interval: interval, last: time.Now()}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+	case ".json":
+		m.json = true
+	default:
+		return nil, fmt.Errorf("%v must end with .csv or .json", path)
+	}
+	m.rows = newPorcelain(nil, outputJSON, root)
+	return m, nil
+}
+
+// Event records the file of e, writing the manifest if interval elapsed
+// since it was last written, or the upload completed.
+func (m *manifest) Event(e uploader.Event) {
+	m.rows.Event(e)
+	_, completed := e.(uploader.RunCompleted)
+	if completed || (m.interval > 0 && time.Since(m.last) >= m.interval) {
+		if err := m.Write(); err != nil {
+			logs.Warn(fmt.Sprintf("writing the manifest to %v: %v", m.path, err))
+		}
+		m.last = time.Now()
+	}
+}
+
+// Write writes the records so far to the file, replacing it at once.
+func (m *manifest) Write() error {
+	var buf bytes.Buffer
+	if m.json {
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(m.rows.records); err != nil {
+			return err
+		}
+		return uploader.WriteFileAtomic(m.path, buf.Bytes())
+	}
+
+	w := csv.NewWriter(&buf)
+	_ = w.Write(manifestHeader)
+	for _, r := range m.rows.records {
+		index := ""
+		if r.Index != nil {
+			index = strconv.Itoa(*r.Index)
+		}
+		_ = w.Write([]string{r.Path, index, r.Cid, strconv.FormatInt(r.Size, 10), r.Status, strconv.Itoa(r.Attempts), strconv.FormatFloat(r.DurationMs, 'f', -1, 64), r.Error})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return uploader.WriteFileAtomic(m.path, buf.Bytes())
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// mappingFields are the fields of --mapping-keys: the token index, the
+// number the file is named after, which differs with --shuffle-seed, its hex
+// ERC-1155 id, the file path, the local file or the archive entry it was
+// read from, its CID, its URL in the metadata, the name of
+// its metadata file, the URI of the uploaded metadata and its CID with
+// --upload-json individual.
+var mappingFields = map[string]bool{
+	"metadataCid": true,
+	"sourceIndex": true,
+	"tokenId":     true,
+	"id":          true,
+	"file":        true,
+	"source":      true,
+	"cid":         true,
+	"url":         true,
+	"metadata":    true,
+	"uri":         true,
+}
+
+// mappingKey is a field of the mapping and the key it is written as.
+type mappingKey struct {
+	Field string
+	Name  string
+}
+
+// parseMappingKeys parses --mapping-keys, fields renamed with field=name,
+// e.g. tokenId,file=image,cid.
+func parseMappingKeys(s string) ([]mappingKey, error) {
+	var keys []mappingKey
+	for _, key := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(key), "=", 2)
+		k := mappingKey{Field: parts[0], Name: parts[0]}
+		if len(parts) == 2 {
+			k.Name = parts[1]
+		}
+		if !mappingFields[k.Field] || k.Name == "" {
+			return nil, fmt.Errorf("invalid --mapping-keys field %q, must be tokenId, sourceIndex, id, file, source, cid, url, metadata, uri or metadataCid", key)
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) < 2 {
+		return nil, fmt.Errorf("parameter --mapping-keys needs the field of the mapping keys and at least another one")
+	}
+	return keys, nil
+}
+
+// writeMapping writes the uploaded tokens to path as a JSON object keyed by
+// the value of the first key, holding the values of the others, in index
+// order. metadataRoot is the CID of the uploaded metadata directory, if any.
+func writeMapping(path string, tokens []*token, keys []mappingKey, opts metadataOptions, metadataRoot string) error {
+	value := func(t *token, field string) interface{} {
+		switch field {
+		case "tokenId":
+			return t.Index
+		case "sourceIndex":
+			return t.SourceIndex
+		case "id":
+			return tokenID(t.Index)
+		case "file":
+			return t.Path
+		case "source":
+			if t.Source != "" {
+				return t.Source
+			}
+			return t.LocalPath
+		case "cid":
+			return t.CID()
+		case "url":
+			image, _ := t.URLs(opts.Prefix)
+			return image
+		case "metadata":
+			return metadataName(t, opts)
+		case "metadataCid":
+			return t.MetadataCid.String()
+		default:
+			if t.MetadataCid.Defined() {
+				return "ipfs://" + t.MetadataCid.String()
+			}
+			return "ipfs://" + metadataRoot + "/" + metadataName(t, opts)
+		}
+	}
+
+	var mapping jsonObject
+	for _, t := range tokens {
+		if !t.Cid.Defined() {
+			continue
+		}
+		var entry jsonObject
+		for _, k := range keys[1:] {
+			if err := entry.Set(k.Name, value(t, k.Field)); err != nil {
+				return err
+			}
+		}
+		if err := mapping.Set(fmt.Sprint(value(t, keys[0].Field)), entry); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(mapping, "", "  ")
+	if err != nil {
+		return err
+	}
+	return uploader.WriteFileAtomic(path, data)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// heapPeak samples the heap in use until stop is called, which returns the
+// largest sample.
+func heapPeak() (stop func() uint64) {
+	done := make(chan struct{})
+	peak := make(chan uint64)
+	go func() {
+		var most uint64
+		var stats runtime.MemStats
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			runtime.ReadMemStats(&stats)
+			if stats.HeapInuse > most {
+				most = stats.HeapInuse
+			}
+			select {
+			case <-ticker.C:
+			case <-done:
+				peak <- most
+				return
+			}
+		}
+	}()
+	return func() uint64 {
+		close(done)
+		return <-peak
+	}
+}
+
+func TestUploadMemoryBounded(t *testing.T) {
+	if testing.Short() {
+		t.Skip("uploads 2GB")
+	}
+	dir, err := ioutil.TempDir("", "ipfs-upload-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// sparse files, streamed from disk, and small ones read ahead
+	const large, small = 1 << 30, 256 << 10
+	files := make(map[string]string)
+	for i := 0; i < 64; i++ {
+		files[fmt.Sprintf("nft/%v.png", i)] = string(make([]byte, small))
+	}
+	writeFiles(t, dir, files)
+	for _, name := range []string{"nft/video1.mp4", "nft/video2.mp4"} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		f, err := os.Create(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Truncate(p, large); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fake := uploader.NewFakeAPI(0)
+	defer fake.Close()
+	up, err := uploader.New(uploader.Options{API: fake.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, "nft")
+	stat, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := uploader.NewFileNode(p, false, stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const budget, threshold = 8 << 20, 1 << 20
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node = newPrefetcher(ctx, 4, budget, threshold).Wrap(node)
+
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	stop := heapPeak()
+	_, added, err := up.Add(ctx, node, nil)
+	peak := stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 67 {
+		t.Fatalf("added %v files, want 67", len(added))
+	}
+
+	// the read-ahead budget, the buffers of the upload and of the fake API
+	// and the garbage the GC lets grow, whatever the size of the files:
+	// buffering a single file whole would take 1GB
+	const bound = budget + 64<<20
+	if grown := int64(peak) - int64(before.HeapInuse); grown > bound {
+		t.Errorf("uploading 2 files of %vMB grew the heap by %vMB, want at most %vMB", large>>20, grown>>20, bound>>20)
+	} else {
+		t.Logf("the heap grew by %vMB at most", grown>>20)
+	}
+}
@@ -0,0 +1,844 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/ipfs/go-cid"
+	ipfsFiles "github.com/ipfs/go-ipfs-files"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// sampleCID stands for the CID of a file which isn't uploaded yet.
+const sampleCID = "SAMPLE-CID"
+
+// combinedMetadataName is the name of the --combined-json file, and
+// partialMetadataName its name when the metadata of some tokens is missing.
+const (
+	combinedMetadataName = "_metadata.json"
+	partialMetadataName  = "_metadata.partial.json"
+)
+
+// token is a file of the collection, its index is the number it is named
+// after, e.g. 7 for 7.png.
+type token struct {
+	Index int
+	// SourceIndex is the number the file is named after, which Index is
+	// unless shuffled by --shuffle-seed, and keys the inputs about it
+	SourceIndex int
+	Path        string // slash separated, relative to the uploaded path
+	LocalPath   string
+	// Source is the archive and the name of the entry of a file uploaded
+	// from an archive, e.g. collection.zip!art/1.png, or the URL of an S3
+	// object, or - for the standard input, LocalPath being empty
+	Source   string
+	Filename string
+	Size     int64
+	MIMEType string
+	// Width and Height are the dimensions of an image, with --dimensions
+	Width  int
+	Height int
+	Cid    cid.Cid
+	// MetadataCid is the CID of the metadata uploaded with --upload-json
+	// individual
+	MetadataCid cid.Cid
+	// Thumbnail is the image shown for a video or audio file, if any
+	Thumbnail *token
+	// Preview is a scaled down copy of the image, or the token itself if
+	// small enough, with --thumbnails
+	Preview *token
+	// Files are the files of the token in --group-by-index mode, the token
+	// itself being the first one
+	Files []tokenFile
+}
+
+// CID returns the CID of t, or sampleCID if it isn't uploaded yet.
+func (t *token) CID() string {
+	if !t.Cid.Defined() {
+		return sampleCID
+	}
+	return t.Cid.String()
+}
+
+// IsMedia reports whether t is a video or audio file, which marketplaces
+// play from animation_url.
+func (t *token) IsMedia() bool {
+	return strings.HasPrefix(t.MIMEType, "video/") || strings.HasPrefix(t.MIMEType, "audio/")
+}
+
+// URL returns the URL of t, prefix being prepended to its CID unless it
+// has placeholders, see expandTemplate.
+func (t *token) URL(prefix string) string {
+	if !strings.Contains(prefix, "{cid}") && !strings.Contains(prefix, "{index}") && !strings.Contains(prefix, "{id}") && !strings.Contains(prefix, "{filename}") {
+		return prefix + t.CID()
+	}
+	return expandTemplate(prefix, t)
+}
+
+// URLs returns the image and animation URLs of t. A video or audio file is
+// the animation, with its thumbnail as the image, or itself without one.
+func (t *token) URLs(prefix string) (image, animation string) {
+	url := t.URL(prefix)
+	if !t.IsMedia() {
+		return url, ""
+	}
+	if t.Thumbnail != nil {
+		return t.Thumbnail.URL(prefix), url
+	}
+	return url, url
+}
+
+// Metadata is the ERC-721 metadata of a token. Empty fields are omitted and
+// fields are written in declaration order so that the output is stable.
+type Metadata struct {
+	Name         string      `json:"name,omitempty"`
+	Description  string      `json:"description,omitempty"`
+	Image        string      `json:"image"`
+	AnimationURL string      `json:"animation_url,omitempty"`
+	MediaType    string      `json:"media_type,omitempty"`
+	ExternalURL  string      `json:"external_url,omitempty"`
+	Decimals     *int        `json:"decimals,omitempty"`
+	Attributes   []Attribute `json:"attributes,omitempty"`
+	// Properties holds the dimensions with --dimensions properties and the
+	// attributes of ERC-1155 metadata
+	Properties   *jsonObject   `json:"properties,omitempty"`
+	Localization *Localization `json:"localization,omitempty"`
+}
+
+// The --standard of the metadata.
+const (
+	erc721  = "erc721"
+	erc1155 = "erc1155"
+)
+
+// tokenID returns the ERC-1155 id of the token index, lowercase hex zero
+// padded to 64 characters, as clients substitute {id} in URIs.
+func tokenID(index int) string {
+	return fmt.Sprintf("%064x", index)
+}
+
+// metadataOptions configures the generated metadata. Name, Description and
+// ExternalURL are templates, see expandTemplate.
+type metadataOptions struct {
+	Prefix      string
+	Name        string
+	Description string
+	ExternalURL string
+	// Attributes is optional
+	Attributes *attributeTable
+	// Template replaces the Metadata struct when set
+	Template *template.Template
+	// ImageField is the dot separated path of the image URL
+	ImageField string
+	// PreviewField is the dot separated path of the preview URL
+	PreviewField string
+	// MediaType adds the MIME type of the file as media_type
+	MediaType bool
+	// Dimensions adds the width and height of the images to the
+	// "attributes" or the "properties", or nowhere if empty
+	Dimensions string
+	// Standard is erc721 or erc1155, which has Decimals and the attributes
+	// as properties
+	Standard string
+	Decimals int
+	// Localization writes the metadata in other locales too, if set
+	Localization *localization
+	// Royalty is added to the metadata of every token, if set
+	Royalty *royalty
+	// Extra is merged into the metadata of every token, if set
+	Extra *extraFields
+	// Combined writes the array of the metadata of every token to
+	// combinedMetadataName too
+	Combined bool
+	// MergeDir holds existing <index>.json documents to set the ImageField
+	// of, instead of generating the metadata
+	MergeDir string
+	// Extension is the suffix of the written files after the index, e.g.
+	// .json, or nothing for baseURI/7
+	Extension string
+	// FileTemplate names the written files instead of Extension, see
+	// expandFileTemplate
+	FileTemplate string
+	Format       jsonFormat
+}
+
+// jsonFormat is the layout of the metadata files, which keeps the order of
+// the fields.
+type jsonFormat struct {
+	Indent  int // spaces
+	Compact bool
+	Newline bool // at the end
+}
+
+// Apply lays out the JSON document data.
+func (f jsonFormat) Apply(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if f.Compact {
+		err = json.Compact(&buf, data)
+	} else {
+		err = json.Indent(&buf, data, "", strings.Repeat(" ", f.Indent))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if f.Newline {
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// indexPlaceholderRe matches {index} and its zero padded form, e.g.
+// {index:05d}.
+var indexPlaceholderRe = regexp.MustCompile(`\{index(:0(\d+)d)?\}`)
+
+// metadataName returns the name of the metadata file of t.
+func metadataName(t *token, opts metadataOptions) string {
+	if opts.FileTemplate == "" {
+		return strconv.Itoa(t.Index) + opts.Extension
+	}
+	name := indexPlaceholderRe.ReplaceAllStringFunc(opts.FileTemplate, func(placeholder string) string {
+		width := indexPlaceholderRe.FindStringSubmatch(placeholder)[2]
+		if width == "" {
+			return strconv.Itoa(t.Index)
+		}
+		return fmt.Sprintf("%0"+width+"d", t.Index)
+	})
+	name = strings.Replace(name, "{id}", tokenID(t.Index), -1)
+	return strings.Replace(name, "{filename}", t.Filename, -1)
+}
+
+// checkMetadataNames returns an error if a metadata file name is invalid or
+// shared by several tokens.
+func checkMetadataNames(tokens []*token, opts metadataOptions) error {
+	byName := make(map[string]*token)
+	for _, t := range tokens {
+		name := metadataName(t, opts)
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return fmt.Errorf("invalid metadata file name %q for %v", name, t.Filename)
+		}
+		if opts.Combined && (name == combinedMetadataName || name == partialMetadataName) {
+			return fmt.Errorf("the metadata of %v would overwrite the --combined-json file %v", t.Filename, name)
+		}
+		if other, ok := byName[name]; ok {
+			return fmt.Errorf("the metadata of %v and %v would both be written to %v", other.Filename, t.Filename, name)
+		}
+		byName[name] = t
+	}
+	return nil
+}
+
+// templateContext is the data of a --metadata-template.
+type templateContext struct {
+	Index        int
+	ID           string // hex ERC-1155 id
+	Filename     string
+	CID          string
+	URL          string
+	ThumbnailURL string
+	PreviewURL   string
+	Size         int64
+	MIMEType     string
+	Width        int
+	Height       int
+	// RoyaltyBPS and RoyaltyRecipient are set with --token-royalty
+	RoyaltyBPS       int
+	RoyaltyRecipient string
+	Attributes       []Attribute
+	// Files are the URLs by field in --group-by-index mode
+	Files map[string]string
+}
+
+// FileName is Filename, as the templates written for other tools spell it.
+func (c templateContext) FileName() string {
+	return c.Filename
+}
+
+// templateFuncs are the functions available to the templates, json quotes
+// a value.
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// parseTemplate parses the template file at path.
+func parseTemplate(path string) (*template.Template, error) {
+	tmpl, err := template.New(filepath.Base(path)).Funcs(templateFuncs).ParseFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// scanTokens walks root, skipping the hidden files unless includeHidden
+// and the excluded local paths like the upload does, and returns the files
+// named after a number sorted by index.
+func scanTokens(root string, includeHidden bool, excluded map[string]bool) ([]*token, error) {
+	return indexTokens(func(fn func(t *token) error) error {
+		return walkFiles(root, includeHidden, excluded, fn)
+	})
+}
+
+// scanListingTokens is scanTokens for the files of an archive or S3
+// prefix, typed by their extension only.
+func scanListingTokens(listing *uploader.Listing) ([]*token, error) {
+	return indexTokens(func(fn func(t *token) error) error {
+		for _, f := range listing.Files {
+			t := &token{Path: f.Name, Source: f.Source, Filename: path.Base(f.Name), Size: f.Size}
+			if err := fn(t); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// stdinTokens is scanTokens for the standard input uploaded as the file
+// name, typed by its extension only.
+func stdinTokens(name string) ([]*token, error) {
+	return indexTokens(func(fn func(t *token) error) error {
+		return fn(&token{Source: "-", Filename: name})
+	})
+}
+
+// indexTokens returns the files named after a number walk calls its
+// function with, sorted by index.
+func indexTokens(walk func(fn func(t *token) error) error) ([]*token, error) {
+	var tokens []*token
+	byIndex := make(map[int]*token)
+
+	err := walk(func(t *token) error {
+		index, ok := tokenIndex(t.Filename)
+		if !ok {
+			return nil
+		}
+		t.Index = index
+		t.SourceIndex = index
+		if t.LocalPath != "" {
+			t.MIMEType = detectMIMEType(t.LocalPath)
+		} else {
+			t.MIMEType = mime.TypeByExtension(filepath.Ext(t.Filename))
+		}
+		if other, ok := byIndex[index]; ok {
+			return fmt.Errorf("files %v and %v have the same token index %v", other.Path, t.Path, index)
+		}
+		byIndex[index] = t
+		tokens = append(tokens, t)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Index < tokens[j].Index })
+	return tokens, nil
+}
+
+// walkFiles calls fn with every regular file under root in the order of the
+// file system, skipping the hidden files unless includeHidden and the
+// excluded local paths like the upload does.
+func walkFiles(root string, includeHidden bool, excluded map[string]bool, fn func(t *token) error) error {
+	return uploader.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != root && ((!includeHidden && strings.HasPrefix(info.Name(), ".")) || excluded[filepath.Clean(p)]) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			rel = ""
+		}
+		return fn(&token{
+			Path:      filepath.ToSlash(rel),
+			LocalPath: p,
+			Filename:  info.Name(),
+			Size:      info.Size(),
+		})
+	})
+}
+
+// tokenIndex returns the number name is made of, ignoring its extension.
+func tokenIndex(name string) (int, bool) {
+	return parseIndex(strings.TrimSuffix(name, filepath.Ext(name)))
+}
+
+// parseIndex parses a token index, which is a plain non-negative number.
+func parseIndex(stem string) (int, bool) {
+	index, err := strconv.Atoi(stem)
+	if err != nil || index < 0 || strings.HasPrefix(stem, "+") {
+		return 0, false
+	}
+	return index, true
+}
+
+// expandTemplate replaces the {index}, {id}, {filename} and {cid}
+// placeholders of tmpl with the values of t.
+func expandTemplate(tmpl string, t *token) string {
+	return strings.NewReplacer(
+		"{index}", strconv.Itoa(t.Index),
+		"{id}", tokenID(t.Index),
+		"{filename}", t.Filename,
+		"{cid}", t.CID(),
+	).Replace(tmpl)
+}
+
+// attachThumbnails sets the thumbnail of every token with the same source
+// index and returns the video and audio tokens without one.
+func attachThumbnails(tokens, thumbnails []*token) (missing []int) {
+	byIndex := make(map[int]*token)
+	for _, thumb := range thumbnails {
+		byIndex[thumb.Index] = thumb
+	}
+	for _, t := range tokens {
+		t.Thumbnail = byIndex[t.SourceIndex]
+		if t.IsMedia() && t.Thumbnail == nil {
+			missing = append(missing, t.SourceIndex)
+		}
+	}
+	return missing
+}
+
+func newMetadata(t *token, opts metadataOptions) Metadata {
+	image, animation := t.URLs(opts.Prefix)
+	meta := Metadata{
+		Name:         expandTemplate(opts.Name, t),
+		Description:  expandTemplate(opts.Description, t),
+		Image:        image,
+		AnimationURL: animation,
+		ExternalURL:  expandTemplate(opts.ExternalURL, t),
+	}
+	if opts.Attributes != nil {
+		meta.Attributes, _ = opts.Attributes.Attributes(t.SourceIndex)
+	}
+	if opts.MediaType {
+		meta.MediaType = t.MIMEType
+	}
+	if t.Width > 0 {
+		switch opts.Dimensions {
+		case "attributes":
+			meta.Attributes = append(meta.Attributes, dimensionAttributes(t)...)
+		case "properties":
+			meta.Properties = &jsonObject{}
+			_ = meta.Properties.Set("width", t.Width)
+			_ = meta.Properties.Set("height", t.Height)
+		}
+	}
+	if opts.Standard == erc1155 {
+		decimals := opts.Decimals
+		meta.Decimals = &decimals
+		if len(meta.Attributes) > 0 && meta.Properties == nil {
+			meta.Properties = &jsonObject{}
+		}
+		for _, a := range meta.Attributes {
+			_ = meta.Properties.Set(a.TraitType, a.Value)
+		}
+		meta.Attributes = nil
+	}
+	if opts.Localization != nil {
+		meta.Localization = opts.Localization.Block(opts)
+	}
+	return meta
+}
+
+// dimensionAttributes returns the width and height of the image of t as
+// attributes.
+func dimensionAttributes(t *token) []Attribute {
+	return []Attribute{{TraitType: "width", Value: t.Width}, {TraitType: "height", Value: t.Height}}
+}
+
+// renderMetadata returns the metadata document of t laid out by
+// opts.Format.
+func renderMetadata(t *token, opts metadataOptions) ([]byte, error) {
+	data, err := renderDocument(t, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Extra != nil {
+		doc, err := readJSONObject(data)
+		if err == nil {
+			err = opts.Extra.Merge(doc)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("merging the --extra-fields into the metadata of %v: %v", t.Index, err)
+		}
+		if data, err = json.Marshal(doc); err != nil {
+			return nil, err
+		}
+	}
+	return opts.Format.Apply(data)
+}
+
+func renderDocument(t *token, opts metadataOptions) ([]byte, error) {
+	if opts.MergeDir != "" {
+		doc, err := readMergeInput(t, opts)
+		if err != nil {
+			return nil, err
+		}
+		if err := setURLs(doc, t, opts); err != nil {
+			return nil, err
+		}
+		if err := setMediaInfo(doc, t, opts); err != nil {
+			return nil, err
+		}
+		if opts.Royalty != nil {
+			if err := opts.Royalty.Set(doc); err != nil {
+				return nil, err
+			}
+		}
+		return json.Marshal(doc)
+	}
+	if opts.Template == nil {
+		meta := newMetadata(t, opts)
+		if len(t.Files) == 0 && (opts.ImageField == "" || opts.ImageField == "image") && t.Preview == nil && opts.Royalty == nil {
+			return json.Marshal(meta)
+		}
+		return moveURLs(meta, t, opts)
+	}
+
+	ctx := templateContext{
+		Index:    t.Index,
+		ID:       tokenID(t.Index),
+		Filename: t.Filename,
+		CID:      t.CID(),
+		URL:      t.URL(opts.Prefix),
+		Size:     t.Size,
+		MIMEType: t.MIMEType,
+		Width:    t.Width,
+		Height:   t.Height,
+	}
+	if t.Thumbnail != nil {
+		ctx.ThumbnailURL = t.Thumbnail.URL(opts.Prefix)
+	}
+	if opts.Royalty != nil {
+		ctx.RoyaltyBPS, ctx.RoyaltyRecipient = opts.Royalty.BPS, opts.Royalty.Recipient
+	}
+	if t.Preview != nil {
+		ctx.PreviewURL = t.Preview.URL(opts.Prefix)
+	}
+	if len(t.Files) > 0 {
+		ctx.Files = make(map[string]string)
+		for _, f := range t.Files {
+			ctx.Files[f.Field] = f.File.URL(opts.Prefix)
+		}
+	}
+	if opts.Attributes != nil {
+		ctx.Attributes, _ = opts.Attributes.Attributes(t.SourceIndex)
+	}
+	var buf bytes.Buffer
+	if err := opts.Template.Execute(&buf, ctx); err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := json.Unmarshal(buf.Bytes(), &v); err != nil {
+		return nil, fmt.Errorf("the metadata template output for %v is not valid JSON: %v", t.Filename, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// moveURLs renders meta with the URLs of t at the fields set by opts
+// instead of image and animation_url.
+func moveURLs(meta Metadata, t *token, opts metadataOptions) ([]byte, error) {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := readJSONObject(data)
+	if err != nil {
+		return nil, err
+	}
+	// the fields set again keep their position
+	if len(t.Files) > 0 || opts.ImageField != "image" {
+		doc.Delete("image")
+	}
+	if len(t.Files) > 0 {
+		doc.Delete("animation_url")
+	}
+	if err := setURLs(doc, t, opts); err != nil {
+		return nil, err
+	}
+	if opts.Royalty != nil {
+		if err := opts.Royalty.Set(doc); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(doc)
+}
+
+// setURLs sets the URLs of the files of t in doc, at the fields of their
+// --map rule in --group-by-index mode.
+func setURLs(doc *jsonObject, t *token, opts metadataOptions) error {
+	if t.Preview != nil {
+		if err := doc.SetPath(opts.PreviewField, t.Preview.URL(opts.Prefix)); err != nil {
+			return err
+		}
+	}
+	if len(t.Files) > 0 {
+		for _, f := range t.Files {
+			if err := doc.SetPath(f.Field, f.File.URL(opts.Prefix)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	image, animation := t.URLs(opts.Prefix)
+	if err := doc.SetPath(opts.ImageField, image); err != nil {
+		return err
+	}
+	if animation != "" {
+		return doc.Set("animation_url", animation)
+	}
+	return nil
+}
+
+// setMediaInfo sets the media type and the dimensions of t in doc, the
+// dimensions being appended to its attributes.
+func setMediaInfo(doc *jsonObject, t *token, opts metadataOptions) error {
+	if opts.MediaType && t.MIMEType != "" {
+		if err := doc.Set("media_type", t.MIMEType); err != nil {
+			return err
+		}
+	}
+	if t.Width == 0 {
+		return nil
+	}
+	switch opts.Dimensions {
+	case "attributes":
+		var attributes []interface{}
+		if raw, ok := doc.values["attributes"]; ok {
+			if err := json.Unmarshal(raw, &attributes); err != nil {
+				return errors.New("attributes is not a JSON array")
+			}
+		}
+		for _, a := range dimensionAttributes(t) {
+			attributes = append(attributes, a)
+		}
+		return doc.Set("attributes", attributes)
+	case "properties":
+		if err := doc.SetPath("properties.width", t.Width); err != nil {
+			return err
+		}
+		return doc.SetPath("properties.height", t.Height)
+	}
+	return nil
+}
+
+// readMergeInput reads the existing metadata document of t.
+func readMergeInput(t *token, opts metadataOptions) (*jsonObject, error) {
+	name := filepath.Join(opts.MergeDir, strconv.Itoa(t.SourceIndex)+".json")
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := readJSONObject(data)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", name, err)
+	}
+	return doc, nil
+}
+
+// checkMergeInputs returns the errors reading the existing metadata
+// documents of tokens or setting their URLs.
+func checkMergeInputs(tokens []*token, opts metadataOptions) []error {
+	var errs []error
+	for _, t := range tokens {
+		doc, err := readMergeInput(t, opts)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		err = setURLs(doc, t, opts)
+		if err == nil {
+			err = setMediaInfo(doc, t, opts)
+		}
+		if err == nil && opts.Royalty != nil {
+			err = opts.Royalty.Set(doc)
+		}
+		if err != nil {
+			name := filepath.Join(opts.MergeDir, strconv.Itoa(t.SourceIndex)+".json")
+			errs = append(errs, fmt.Errorf("%v: %v", name, err))
+		}
+	}
+	return errs
+}
+
+// detectMIMEType returns the MIME type of the file at path from its
+// extension, or from its content if the extension is unknown.
+func detectMIMEType(path string) string {
+	if mimeType := mime.TypeByExtension(filepath.Ext(path)); mimeType != "" {
+		return mimeType
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	return http.DetectContentType(head[:n])
+}
+
+// readDimensions sets the width and height of the image tokens from the
+// header of their file, and returns the files whose dimensions can't be
+// read with the reason.
+func readDimensions(tokens []*token) (failed []string) {
+	for _, t := range tokens {
+		if !strings.HasPrefix(t.MIMEType, "image/") {
+			continue
+		}
+		f, err := os.Open(t.LocalPath)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%v: %v", t.Path, err))
+			continue
+		}
+		config, _, err := image.DecodeConfig(f)
+		_ = f.Close()
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%v: %v", t.Path, err))
+			continue
+		}
+		t.Width, t.Height = config.Width, config.Height
+	}
+	return failed
+}
+
+// assignCIDs sets the CIDs of tokens and of their files from the CIDs
+// added by path.
+func assignCIDs(tokens []*token, added map[string]cid.Cid) error {
+	for _, t := range tokens {
+		files := []*token{t}
+		for _, f := range t.Files {
+			files = append(files, f.File)
+		}
+		for _, f := range files {
+			c, ok := added[f.Path]
+			if !ok {
+				return fmt.Errorf("no CID for %v", f.LocalPath)
+			}
+			f.Cid = c
+		}
+	}
+	return nil
+}
+
+// placeholderTokens returns copies of tokens, with their files and
+// thumbnails, which all have the CID c, for metadata not revealing the
+// actual files.
+func placeholderTokens(tokens []*token, c cid.Cid) []*token {
+	hide := func(t *token) *token {
+		hidden := *t
+		hidden.Cid = c
+		return &hidden
+	}
+
+	hidden := make([]*token, len(tokens))
+	for i, t := range tokens {
+		hidden[i] = hide(t)
+		if t.Thumbnail != nil {
+			hidden[i].Thumbnail = hide(t.Thumbnail)
+		}
+		if t.Preview != nil {
+			hidden[i].Preview = hide(t.Preview)
+		}
+		hidden[i].Files = make([]tokenFile, len(t.Files))
+		for j, f := range t.Files {
+			hidden[i].Files[j] = tokenFile{Field: f.Field, File: hide(f.File)}
+		}
+	}
+	return hidden
+}
+
+// writeMetadata writes the metadata of every token to dir as
+// <index><extension>. With opts.Combined, a failure writes the metadata
+// written so far to partialMetadataName.
+func writeMetadata(dir string, tokens []*token, opts metadataOptions) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var combined []json.RawMessage
+	for _, t := range tokens {
+		data, err := renderMetadata(t, opts)
+		if err == nil {
+			name := filepath.Join(dir, metadataName(t, opts))
+			err = uploader.WriteFileAtomic(name, data)
+		}
+		if err != nil {
+			if opts.Combined {
+				_ = writeCombined(filepath.Join(dir, partialMetadataName), combined, opts.Format)
+			}
+			return err
+		}
+		combined = append(combined, data)
+	}
+	if opts.Combined {
+		if err := writeCombined(filepath.Join(dir, combinedMetadataName), combined, opts.Format); err != nil {
+			return err
+		}
+		// a partial file of an earlier run is outdated
+		_ = os.Remove(filepath.Join(dir, partialMetadataName))
+	}
+	if opts.Localization != nil {
+		return opts.Localization.Write(dir, tokens, opts)
+	}
+	return nil
+}
+
+// writeCombined writes the array of the metadata documents to path.
+func writeCombined(path string, documents []json.RawMessage, format jsonFormat) error {
+	if documents == nil {
+		documents = []json.RawMessage{}
+	}
+	data, err := json.Marshal(documents)
+	if err != nil {
+		return err
+	}
+	if data, err = format.Apply(data); err != nil {
+		return err
+	}
+	return uploader.WriteFileAtomic(path, data)
+}
+
+// metadataDirectory returns the metadata files of tokens written to dir,
+// localized ones included, leaving out any other file of dir.
+func metadataDirectory(dir string, tokens []*token, opts metadataOptions) (ipfsFiles.Directory, error) {
+	var names []string
+	for _, t := range tokens {
+		names = append(names, metadataName(t, opts))
+	}
+	if opts.Localization != nil {
+		names = append(names, opts.Localization.Names(tokens, opts)...)
+	}
+	if opts.Combined {
+		names = append(names, combinedMetadataName)
+	}
+	return namedFiles(dir, names)
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// compact lays the rendered metadata out on a single line, to be compared.
+var compact = jsonFormat{Compact: true}
+
+func TestRenderMetadata(t *testing.T) {
+	image := func() *token {
+		return &token{Index: 7, SourceIndex: 7, Filename: "7.png", MIMEType: "image/png"}
+	}
+	video := func() *token {
+		return &token{Index: 3, SourceIndex: 3, Filename: "3.mp4", MIMEType: "video/mp4"}
+	}
+	tests := []struct {
+		name  string
+		token *token
+		opts  metadataOptions
+		want  string
+	}{
+		{
+			name:  "image only",
+			token: image(),
+			opts:  metadataOptions{Prefix: "ipfs://", Format: compact},
+			want:  `{"image":"ipfs://SAMPLE-CID"}`,
+		},
+		{
+			name:  "erc-721 fields",
+			token: image(),
+			opts:  metadataOptions{Prefix: "ipfs://", Name: "Token #{index}", Description: "Made from {filename}", ExternalURL: "https://example.com/tokens/{index}", Format: compact},
+			want:  `{"name":"Token #7","description":"Made from 7.png","image":"ipfs://SAMPLE-CID","external_url":"https://example.com/tokens/7"}`,
+		},
+		{
+			name:  "gateway prefix",
+			token: image(),
+			opts:  metadataOptions{Prefix: "https://gateway.example.com/ipfs/", Format: compact},
+			want:  `{"image":"https://gateway.example.com/ipfs/SAMPLE-CID"}`,
+		},
+		{
+			name:  "prefix placeholders",
+			token: image(),
+			opts:  metadataOptions{Prefix: "ipfs://{cid}/{filename}?token={index}", Format: compact},
+			want:  `{"image":"ipfs://SAMPLE-CID/7.png?token=7"}`,
+		},
+		{
+			name:  "video without thumbnail",
+			token: video(),
+			opts:  metadataOptions{Prefix: "ipfs://{filename}", MediaType: true, Format: compact},
+			want:  `{"image":"ipfs://3.mp4","animation_url":"ipfs://3.mp4","media_type":"video/mp4"}`,
+		},
+		{
+			name: "video with thumbnail",
+			token: func() *token {
+				t := video()
+				t.Thumbnail = &token{Index: 3, Filename: "3.png", Path: "thumbs/3.png"}
+				return t
+			}(),
+			opts: metadataOptions{Prefix: "ipfs://{filename}", Format: compact},
+			want: `{"image":"ipfs://3.png","animation_url":"ipfs://3.mp4"}`,
+		},
+		{
+			name: "dimensions as attributes",
+			token: func() *token {
+				t := image()
+				t.Width, t.Height = 640, 480
+				return t
+			}(),
+			opts: metadataOptions{Prefix: "ipfs://", Dimensions: "attributes", Format: compact},
+			want: `{"image":"ipfs://SAMPLE-CID","attributes":[{"trait_type":"width","value":640},{"trait_type":"height","value":480}]}`,
+		},
+		{
+			name: "dimensions as properties",
+			token: func() *token {
+				t := image()
+				t.Width, t.Height = 640, 480
+				return t
+			}(),
+			opts: metadataOptions{Prefix: "ipfs://", Dimensions: "properties", Format: compact},
+			want: `{"image":"ipfs://SAMPLE-CID","properties":{"width":640,"height":480}}`,
+		},
+		{
+			name:  "erc-1155",
+			token: image(),
+			opts:  metadataOptions{Prefix: "ipfs://", Name: "{id}", Standard: erc1155, Decimals: 2, Format: compact},
+			want:  `{"name":"0000000000000000000000000000000000000000000000000000000000000007","image":"ipfs://SAMPLE-CID","decimals":2}`,
+		},
+		{
+			name:  "indented with a newline",
+			token: image(),
+			opts:  metadataOptions{Prefix: "ipfs://", Name: "#{index}", Format: jsonFormat{Indent: 4, Newline: true}},
+			want:  "{\n    \"name\": \"#7\",\n    \"image\": \"ipfs://SAMPLE-CID\"\n}\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderMetadata(tt.token, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	table, err := readAttributes(writeTestFile(t, "attributes.csv", "token_id,Eyes\n7,Green\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok := &token{Index: 7, SourceIndex: 7, Filename: "7.png", MIMEType: "image/png", Size: 1234, Width: 64, Height: 32}
+	tests := []struct {
+		name     string
+		template string
+		opts     metadataOptions
+		want     string
+		err      string
+	}{
+		{
+			name:     "fields",
+			template: `{"name": "Token {{.Index}}", "image": {{json .URL}}, "file": {{json .FileName}}, "size": {{.Size}}, "type": {{json .MIMEType}}, "width": {{.Width}}, "height": {{.Height}}}`,
+			opts:     metadataOptions{Prefix: "ipfs://"},
+			want:     `{"name":"Token 7","image":"ipfs://SAMPLE-CID","file":"7.png","size":1234,"type":"image/png","width":64,"height":32}`,
+		},
+		{
+			name:     "attributes",
+			template: `{"image": {{json .URL}}, "attributes": {{json .Attributes}}}`,
+			opts:     metadataOptions{Prefix: "ipfs://", Attributes: table},
+			want:     `{"image":"ipfs://SAMPLE-CID","attributes":[{"trait_type":"Eyes","value":"Green"}]}`,
+		},
+		{
+			name:     "erc-1155 id",
+			template: `{"id": "{{.ID}}"}`,
+			want:     `{"id":"0000000000000000000000000000000000000000000000000000000000000007"}`,
+		},
+		{
+			name:     "quoting",
+			template: `{"name": {{json "say \"hi\""}}}`,
+			want:     `{"name":"say \"hi\""}`,
+		},
+		{
+			name:     "invalid JSON",
+			template: `{"name": {{.Filename}}}`,
+			err:      "the metadata template output for 7.png is not valid JSON",
+		},
+		{
+			name:     "unknown field",
+			template: `{"name": "{{.Nope}}"}`,
+			err:      "can't evaluate field Nope",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := parseTemplate(writeTestFile(t, "token.json.tmpl", tt.template))
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := tt.opts
+			opts.Template, opts.Format = tmpl, compact
+			got, err := renderMetadata(tok, opts)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTemplateError(t *testing.T) {
+	if _, err := parseTemplate(writeTestFile(t, "token.json.tmpl", `{"name": "{{.Index"}`)); err == nil {
+		t.Error("parsed a template missing a }}")
+	}
+	if _, err := parseTemplate(filepath.Join(t.TempDir(), "missing.tmpl")); err == nil {
+		t.Error("parsed a missing template")
+	}
+}
+
+func TestRenderMerged(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"1.json": `{"name": "One", "image": "old", "attributes": [{"trait_type": "Eyes", "value": "Green"}]}`,
+		"2.json": `{"description": "no image yet", "name": "Two"}`,
+		"4.json": `[1, 2]`,
+	})
+	tests := []struct {
+		name  string
+		index int
+		opts  metadataOptions
+		want  string
+		err   string
+	}{
+		{
+			name:  "image replaced in place",
+			index: 1,
+			opts:  metadataOptions{ImageField: "image"},
+			want:  `{"name":"One","image":"ipfs://SAMPLE-CID","attributes":[{"trait_type":"Eyes","value":"Green"}]}`,
+		},
+		{
+			name:  "image appended",
+			index: 2,
+			opts:  metadataOptions{ImageField: "image"},
+			want:  `{"description":"no image yet","name":"Two","image":"ipfs://SAMPLE-CID"}`,
+		},
+		{
+			name:  "media type and dimensions",
+			index: 2,
+			opts:  metadataOptions{ImageField: "image", MediaType: true, Dimensions: "attributes"},
+			want:  `{"description":"no image yet","name":"Two","image":"ipfs://SAMPLE-CID","media_type":"image/png","attributes":[{"trait_type":"width","value":64},{"trait_type":"height","value":32}]}`,
+		},
+		{name: "not an object", index: 4, opts: metadataOptions{ImageField: "image"}, err: "not a JSON object"},
+		{name: "missing document", index: 6, opts: metadataOptions{ImageField: "image"}, err: "6.json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the documents are those of the files, whatever the shuffled
+			// index
+			tok := &token{Index: 100 + tt.index, SourceIndex: tt.index, Filename: "x.png", MIMEType: "image/png", Width: 64, Height: 32}
+			opts := tt.opts
+			opts.Prefix, opts.MergeDir, opts.Format = "ipfs://", dir, compact
+			got, err := renderMetadata(tok, opts)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckMergeInputs(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"1.json": `{"name": "One"}`,
+		"2.json": `{"name": `,
+		"3.json": `{"properties": 3}`,
+	})
+	var tokens []*token
+	for i := 1; i <= 4; i++ {
+		tokens = append(tokens, &token{Index: i, SourceIndex: i, Filename: "x.png"})
+	}
+	errs := checkMergeInputs(tokens, metadataOptions{MergeDir: dir, ImageField: "properties.image"})
+	if len(errs) != 3 {
+		t.Fatalf("got %v errors, want those of 2.json, 3.json and the missing 4.json: %v", len(errs), errs)
+	}
+	for i, want := range []string{"2.json", "3.json: properties is not a JSON object", "4.json"} {
+		if !strings.Contains(errs[i].Error(), want) {
+			t.Errorf("error %v is %v, want %v", i, errs[i], want)
+		}
+	}
+}
+
+func TestImageField(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"1.json": `{"name": "One", "properties": {"rarity": 1}}`,
+		"2.json": `{"name": "Two", "properties": "flat"}`,
+	})
+	tests := []struct {
+		name  string
+		field string
+		merge bool
+		want  string
+		err   string
+	}{
+		{name: "default", field: "image", want: `{"name":"#1","image":"ipfs://SAMPLE-CID"}`},
+		{name: "renamed", field: "image_url", want: `{"name":"#1","image_url":"ipfs://SAMPLE-CID"}`},
+		{name: "nested", field: "properties.image", want: `{"name":"#1","properties":{"image":"ipfs://SAMPLE-CID"}}`},
+		{name: "deeply nested", field: "a.b.c", want: `{"name":"#1","a":{"b":{"c":"ipfs://SAMPLE-CID"}}}`},
+		{name: "nested in a merged object", field: "properties.image", merge: true, want: `{"name":"One","properties":{"rarity":1,"image":"ipfs://SAMPLE-CID"}}`},
+		{name: "nested in a merged string", field: "properties.image", merge: true, err: "properties is not a JSON object"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			index := 1
+			if tt.err != "" {
+				index = 2
+			}
+			tok := &token{Index: index, SourceIndex: index, Filename: "1.png"}
+			opts := metadataOptions{Prefix: "ipfs://", Name: "#{index}", ImageField: tt.field, Format: compact}
+			if tt.merge {
+				opts.MergeDir = dir
+			}
+			got, err := renderMetadata(tok, opts)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetadataName(t *testing.T) {
+	tok := &token{Index: 7, Filename: "7.png"}
+	tests := []struct {
+		opts metadataOptions
+		want string
+	}{
+		{metadataOptions{Extension: ".json"}, "7.json"},
+		{metadataOptions{}, "7"},
+		{metadataOptions{FileTemplate: "token-{index}.json"}, "token-7.json"},
+		{metadataOptions{FileTemplate: "{index:04d}.json"}, "0007.json"},
+		{metadataOptions{FileTemplate: "{index}-{index:03d}"}, "7-007"},
+		{metadataOptions{FileTemplate: "{filename}.json"}, "7.png.json"},
+		{metadataOptions{FileTemplate: "{id}.json"}, "0000000000000000000000000000000000000000000000000000000000000007.json"},
+	}
+	for _, tt := range tests {
+		if got := metadataName(tok, tt.opts); got != tt.want {
+			t.Errorf("metadataName with %q = %q, want %q", tt.opts.FileTemplate, got, tt.want)
+		}
+	}
+}
+
+func TestCheckMetadataNames(t *testing.T) {
+	tokens := []*token{
+		{Index: 1, Filename: "1.png"},
+		{Index: 2, Filename: "02.png"},
+		{Index: 10, Filename: "10.png"},
+	}
+	tests := []struct {
+		name string
+		opts metadataOptions
+		err  string
+	}{
+		{name: "by index", opts: metadataOptions{Extension: ".json"}},
+		{name: "padded", opts: metadataOptions{FileTemplate: "{index:03d}.json"}},
+		{name: "constant", opts: metadataOptions{FileTemplate: "token.json"}, err: "the metadata of 1.png and 02.png would both be written to token.json"},
+		{name: "padding narrower than the index", opts: metadataOptions{FileTemplate: "{index:01d}"}},
+		{name: "directory", opts: metadataOptions{FileTemplate: "meta/{index}.json"}, err: `invalid metadata file name "meta/1.json" for 1.png`},
+		{name: "backslash", opts: metadataOptions{FileTemplate: `{index}\.json`}, err: "invalid metadata file name"},
+		{name: "filename", opts: metadataOptions{FileTemplate: "{filename}.json"}},
+		{name: "filename without index", opts: metadataOptions{FileTemplate: "{filename}"}},
+		{name: "dot dot", opts: metadataOptions{FileTemplate: ".."}, err: `invalid metadata file name ".."`},
+		{name: "combined file", opts: metadataOptions{FileTemplate: "_metadata.json", Combined: true}, err: "would overwrite the --combined-json file _metadata.json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkMetadataNames(tokens, tt.opts)
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("unexpected error %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+}
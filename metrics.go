@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metric names are part of the interface, alerting rules depend on them.
+// Don't rename them.
+type metrics struct {
+	registry *prometheus.Registry
+
+	filesAdded   prometheus.Counter
+	uploadFailed prometheus.Counter
+	bytes        prometheus.CounterFunc
+	fileDuration prometheus.Histogram
+	inFlight     prometheus.Gauge
+	responses    *prometheus.CounterVec
+}
+
+func newMetrics(bytesRead func() int64) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		filesAdded: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ipfs_upload_files_added_total",
+			Help: "Number of files and directories added.",
+		}),
+		uploadFailed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ipfs_upload_failures_total",
+			Help: "Number of failed uploads.",
+		}),
+		bytes: prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ipfs_upload_bytes_total",
+			Help: "Number of file content bytes uploaded.",
+		}, func() float64 { return float64(bytesRead()) }),
+		fileDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "ipfs_upload_file_duration_seconds",
+			Help:    "Time taken to add each file, from its first event to its addition.",
+			Buckets: prometheus.ExponentialBuckets(0.005, 4, 10),
+		}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ipfs_upload_requests_in_flight",
+			Help: "Number of API requests in progress.",
+		}),
+		responses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ipfs_upload_http_responses_total",
+			Help: "Number of API responses by HTTP status code.",
+		}, []string{"code"}),
+	}
+	m.registry.MustRegister(
+		m.filesAdded,
+		m.uploadFailed,
+		m.bytes,
+		m.fileDuration,
+		m.inFlight,
+		m.responses,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// watchConcurrency exports the requests allowed in flight of --concurrency
+// auto.
+func (m *metrics) watchConcurrency(limit func() int) {
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ipfs_upload_concurrency",
+		Help: "Number of API requests allowed in flight by --concurrency auto.",
+	}, func() float64 { return float64(limit()) }))
+}
+
+// Serve starts serving the metrics on addr. The returned function stops the
+// server.
+func (m *metrics) Serve(addr string) (func(), error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	srv := &http.Server{Handler: mux}
+	go func() { _ = srv.Serve(listener) }()
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	}, nil
+}
+
+// metricsTransport records in-flight requests and response status codes.
+type metricsTransport struct {
+	base    http.RoundTripper
+	metrics *metrics
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.metrics.inFlight.Inc()
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		t.metrics.inFlight.Dec()
+		return nil, err
+	}
+	t.metrics.responses.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
+
+	// the request is in flight until its response is fully read
+	resp.Body = &inFlightBody{ReadCloser: resp.Body, done: t.metrics.inFlight.Dec}
+	return resp, nil
+}
+
+type inFlightBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *inFlightBody) Close() error {
+	b.once.Do(b.done)
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+const (
+	notifyAttempts = 3
+	notifyTimeout  = 10 * time.Second
+)
+
+// runSummary describes the outcome of a run, it is the payload of the
+// completion webhook and the data of --notify-template.
+type runSummary struct {
+	Status       string `json:"status"`
+	ExitCode     int    `json:"exit_code"`
+	Error        string `json:"error,omitempty"`
+	Root         string `json:"root,omitempty"`
+	MetadataRoot string `json:"metadata_root,omitempty"`
+	Files        int    `json:"files"`
+	Thumbnails   int    `json:"thumbnails,omitempty"`
+	Previews     int    `json:"previews,omitempty"`
+	// SkippedIDs are the tokens left out by --skip-ids, SkippedHidden the
+	// hidden files and directories left out unless --ignore-hidden=false,
+	// SkippedFiltered the files of --include, --exclude and .ipfsignore
+	SkippedIDs      int    `json:"skipped_ids,omitempty"`
+	SkippedHidden   int    `json:"skipped_hidden,omitempty"`
+	SkippedFiltered int    `json:"skipped_filtered,omitempty"`
+	ContractURI     string `json:"contract_uri,omitempty"`
+	Bytes           int64  `json:"bytes"`
+	Duration        string `json:"duration"`
+	RunID           string `json:"run_id"`
+	// CacheHits are the files the --cache-file avoided uploading, and
+	// CacheHashTime the time --cache-mode hash spent hashing the files
+	CacheHits     int    `json:"cache_hits,omitempty"`
+	CacheHashTime string `json:"cache_hash_time,omitempty"`
+}
+
+// notifier posts the run summary to a webhook. A broken webhook is reported
+// but never changes the outcome of the run.
+type notifier struct {
+	client   *http.Client
+	url      string
+	template *template.Template
+	on       string
+	start    time.Time
+}
+
+func newNotifier(client *http.Client, url, templatePath, on string) (*notifier, error) {
+	switch on {
+	case "always", "success", "failure":
+	default:
+		return nil, fmt.Errorf("parameter --notify-on must be always, success or failure")
+	}
+
+	n := &notifier{client: client, url: url, on: on, start: time.Now()}
+	if templatePath != "" {
+		tmpl, err := parseTemplate(templatePath)
+		if err != nil {
+			return nil, err
+		}
+		n.template = tmpl
+	}
+	return n, nil
+}
+
+// Finish completes summary with the outcome of the run and sends it. Errors
+// are only reported on stderr. It does nothing on a nil notifier.
+func (n *notifier) Finish(summary runSummary, exitCode int, err error) {
+	if n == nil {
+		return
+	}
+
+	summary.Duration = time.Since(n.start).Round(time.Millisecond).String()
+	summary.ExitCode = exitCode
+	summary.Status = "success"
+	if exitCode != 0 {
+		summary.Status = "failure"
+	}
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	if err := n.Send(summary); err != nil {
+		logs.Info(fmt.Sprintf("notification failed: %v", err))
+	}
+}
+
+// Send posts summary, retrying a few times on failure.
+func (n *notifier) Send(summary runSummary) error {
+	if n.on != "always" && n.on != summary.Status {
+		return nil
+	}
+
+	var body bytes.Buffer
+	if n.template != nil {
+		if err := n.template.Execute(&body, summary); err != nil {
+			return err
+		}
+	} else if err := json.NewEncoder(&body).Encode(summary); err != nil {
+		return err
+	}
+
+	var err error
+	for attempt := 1; attempt <= notifyAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(time.Duration(attempt-1) * time.Second)
+		}
+		if err = n.post(body.Bytes()); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (n *notifier) post(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("webhook responded %v", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	ipfsPath "github.com/ipfs/interface-go-ipfs-core/path"
+	flag "github.com/spf13/pflag"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// pathsPrefixes are those of the flags an upload of several paths takes
+// besides the common ones, the others being of the upload of a single path.
+var pathsPrefixes = []string{"pin", "only-hash", "cid-version", "hash", "chunker", "raw-leaves", "ignore-hidden", "mock-fail-rate", "hedge-after"}
+
+// checkPathsFlags returns an error naming the first flag set which an
+// upload of several paths doesn't take.
+func checkPathsFlags(fs *flag.FlagSet) error {
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if err == nil && !hasFlagPrefix(f.Name, pathsPrefixes) && !hasFlagPrefix(f.Name, commonPrefixes) {
+			err = fmt.Errorf("parameter --%v requires a single path, upload a directory of the files instead", f.Name)
+		}
+	})
+	return err
+}
+
+// statPaths returns the FileInfo of every path, or an error if one is the
+// standard input, an S3 prefix or doesn't exist, before anything is
+// uploaded.
+func statPaths(paths []string) ([]os.FileInfo, error) {
+	stats := make([]os.FileInfo, len(paths))
+	for i, p := range paths {
+		if p == "-" || uploader.IsS3URL(p) {
+			return nil, fmt.Errorf("%v can only be uploaded on its own", p)
+		}
+		stat, err := os.Lstat(p)
+		if err != nil {
+			return nil, err
+		}
+		stats[i] = stat
+	}
+	return stats, nil
+}
+
+// uploadPaths uploads every path on its own, like ipfs add with several
+// paths, writing the CID and the path of each to w once uploaded. A path
+// lagging behind the others is uploaded a second time in parallel by
+// hedger, if not nil. It stops at the first failure.
+func uploadPaths(ctx context.Context, up *uploader.Uploader, paths []string, stats []os.FileInfo, includeHidden bool, hedger *uploader.Hedger, w io.Writer) error {
+	for i, p := range paths {
+		var roots [2]ipfsPath.Resolved
+		winner, hedged, err := hedger.Do(ctx, func(ctx context.Context, attempt int) error {
+			node, err := uploader.NewFileNode(p, includeHidden, stats[i])
+			if err != nil {
+				return err
+			}
+			defer node.Close()
+			roots[attempt], _, err = up.Add(ctx, node, nil)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("%v: %w", p, err)
+		}
+		res := roots[winner]
+		if hedged {
+			logs.Info(fmt.Sprintf("Added %v, hedged by a second upload which completed first: %v", p, winner == 1), "path", p, "cid", res.Cid(), "hedged", true, "hedge_won", winner == 1)
+		} else {
+			logs.Info(fmt.Sprintf("Added %v", p), "path", p, "cid", res.Cid())
+		}
+		_, _ = fmt.Fprintf(w, "%v %v\n", res.Cid(), p)
+	}
+	return nil
+}
+
+// runUploadPaths runs upload with several paths, each uploaded on its own.
+func runUploadPaths(o *commonOptions) error {
+	if err := checkPathsFlags(flag.CommandLine); err != nil {
+		return &usageError{err.Error()}
+	}
+	stats, err := statPaths(o.args)
+	if err != nil {
+		return &usageError{err.Error()}
+	}
+	ctx, cancel := signalContext()
+	defer cancel()
+	var hedger *uploader.Hedger
+	if *hedgeAfter != "" {
+		policy, err := parseHedgeAfter(*hedgeAfter)
+		if err != nil {
+			return &usageError{err.Error()}
+		}
+		// the paths being uploaded one by one, a hedge always has a slot
+		hedger = uploader.NewHedger(policy, 1)
+	}
+	up, _, err := o.newUploaderFromFlags(ctx)
+	if err != nil {
+		return err
+	}
+	return uploadPaths(ctx, up, o.args, stats, !*ignoreHidden, hedger, os.Stdout)
+}
@@ -0,0 +1,143 @@
+package uploader
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writerEnv makes TestWriteFileAtomicKilled run as the process writing the
+// file of the variable until it is killed.
+const writerEnv = "IPFS_UPLOAD_TEST_WRITER"
+
+// atomicVersion is the content of the version v of the file written.
+func atomicVersion(v int) []byte {
+	return bytes.Repeat([]byte{byte('a' + v%26)}, 4<<20)
+}
+
+// checkVersion fails unless the file at path is one complete version, and
+// returns it.
+func checkVersion(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 4<<20 || !bytes.Equal(data, atomicVersion(int(data[0]-'a'))) {
+		t.Fatalf("the file has %v bytes, not a complete version", len(data))
+	}
+	return data
+}
+
+// tempFiles returns the temporary files WriteFileAtomic left next to path.
+func tempFiles(t *testing.T, path string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-upload-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "manifest.csv")
+
+	for v := 0; v < 3; v++ {
+		if err := WriteFileAtomic(path, atomicVersion(v)); err != nil {
+			t.Fatal(err)
+		}
+		if data := checkVersion(t, path); data[0] != byte('a'+v) {
+			t.Fatalf("the version %c was read back, want %c", data[0], 'a'+v)
+		}
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode().Perm() != 0644 {
+		t.Errorf("the file has the mode %v, want 0644", stat.Mode().Perm())
+	}
+
+	// a failing rename, onto a directory which isn't empty, leaves no
+	// temporary file
+	blocked := filepath.Join(writeTestFiles(t, map[string]string{"blocked/file": "x"}), "blocked")
+	if err := WriteFileAtomic(blocked, atomicVersion(0)); err == nil {
+		t.Fatal("the rename onto a directory didn't fail")
+	}
+	if tmp := tempFiles(t, blocked); len(tmp) > 0 {
+		t.Errorf("the failed write left %q", tmp)
+	}
+	// a missing directory fails before anything is written
+	if err := WriteFileAtomic(filepath.Join(dir, "missing", "file"), atomicVersion(0)); err == nil {
+		t.Error("the write into a missing directory didn't fail")
+	}
+	if tmp := tempFiles(t, path); len(tmp) > 0 {
+		t.Errorf("the writes left %q", tmp)
+	}
+}
+
+func TestWriteFileAtomicKilled(t *testing.T) {
+	if path := os.Getenv(writerEnv); path != "" {
+		// write versions in a loop, telling the test once the first one is
+		// written
+		for v := 0; ; v++ {
+			if err := WriteFileAtomic(path, atomicVersion(v)); err != nil {
+				os.Exit(1)
+			}
+			if v == 0 {
+				os.Stdout.WriteString("written\n")
+			}
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "ipfs-upload-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "manifest.csv")
+
+	// kill the writer at points spread over the write, sync and rename of
+	// a version
+	for round := 0; round < 10; round++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestWriteFileAtomicKilled$")
+		cmd.Env = append(os.Environ(), writerEnv+"="+path)
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bufio.NewReader(stdout).ReadString('\n'); err != nil {
+			t.Fatalf("round %v: the writer exited: %v", round, err)
+		}
+		time.Sleep(time.Duration(round) * 3 * time.Millisecond)
+		if err := cmd.Process.Kill(); err != nil {
+			t.Fatal(err)
+		}
+		_ = cmd.Wait()
+
+		checkVersion(t, path)
+	}
+
+	// the temporary files of the writes killed are left, but don't stand in
+	// the way of the next write
+	t.Logf("the writers killed left %v temporary files", len(tempFiles(t, path)))
+	if err := WriteFileAtomic(path, atomicVersion(25)); err != nil {
+		t.Fatal(err)
+	}
+	if data := checkVersion(t, path); data[0] != 'z' {
+		t.Errorf("the version %c was read back after the kills, want z", data[0])
+	}
+}
@@ -0,0 +1,148 @@
+package uploader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	ipfsFiles "github.com/ipfs/go-ipfs-files"
+	httpapi "github.com/ipfs/go-ipfs-http-client"
+	caopts "github.com/ipfs/interface-go-ipfs-core/options"
+	ipfsPath "github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+// ErrUnsupported is returned by the operations the service of the Uploader
+// doesn't offer, e.g. listing the pins of a service without the IPFS API.
+var ErrUnsupported = errors.New("not supported by the provider")
+
+// Backend is how an Uploader stores and pins on the service of its
+// Provider: the IPFS API of Infura, Filebase or a node of your own, the
+// upload API of Pinata, or the CAR uploads of web3.storage and NFT.Storage.
+// Options.Backend replaces it for the services of your own.
+type Backend interface {
+	// Check makes a cheap authenticated request to the service, returning
+	// its version if known, for Preflight
+	Check(ctx context.Context) (string, error)
+	// Upload stores node and returns its root, sending to events the
+	// *coreiface.AddEvent of every file and directory as the add of the
+	// IPFS API does, of github.com/ipfs/interface-go-ipfs-core, without
+	// closing it
+	Upload(ctx context.Context, node ipfsFiles.Node, events chan<- interface{}) (ipfsPath.Resolved, error)
+	// Pin pins c, fetching it if the service doesn't have it, and Unpin
+	// removes its pin
+	Pin(ctx context.Context, c cid.Cid) error
+	Unpin(ctx context.Context, c cid.Cid) error
+}
+
+// newBackend returns the Backend of the provider of opts, requests going
+// through client with headers.
+func newBackend(opts Options, client *http.Client, headers http.Header, dag dagSettings) (Backend, error) {
+	switch opts.Provider.Backend {
+	case BackendPinata:
+		if err := checkServiceDAG(opts.Provider, opts.DAG); err != nil {
+			return nil, err
+		}
+		return &pinataBackend{url: strings.TrimRight(opts.API, "/"), client: client, headers: headers, dag: dag}, nil
+	case BackendCAR:
+		if err := opts.DAG.Validate(true); err != nil {
+			return nil, err
+		}
+		return &carBackend{provider: opts.Provider, url: strings.TrimRight(opts.API, "/"), client: client, headers: headers, dag: dag}, nil
+	}
+	api, err := httpapi.NewURLApiWithClient(opts.API, client)
+	if err != nil {
+		return nil, err
+	}
+	api.Headers = headers
+	return &ipfsBackend{api: api, url: strings.TrimRight(opts.API, "/"), client: client, dag: dag, rawLeavesSet: opts.DAG.RawLeaves != nil, pin: opts.Pin}, nil
+}
+
+// ipfsBackend stores with the IPFS API.
+type ipfsBackend struct {
+	api          *httpapi.HttpApi
+	url          string
+	client       *http.Client
+	dag          dagSettings
+	rawLeavesSet bool
+	pin          bool
+}
+
+func (b *ipfsBackend) Check(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.url+"/api/v0/version", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header = b.api.Headers.Clone()
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return "", preflightError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return "", fmt.Errorf("unexpected response to the preflight check: %v", resp.Status)
+	}
+
+	var version struct {
+		Version string
+	}
+	// some endpoints answer with an empty or non-JSON body, that's fine
+	_ = json.NewDecoder(resp.Body).Decode(&version)
+	return version.Version, nil
+}
+
+func (b *ipfsBackend) Upload(ctx context.Context, node ipfsFiles.Node, events chan<- interface{}) (ipfsPath.Resolved, error) {
+	opts := append(b.dag.addOptions(b.rawLeavesSet), caopts.Unixfs.Pin(b.pin), caopts.Unixfs.Progress(true), caopts.Unixfs.Events(events))
+	return b.api.Unixfs().Add(ctx, node, opts...)
+}
+
+func (b *ipfsBackend) Pin(ctx context.Context, c cid.Cid) error {
+	return b.api.Request("pin/add", c.String()).Exec(ctx, nil)
+}
+
+func (b *ipfsBackend) Unpin(ctx context.Context, c cid.Cid) error {
+	return b.api.Request("pin/rm", c.String()).Exec(ctx, nil)
+}
+
+// checkServiceDAG returns an error if the service of provider, storing
+// with an API of its own, can't build the DAG of opts, as it only takes
+// the CID version.
+func checkServiceDAG(provider Provider, opts DAGOptions) error {
+	defaults, _ := DAGOptions{CidVersion: opts.CidVersion}.settings()
+	s, err := opts.settings()
+	if err != nil {
+		return err
+	}
+	if s.hash != defaults.hash || (s.chunker != "" && s.chunker != "size-262144") || s.rawLeaves != defaults.rawLeaves {
+		return fmt.Errorf("%v only takes the CID version of the DAG, not its hash function, chunker or raw leaves", provider.Name)
+	}
+	return nil
+}
+
+// ServiceError is a failure reported by the API of a service other than
+// the IPFS API, classed by its status by ErrorClass.
+type ServiceError struct {
+	Service    string
+	StatusCode int
+	Message    string
+}
+
+func (e *ServiceError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%v: %v", e.Service, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("%v: %v (%v)", e.Service, e.Message, e.StatusCode)
+}
+
+// serviceError returns the ServiceError of the response of service failing
+// with its status, its message being the body.
+func serviceError(service string, resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return &ServiceError{Service: service, StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+}
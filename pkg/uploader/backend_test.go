@@ -0,0 +1,106 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackends(t *testing.T) {
+	fake := NewFakeAPI(0)
+	defer fake.Close()
+	files := writeTestFiles(t, map[string]string{"nft/1.png": "one", "nft/2.png": "two", "nft/sub/3.png": "three"})
+
+	for _, name := range []string{"pinata", "web3storage", "nftstorage"} {
+		for _, path := range []string{"nft", "nft/sub/3.png"} {
+			t.Run(name+" "+path, func(t *testing.T) {
+				provider, err := LookupProvider(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				p := filepath.Join(files, filepath.FromSlash(path))
+				stat, err := os.Stat(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				node, err := NewFileNode(p, false, stat)
+				if err != nil {
+					t.Fatal(err)
+				}
+				up, err := New(Options{API: fake.URL, Provider: provider, ProjectSecret: "token", DAG: DAGOptions{CidVersion: 1}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := up.Preflight(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+				want, err := up.HashOnly(context.Background(), node)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if node, err = NewFileNode(p, false, stat); err != nil {
+					t.Fatal(err)
+				}
+				res, added, err := up.Add(context.Background(), node, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !res.Cid().Equals(want) || !added[""].Equals(want) {
+					t.Errorf("the root is %v, want %v", res.Cid(), want)
+				}
+				if pins := fake.Pins(); len(pins) == 0 {
+					t.Error("nothing was pinned")
+				}
+
+				err = up.Unpin(context.Background(), want)
+				if provider.Backend == BackendCAR {
+					if !errors.Is(err, ErrUnsupported) {
+						t.Errorf("unpinning on %v returned %v, want ErrUnsupported", name, err)
+					}
+				} else if err != nil {
+					t.Errorf("unpinning on %v: %v", name, err)
+				}
+				if _, err := up.Pins(context.Background()); !errors.Is(err, ErrUnsupported) {
+					t.Errorf("listing the pins on %v returned %v, want ErrUnsupported", name, err)
+				}
+			})
+		}
+	}
+}
+
+func TestBackendDAG(t *testing.T) {
+	provider, _ := LookupProvider("pinata")
+	if _, err := New(Options{Provider: provider, API: provider.API, DAG: DAGOptions{CidVersion: 1}}); err != nil {
+		t.Errorf("pinata refused the CID version: %v", err)
+	}
+	if _, err := New(Options{Provider: provider, API: provider.API, DAG: DAGOptions{Chunker: "size-1024"}}); err == nil {
+		t.Error("pinata took a chunker")
+	}
+}
+
+func TestServiceError(t *testing.T) {
+	fake := NewFakeAPI(1)
+	defer fake.Close()
+	provider, _ := LookupProvider("nftstorage")
+	up, err := New(Options{API: fake.URL, Provider: provider, ProjectSecret: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := writeTestFiles(t, map[string]string{"1.png": "one"})
+	p := filepath.Join(dir, "1.png")
+	stat, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := NewFileNode(p, false, stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = up.Add(context.Background(), node, nil)
+	var serviceErr *ServiceError
+	if !errors.As(err, &serviceErr) || serviceErr.StatusCode != 500 || ErrorClass(err) != ClassServer {
+		t.Errorf("the upload returned %v of class %v, want a ServiceError of class server", err, ErrorClass(err))
+	}
+}
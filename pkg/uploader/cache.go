@@ -0,0 +1,399 @@
+package uploader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/INFURA/ipfs-upload-client/internal/strip"
+)
+
+// cacheVersion is the version of the cache file written, the files of
+// other versions being ignored.
+const cacheVersion = 1
+
+// Modes of the cache: the files are unchanged if their size and
+// modification time are, or if their SHA-256 is.
+const (
+	CacheModeMtime = "mtime"
+	CacheModeHash  = "hash"
+)
+
+// Cache is the cache file, the CIDs of the files and directories
+// uploaded before by upload settings and absolute path, valid as long as
+// their size and modification time, or their SHA-256, don't change.
+type Cache struct {
+	Version int `json:"version"`
+	// Uploads are the entries by CacheSettings and absolute path
+	Uploads map[string]map[string]*CacheEntry `json:"uploads"`
+}
+
+// CacheEntry is the upload of a file or directory.
+type CacheEntry struct {
+	CID     string    `json:"cid"`
+	Size    int64     `json:"size,omitempty"`
+	ModTime time.Time `json:"mtime"`
+	// SHA256 is the hash of the file as uploaded, if hashed
+	SHA256 string `json:"sha256,omitempty"`
+	// Listing is the fingerprint of the files of a directory, see
+	// CacheListing, and Dirs the CIDs of its subdirectories by relative path
+	Listing string            `json:"listing,omitempty"`
+	Dirs    map[string]string `json:"dirs,omitempty"`
+}
+
+// CacheSettings returns the key of the uploads to endpoint with the
+// settings changing their CIDs or their availability, dag being the DAG
+// options differing from the defaults.
+func CacheSettings(endpoint string, pinned, stripped bool, dag string) string {
+	key := fmt.Sprintf("%v pin=%v strip=%v", endpoint, pinned, stripped)
+	if dag != "" {
+		key += " " + dag
+	}
+	return key
+}
+
+// DefaultCacheFile returns the path of the cache file in the cache
+// directory of the user.
+func DefaultCacheFile() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "ipfs-upload-client", "cids.json"), nil
+}
+
+// ReadCache reads the cache file at path, an empty cache if it doesn't
+// exist. A cache which can't be read is an error the caller ignores, the
+// files being uploaded again.
+func ReadCache(path string) (*Cache, error) {
+	cache := &Cache{Version: cacheVersion, Uploads: make(map[string]map[string]*CacheEntry)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return cache, err
+	}
+	var read Cache
+	if err := json.Unmarshal(data, &read); err != nil {
+		return cache, fmt.Errorf("%v: %v", path, err)
+	}
+	if read.Version != cacheVersion || read.Uploads == nil {
+		return cache, fmt.Errorf("%v is not a version %v cache file", path, cacheVersion)
+	}
+	return &read, nil
+}
+
+// CacheListing are the files of an upload as cached: their size and
+// modification time by relative path, their SHA-256 in hash mode, and the
+// fingerprint of them all, empty for a file.
+type CacheListing struct {
+	Root   string
+	Files  map[string]os.FileInfo
+	Hashes map[string]string
+	Dirs   []string
+}
+
+// ListContent lists the files of the upload of path without the hidden
+// files unless includeHidden and the excluded local paths, like
+// HashContent without reading them.
+func ListContent(path string, stat os.FileInfo, includeHidden bool, excluded map[string]bool) (*CacheListing, error) {
+	listing := &CacheListing{Files: make(map[string]os.FileInfo)}
+	if !stat.IsDir() {
+		listing.Files[""] = stat
+		return listing, nil
+	}
+
+	err := Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == path {
+			return nil
+		}
+		if (!includeHidden && strings.HasPrefix(info.Name(), ".")) || excluded[filepath.Clean(p)] {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			listing.Dirs = append(listing.Dirs, rel)
+			return nil
+		}
+		listing.Files[rel] = info
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	listing.fingerprint(stat)
+	return listing, nil
+}
+
+// fingerprint sets the Root of a directory from the size and the
+// modification time or hash of its files.
+func (l *CacheListing) fingerprint(stat os.FileInfo) {
+	if !stat.IsDir() {
+		return
+	}
+	var lines []string
+	for _, rel := range l.Dirs {
+		lines = append(lines, rel+"/")
+	}
+	for rel, info := range l.Files {
+		if l.Hashes != nil {
+			lines = append(lines, fmt.Sprintf("%v\t%v\t%v", rel, info.Size(), l.Hashes[rel]))
+		} else {
+			lines = append(lines, fmt.Sprintf("%v\t%v\t%v", rel, info.Size(), info.ModTime().UnixNano()))
+		}
+	}
+	sort.Strings(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	l.Root = hex.EncodeToString(sum[:])
+}
+
+// Hash sets the SHA-256 of the files of the upload of the local path
+// listed by l, of their content without the image metadata if stripped,
+// using up to workers goroutines, and returns the number of files hashed.
+// The hash cached with settings is reused for the files whose size and
+// modification time didn't change.
+func (l *CacheListing) Hash(ctx context.Context, c *Cache, settings, path string, stat os.FileInfo, stripped bool, workers int) (int, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return 0, err
+	}
+	entries := c.Uploads[settings]
+	l.Hashes = make(map[string]string)
+	var mu sync.Mutex
+	hashed := 0
+	g, gctx := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, workers)
+
+dispatch:
+	for rel, info := range l.Files {
+		local := filepath.Join(abs, filepath.FromSlash(rel))
+		if e, ok := entries[local]; ok && e.SHA256 != "" && e.unchanged(info) {
+			l.Hashes[rel] = e.SHA256
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-gctx.Done():
+			break dispatch
+		}
+		rel := rel
+		g.Go(func() error {
+			defer func() { <-sem }()
+			sum, err := HashFile(local, stripped && strip.Supported(local))
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			l.Hashes[rel] = sum
+			hashed++
+			mu.Unlock()
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return 0, err
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	l.fingerprint(stat)
+	return hashed, nil
+}
+
+// unchanged reports whether e is the upload of a file of info, by its
+// modification time.
+func (e *CacheEntry) unchanged(info os.FileInfo) bool {
+	return e.Size == info.Size() && e.ModTime.Equal(info.ModTime())
+}
+
+// matches reports whether e is the upload of the file rel of l, by its
+// hash in hash mode.
+func (e *CacheEntry) matches(l *CacheListing, rel string) bool {
+	if l.Hashes != nil {
+		return e.Size == l.Files[rel].Size() && e.SHA256 != "" && e.SHA256 == l.Hashes[rel]
+	}
+	return e.unchanged(l.Files[rel])
+}
+
+// Lookup returns the CIDs of the upload of the local path listed by
+// listing with settings, the root and the files and directories by name,
+// or an undefined root if anything changed since.
+func (c *Cache) Lookup(settings, path string, listing *CacheListing) (cid.Cid, map[string]cid.Cid) {
+	entries := c.Uploads[settings]
+	abs, err := filepath.Abs(path)
+	if err != nil || entries == nil {
+		return cid.Undef, nil
+	}
+	root, ok := entries[abs]
+	if !ok {
+		return cid.Undef, nil
+	}
+	if listing.Root == "" {
+		if !root.matches(listing, "") {
+			return cid.Undef, nil
+		}
+	} else if root.Listing != listing.Root {
+		return cid.Undef, nil
+	}
+	rootCID, err := cid.Decode(root.CID)
+	if err != nil {
+		return cid.Undef, nil
+	}
+
+	added := map[string]cid.Cid{"": rootCID}
+	for rel := range listing.Files {
+		if rel == "" {
+			continue
+		}
+		e, ok := entries[filepath.Join(abs, filepath.FromSlash(rel))]
+		if !ok || !e.matches(listing, rel) {
+			return cid.Undef, nil
+		}
+		if added[rel], err = cid.Decode(e.CID); err != nil {
+			return cid.Undef, nil
+		}
+	}
+	for _, rel := range listing.Dirs {
+		if added[rel], err = cid.Decode(root.Dirs[rel]); err != nil {
+			return cid.Undef, nil
+		}
+	}
+	return rootCID, added
+}
+
+// Record records the CIDs added by the upload of the local path listed by
+// listing with settings, replacing the entries of the files which changed.
+func (c *Cache) Record(settings, path string, listing *CacheListing, added map[string]cid.Cid) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	entries := c.Uploads[settings]
+	if entries == nil {
+		entries = make(map[string]*CacheEntry)
+		c.Uploads[settings] = entries
+	}
+	for rel, info := range listing.Files {
+		id, ok := added[rel]
+		if !ok {
+			continue
+		}
+		entries[filepath.Join(abs, filepath.FromSlash(rel))] = &CacheEntry{CID: id.String(), Size: info.Size(), ModTime: info.ModTime(), SHA256: listing.Hashes[rel]}
+	}
+	if listing.Root != "" {
+		if id, ok := added[""]; ok {
+			e := &CacheEntry{CID: id.String(), Listing: listing.Root, Dirs: make(map[string]string)}
+			for _, rel := range listing.Dirs {
+				if d, ok := added[rel]; ok {
+					e.Dirs[rel] = d.String()
+				}
+			}
+			entries[abs] = e
+		}
+	}
+	return nil
+}
+
+// Forget removes the entries of the uploads pinned to endpoint with one of
+// the CIDs unpinned, and the entries below the directories removed, whose
+// content is no longer pinned either, so that they are uploaded again
+// rather than reused.
+func (c *Cache) Forget(endpoint string, unpinned map[cid.Cid]bool) {
+	prefix := endpoint + " pin=true "
+	for settings, entries := range c.Uploads {
+		if !strings.HasPrefix(settings, prefix) {
+			continue
+		}
+		var dirs []string
+		for abs, e := range entries {
+			if !e.unpinned(unpinned) {
+				continue
+			}
+			delete(entries, abs)
+			if e.Listing != "" {
+				dirs = append(dirs, abs+string(filepath.Separator))
+			}
+		}
+		for abs := range entries {
+			for _, dir := range dirs {
+				if strings.HasPrefix(abs, dir) {
+					delete(entries, abs)
+					break
+				}
+			}
+		}
+	}
+}
+
+// unpinned reports whether the CID of e, or of one of its subdirectories,
+// is one of unpinned.
+func (e *CacheEntry) unpinned(unpinned map[cid.Cid]bool) bool {
+	if c, err := cid.Decode(e.CID); err == nil && unpinned[c] {
+		return true
+	}
+	for _, d := range e.Dirs {
+		if c, err := cid.Decode(d); err == nil && unpinned[c] {
+			return true
+		}
+	}
+	return false
+}
+
+// ForgetUnpinned removes the CIDs unpinned from endpoint from the cache file
+// at path, if there is one.
+func ForgetUnpinned(path, endpoint string, unpinned map[cid.Cid]bool) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	return UpdateCache(path, func(c *Cache) error {
+		c.Forget(endpoint, unpinned)
+		return nil
+	})
+}
+
+// UpdateCache applies update to the cache file at path while holding its
+// lock, starting from an empty cache if it can't be read, and replaces the
+// file atomically.
+func UpdateCache(path string, update func(c *Cache) error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	unlock, err := LockFile(path+".lock", StateLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	cache, _ := ReadCache(path)
+	if err := update(cache); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, data)
+}
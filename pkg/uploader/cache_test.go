@@ -0,0 +1,68 @@
+package uploader
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// testCID returns the CID of s.
+func testCID(t *testing.T, s string) cid.Cid {
+	t.Helper()
+	hash, err := mh.Sum([]byte(s), mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cid.NewCidV0(hash)
+}
+
+func TestCacheForget(t *testing.T) {
+	root, file, other, sub := testCID(t, "root"), testCID(t, "file"), testCID(t, "other"), testCID(t, "sub")
+	dir := filepath.Join(string(filepath.Separator), "nft")
+	pinned := CacheSettings("https://api", true, false, "")
+	unpinnedSettings := CacheSettings("https://api", false, false, "")
+	newCache := func() *Cache {
+		return &Cache{Version: cacheVersion, Uploads: map[string]map[string]*CacheEntry{
+			pinned: {
+				dir:                                {CID: root.String(), Listing: "listing", Dirs: map[string]string{"sub": sub.String()}},
+				filepath.Join(dir, "1.png"):        {CID: file.String()},
+				filepath.Join(dir, "sub", "2.png"): {CID: file.String()},
+				filepath.Join(string(filepath.Separator), "other.png"): {CID: other.String()},
+			},
+			unpinnedSettings: {
+				dir: {CID: root.String(), Listing: "listing"},
+			},
+		}}
+	}
+
+	tests := []struct {
+		name     string
+		endpoint string
+		unpinned cid.Cid
+		kept     []string
+	}{
+		{"root", "https://api", root, []string{filepath.Join(string(filepath.Separator), "other.png")}},
+		{"subdirectory", "https://api", sub, []string{filepath.Join(string(filepath.Separator), "other.png")}},
+		{"file", "https://api", other, []string{dir, filepath.Join(dir, "1.png"), filepath.Join(dir, "sub", "2.png")}},
+		{"other endpoint", "https://other", root, []string{dir, filepath.Join(dir, "1.png"), filepath.Join(dir, "sub", "2.png"), filepath.Join(string(filepath.Separator), "other.png")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCache()
+			c.Forget(tt.endpoint, map[cid.Cid]bool{tt.unpinned: true})
+			if len(c.Uploads[pinned]) != len(tt.kept) {
+				t.Errorf("kept %v entries, want %v", len(c.Uploads[pinned]), tt.kept)
+			}
+			for _, abs := range tt.kept {
+				if _, ok := c.Uploads[pinned][abs]; !ok {
+					t.Errorf("%v was removed", abs)
+				}
+			}
+			if len(c.Uploads[unpinnedSettings]) != 1 {
+				t.Errorf("the entries of the uploads not pinned were removed")
+			}
+		})
+	}
+}
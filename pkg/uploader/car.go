@@ -0,0 +1,475 @@
+package uploader
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/ipfs/go-cid"
+	ipfsFiles "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	ft "github.com/ipfs/go-unixfs"
+	"github.com/ipfs/go-unixfs/importer/balanced"
+	"github.com/ipfs/go-unixfs/importer/helpers"
+	uio "github.com/ipfs/go-unixfs/io"
+	coreiface "github.com/ipfs/interface-go-ipfs-core"
+	ipfsPath "github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+// WriteCAR packs node into a CARv1 file at path, without any network,
+// and returns its root. The DAG is built like the API adds it with opts,
+// CIDv0 with 256KiB chunks and balanced files by default, so that the root
+// is the CID Add would return, except for directories large enough for a
+// node to shard them. The blocks are spooled to a temporary file next to
+// path, the CAR being renamed into place once complete.
+func WriteCAR(ctx context.Context, node ipfsFiles.Node, path string, opts DAGOptions) (cid.Cid, error) {
+	settings, err := opts.settings()
+	if err != nil {
+		return cid.Undef, err
+	}
+	spool, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".blocks")
+	if err != nil {
+		return cid.Undef, err
+	}
+	defer func() {
+		_ = spool.Close()
+		_ = os.Remove(spool.Name())
+	}()
+	dag := &carDAG{w: bufio.NewWriter(spool), written: cid.NewSet()}
+	root, err := carNode(ctx, dag, settings, "", node, nil)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if err := dag.w.Flush(); err != nil {
+		return cid.Undef, err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return cid.Undef, err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return cid.Undef, err
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+	w := bufio.NewWriter(tmp)
+	if err := writeCARSection(w, carHeader(root.Cid())); err != nil {
+		return cid.Undef, err
+	}
+	if _, err := io.Copy(w, spool); err != nil {
+		return cid.Undef, err
+	}
+	if err := w.Flush(); err != nil {
+		return cid.Undef, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return cid.Undef, err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		return cid.Undef, err
+	}
+	if err := tmp.Close(); err != nil {
+		return cid.Undef, err
+	}
+	return root.Cid(), os.Rename(tmp.Name(), path)
+}
+
+// ImportCAR uploads the CARv1 of r with dag/import, the blocks being stored
+// at once or not at all, and returns its roots, pinned if Options.Pin.
+func (u *Uploader) ImportCAR(ctx context.Context, r io.Reader) ([]cid.Cid, error) {
+	if err := u.needsIPFS("importing a CAR"); err != nil {
+		return nil, err
+	}
+	resp, err := u.api.Request("dag/import").FileBody(r).Option("pin-roots", u.opts.Pin).Send(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	var roots []cid.Cid
+	dec := json.NewDecoder(resp.Output)
+	for {
+		var out struct {
+			Root *struct {
+				Cid struct {
+					Link string `json:"/"`
+				}
+				PinErrorMsg string
+			}
+		}
+		if err := dec.Decode(&out); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if out.Root == nil {
+			continue
+		}
+		c, err := cid.Decode(out.Root.Cid.Link)
+		if err != nil {
+			return nil, fmt.Errorf("invalid root %q: %v", out.Root.Cid.Link, err)
+		}
+		if out.Root.PinErrorMsg != "" {
+			return nil, fmt.Errorf("pinning %v: %v", c, out.Root.PinErrorMsg)
+		}
+		roots = append(roots, c)
+	}
+	return roots, nil
+}
+
+// hashNode returns the root of node as Add would, building its DAG locally
+// without storing it, and sends the AddEvent of every file and directory
+// to events as the API does.
+func hashNode(ctx context.Context, node ipfsFiles.Node, settings dagSettings, events chan<- interface{}) (ipfsPath.Resolved, error) {
+	dag := &carDAG{w: bufio.NewWriter(ioutil.Discard), written: cid.NewSet()}
+	root, err := carNode(ctx, dag, settings, "", node, addEvents(events))
+	if err != nil {
+		return nil, err
+	}
+	return ipfsPath.IpfsPath(root.Cid()), nil
+}
+
+// addEvents returns the function of carNode sending the AddEvent of every
+// file and directory built to events, as the API does, or nil if events is.
+func addEvents(events chan<- interface{}) func(name string, n ipld.Node, bytes int64) {
+	if events == nil {
+		return nil
+	}
+	return func(name string, n ipld.Node, bytes int64) {
+		if bytes > 0 {
+			events <- &coreiface.AddEvent{Name: name, Bytes: bytes}
+		}
+		size, _ := n.Size()
+		events <- &coreiface.AddEvent{Name: name, Path: ipfsPath.IpfsPath(n.Cid()), Bytes: bytes, Size: strconv.FormatUint(size, 10)}
+	}
+}
+
+// carNode adds node, named name below the root, to dag as settings build
+// it and returns its DAG node, calling added if not nil with every file and
+// directory once built and the bytes read of the files.
+func carNode(ctx context.Context, dag ipld.DAGService, settings dagSettings, name string, node ipfsFiles.Node, added func(name string, n ipld.Node, bytes int64)) (ipld.Node, error) {
+	var built ipld.Node
+	var bytes int64
+	switch n := node.(type) {
+	case *ipfsFiles.Symlink:
+		data, err := ft.SymlinkData(n.Target)
+		if err != nil {
+			return nil, err
+		}
+		link := merkledag.NodeWithData(data)
+		link.SetCidBuilder(settings.builder())
+		built = link
+		if err := dag.Add(ctx, built); err != nil {
+			return nil, err
+		}
+	case ipfsFiles.File:
+		defer n.Close()
+		counted := &countingReader{r: n}
+		splitter, err := settings.splitter(counted)
+		if err != nil {
+			return nil, err
+		}
+		params := helpers.DagBuilderParams{Dagserv: dag, Maxlinks: helpers.DefaultLinksPerBlock, RawLeaves: settings.rawLeaves, CidBuilder: settings.builder()}
+		db, err := params.New(splitter)
+		if err != nil {
+			return nil, err
+		}
+		if built, err = balanced.Layout(db); err != nil {
+			return nil, err
+		}
+		bytes = counted.n
+	case ipfsFiles.Directory:
+		dir := uio.NewDirectory(dag)
+		dir.SetCidBuilder(settings.builder())
+		it := n.Entries()
+		for it.Next() {
+			child, err := carNode(ctx, dag, settings, path.Join(name, it.Name()), it.Node(), added)
+			if err != nil {
+				return nil, err
+			}
+			if err := dir.AddChild(ctx, it.Name(), child); err != nil {
+				return nil, err
+			}
+		}
+		if it.Err() != nil {
+			return nil, it.Err()
+		}
+		var err error
+		if built, err = dir.GetNode(); err != nil {
+			return nil, err
+		}
+		if err := dag.Add(ctx, built); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported node %T", node)
+	}
+	if added != nil {
+		added(name, built, bytes)
+	}
+	return built, nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// carDAG is a write-only DAGService writing the blocks added as CAR
+// sections, once each.
+type carDAG struct {
+	w       *bufio.Writer
+	written *cid.Set
+}
+
+func (d *carDAG) Add(ctx context.Context, node ipld.Node) error {
+	if !d.written.Visit(node.Cid()) {
+		return nil
+	}
+	return writeCARSection(d.w, append(node.Cid().Bytes(), node.RawData()...))
+}
+
+func (d *carDAG) AddMany(ctx context.Context, nodes []ipld.Node) error {
+	for _, node := range nodes {
+		if err := d.Add(ctx, node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *carDAG) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	return nil, ipld.ErrNotFound
+}
+
+func (d *carDAG) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	out := make(chan *ipld.NodeOption, len(cids))
+	for range cids {
+		out <- &ipld.NodeOption{Err: ipld.ErrNotFound}
+	}
+	close(out)
+	return out
+}
+
+func (d *carDAG) Remove(ctx context.Context, c cid.Cid) error {
+	return errors.New("the blocks of a CAR can't be removed")
+}
+
+func (d *carDAG) RemoveMany(ctx context.Context, cids []cid.Cid) error {
+	return errors.New("the blocks of a CAR can't be removed")
+}
+
+// writeCARSection writes data prefixed by its length as a varint.
+func writeCARSection(w io.Writer, data []byte) error {
+	var size [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(size[:], uint64(len(data)))
+	if _, err := w.Write(size[:n]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// carHeader returns the DAG-CBOR header of a CARv1 of root:
+// {"roots": [root], "version": 1}.
+func carHeader(root cid.Cid) []byte {
+	// a CID is a byte string prefixed with 0 tagged 42
+	link := append([]byte{0}, root.Bytes()...)
+	h := []byte{0xa2, 0x65}
+	h = append(h, "roots"...)
+	h = append(h, 0x81, 0xd8, 42)
+	h = append(h, cborHead(2, uint64(len(link)))...)
+	h = append(h, link...)
+	h = append(h, 0x67)
+	h = append(h, "version"...)
+	return append(h, 0x01)
+}
+
+// cborHead returns the head of a CBOR item of the major type and argument.
+func cborHead(major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return []byte{major<<5 | byte(arg)}
+	case arg < 1<<8:
+		return []byte{major<<5 | 24, byte(arg)}
+	case arg < 1<<16:
+		return []byte{major<<5 | 25, byte(arg >> 8), byte(arg)}
+	}
+	h := []byte{major<<5 | 26, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(h[1:], uint32(arg))
+	return h
+}
+
+// CARReader reads the blocks of a CARv1.
+type CARReader struct {
+	r *bufio.Reader
+	// Roots are the roots of the header
+	Roots []cid.Cid
+}
+
+// NewCARReader reads the header of the CARv1 of r.
+func NewCARReader(r io.Reader) (*CARReader, error) {
+	cr := &CARReader{r: bufio.NewReader(r)}
+	header, err := cr.section()
+	if err == io.EOF {
+		return nil, errors.New("not a CAR: empty")
+	}
+	if err == nil {
+		cr.Roots, err = parseCARHeader(header)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("not a CAR: %v", err)
+	}
+	return cr, nil
+}
+
+// Next returns the next block, or io.EOF after the last one.
+func (cr *CARReader) Next() (cid.Cid, []byte, error) {
+	data, err := cr.section()
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+	n, c, err := cid.CidFromBytes(data)
+	if err != nil {
+		return cid.Undef, nil, fmt.Errorf("invalid block of the CAR: %v", err)
+	}
+	return c, data[n:], nil
+}
+
+// carMaxSection is the size of the largest section read, well over the
+// blocks of the API.
+const carMaxSection = 32 << 20
+
+func (cr *CARReader) section() ([]byte, error) {
+	size, err := binary.ReadUvarint(cr.r)
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 || size > carMaxSection {
+		return nil, fmt.Errorf("invalid section of %v bytes", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(cr.r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// parseCARHeader returns the roots of a CARv1 header, the DAG-CBOR map of
+// the roots and the version.
+func parseCARHeader(data []byte) ([]cid.Cid, error) {
+	major, entries, data, err := cborItem(data)
+	if err != nil || major != 5 {
+		return nil, errors.New("the header isn't a map")
+	}
+	var roots []cid.Cid
+	version := uint64(0)
+	for i := uint64(0); i < entries; i++ {
+		var key []byte
+		if key, data, err = cborText(data); err != nil {
+			return nil, err
+		}
+		switch string(key) {
+		case "version":
+			var major byte
+			if major, version, data, err = cborItem(data); err != nil || major != 0 {
+				return nil, errors.New("invalid version")
+			}
+		case "roots":
+			var major byte
+			var n uint64
+			if major, n, data, err = cborItem(data); err != nil || major != 4 {
+				return nil, errors.New("invalid roots")
+			}
+			for j := uint64(0); j < n; j++ {
+				var tag uint64
+				if major, tag, data, err = cborItem(data); err != nil || major != 6 || tag != 42 {
+					return nil, errors.New("invalid root")
+				}
+				var link []byte
+				var size uint64
+				if major, size, data, err = cborItem(data); err != nil || major != 2 || size == 0 || uint64(len(data)) < size {
+					return nil, errors.New("invalid root")
+				}
+				link, data = data[:size], data[size:]
+				c, err := cid.Cast(link[1:])
+				if err != nil {
+					return nil, fmt.Errorf("invalid root: %v", err)
+				}
+				roots = append(roots, c)
+			}
+		default:
+			return nil, fmt.Errorf("unexpected field %q", key)
+		}
+	}
+	if version != 1 {
+		return nil, fmt.Errorf("version %v, only CARv1 is supported", version)
+	}
+	return roots, nil
+}
+
+func cborText(data []byte) ([]byte, []byte, error) {
+	major, n, data, err := cborItem(data)
+	if err != nil || major != 3 || uint64(len(data)) < n {
+		return nil, nil, errors.New("invalid key")
+	}
+	return data[:n], data[n:], nil
+}
+
+// cborItem returns the major type and argument of the CBOR item of data,
+// and what follows its head.
+func cborItem(data []byte) (byte, uint64, []byte, error) {
+	if len(data) == 0 {
+		return 0, 0, nil, io.ErrUnexpectedEOF
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+	size := 0
+	switch {
+	case info < 24:
+		return major, uint64(info), data, nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, nil, errors.New("indefinite lengths aren't DAG-CBOR")
+	}
+	if len(data) < size {
+		return 0, 0, nil, io.ErrUnexpectedEOF
+	}
+	var arg uint64
+	for _, b := range data[:size] {
+		arg = arg<<8 | uint64(b)
+	}
+	return major, arg, data[size:], nil
+}
@@ -0,0 +1,111 @@
+package uploader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/ipfs/go-cid"
+	ipfsFiles "github.com/ipfs/go-ipfs-files"
+	ipfsPath "github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+// MaxCARUpload is the largest CAR the services of BackendCAR take in a
+// request.
+const MaxCARUpload = 100 << 20
+
+// carBackend stores with the CAR uploads of web3.storage and NFT.Storage,
+// the DAG being built locally and packed into a CAR spooled to a temporary
+// file, whose root the service is to store. They don't pin by CID.
+type carBackend struct {
+	provider Provider
+	url      string
+	client   *http.Client
+	headers  http.Header
+	dag      dagSettings
+}
+
+func (b *carBackend) Check(ctx context.Context) (string, error) {
+	resp, err := doService(ctx, b.client, b.provider.Name, http.MethodGet, b.url+b.provider.CheckPath, b.headers, "", nil)
+	if err != nil {
+		return "", preflightError(err)
+	}
+	_ = resp.Body.Close()
+	return "", nil
+}
+
+func (b *carBackend) Upload(ctx context.Context, node ipfsFiles.Node, events chan<- interface{}) (ipfsPath.Resolved, error) {
+	spool, err := ioutil.TempFile("", "ipfs-upload-*.car")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = spool.Close()
+		_ = os.Remove(spool.Name())
+	}()
+	dag := &carDAG{w: bufio.NewWriter(spool), written: cid.NewSet()}
+	root, err := carNode(ctx, dag, b.dag, "", node, addEvents(events))
+	if err != nil {
+		return nil, err
+	}
+	if err := dag.w.Flush(); err != nil {
+		return nil, err
+	}
+	blocks, err := spool.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	var header bytes.Buffer
+	if err := writeCARSection(&header, carHeader(root.Cid())); err != nil {
+		return nil, err
+	}
+	if size := int64(header.Len()) + blocks; size > MaxCARUpload {
+		return nil, fmt.Errorf("the CAR of the upload is %v bytes, %v takes up to %v in a request, upload fewer files at once", size, b.provider.Name, MaxCARUpload)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	resp, err := doService(ctx, b.client, b.provider.Name, http.MethodPost, b.url+b.provider.UploadPath, b.headers, "application/vnd.ipld.car", io.MultiReader(&header, spool))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	// web3.storage answers {"cid": ...}, NFT.Storage {"ok": true, "value": {"cid": ...}}
+	var out struct {
+		Cid   string
+		Value struct {
+			Cid string
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("%v: invalid response: %v", b.provider.Name, err)
+	}
+	stored := out.Cid
+	if stored == "" {
+		stored = out.Value.Cid
+	}
+	c, err := cid.Decode(stored)
+	if err != nil {
+		return nil, fmt.Errorf("%v: invalid CID %q: %v", b.provider.Name, stored, err)
+	}
+	// the services may answer with the CIDv1 of the root
+	if !bytes.Equal(c.Hash(), root.Cid().Hash()) {
+		return nil, fmt.Errorf("%v stored the root %v, not the %v of the CAR", b.provider.Name, c, root.Cid())
+	}
+	return ipfsPath.IpfsPath(root.Cid()), nil
+}
+
+func (b *carBackend) Pin(ctx context.Context, c cid.Cid) error {
+	return fmt.Errorf("pinning %v on %v: %w", c, b.provider.Name, ErrUnsupported)
+}
+
+func (b *carBackend) Unpin(ctx context.Context, c cid.Cid) error {
+	return fmt.Errorf("unpinning %v on %v: %w", c, b.provider.Name, ErrUnsupported)
+}
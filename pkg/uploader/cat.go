@@ -0,0 +1,45 @@
+package uploader
+
+import (
+	"context"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	ipfsFiles "github.com/ipfs/go-ipfs-files"
+	caopts "github.com/ipfs/interface-go-ipfs-core/options"
+)
+
+// Cat returns the content of the file c on the API, or ErrNotFound if the
+// API doesn't have it. The caller closes it.
+func (u *Uploader) Cat(ctx context.Context, c cid.Cid) (io.ReadCloser, error) {
+	if err := u.needsIPFS("reading a file"); err != nil {
+		return nil, err
+	}
+	resp, err := u.api.Request("cat", c.String()).Send(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		_ = resp.Close()
+		return nil, notFoundError(resp.Error)
+	}
+	return resp.Output, nil
+}
+
+// HashOnly returns the CID node gets when added by Add, without storing
+// nor pinning it, built locally if the service stores with an API of its
+// own.
+func (u *Uploader) HashOnly(ctx context.Context, node ipfsFiles.Node) (cid.Cid, error) {
+	if u.api == nil {
+		res, err := hashNode(ctx, node, u.dag, nil)
+		if err != nil {
+			return cid.Undef, err
+		}
+		return res.Cid(), nil
+	}
+	res, err := u.api.Unixfs().Add(ctx, node, caopts.Unixfs.HashOnly(true), caopts.Unixfs.Pin(false))
+	if err != nil {
+		return cid.Undef, err
+	}
+	return res.Cid(), nil
+}
@@ -0,0 +1,331 @@
+package uploader
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	ipfsFiles "github.com/ipfs/go-ipfs-files"
+
+	"github.com/INFURA/ipfs-upload-client/internal/strip"
+)
+
+// checksumHeader are the columns of the checksums CSV file, files written
+// before the stripped column have only the first four
+var checksumHeader = []string{"path", "size", "cid", "sha256", "stripped"}
+
+// Checksum is the SHA-256 of a file computed while uploading it.
+type Checksum struct {
+	Path   string // local path
+	Size   int64
+	Cid    cid.Cid
+	SHA256 string
+	// Stripped reports whether the metadata of the image was stripped
+	// before uploading, which the checksum is of
+	Stripped bool
+}
+
+// Checksummer hashes the files of the upload as they are read, so that they
+// aren't read twice.
+type Checksummer struct {
+	mu   sync.Mutex
+	sums map[string]*Checksum
+}
+
+// NewChecksummer returns a Checksummer without checksums.
+func NewChecksummer() *Checksummer {
+	return &Checksummer{sums: make(map[string]*Checksum)}
+}
+
+// Wrap returns node, read from the local path, with every regular file
+// below it hashed.
+func (c *Checksummer) Wrap(node ipfsFiles.Node, path string) ipfsFiles.Node {
+	switch n := node.(type) {
+	case *ipfsFiles.Symlink:
+		return n
+	case ipfsFiles.Directory:
+		return &checksumDirectory{Directory: n, checksummer: c, path: path}
+	case ipfsFiles.File:
+		return &checksumFile{File: n, checksummer: c, path: path, hash: sha256.New()}
+	default:
+		return n
+	}
+}
+
+// SetCIDs sets the CIDs of the files uploaded from the local path root
+// from the CIDs added by name.
+func (c *Checksummer) SetCIDs(root string, added map[string]cid.Cid) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for name, id := range added {
+		if sum, ok := c.sums[filepath.Join(root, filepath.FromSlash(name))]; ok {
+			sum.Cid = id
+		}
+	}
+}
+
+// Write writes the checksums as CSV to path, sorted by path.
+func (c *Checksummer) Write(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sums := make([]*Checksum, 0, len(c.sums))
+	for _, sum := range c.sums {
+		sums = append(sums, sum)
+	}
+	return WriteChecksums(path, sums)
+}
+
+// WriteChecksums writes sums as a checksums CSV file to path, sorted by
+// path.
+func WriteChecksums(path string, sums []*Checksum) error {
+	sort.Slice(sums, func(i, j int) bool { return sums[i].Path < sums[j].Path })
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	_ = w.Write(checksumHeader)
+	for _, sum := range sums {
+		id := ""
+		if sum.Cid.Defined() {
+			id = sum.Cid.String()
+		}
+		_ = w.Write([]string{sum.Path, strconv.FormatInt(sum.Size, 10), id, sum.SHA256, strconv.FormatBool(sum.Stripped)})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, buf.Bytes())
+}
+
+type checksumFile struct {
+	ipfsFiles.File
+	checksummer *Checksummer
+	path        string
+	hash        hash.Hash
+	size        int64
+}
+
+func (f *checksumFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.hash.Write(p[:n])
+	f.size += int64(n)
+	if err == io.EOF {
+		// only files read entirely have a checksum
+		sum := &Checksum{Path: f.path, Size: f.size, SHA256: hex.EncodeToString(f.hash.Sum(nil))}
+		if stripped, ok := f.File.(*strip.File); ok {
+			sum.Stripped = stripped.Stripped
+		}
+		f.checksummer.mu.Lock()
+		f.checksummer.sums[f.path] = sum
+		f.checksummer.mu.Unlock()
+	}
+	return n, err
+}
+
+type checksumDirectory struct {
+	ipfsFiles.Directory
+	checksummer *Checksummer
+	path        string
+}
+
+func (d *checksumDirectory) Entries() ipfsFiles.DirIterator {
+	return &checksumIterator{DirIterator: d.Directory.Entries(), checksummer: d.checksummer, path: d.path}
+}
+
+type checksumIterator struct {
+	ipfsFiles.DirIterator
+	checksummer *Checksummer
+	path        string
+}
+
+func (it *checksumIterator) Node() ipfsFiles.Node {
+	return it.checksummer.Wrap(it.DirIterator.Node(), filepath.Join(it.path, it.Name()))
+}
+
+// VerifyChecksums hashes the files listed in the checksums CSV file at path
+// again and returns the ones which changed or are missing.
+func VerifyChecksums(path string) (changed []string, total int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading %v: %v", path, err)
+	}
+	if !IsChecksumHeader(header) {
+		return nil, 0, fmt.Errorf("%v is not a --checksums file", path)
+	}
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("reading %v: %v", path, err)
+		}
+		total++
+
+		stripped := len(record) > 4 && record[4] == "true"
+		sum, err := HashFile(record[0], stripped)
+		if err != nil {
+			changed = append(changed, fmt.Sprintf("%v: %v", record[0], err))
+		} else if sum != record[3] {
+			changed = append(changed, fmt.Sprintf("%v: the SHA-256 changed", record[0]))
+		}
+	}
+	return changed, total, nil
+}
+
+// IsChecksumHeader reports whether header is the header of a checksums
+// file, with or without the stripped column.
+func IsChecksumHeader(header []string) bool {
+	if len(header) != len(checksumHeader) && len(header) != len(checksumHeader)-1 {
+		return false
+	}
+	for i, name := range header {
+		if name != checksumHeader[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// HashFile returns the hex encoded SHA-256 of the file at path, of its
+// content without the image metadata if stripped.
+func HashFile(path string, stripped bool) (string, error) {
+	if stripped {
+		data, err := strip.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:]), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ReadChecksums reads the rows of a checksums CSV file, with or without
+// a CID.
+func ReadChecksums(path string) ([]*Checksum, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading %v: %v", path, err)
+	}
+	if !IsChecksumHeader(header) {
+		return nil, fmt.Errorf("%v is not a --checksums file", path)
+	}
+
+	var sums []*Checksum
+	for row := 2; ; row++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %v: %v", path, err)
+		}
+		sum := &Checksum{Path: record[0], SHA256: record[3], Stripped: len(record) > 4 && record[4] == "true"}
+		if sum.Size, err = strconv.ParseInt(record[1], 10, 64); err != nil {
+			return nil, fmt.Errorf("%v row %v: invalid size %q", path, row, record[1])
+		}
+		if record[2] != "" {
+			if sum.Cid, err = cid.Decode(record[2]); err != nil {
+				return nil, fmt.Errorf("%v row %v: invalid CID %q", path, row, record[2])
+			}
+		}
+		sums = append(sums, sum)
+	}
+	return sums, nil
+}
+
+// ReadRecordedCIDs reads the CIDs of a checksums CSV file by local path.
+func ReadRecordedCIDs(path string) (map[string]cid.Cid, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading %v: %v", path, err)
+	}
+	if !IsChecksumHeader(header) {
+		return nil, fmt.Errorf("%v is not a --checksums file", path)
+	}
+
+	recorded := make(map[string]cid.Cid)
+	for row := 2; ; row++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %v: %v", path, err)
+		}
+		if record[2] == "" {
+			continue
+		}
+		c, err := cid.Decode(record[2])
+		if err != nil {
+			return nil, fmt.Errorf("%v row %v: invalid CID %q", path, row, record[2])
+		}
+		recorded[filepath.Clean(record[0])] = c
+	}
+	return recorded, nil
+}
+
+// CIDsUnder returns the recorded CIDs of the files under the local path
+// root by name relative to root, like the upload of root reports them.
+func CIDsUnder(recorded map[string]cid.Cid, root string) map[string]cid.Cid {
+	root = filepath.Clean(root)
+	cids := make(map[string]cid.Cid)
+	for path, c := range recorded {
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if rel == "." {
+			rel = ""
+		}
+		cids[filepath.ToSlash(rel)] = c
+	}
+	return cids
+}
@@ -0,0 +1,127 @@
+package uploader
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	"github.com/ipfs/go-merkledag"
+	caopts "github.com/ipfs/interface-go-ipfs-core/options"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// DAGOptions are how the files are chunked and hashed into their DAG, the
+// defaults of the API when zero: CIDv0, SHA2-256 and 256KiB chunks.
+type DAGOptions struct {
+	// CidVersion is 0 or 1, 1 being implied by a Hash other than sha2-256
+	CidVersion int
+	// Hash is the name of the multihash function, e.g. blake2b-256,
+	// sha2-256 if empty
+	Hash string
+	// Chunker is the chunker of the API, e.g. size-1048576, rabin or
+	// buzhash, size-262144 if empty
+	Chunker string
+	// RawLeaves stores the data of the files in raw blocks, if not nil,
+	// the API defaulting to raw leaves with CIDv1 only
+	RawLeaves *bool
+}
+
+// dagSettings are DAGOptions with their defaults resolved.
+type dagSettings struct {
+	version   int
+	hash      uint64
+	chunker   string
+	rawLeaves bool
+}
+
+// settings returns the DAG of o as the API builds it, or an error if the
+// options are invalid.
+func (o DAGOptions) settings() (dagSettings, error) {
+	s := dagSettings{version: o.CidVersion, hash: mh.SHA2_256, chunker: o.Chunker}
+	if o.Hash != "" {
+		code, ok := mh.Names[strings.ToLower(o.Hash)]
+		if !ok {
+			return s, fmt.Errorf("unknown hash function %q", o.Hash)
+		}
+		s.hash = code
+	}
+	if s.version != 0 && s.version != 1 {
+		return s, fmt.Errorf("unknown CID version %v", s.version)
+	}
+	// CIDv0 can only be SHA2-256
+	if s.hash != mh.SHA2_256 {
+		s.version = 1
+	}
+	s.rawLeaves = s.version == 1
+	if o.RawLeaves != nil {
+		s.rawLeaves = *o.RawLeaves
+	}
+	return s, nil
+}
+
+// String returns the options differing from the defaults, e.g.
+// cid-version=1 raw-leaves=true, or an empty string.
+func (o DAGOptions) String() string {
+	var parts []string
+	if o.CidVersion != 0 {
+		parts = append(parts, fmt.Sprintf("cid-version=%v", o.CidVersion))
+	}
+	if o.Hash != "" && o.Hash != "sha2-256" {
+		parts = append(parts, "hash="+o.Hash)
+	}
+	if o.Chunker != "" && o.Chunker != "size-262144" {
+		parts = append(parts, "chunker="+o.Chunker)
+	}
+	if o.RawLeaves != nil {
+		parts = append(parts, fmt.Sprintf("raw-leaves=%v", *o.RawLeaves))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Validate returns an error if the options are invalid, or if local is
+// set and the DAG can't be built locally, as with WriteCAR and
+// Options.OnlyHash.
+func (o DAGOptions) Validate(local bool) error {
+	s, err := o.settings()
+	if err != nil {
+		return err
+	}
+	if _, err := s.splitter(strings.NewReader("")); err != nil {
+		if !local && strings.HasPrefix(s.chunker, "buzhash") {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// addOptions returns the options of add on the API.
+func (s dagSettings) addOptions(rawLeavesSet bool) []caopts.UnixfsAddOption {
+	opts := []caopts.UnixfsAddOption{caopts.Unixfs.CidVersion(s.version), caopts.Unixfs.Hash(s.hash)}
+	if s.chunker != "" {
+		opts = append(opts, caopts.Unixfs.Chunker(s.chunker))
+	}
+	if rawLeavesSet {
+		opts = append(opts, caopts.Unixfs.RawLeaves(s.rawLeaves))
+	}
+	return opts
+}
+
+// builder returns the builder of the CIDs of the nodes.
+func (s dagSettings) builder() cid.Builder {
+	prefix, _ := merkledag.PrefixForCidVersion(s.version)
+	prefix.MhType = s.hash
+	prefix.MhLength = -1
+	return prefix
+}
+
+// splitter returns the chunker of r, buzhash being only chunked by the
+// API.
+func (s dagSettings) splitter(r io.Reader) (chunker.Splitter, error) {
+	if strings.HasPrefix(s.chunker, "buzhash") {
+		return nil, fmt.Errorf("the %v chunker can only be used by the API", s.chunker)
+	}
+	return chunker.FromString(r, s.chunker)
+}
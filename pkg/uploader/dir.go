@@ -0,0 +1,204 @@
+package uploader
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	ipfsFiles "github.com/ipfs/go-ipfs-files"
+)
+
+// readDirBatch is the number of directory entries read at once.
+const readDirBatch = 1024
+
+// NewFileNode returns the node of the file or directory at path, with the
+// hidden files below it if includeHidden is set, as ipfsFiles.NewSerialFile
+// does. Unlike ipfsFiles.NewSerialFile, directories
+// are read in batches as the upload goes rather than listed and sorted up
+// front, so that a directory of hundreds of thousands of files starts
+// uploading at once without holding their FileInfo. The entries of each
+// batch are uploaded sorted by name, the same from one run to the next, and
+// the order doesn't change the CIDs.
+func NewFileNode(path string, includeHidden bool, stat os.FileInfo) (ipfsFiles.Node, error) {
+	if stat.IsDir() {
+		return &streamDirectory{path: path, stat: stat, includeHidden: includeHidden}, nil
+	}
+	return ipfsFiles.NewSerialFile(path, includeHidden, stat)
+}
+
+type streamDirectory struct {
+	path          string
+	stat          os.FileInfo
+	includeHidden bool
+}
+
+func (d *streamDirectory) Entries() ipfsFiles.DirIterator {
+	return &streamIterator{path: d.path, includeHidden: d.includeHidden}
+}
+
+func (d *streamDirectory) Close() error {
+	return nil
+}
+
+// Size returns the size of the files below the directory.
+func (d *streamDirectory) Size() (int64, error) {
+	var size int64
+	err := Walk(d.path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != d.path && !d.includeHidden && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+func (d *streamDirectory) Stat() os.FileInfo {
+	return d.stat
+}
+
+// streamIterator reads the directory readDirBatch entries at a time.
+type streamIterator struct {
+	path          string
+	includeHidden bool
+	dir           *os.File
+	batch         []os.FileInfo
+	done          bool
+
+	name string
+	node ipfsFiles.Node
+	err  error
+}
+
+func (it *streamIterator) Name() string {
+	return it.name
+}
+
+func (it *streamIterator) Node() ipfsFiles.Node {
+	return it.node
+}
+
+func (it *streamIterator) Next() bool {
+	for {
+		if len(it.batch) == 0 && !it.fill() {
+			return false
+		}
+		stat := it.batch[0]
+		it.batch = it.batch[1:]
+		if !it.includeHidden && strings.HasPrefix(stat.Name(), ".") {
+			continue
+		}
+
+		node, err := NewFileNode(filepath.Join(it.path, stat.Name()), it.includeHidden, stat)
+		if err != nil {
+			it.fail(err)
+			return false
+		}
+		it.name, it.node = stat.Name(), node
+		return true
+	}
+}
+
+// fill reads the next batch of entries, returning false at the end of the
+// directory or on failure.
+func (it *streamIterator) fill() bool {
+	if it.done {
+		return false
+	}
+	if it.dir == nil {
+		dir, err := os.Open(it.path)
+		if err != nil {
+			it.fail(err)
+			return false
+		}
+		it.dir = dir
+	}
+	batch, err := it.dir.Readdir(readDirBatch)
+	if err == io.EOF || (err == nil && len(batch) == 0) {
+		it.fail(nil)
+		return false
+	}
+	if err != nil {
+		it.fail(err)
+		return false
+	}
+	sortByName(batch)
+	it.batch = batch
+	return true
+}
+
+// sortByName sorts a batch of directory entries by name, the order of the
+// file system changing from one file system to another.
+func sortByName(batch []os.FileInfo) {
+	sort.Slice(batch, func(i, j int) bool { return batch[i].Name() < batch[j].Name() })
+}
+
+func (it *streamIterator) fail(err error) {
+	it.err = err
+	it.done = true
+	it.batch = nil
+	if it.dir != nil {
+		_ = it.dir.Close()
+		it.dir = nil
+	}
+}
+
+func (it *streamIterator) Err() error {
+	return it.err
+}
+
+// Walk is like filepath.Walk, but reads the directories readDirBatch
+// entries at a time and calls fn with each batch sorted by name instead of
+// listing and sorting every directory first.
+func Walk(root string, fn filepath.WalkFunc) error {
+	info, err := os.Lstat(root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+	err = walk(root, info, fn)
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func walk(path string, info os.FileInfo, fn filepath.WalkFunc) error {
+	if err := fn(path, info, nil); err != nil || !info.IsDir() {
+		return err
+	}
+	dir, err := os.Open(path)
+	if err != nil {
+		return fn(path, info, err)
+	}
+	defer dir.Close()
+
+	for {
+		batch, err := dir.Readdir(readDirBatch)
+		sortByName(batch)
+		for _, child := range batch {
+			err := walk(filepath.Join(path, child.Name()), child, fn)
+			if err == filepath.SkipDir && child.IsDir() {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || (err == nil && len(batch) == 0) {
+			return nil
+		}
+		if err != nil {
+			return fn(path, info, err)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	cmds "github.com/ipfs/go-ipfs-cmds"
+	httpapi "github.com/ipfs/go-ipfs-http-client"
+)
+
+// DefaultEventBuffer is the number of events buffered for Options.Events
+// when Options.EventBuffer is 0.
+const DefaultEventBuffer = 1024
+
+// Error classes of FileFailed. ClassTimeout, ClassConnect,
+// ClassRateLimited and ClassServer are transient, see Transient.
+const (
+	ClassCanceled    = "canceled"
+	ClassTimeout     = "timeout"
+	ClassConnect     = "connect"
+	ClassRateLimited = "rate_limited"
+	ClassForbidden   = "forbidden"
+	ClassClient      = "client"
+	ClassServer      = "server"
+	ClassOther       = "other"
+)
+
+// Events receives the events of the uploads. Event is called on a
+// goroutine of its own, one event at a time in the order they happened.
+type Events interface {
+	Event(e Event)
+}
+
+// EventsFunc is a function receiving the events.
+type EventsFunc func(e Event)
+
+// Event calls f(e).
+func (f EventsFunc) Event(e Event) {
+	f(e)
+}
+
+// Event is one of FileStarted, FileProgress, FileCompleted, FileFailed and
+// RunCompleted.
+type Event interface {
+	event()
+}
+
+// FileStarted is sent when the upload of a file or directory starts. Name
+// is relative to the uploaded directory, empty for the uploaded directory
+// or file itself.
+type FileStarted struct {
+	Name string
+}
+
+// FileProgress is sent as the content of a file is uploaded. Bytes is the
+// number of bytes of the file uploaded so far. The FileProgress events are
+// dropped when the buffer is full.
+type FileProgress struct {
+	Name  string
+	Bytes int64
+}
+
+// FileCompleted is sent when a file or directory is added, or by the
+// programs reusing the CID of a previous upload, Cached then being set.
+type FileCompleted struct {
+	Name string
+	Cid  cid.Cid
+	// Bytes is the number of bytes of the file uploaded, 0 for a
+	// directory, Size the size of its DAG
+	Bytes    int64
+	Size     string
+	Duration time.Duration
+	// Attempts is the number of uploads of the file, more than 1 if
+	// Options.Retry tried it again
+	Attempts int
+	// Cached is whether the CID is the one of a previous upload, the file
+	// not being uploaded again
+	Cached bool
+}
+
+// FileFailed is sent for the files in progress when the upload fails, Class
+// being one of the Class constants. Retry reports whether the upload is
+// tried again, per Options.Retry, the file then starting again.
+type FileFailed struct {
+	Name  string
+	Err   error
+	Class string
+	Retry bool
+}
+
+// RunCompleted is the last event of an upload.
+type RunCompleted struct {
+	// Root is undefined if the upload failed with Err
+	Root     cid.Cid
+	Err      error
+	Files    int
+	Bytes    int64
+	Duration time.Duration
+	// DroppedProgress is the number of FileProgress events dropped
+	DroppedProgress int
+}
+
+func (FileStarted) event()   {}
+func (FileProgress) event()  {}
+func (FileCompleted) event() {}
+func (FileFailed) event()    {}
+func (RunCompleted) event()  {}
+
+// ErrorClass returns the class of an upload error, or of an error reading
+// from S3 or of the API of a service, one of the Class constants.
+func ErrorClass(err error) string {
+	var apiErr *httpapi.Error
+	var s3Err *S3Error
+	var serviceErr *ServiceError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ClassCanceled
+	case errors.Is(err, ErrAuthFailed), errors.Is(err, ErrProxyAuthFailed):
+		return ClassForbidden
+	case IsConnectError(err):
+		return ClassConnect
+	// a request timing out, like the deadline of the upload, may succeed
+	// when tried again, unlike one canceled
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ClassTimeout
+	case errors.As(err, &apiErr):
+		switch apiErr.Code {
+		case cmds.ErrRateLimited:
+			return ClassRateLimited
+		case cmds.ErrForbidden:
+			return ClassForbidden
+		case cmds.ErrClient:
+			return ClassClient
+		}
+		return ClassServer
+	case errors.As(err, &s3Err):
+		switch {
+		case s3Err.Code == "SlowDown" || s3Err.StatusCode == http.StatusTooManyRequests:
+			return ClassRateLimited
+		case s3Err.StatusCode == http.StatusForbidden:
+			return ClassForbidden
+		case s3Err.StatusCode < http.StatusInternalServerError:
+			return ClassClient
+		}
+		return ClassServer
+	case errors.As(err, &serviceErr):
+		switch {
+		case serviceErr.StatusCode == http.StatusTooManyRequests:
+			return ClassRateLimited
+		case serviceErr.StatusCode == http.StatusForbidden:
+			return ClassForbidden
+		case serviceErr.StatusCode < http.StatusInternalServerError:
+			return ClassClient
+		}
+		return ClassServer
+	}
+	return ClassOther
+}
+
+// Transient reports whether an error of class, as returned by ErrorClass,
+// may succeed when tried again.
+func Transient(class string) bool {
+	switch class {
+	case ClassTimeout, ClassConnect, ClassRateLimited, ClassServer:
+		return true
+	}
+	return false
+}
+
+// dispatcher delivers the events to Events on a goroutine of its own, so
+// that a slow handler doesn't slow the upload down until the buffer is
+// full. Once it is, the FileProgress events are dropped and the others wait
+// for room, so that no file goes unreported.
+type dispatcher struct {
+	events  chan Event
+	done    chan struct{}
+	dropped int
+}
+
+func newDispatcher(h Events, size int) *dispatcher {
+	if size <= 0 {
+		size = DefaultEventBuffer
+	}
+	d := &dispatcher{events: make(chan Event, size), done: make(chan struct{})}
+	go func() {
+		defer close(d.done)
+		for e := range d.events {
+			h.Event(e)
+		}
+	}()
+	return d
+}
+
+func (d *dispatcher) send(e Event) {
+	if _, ok := e.(FileProgress); ok {
+		select {
+		case d.events <- e:
+		default:
+			d.dropped++
+		}
+		return
+	}
+	d.events <- e
+}
+
+// close waits for the events sent to be delivered.
+func (d *dispatcher) close() {
+	close(d.events)
+	<-d.done
+}
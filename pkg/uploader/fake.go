@@ -0,0 +1,756 @@
+package uploader
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	ipfsFiles "github.com/ipfs/go-ipfs-files"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// FakeAPI is an in-process fake of the endpoints of the IPFS API the
+// uploader uses: add, cat, pin/add, pin/ls, pin/rm, dag/import, dag/stat,
+// object/stat and version, with the /pins endpoints of the IPFS Pinning Service API pinning
+// the CIDs added, a pin request being queued until its status is first
+// polled. The CIDs are derived from the content, so that the same files
+// always get the same CIDs, but they aren't the CIDs IPFS computes, nor are
+// the sizes of their DAGs. Any credentials are accepted.
+//
+// It also fakes the APIs of the services of BackendPinata and BackendCAR,
+// for the providers pinata, web3storage and nftstorage pointed at it:
+// pinFileToIPFS, pinByHash, unpin and testAuthentication of Pinata, whose
+// CIDs are those IPFS computes, the files being kept in memory to build
+// them, and the CAR uploads of /car and /upload.
+type FakeAPI struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	rand     *rand.Rand
+	failRate float64
+	pins     map[string]bool
+	// objects are the DAGs added, by CID
+	objects map[string]fakeObject
+	// remotePins are the requests of the Pinning Service API, by ID
+	remotePins map[string]*PinStatus
+}
+
+// fakeObject is a DAG of the fake, chunked like the files added by default.
+type fakeObject struct {
+	blocks int
+	size   uint64
+	// cumulative adds to size the links of the blocks
+	cumulative uint64
+	// content is the content of a file up to fakeCatLimit, kept for cat
+	content []byte
+	kept    bool
+	isDir   bool
+}
+
+// fakeChunkSize and fakeLinkSize are the size of the chunks of the files
+// and of the links to them.
+const (
+	fakeChunkSize = 262144
+	fakeLinkSize  = 48
+)
+
+// fakeCatLimit is the size of the largest file whose content is kept.
+const fakeCatLimit = 16 << 20
+
+// fakeContent keeps what is written to it up to fakeCatLimit.
+type fakeContent struct {
+	data []byte
+	over bool
+}
+
+func (c *fakeContent) Write(p []byte) (int, error) {
+	if !c.over && len(c.data)+len(p) > fakeCatLimit {
+		c.data, c.over = nil, true
+	}
+	if !c.over {
+		c.data = append(c.data, p...)
+	}
+	return len(p), nil
+}
+
+func fakeFileObject(size int64) fakeObject {
+	chunks := int((size + fakeChunkSize - 1) / fakeChunkSize)
+	if chunks <= 1 {
+		return fakeObject{blocks: 1, size: uint64(size), cumulative: uint64(size)}
+	}
+	links := uint64(chunks * fakeLinkSize)
+	return fakeObject{blocks: chunks + 1, size: uint64(size) + links, cumulative: uint64(size) + 2*links}
+}
+
+// NewFakeAPI starts a FakeAPI failing the given fraction of the add
+// requests, e.g. 0.1, with a 500 error. The failures are drawn from a fixed
+// seed, so that a run fails the same requests every time. Close stops it.
+func NewFakeAPI(failRate float64) *FakeAPI {
+	f := &FakeAPI{rand: rand.New(rand.NewSource(1)), failRate: failRate, pins: make(map[string]bool), objects: make(map[string]fakeObject), remotePins: make(map[string]*PinStatus)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v0/version", f.version)
+	mux.HandleFunc("/api/v0/add", f.add)
+	mux.HandleFunc("/api/v0/cat", f.cat)
+	mux.HandleFunc("/api/v0/pin/add", f.pinAdd)
+	mux.HandleFunc("/api/v0/pin/ls", f.pinLs)
+	mux.HandleFunc("/api/v0/pin/rm", f.pinRm)
+	mux.HandleFunc("/api/v0/dag/import", f.dagImport)
+	mux.HandleFunc("/api/v0/dag/stat", f.dagStat)
+	mux.HandleFunc("/api/v0/object/stat", f.objectStat)
+	mux.HandleFunc("/pins", f.remotePinAdd)
+	mux.HandleFunc("/pins/", f.remotePinStatus)
+	mux.HandleFunc("/data/testAuthentication", f.pinataAuth)
+	mux.HandleFunc("/pinning/pinFileToIPFS", f.pinataUpload)
+	mux.HandleFunc("/pinning/pinByHash", f.pinataPin)
+	mux.HandleFunc("/pinning/unpin/", f.pinataUnpin)
+	mux.HandleFunc("/car", f.carUpload)
+	mux.HandleFunc("/upload", f.carUpload)
+	mux.HandleFunc("/user/uploads", f.carUploads)
+	mux.HandleFunc("/", f.carUploads)
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+// Pins returns the pinned CIDs, sorted.
+func (f *FakeAPI) Pins() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pins := make([]string, 0, len(f.pins))
+	for c := range f.pins {
+		pins = append(pins, c)
+	}
+	sort.Strings(pins)
+	return pins
+}
+
+// fakeEvent is an event of the add endpoint.
+type fakeEvent struct {
+	Name  string
+	Hash  string `json:",omitempty"`
+	Bytes int64  `json:",omitempty"`
+	Size  string `json:",omitempty"`
+}
+
+func (f *FakeAPI) version(w http.ResponseWriter, r *http.Request) {
+	fakeReply(w, http.StatusOK, map[string]string{"Version": "fake"})
+}
+
+func (f *FakeAPI) add(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	failed := f.rand.Float64() < f.failRate
+	f.mu.Unlock()
+	if failed {
+		_, _ = io.Copy(ioutil.Discard, r.Body)
+		fakeError(w, http.StatusInternalServerError, "fake failure")
+		return
+	}
+
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	reader := multipart.NewReader(r.Body, params["boundary"])
+
+	var events []fakeEvent
+	// dirs are the names and CIDs of the entries of every directory
+	dirs := make(map[string][]string)
+	objects := make(map[string]fakeObject)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fakeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		// Part.FileName drops the directories of the name
+		_, disposition, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		name, err := url.QueryUnescape(disposition["filename"])
+		if err != nil {
+			fakeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if part.Header.Get("Content-Type") == "application/x-directory" {
+			dirs[name] = nil
+			continue
+		}
+		// the files are hashed as they are read, as large as they may be
+		h := sha256.New()
+		content := &fakeContent{}
+		size, err := io.Copy(io.MultiWriter(h, content), part)
+		if err != nil {
+			fakeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		c := fakeCID(h.Sum(nil))
+		o := fakeFileObject(size)
+		o.content, o.kept = content.data, !content.over
+		objects[c] = o
+		// the progress of the file, all at once
+		if progress, _ := strconv.ParseBool(r.URL.Query().Get("progress")); progress && size > 0 {
+			events = append(events, fakeEvent{Name: name, Bytes: size})
+		}
+		events = append(events, fakeEvent{Name: name, Hash: c, Size: strconv.FormatInt(size, 10)})
+		// a single file is uploaded without a directory
+		if name != "" {
+			parent := fakeParent(name)
+			dirs[parent] = append(dirs[parent], name+" "+c)
+		}
+	}
+
+	// the deepest directories first, for their parents to include them
+	names := make([]string, 0, len(dirs))
+	for name := range dirs {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		di, dj := fakeDepth(names[i]), fakeDepth(names[j])
+		if di != dj {
+			return di > dj
+		}
+		return names[i] < names[j]
+	})
+	for _, name := range names {
+		entries := dirs[name]
+		sort.Strings(entries)
+		sum := sha256.Sum256([]byte("dir\n" + strings.Join(entries, "\n")))
+		c := fakeCID(sum[:])
+		dir := fakeObject{blocks: 1, size: uint64(len(entries) * fakeLinkSize), isDir: true}
+		dir.cumulative = dir.size
+		for _, entry := range entries {
+			child := objects[entry[strings.LastIndex(entry, " ")+1:]]
+			dir.blocks += child.blocks
+			dir.size += child.size
+			dir.cumulative += child.cumulative
+		}
+		objects[c] = dir
+		events = append(events, fakeEvent{Name: name, Hash: c, Size: "0"})
+		if name != "" {
+			parent := fakeParent(name)
+			dirs[parent] = append(dirs[parent], name+" "+c)
+		}
+	}
+
+	f.mu.Lock()
+	for c, o := range objects {
+		f.objects[c] = o
+	}
+	f.mu.Unlock()
+	if pin, _ := strconv.ParseBool(r.URL.Query().Get("pin")); pin {
+		f.mu.Lock()
+		for _, e := range events {
+			if e.Hash != "" {
+				f.pins[e.Hash] = true
+			}
+		}
+		f.mu.Unlock()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Chunked-Output", "1")
+	enc := json.NewEncoder(w)
+	for _, e := range events {
+		_ = enc.Encode(e)
+	}
+}
+
+// pinAdd pins the CIDs added, the fake having no network to fetch the
+// others from.
+func (f *FakeAPI) pinAdd(w http.ResponseWriter, r *http.Request) {
+	args := r.URL.Query()["arg"]
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, arg := range args {
+		if _, ok := f.objects[arg]; !ok {
+			fakeError(w, http.StatusInternalServerError, "fake: "+arg+" wasn't added and the fake has no network")
+			return
+		}
+	}
+	for _, arg := range args {
+		f.pins[arg] = true
+	}
+	fakeReply(w, http.StatusOK, map[string][]string{"Pins": args})
+}
+
+func (f *FakeAPI) pinLs(w http.ResponseWriter, r *http.Request) {
+	keys := make(map[string]map[string]string)
+	pins := f.Pins()
+	// the pins of the arguments only, like the real endpoint
+	if args := r.URL.Query()["arg"]; len(args) > 0 {
+		pinned := make(map[string]bool)
+		for _, c := range pins {
+			pinned[c] = true
+		}
+		for _, arg := range args {
+			if !pinned[arg] {
+				fakeError(w, http.StatusInternalServerError, fmt.Sprintf("path '%v' is not pinned", arg))
+				return
+			}
+		}
+		pins = args
+	}
+	for _, c := range pins {
+		keys[c] = map[string]string{"Type": "recursive"}
+	}
+	fakeReply(w, http.StatusOK, map[string]interface{}{"Keys": keys})
+}
+
+func (f *FakeAPI) pinRm(w http.ResponseWriter, r *http.Request) {
+	args := r.URL.Query()["arg"]
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, arg := range args {
+		if !f.pins[arg] {
+			fakeError(w, http.StatusInternalServerError, "not pinned or pinned indirectly")
+			return
+		}
+	}
+	for _, arg := range args {
+		delete(f.pins, arg)
+	}
+	fakeReply(w, http.StatusOK, map[string][]string{"Pins": args})
+}
+
+// object returns the DAG of the argument of r, replying with the error of
+// the API if it wasn't added.
+func (f *FakeAPI) object(w http.ResponseWriter, r *http.Request) (fakeObject, bool) {
+	arg := r.URL.Query().Get("arg")
+	f.mu.Lock()
+	o, ok := f.objects[arg]
+	f.mu.Unlock()
+	if !ok {
+		fakeError(w, http.StatusInternalServerError, "block was not found locally (offline): ipld: could not find "+arg)
+	}
+	return o, ok
+}
+
+// dagImport stores the blocks of the CARs of the request, the roots of
+// their size, and pins the roots unless pin-roots is false. Unlike add, the
+// CIDs are those of the CARs, and the content of the files isn't kept.
+func (f *FakeAPI) dagImport(w http.ResponseWriter, r *http.Request) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	reader := multipart.NewReader(r.Body, params["boundary"])
+	objects := make(map[string]fakeObject)
+	var roots []string
+	var blocks int
+	var size uint64
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fakeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		partRoots, partBlocks, partSize, err := fakeReadCAR(part, objects)
+		if err != nil {
+			fakeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		roots = append(roots, partRoots...)
+		blocks += partBlocks
+		size += partSize
+	}
+	if err := fakeCARRoots(roots, objects, blocks, size); err != nil {
+		fakeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	for c, o := range objects {
+		f.objects[c] = o
+	}
+	if r.URL.Query().Get("pin-roots") != "false" {
+		for _, root := range roots {
+			f.pins[root] = true
+		}
+	}
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	for _, root := range roots {
+		_ = enc.Encode(map[string]interface{}{"Root": map[string]interface{}{"Cid": map[string]string{"/": root}, "PinErrorMsg": ""}})
+	}
+}
+
+// fakeReadCAR adds the blocks of the CAR of r to objects, returning its
+// roots and the number and size of its blocks.
+func fakeReadCAR(r io.Reader, objects map[string]fakeObject) ([]string, int, uint64, error) {
+	car, err := NewCARReader(r)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	var roots []string
+	for _, root := range car.Roots {
+		roots = append(roots, root.String())
+	}
+	var blocks int
+	var size uint64
+	for {
+		c, data, err := car.Next()
+		if err == io.EOF {
+			return roots, blocks, size, nil
+		}
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		objects[c.String()] = fakeObject{blocks: 1, size: uint64(len(data)), cumulative: uint64(len(data))}
+		blocks++
+		size += uint64(len(data))
+	}
+}
+
+// fakeCARRoots gives the roots in objects the number and size of the blocks
+// of their CARs, returning an error if one is missing.
+func fakeCARRoots(roots []string, objects map[string]fakeObject, blocks int, size uint64) error {
+	for _, root := range roots {
+		if _, ok := objects[root]; !ok {
+			return fmt.Errorf("the CAR doesn't have its root %v", root)
+		}
+		objects[root] = fakeObject{blocks: blocks, size: size, cumulative: size}
+	}
+	return nil
+}
+
+func (f *FakeAPI) dagStat(w http.ResponseWriter, r *http.Request) {
+	if o, ok := f.object(w, r); ok {
+		fakeReply(w, http.StatusOK, map[string]interface{}{"Size": o.size, "NumBlocks": o.blocks})
+	}
+}
+
+func (f *FakeAPI) cat(w http.ResponseWriter, r *http.Request) {
+	o, ok := f.object(w, r)
+	switch {
+	case !ok:
+	case o.isDir:
+		fakeError(w, http.StatusInternalServerError, "this dag node is a directory")
+	case !o.kept:
+		fakeError(w, http.StatusInternalServerError, fmt.Sprintf("fake: the content of files over %v bytes isn't kept", fakeCatLimit))
+	default:
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write(o.content)
+	}
+}
+
+func (f *FakeAPI) objectStat(w http.ResponseWriter, r *http.Request) {
+	if o, ok := f.object(w, r); ok {
+		arg := r.URL.Query().Get("arg")
+		fakeReply(w, http.StatusOK, map[string]interface{}{"Hash": arg, "CumulativeSize": o.cumulative})
+	}
+}
+
+func (f *FakeAPI) remotePinAdd(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		fakeRemotePinError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED")
+		return
+	}
+	var pin struct {
+		Cid  string `json:"cid"`
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&pin); err != nil || pin.Cid == "" {
+		fakeRemotePinError(w, http.StatusBadRequest, "BAD_REQUEST")
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	status := &PinStatus{RequestID: fmt.Sprint(len(f.remotePins) + 1), Status: PinQueued, Created: time.Now().UTC(), Delegates: []string{}}
+	status.Pin.Cid, status.Pin.Name = pin.Cid, pin.Name
+	f.remotePins[status.RequestID] = status
+	fakeReply(w, http.StatusAccepted, status)
+}
+
+// remotePinStatus replies with the pin request, which is pinned once polled
+// if the CID was added, failed otherwise.
+func (f *FakeAPI) remotePinStatus(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	status, ok := f.remotePins[strings.TrimPrefix(r.URL.Path, "/pins/")]
+	if !ok {
+		fakeRemotePinError(w, http.StatusNotFound, "NOT_FOUND")
+		return
+	}
+	if status.Status == PinQueued {
+		if _, added := f.objects[status.Pin.Cid]; added {
+			status.Status = PinPinned
+		} else {
+			status.Status = PinFailed
+			status.Info = map[string]interface{}{"status_details": "fake: the CID wasn't added"}
+		}
+	}
+	fakeReply(w, http.StatusOK, status)
+}
+
+// fakeRemotePinError replies with an error the way the Pinning Service API
+// does.
+func fakeRemotePinError(w http.ResponseWriter, status int, reason string) {
+	fakeReply(w, status, map[string]interface{}{"error": map[string]string{"reason": reason}})
+}
+
+// fakeCID returns the CIDv0 of a SHA-256 digest.
+func fakeCID(digest []byte) string {
+	hash, _ := mh.Encode(digest, mh.SHA2_256)
+	return cid.NewCidV0(hash).String()
+}
+
+// fakeParent returns the directory of the multipart name, "" being the
+// root.
+func fakeParent(name string) string {
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		return name[:i]
+	}
+	return ""
+}
+
+func fakeDepth(name string) int {
+	if name == "" {
+		return 0
+	}
+	return strings.Count(name, "/") + 1
+}
+
+func fakeReply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// fakeError replies with an error the way the IPFS API does.
+func fakeError(w http.ResponseWriter, status int, message string) {
+	fakeReply(w, status, map[string]interface{}{"Message": message, "Code": 0, "Type": "error"})
+}
+
+func (f *FakeAPI) pinataAuth(w http.ResponseWriter, r *http.Request) {
+	fakeReply(w, http.StatusOK, map[string]string{"message": "Congratulations! You are communicating with the Pinata API!"})
+}
+
+// pinataUpload builds and pins the DAG of the files of the request as
+// pinFileToIPFS does, a directory when their names have one, its top
+// directory being left out.
+func (f *FakeAPI) pinataUpload(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	failed := f.rand.Float64() < f.failRate
+	f.mu.Unlock()
+	if failed {
+		_, _ = io.Copy(ioutil.Discard, r.Body)
+		fakePinataError(w, http.StatusInternalServerError, "fake failure")
+		return
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		fakePinataError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var options struct {
+		CidVersion int
+	}
+	files := make(map[string][]byte)
+	var single string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fakePinataError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			fakePinataError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if part.FormName() == "pinataOptions" {
+			if err := json.Unmarshal(data, &options); err != nil {
+				fakePinataError(w, http.StatusBadRequest, "invalid pinataOptions")
+				return
+			}
+			continue
+		}
+		_, disposition, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		name := disposition["filename"]
+		if i := strings.Index(name, "/"); i >= 0 {
+			name = name[i+1:]
+		} else {
+			single = name
+		}
+		files[name] = data
+	}
+	if len(files) == 0 {
+		fakePinataError(w, http.StatusBadRequest, "no files")
+		return
+	}
+
+	var node ipfsFiles.Node
+	if data, ok := files[single]; ok && len(files) == 1 {
+		node = ipfsFiles.NewBytesFile(data)
+	} else {
+		node = fakeTree(files, "")
+	}
+	settings, err := DAGOptions{CidVersion: options.CidVersion}.settings()
+	if err != nil {
+		fakePinataError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	root, err := hashNode(r.Context(), node, settings, nil)
+	if err != nil {
+		fakePinataError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c := root.Cid().String()
+	o := fakeObject{blocks: 1, isDir: len(files) > 1 || single == ""}
+	for _, data := range files {
+		o.size += uint64(len(data))
+	}
+	o.cumulative = o.size
+	if !o.isDir {
+		o.content, o.kept = files[single], true
+	}
+
+	f.mu.Lock()
+	f.objects[c] = o
+	f.pins[c] = true
+	f.mu.Unlock()
+	fakeReply(w, http.StatusOK, map[string]interface{}{"IpfsHash": c, "PinSize": o.size, "Timestamp": time.Now().UTC()})
+}
+
+// fakeTree returns the directory of files below dir, by their names below
+// the top directory.
+func fakeTree(files map[string][]byte, dir string) ipfsFiles.Directory {
+	entries := make(map[string]ipfsFiles.Node)
+	for name, data := range files {
+		if fakeParent(name) == dir {
+			entries[name[strings.LastIndex(name, "/")+1:]] = ipfsFiles.NewBytesFile(data)
+			continue
+		}
+		// the subdirectory of dir on the way to the file
+		prefix := ""
+		if dir != "" {
+			prefix = dir + "/"
+		}
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		sub := name[len(prefix):]
+		sub = sub[:strings.Index(sub, "/")]
+		if _, ok := entries[sub]; !ok {
+			entries[sub] = fakeTree(files, prefix+sub)
+		}
+	}
+	return ipfsFiles.NewMapDirectory(entries)
+}
+
+func (f *FakeAPI) pinataPin(w http.ResponseWriter, r *http.Request) {
+	var pin struct {
+		HashToPin string `json:"hashToPin"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&pin); err != nil || pin.HashToPin == "" {
+		fakePinataError(w, http.StatusBadRequest, "invalid hashToPin")
+		return
+	}
+	f.mu.Lock()
+	f.pins[pin.HashToPin] = true
+	f.mu.Unlock()
+	fakeReply(w, http.StatusOK, map[string]string{"hashToPin": pin.HashToPin, "status": "prechecking"})
+}
+
+func (f *FakeAPI) pinataUnpin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		fakePinataError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	c := strings.TrimPrefix(r.URL.Path, "/pinning/unpin/")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.pins[c] {
+		fakePinataError(w, http.StatusNotFound, "the current user has not pinned the cid: "+c)
+		return
+	}
+	delete(f.pins, c)
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = io.WriteString(w, "OK")
+}
+
+// fakePinataError replies with an error the way Pinata does.
+func fakePinataError(w http.ResponseWriter, status int, reason string) {
+	fakeReply(w, status, map[string]interface{}{"error": map[string]string{"reason": reason}})
+}
+
+// carUpload stores and pins the blocks of the CAR of the request, replying
+// as web3.storage does to /car and NFT.Storage to /upload.
+func (f *FakeAPI) carUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		fakeReply(w, http.StatusMethodNotAllowed, map[string]string{"message": "method not allowed"})
+		return
+	}
+	f.mu.Lock()
+	failed := f.rand.Float64() < f.failRate
+	f.mu.Unlock()
+	if failed {
+		_, _ = io.Copy(ioutil.Discard, r.Body)
+		fakeReply(w, http.StatusInternalServerError, map[string]string{"message": "fake failure"})
+		return
+	}
+
+	objects := make(map[string]fakeObject)
+	roots, blocks, size, err := fakeReadCAR(r.Body, objects)
+	if err == nil && len(roots) != 1 {
+		err = fmt.Errorf("the CAR has %v roots, not one", len(roots))
+	}
+	if err == nil {
+		err = fakeCARRoots(roots, objects, blocks, size)
+	}
+	if err != nil {
+		fakeReply(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+
+	f.mu.Lock()
+	for c, o := range objects {
+		f.objects[c] = o
+	}
+	f.pins[roots[0]] = true
+	f.mu.Unlock()
+	if r.URL.Path == "/upload" {
+		fakeReply(w, http.StatusOK, map[string]interface{}{"ok": true, "value": map[string]string{"cid": roots[0]}})
+		return
+	}
+	fakeReply(w, http.StatusOK, map[string]string{"cid": roots[0]})
+}
+
+// carUploads replies with no uploads, to the checks of web3.storage and
+// NFT.Storage.
+func (f *FakeAPI) carUploads(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" && r.URL.Path != "/user/uploads" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.URL.Path == "/" {
+		fakeReply(w, http.StatusOK, map[string]interface{}{"ok": true, "value": []interface{}{}})
+		return
+	}
+	fakeReply(w, http.StatusOK, []interface{}{})
+}
@@ -0,0 +1,139 @@
+package uploader
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// hedgeMinSamples is the files uploaded before their median is known to
+// HedgePolicy.Factor.
+const hedgeMinSamples = 3
+
+// hedgeInterval is how often a running upload is checked against its
+// HedgePolicy.
+var hedgeInterval = 100 * time.Millisecond
+
+// HedgePolicy is when an upload lagging behind the others of a run gets a
+// second attempt in parallel, the first to complete being kept. The adds
+// being idempotent by content, the second one costs the bandwidth only.
+type HedgePolicy struct {
+	// Factor of the median duration of the files of the run uploaded so
+	// far, once hedgeMinSamples are, after which an upload is hedged, e.g.
+	// 2; After is a fixed duration instead. Neither hedges nothing.
+	Factor float64
+	After  time.Duration
+}
+
+// Enabled reports whether the policy hedges anything.
+func (p HedgePolicy) Enabled() bool {
+	return p.Factor > 0 || p.After > 0
+}
+
+// Hedger hedges the uploads of a run per its policy, when one of its slots
+// is idle, recording the duration of the files it uploads.
+type Hedger struct {
+	policy HedgePolicy
+	// slots are taken by the uploads of the run, when shared with them,
+	// and by the hedges
+	slots chan struct{}
+
+	mu        sync.Mutex
+	durations []time.Duration
+}
+
+// NewHedger returns a Hedger of the uploads of a run made one after the
+// other or by workers of their own, with spare slots for the hedges.
+func NewHedger(policy HedgePolicy, spare int) *Hedger {
+	if spare < 1 {
+		spare = 1
+	}
+	return &Hedger{policy: policy, slots: make(chan struct{}, spare)}
+}
+
+// Do calls upload with 0, and with 1 for a second attempt in parallel if
+// the first lags per the policy and a slot is idle, returning the attempt
+// completed first and whether there was a second one. The other attempt is
+// canceled, and waited for. It returns the error of the first attempt if
+// both fail.
+func (h *Hedger) Do(ctx context.Context, upload func(ctx context.Context, attempt int) error) (int, bool, error) {
+	if h == nil || !h.policy.Enabled() {
+		return 0, false, upload(ctx, 0)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		attempt int
+		err     error
+	}
+	results := make(chan result, 2)
+	start := time.Now()
+	go func() { results <- result{0, upload(ctx, 0)} }()
+
+	ticker := time.NewTicker(hedgeInterval)
+	defer ticker.Stop()
+	running, hedged := 1, false
+	var firstErr error
+	winner := -1
+	for running > 0 {
+		select {
+		case r := <-results:
+			running--
+			switch {
+			case r.err == nil && winner < 0:
+				winner = r.attempt
+				h.record(time.Since(start))
+				cancel()
+			case r.attempt == 0:
+				firstErr = r.err
+			case firstErr == nil:
+				firstErr = r.err
+			}
+		case <-ticker.C:
+			if hedged || winner >= 0 || !h.due(time.Since(start)) {
+				continue
+			}
+			select {
+			case h.slots <- struct{}{}:
+			default:
+				continue
+			}
+			hedged = true
+			running++
+			go func() {
+				defer func() { <-h.slots }()
+				results <- result{1, upload(ctx, 1)}
+			}()
+		}
+	}
+	if winner < 0 {
+		return 0, hedged, firstErr
+	}
+	return winner, hedged, nil
+}
+
+// due reports whether an upload running for elapsed is to be hedged.
+func (h *Hedger) due(elapsed time.Duration) bool {
+	if h.policy.After > 0 && elapsed >= h.policy.After {
+		return true
+	}
+	if h.policy.Factor <= 0 {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.durations) < hedgeMinSamples {
+		return false
+	}
+	sorted := append([]time.Duration(nil), h.durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	median := sorted[len(sorted)/2]
+	return float64(elapsed) >= h.policy.Factor*float64(median)
+}
+
+func (h *Hedger) record(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.durations = append(h.durations, d)
+}
@@ -0,0 +1,131 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHedger(t *testing.T) {
+	defer func(interval time.Duration) { hedgeInterval = interval }(hedgeInterval)
+	hedgeInterval = time.Millisecond
+
+	// stall blocks the first attempt until canceled, the second one
+	// completing at once
+	stall := func(ctx context.Context, attempt int) error {
+		if attempt == 0 {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}
+	quick := func(ctx context.Context, attempt int) error {
+		time.Sleep(5 * time.Millisecond)
+		return nil
+	}
+	tests := []struct {
+		name   string
+		policy HedgePolicy
+		// samples are the uploads completed before, taking 5ms
+		samples int
+		// busy takes the only spare slot
+		busy       bool
+		upload     func(ctx context.Context, attempt int) error
+		wantHedged bool
+		wantWinner int
+		wantErr    bool
+	}{
+		{"after", HedgePolicy{After: 10 * time.Millisecond}, 0, false, stall, true, 1, false},
+		{"median", HedgePolicy{Factor: 2}, hedgeMinSamples, false, stall, true, 1, false},
+		{"first completes", HedgePolicy{After: time.Hour}, 0, false, quick, false, 0, false},
+		{"both fail", HedgePolicy{After: time.Millisecond}, 0, false, func(ctx context.Context, attempt int) error {
+			time.Sleep(10 * time.Millisecond)
+			return errors.New("failed")
+		}, true, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHedger(tt.policy, 1)
+			for i := 0; i < tt.samples; i++ {
+				if _, hedged, err := h.Do(context.Background(), quick); err != nil || hedged {
+					t.Fatalf("a quick upload returned %v and hedged %v", err, hedged)
+				}
+			}
+			winner, hedged, err := h.Do(context.Background(), tt.upload)
+			if (err != nil) != tt.wantErr || hedged != tt.wantHedged || winner != tt.wantWinner {
+				t.Errorf("Do returned the attempt %v, hedged %v and %v, want %v, %v and an error %v", winner, hedged, err, tt.wantWinner, tt.wantHedged, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("no idle slot", func(t *testing.T) {
+		h := NewHedger(HedgePolicy{After: time.Millisecond}, 1)
+		h.slots <- struct{}{}
+		_, hedged, err := h.Do(context.Background(), quick)
+		if err != nil || hedged {
+			t.Errorf("Do returned %v and hedged %v without an idle slot", err, hedged)
+		}
+	})
+	t.Run("median unknown", func(t *testing.T) {
+		h := NewHedger(HedgePolicy{Factor: 2}, 1)
+		_, hedged, err := h.Do(context.Background(), quick)
+		if err != nil || hedged {
+			t.Errorf("Do returned %v and hedged %v before the median is known", err, hedged)
+		}
+	})
+}
+
+func TestSyncHedge(t *testing.T) {
+	defer func(interval time.Duration) { hedgeInterval = interval }(hedgeInterval)
+	hedgeInterval = time.Millisecond
+
+	// the first add stalls until canceled, as on a slow connection
+	fake := NewFakeAPI(0)
+	defer fake.Close()
+	target, _ := url.Parse(fake.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	var once sync.Once
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stalled := false
+		if r.URL.Path == "/api/v0/add" {
+			once.Do(func() { stalled = true })
+		}
+		if stalled {
+			// the cancellation is seen once the body is read
+			_, _ = io.Copy(ioutil.Discard, r.Body)
+			<-r.Context().Done()
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer api.Close()
+
+	dir := writeTestFiles(t, map[string]string{"1.png": "one"})
+	stat, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up, err := New(Options{API: api.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Syncer{Uploader: up, Workers: 2, Hedge: HedgePolicy{After: 20 * time.Millisecond}}
+	changes, _, err := s.Diff(dir, stat, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploaded := s.Upload(context.Background(), changes)
+	r := NewSyncReport(changes, 0)
+	if len(uploaded) != 1 || r.Failed != 0 || r.Hedged != 1 || r.HedgesWon != 1 || !changes[0].Hedged || !changes[0].HedgeWon {
+		t.Errorf("uploaded %v files, the report being %+v", len(uploaded), r)
+	}
+}
@@ -0,0 +1,277 @@
+package uploader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	ipfsFiles "github.com/ipfs/go-ipfs-files"
+)
+
+// ListingEntry is a regular file of a Listing.
+type ListingEntry struct {
+	// Name is slash separated, relative to the uploaded directory
+	Name string
+	// Source is the archive and the name of the entry, e.g.
+	// collection.zip!collection/1.png, or the URL of the object
+	Source string
+	Size   int64
+}
+
+// Listing is the content of a tar or zip archive, read from its headers,
+// or of an S3 prefix.
+type Listing struct {
+	// Prefix is the top-level directory every entry is in, which is
+	// uploaded as the root, if any
+	Prefix string
+	// Files are the regular files, in the order of the archive or bucket,
+	// without the hidden ones
+	Files []ListingEntry
+	// Skipped are the entries which are neither regular files nor
+	// directories, with their type
+	Skipped []string
+
+	// sizes are the sizes of the directories by name, "" being the root
+	sizes map[string]int64
+}
+
+// archiveHeader is an entry of an archive the upload keeps.
+type archiveHeader struct {
+	// name is cleaned, without a trailing slash
+	name   string
+	entry  string
+	source string
+	dir    bool
+	size   int64
+}
+
+// cleanEntryName returns the slash separated name of an archive entry,
+// without the leading slash and ./, or an error if it leaves the archive.
+// The separators of the entries zipped on Windows are backslashes.
+func cleanEntryName(name string) (string, error) {
+	cleaned := path.Clean(strings.TrimPrefix(strings.ReplaceAll(name, "\\", "/"), "/"))
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("entry %v is outside of the archive", name)
+	}
+	return cleaned, nil
+}
+
+// archiveHidden reports whether name is or is below a hidden file, which the
+// upload skips like in directories, or the __MACOSX directory of the
+// resource forks macOS adds to zip archives.
+func archiveHidden(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") || part == "__MACOSX" {
+			return true
+		}
+	}
+	return false
+}
+
+// newListing returns the listing of the headers of the archive, or
+// bucket, at path, the single top-level directory of the entries being the
+// root if topLevel.
+func newListing(path string, headers []*archiveHeader, skipped []string, topLevel bool) (*Listing, error) {
+	listing := &Listing{Skipped: skipped, sizes: make(map[string]int64)}
+	if topLevel {
+		listing.Prefix = archivePrefix(headers)
+	}
+	seen := make(map[string]bool)
+	for _, h := range headers {
+		name := listing.rel(h.name)
+		if name == "" {
+			continue
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("%v: %v is in the archive twice", path, name)
+		}
+		seen[name] = true
+		if h.dir {
+			continue
+		}
+
+		listing.Files = append(listing.Files, ListingEntry{Name: name, Source: h.source, Size: h.size})
+		dir := strings.Split(name, "/")
+		dir = dir[:len(dir)-1]
+		for i := 0; i <= len(dir); i++ {
+			listing.sizes[strings.Join(dir[:i], "/")] += h.size
+		}
+	}
+	return listing, nil
+}
+
+// rel returns name relative to the Prefix, "" for the Prefix itself.
+func (l *Listing) rel(name string) string {
+	if name+"/" == l.Prefix {
+		return ""
+	}
+	return strings.TrimPrefix(name, l.Prefix)
+}
+
+// archivePrefix returns the top-level directory of the entries followed by
+// a slash, if they all are in the same one.
+func archivePrefix(headers []*archiveHeader) string {
+	if len(headers) == 0 {
+		return ""
+	}
+	top := strings.SplitN(headers[0].name, "/", 2)[0]
+	for _, h := range headers {
+		if h.name == top && h.dir {
+			continue
+		}
+		if !strings.HasPrefix(h.name, top+"/") {
+			return ""
+		}
+	}
+	return top + "/"
+}
+
+// tree is the directories of a listing made from the names of its files,
+// for the sources whose files can be read in any order.
+type tree struct {
+	listing *Listing
+	// entries are the entries of every directory, "" being the root
+	entries map[string][]treeEntry
+	added   map[string]bool
+}
+
+// treeEntry is a file or a directory of a tree.
+type treeEntry struct {
+	name string
+	// dir is the name of a directory, file a file
+	dir  string
+	file *lazyFile
+}
+
+func newTree(listing *Listing) *tree {
+	return &tree{listing: listing, entries: make(map[string][]treeEntry), added: make(map[string]bool)}
+}
+
+// addDir adds the directory name and its parents.
+func (t *tree) addDir(name string) {
+	if name == "" || t.added[name] {
+		return
+	}
+	t.added[name] = true
+	parent, base := splitEntryName(name)
+	t.addDir(parent)
+	t.entries[parent] = append(t.entries[parent], treeEntry{name: base, dir: name})
+}
+
+// addFile adds the file name and its parents.
+func (t *tree) addFile(name string, file *lazyFile) {
+	parent, base := splitEntryName(name)
+	t.addDir(parent)
+	t.entries[parent] = append(t.entries[parent], treeEntry{name: base, file: file})
+}
+
+func (t *tree) root() ipfsFiles.Directory {
+	return &treeDirectory{tree: t}
+}
+
+// splitEntryName returns the directory and base name of a slash separated
+// name, the directory of the root being "".
+func splitEntryName(name string) (string, string) {
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
+
+type treeDirectory struct {
+	tree *tree
+	name string
+}
+
+func (d *treeDirectory) Entries() ipfsFiles.DirIterator {
+	return &treeIterator{dir: d, index: -1}
+}
+
+func (d *treeDirectory) Close() error {
+	return nil
+}
+
+func (d *treeDirectory) Size() (int64, error) {
+	return d.tree.listing.sizes[d.name], nil
+}
+
+type treeIterator struct {
+	dir   *treeDirectory
+	index int
+	node  ipfsFiles.Node
+}
+
+func (it *treeIterator) Name() string {
+	return it.dir.tree.entries[it.dir.name][it.index].name
+}
+
+func (it *treeIterator) Node() ipfsFiles.Node {
+	return it.node
+}
+
+func (it *treeIterator) Next() bool {
+	it.index++
+	entries := it.dir.tree.entries[it.dir.name]
+	if it.index >= len(entries) {
+		return false
+	}
+	if e := entries[it.index]; e.file == nil {
+		it.node = &treeDirectory{tree: it.dir.tree, name: e.dir}
+	} else {
+		it.node = e.file
+	}
+	return true
+}
+
+func (it *treeIterator) Err() error {
+	return nil
+}
+
+// lazyFile is a file opened when first read and closed once read.
+type lazyFile struct {
+	name   string
+	size   int64
+	open   func() (io.ReadCloser, error)
+	reader io.ReadCloser
+	done   bool
+}
+
+func (f *lazyFile) Read(p []byte) (int, error) {
+	if f.done {
+		return 0, io.EOF
+	}
+	if f.reader == nil {
+		r, err := f.open()
+		if err != nil {
+			return 0, fmt.Errorf("%v: %w", f.name, err)
+		}
+		f.reader = r
+	}
+	n, err := f.reader.Read(p)
+	if err == io.EOF {
+		f.done = true
+		_ = f.Close()
+	} else if err != nil {
+		err = fmt.Errorf("%v: %w", f.name, err)
+	}
+	return n, err
+}
+
+func (f *lazyFile) Close() error {
+	if f.reader == nil {
+		return nil
+	}
+	err := f.reader.Close()
+	f.reader = nil
+	return err
+}
+
+func (f *lazyFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.New(f.name + " can't be seeked")
+}
+
+func (f *lazyFile) Size() (int64, error) {
+	return f.size, nil
+}
@@ -0,0 +1,80 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	httpapi "github.com/ipfs/go-ipfs-http-client"
+)
+
+// IsPinned reports whether c is pinned recursively on the API.
+func (u *Uploader) IsPinned(ctx context.Context, c cid.Cid) (bool, error) {
+	var out struct {
+		Keys map[string]struct {
+			Type string
+		}
+	}
+	if err := u.needsIPFS("listing the pins"); err != nil {
+		return false, err
+	}
+	err := u.api.Request("pin/ls", c.String()).Option("type", "recursive").Exec(ctx, &out)
+	var apiErr *httpapi.Error
+	if errors.As(err, &apiErr) && strings.Contains(apiErr.Message, "not pinned") {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_, ok := out.Keys[c.String()]
+	return ok, nil
+}
+
+// Pins returns the CIDs pinned recursively on the API, sorted.
+func (u *Uploader) Pins(ctx context.Context) ([]cid.Cid, error) {
+	var out struct {
+		Keys map[string]struct {
+			Type string
+		}
+	}
+	if err := u.needsIPFS("listing the pins"); err != nil {
+		return nil, err
+	}
+	if err := u.api.Request("pin/ls").Option("type", "recursive").Exec(ctx, &out); err != nil {
+		return nil, err
+	}
+	pins := make([]cid.Cid, 0, len(out.Keys))
+	for key := range out.Keys {
+		c, err := cid.Decode(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pin %q: %v", key, err)
+		}
+		pins = append(pins, c)
+	}
+	sort.Slice(pins, func(i, j int) bool { return pins[i].String() < pins[j].String() })
+	return pins, nil
+}
+
+// Pin pins c recursively on the API, which fetches it from the network if
+// it doesn't have it.
+func (u *Uploader) Pin(ctx context.Context, c cid.Cid) error {
+	return u.backend.Pin(ctx, c)
+}
+
+// Unpin removes the recursive pin of c from the API, the node then being
+// free to garbage collect its blocks.
+func (u *Uploader) Unpin(ctx context.Context, c cid.Cid) error {
+	return u.backend.Unpin(ctx, c)
+}
+
+// needsIPFS returns ErrUnsupported for op if the service doesn't store with
+// the IPFS API.
+func (u *Uploader) needsIPFS(op string) error {
+	if u.api == nil {
+		return fmt.Errorf("%v on %v: %w", op, u.opts.Provider.Name, ErrUnsupported)
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/ipfs/go-cid"
+	ipfsFiles "github.com/ipfs/go-ipfs-files"
+	ipfsPath "github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+// pinataFolder is the folder the files of a directory are uploaded to
+// Pinata in, its name not changing the CID of the directory.
+const pinataFolder = "upload"
+
+// errRequestDone stops writing the body of a request once it is answered.
+var errRequestDone = errors.New("the request was answered")
+
+// pinataBackend stores with the pinning API of Pinata, which pins what it
+// stores. Pinata only returns the root, the CIDs of the files being those
+// of the DAG built locally as the content is sent, checked against the
+// root.
+type pinataBackend struct {
+	url     string
+	client  *http.Client
+	headers http.Header
+	dag     dagSettings
+}
+
+func (b *pinataBackend) Check(ctx context.Context) (string, error) {
+	resp, err := b.do(ctx, http.MethodGet, "/data/testAuthentication", "", nil)
+	if err != nil {
+		return "", preflightError(err)
+	}
+	_ = resp.Body.Close()
+	return "", nil
+}
+
+func (b *pinataBackend) Upload(ctx context.Context, node ipfsFiles.Node, events chan<- interface{}) (ipfsPath.Resolved, error) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	type response struct {
+		root cid.Cid
+		err  error
+	}
+	answered := make(chan response, 1)
+	go func() {
+		var res response
+		defer func() { answered <- res }()
+		resp, err := b.do(ctx, http.MethodPost, "/pinning/pinFileToIPFS", mw.FormDataContentType(), pr)
+		// the DAG stops being built if the request fails before its end
+		_ = pr.CloseWithError(errRequestDone)
+		if err != nil {
+			res.err = err
+			return
+		}
+		defer resp.Body.Close()
+		var out struct {
+			IpfsHash string
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			res.err = fmt.Errorf("pinata: invalid response: %v", err)
+			return
+		}
+		if res.root, err = cid.Decode(out.IpfsHash); err != nil {
+			res.err = fmt.Errorf("pinata: invalid CID %q: %v", out.IpfsHash, err)
+		}
+	}()
+
+	options, _ := json.Marshal(map[string]interface{}{"cidVersion": b.dag.version})
+	err := mw.WriteField("pinataOptions", string(options))
+	var root ipfsPath.Resolved
+	if err == nil {
+		name := pinataFolder
+		if _, ok := node.(ipfsFiles.Directory); !ok {
+			name = "file"
+		}
+		root, err = hashNode(ctx, teeNode(node, mw, name), b.dag, events)
+	}
+	if err == nil {
+		err = mw.Close()
+	}
+	_ = pw.CloseWithError(err)
+	res := <-answered
+	switch {
+	case err != nil && !errors.Is(err, errRequestDone):
+		return nil, err
+	case res.err != nil:
+		return nil, res.err
+	case err != nil:
+		return nil, err
+	case !res.root.Equals(root.Cid()):
+		return nil, fmt.Errorf("pinata stored the root %v, not the %v built locally", res.root, root.Cid())
+	}
+	return root, nil
+}
+
+func (b *pinataBackend) Pin(ctx context.Context, c cid.Cid) error {
+	body, _ := json.Marshal(map[string]string{"hashToPin": c.String()})
+	resp, err := b.do(ctx, http.MethodPost, "/pinning/pinByHash", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (b *pinataBackend) Unpin(ctx context.Context, c cid.Cid) error {
+	resp, err := b.do(ctx, http.MethodDelete, "/pinning/unpin/"+c.String(), "", nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// do sends the request of the API at path with the body of contentType,
+// returning a ServiceError if it fails.
+func (b *pinataBackend) do(ctx context.Context, method, path, contentType string, body io.Reader) (*http.Response, error) {
+	return doService(ctx, b.client, "pinata", method, b.url+path, b.headers, contentType, body)
+}
+
+// doService sends the request of the API of service at url with headers and
+// the body of contentType, returning a ServiceError if it fails.
+func doService(ctx context.Context, client *http.Client, service, method, url string, headers http.Header, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = headers.Clone()
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		return nil, serviceError(service, resp)
+	}
+	return resp, nil
+}
+
+// teeNode returns node, named name, with the content of its files written
+// to parts of w as it is read, named by their path, in the order they are
+// read.
+func teeNode(node ipfsFiles.Node, w *multipart.Writer, name string) ipfsFiles.Node {
+	switch n := node.(type) {
+	case *ipfsFiles.Symlink:
+		return n
+	case ipfsFiles.Directory:
+		return &teeDirectory{Directory: n, w: w, name: name}
+	case ipfsFiles.File:
+		return &teeFile{File: n, w: w, name: name}
+	default:
+		return n
+	}
+}
+
+type teeFile struct {
+	ipfsFiles.File
+	w    *multipart.Writer
+	name string
+	part io.Writer
+}
+
+func (f *teeFile) Read(p []byte) (int, error) {
+	if f.part == nil {
+		part, err := f.w.CreateFormFile("file", f.name)
+		if err != nil {
+			return 0, err
+		}
+		f.part = part
+	}
+	n, err := f.File.Read(p)
+	if n > 0 {
+		if _, werr := f.part.Write(p[:n]); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+type teeDirectory struct {
+	ipfsFiles.Directory
+	w    *multipart.Writer
+	name string
+}
+
+func (d *teeDirectory) Entries() ipfsFiles.DirIterator {
+	return &teeIterator{DirIterator: d.Directory.Entries(), w: d.w, name: d.name}
+}
+
+type teeIterator struct {
+	ipfsFiles.DirIterator
+	w    *multipart.Writer
+	name string
+}
+
+func (it *teeIterator) Node() ipfsFiles.Node {
+	return teeNode(it.DirIterator.Node(), it.w, it.name+"/"+it.Name())
+}
@@ -0,0 +1,127 @@
+package uploader
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrAuthFailed is returned when the endpoint rejects the credentials
+	ErrAuthFailed = errors.New("authentication failed")
+	// ErrUnreachable is returned when the endpoint can't be reached, which
+	// may be transient
+	ErrUnreachable = errors.New("endpoint unreachable")
+	// ErrTLS is returned when the certificate of the endpoint isn't trusted,
+	// or it doesn't speak TLS, which trying again won't fix
+	ErrTLS = errors.New("TLS verification failed")
+	// ErrProxyAuthFailed is returned when the proxy rejects its credentials
+	ErrProxyAuthFailed = errors.New("proxy authentication failed")
+)
+
+// Preflight makes a cheap authenticated call to the API before anything is
+// uploaded, so that bad credentials or an unreachable endpoint fail the run
+// at once instead of once per file. It returns the version reported by the
+// endpoint, if any.
+func (u *Uploader) Preflight(ctx context.Context) (string, error) {
+	return u.backend.Check(ctx)
+}
+
+// preflightError wraps the error of the request of Preflight with ErrTLS,
+// ErrProxyAuthFailed or ErrUnreachable.
+func preflightError(err error) error {
+	if wrapped := requestError(err); wrapped != err {
+		return wrapped
+	}
+	return &sentinelError{sentinel: ErrUnreachable, err: err}
+}
+
+// requestError wraps err, failing a request of the API before it got a
+// response, with ErrTLS, ErrProxyAuthFailed or ErrUnreachable if it failed
+// to connect, and returns it as is otherwise.
+func requestError(err error) error {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var header tls.RecordHeaderError
+	switch {
+	case err == nil, errors.Is(err, ErrAuthFailed), errors.Is(err, ErrProxyAuthFailed):
+		return err
+	case errors.As(err, &unknownAuthority), errors.As(err, &hostname), errors.As(err, &invalid), errors.As(err, &header):
+		return &sentinelError{sentinel: ErrTLS, err: err}
+	// neither the transport failing to speak TLS nor the proxy refusing a
+	// CONNECT are typed errors
+	case strings.Contains(err.Error(), "server gave HTTP response to HTTPS client"):
+		return &sentinelError{sentinel: ErrTLS, err: err}
+	case strings.Contains(err.Error(), http.StatusText(http.StatusProxyAuthRequired)):
+		return &sentinelError{sentinel: ErrProxyAuthFailed, err: err}
+	case IsConnectError(err):
+		return &sentinelError{sentinel: ErrUnreachable, err: err}
+	}
+	return err
+}
+
+// sentinelError is err matching sentinel with errors.Is, besides the
+// errors it wraps.
+type sentinelError struct {
+	sentinel, err error
+}
+
+func (e *sentinelError) Error() string {
+	return e.sentinel.Error() + ": " + e.err.Error()
+}
+
+func (e *sentinelError) Is(target error) bool {
+	return target == e.sentinel
+}
+
+func (e *sentinelError) Unwrap() error {
+	return e.err
+}
+
+// authTransport fails the requests of the API refused for their
+// credentials with ErrAuthFailed or ErrProxyAuthFailed, which the API
+// client would only report as the text of the response.
+type authTransport struct {
+	base http.RoundTripper
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	var sentinel error
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		sentinel = ErrAuthFailed
+	case http.StatusProxyAuthRequired:
+		sentinel = ErrProxyAuthFailed
+	default:
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	msg := strings.TrimSpace(string(body))
+	if msg == "" {
+		msg = resp.Status
+	}
+	return nil, &sentinelError{sentinel: sentinel, err: errors.New(msg)}
+}
+
+// IsConnectError reports whether err happened while establishing a
+// connection, as opposed to during a transfer.
+func IsConnectError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	// the TLS handshake timeout isn't exported as a typed error
+	return strings.Contains(err.Error(), "TLS handshake timeout")
+}
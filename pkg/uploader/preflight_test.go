@@ -0,0 +1,99 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	ipfsFiles "github.com/ipfs/go-ipfs-files"
+)
+
+func TestPreflight(t *testing.T) {
+	fake := NewFakeAPI(0)
+	defer fake.Close()
+	unauthorized := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer unauthorized.Close()
+	untrusted := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	untrusted.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	untrusted.StartTLS()
+	defer untrusted.Close()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name   string
+		api    string
+		client *http.Client
+		want   error
+	}{
+		{"fake", fake.URL, nil, nil},
+		{"unauthorized", unauthorized.URL, nil, ErrAuthFailed},
+		{"untrusted certificate", untrusted.URL, nil, ErrTLS},
+		{"TLS to plain HTTP", "https://" + fake.Listener.Addr().String(), nil, ErrTLS},
+		{"proxy authentication", "http://ipfs.invalid", &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}, ErrProxyAuthFailed},
+		{"proxy authentication of CONNECT", "https://ipfs.invalid", &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}, ErrProxyAuthFailed},
+		{"closed", closed.URL, nil, ErrUnreachable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up, err := New(Options{API: tt.api, ProjectID: "id", ProjectSecret: "secret", HTTPClient: tt.client})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = up.Preflight(context.Background())
+			if (tt.want == nil && err != nil) || !errors.Is(err, tt.want) {
+				t.Errorf("Preflight() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddErrors(t *testing.T) {
+	unauthorized := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid project id or secret", http.StatusUnauthorized)
+	}))
+	defer unauthorized.Close()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name   string
+		api    string
+		client *http.Client
+		want   error
+		class  string
+	}{
+		{"unauthorized", unauthorized.URL, nil, ErrAuthFailed, ClassForbidden},
+		{"proxy authentication", "http://ipfs.invalid", &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}, ErrProxyAuthFailed, ClassForbidden},
+		{"closed", closed.URL, nil, ErrUnreachable, ClassConnect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up, err := New(Options{API: tt.api, ProjectID: "id", ProjectSecret: "secret", HTTPClient: tt.client})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = up.Add(context.Background(), ipfsFiles.NewBytesFile([]byte("one")), nil)
+			if !errors.Is(err, tt.want) || ErrorClass(err) != tt.class {
+				t.Errorf("Add() = %v of class %v, want %v of class %v", err, ErrorClass(err), tt.want, tt.class)
+			}
+		})
+	}
+}
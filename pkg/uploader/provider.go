@@ -0,0 +1,95 @@
+package uploader
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Provider is a service the uploader stores on, with the URL of its API,
+// how it takes the credentials and the API it stores with.
+type Provider struct {
+	Name string
+	// API is the URL of the API of the service
+	API string
+	// Auth is how the requests carry the credentials: AuthBasic for the
+	// project ID and secret, AuthBearer for the secret as a token, AuthNone
+	// for a node of your own
+	Auth string
+	// Backend is the API the content is stored with: the IPFS API if
+	// empty, BackendPinata or BackendCAR
+	Backend string
+	// UploadPath and CheckPath are the paths of the CAR uploads and of the
+	// authenticated request of Preflight on the API of BackendCAR
+	UploadPath string
+	CheckPath  string
+}
+
+// Authentications of a Provider.
+const (
+	AuthBasic  = "basic"
+	AuthBearer = "bearer"
+	AuthNone   = "none"
+)
+
+// Backends of a Provider besides the IPFS API: the pinning API of Pinata,
+// and the upload of the DAG built locally as a CAR.
+const (
+	BackendPinata = "pinata"
+	BackendCAR    = "car"
+)
+
+// Providers are the services known by name, Infura being the default.
+var Providers = map[string]Provider{
+	"infura":      {Name: "infura", API: DefaultAPI, Auth: AuthBasic},
+	"filebase":    {Name: "filebase", API: "https://rpc.filebase.io", Auth: AuthBearer},
+	"kubo":        {Name: "kubo", API: "http://127.0.0.1:5001", Auth: AuthNone},
+	"pinata":      {Name: "pinata", API: "https://api.pinata.cloud", Auth: AuthBearer, Backend: BackendPinata},
+	"web3storage": {Name: "web3storage", API: "https://api.web3.storage", Auth: AuthBearer, Backend: BackendCAR, UploadPath: "/car", CheckPath: "/user/uploads?size=1"},
+	"nftstorage":  {Name: "nftstorage", API: "https://api.nft.storage", Auth: AuthBearer, Backend: BackendCAR, UploadPath: "/upload", CheckPath: "/?limit=1"},
+}
+
+// LookupProvider returns the provider named name.
+func LookupProvider(name string) (Provider, error) {
+	if p, ok := Providers[name]; ok {
+		return p, nil
+	}
+	names := make([]string, 0, len(Providers))
+	for n := range Providers {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return Provider{}, fmt.Errorf("unknown provider %v, not one of %v", name, strings.Join(names, ", "))
+}
+
+// ProviderForURL returns the service hosting the API at the URL api, known
+// by its host, if any. Nodes of your own, as kubo, aren't.
+func ProviderForURL(api string) (Provider, bool) {
+	u, err := url.Parse(api)
+	if err != nil || u.Host == "" {
+		return Provider{}, false
+	}
+	for _, p := range Providers {
+		if p.Auth == AuthNone {
+			continue
+		}
+		if known, err := url.Parse(p.API); err == nil && strings.EqualFold(known.Hostname(), u.Hostname()) {
+			return p, true
+		}
+	}
+	return Provider{}, false
+}
+
+// authorization returns the Authorization header of the credentials, empty
+// if none.
+func (p Provider) authorization(projectID, projectSecret string) string {
+	switch p.Auth {
+	case AuthBearer:
+		return "Bearer " + projectSecret
+	case AuthNone:
+		return ""
+	default:
+		return "Basic " + BasicAuth(projectID, projectSecret)
+	}
+}
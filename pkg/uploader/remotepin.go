@@ -0,0 +1,144 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+// Statuses of a pin request of the IPFS Pinning Service API.
+const (
+	PinQueued  = "queued"
+	PinPinning = "pinning"
+	PinPinned  = "pinned"
+	PinFailed  = "failed"
+)
+
+// PinStatus is a pin request of the IPFS Pinning Service API.
+type PinStatus struct {
+	RequestID string    `json:"requestid"`
+	Status    string    `json:"status"`
+	Created   time.Time `json:"created"`
+	Pin       struct {
+		Cid  string `json:"cid"`
+		Name string `json:"name,omitempty"`
+	} `json:"pin"`
+	// Delegates are the addresses of the nodes of the service to connect
+	// to, Info what the service says of the request, e.g. why it failed
+	Delegates []string               `json:"delegates"`
+	Info      map[string]interface{} `json:"info,omitempty"`
+}
+
+// RemotePinner asks a remote service implementing the IPFS Pinning Service
+// API, https://ipfs.github.io/pinning-services-api-spec/, to pin CIDs.
+type RemotePinner struct {
+	endpoint string
+	token    string
+	client   *http.Client
+}
+
+// NewRemotePinner returns a RemotePinner of the service at endpoint, e.g.
+// https://api.pinata.cloud/psa, authenticating with the access token token.
+func NewRemotePinner(endpoint, token string, client *http.Client) *RemotePinner {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &RemotePinner{endpoint: strings.TrimRight(endpoint, "/"), token: token, client: client}
+}
+
+// Add asks the service to pin c as name, fetching it from origins, the
+// multiaddrs of nodes having it, if not empty.
+func (p *RemotePinner) Add(ctx context.Context, c cid.Cid, name string, origins []string) (PinStatus, error) {
+	pin := map[string]interface{}{"cid": c.String(), "name": name}
+	if len(origins) > 0 {
+		pin["origins"] = origins
+	}
+	body, err := json.Marshal(pin)
+	if err != nil {
+		return PinStatus{}, err
+	}
+	var status PinStatus
+	err = p.do(ctx, http.MethodPost, "/pins", body, &status)
+	return status, err
+}
+
+// Status returns the pin request of ID requestID.
+func (p *RemotePinner) Status(ctx context.Context, requestID string) (PinStatus, error) {
+	var status PinStatus
+	err := p.do(ctx, http.MethodGet, "/pins/"+url.PathEscape(requestID), nil, &status)
+	return status, err
+}
+
+// Wait polls the request status every interval until it is pinned or
+// failed, calling progress, if not nil, when its status changes.
+func (p *RemotePinner) Wait(ctx context.Context, status PinStatus, interval time.Duration, progress func(PinStatus)) (PinStatus, error) {
+	for status.Status != PinPinned && status.Status != PinFailed {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return status, ctx.Err()
+		}
+		next, err := p.Status(ctx, status.RequestID)
+		if err != nil {
+			return status, err
+		}
+		if next.Status != status.Status && progress != nil {
+			progress(next)
+		}
+		status = next
+	}
+	return status, nil
+}
+
+func (p *RemotePinner) do(ctx context.Context, method, path string, body []byte, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, p.endpoint+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return ErrAuthFailed
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		// the errors of the API have a reason and details, e.g.
+		// INSUFFICIENT_FUNDS and the message for the humans
+		var failure struct {
+			Error struct {
+				Reason  string `json:"reason"`
+				Details string `json:"details"`
+			} `json:"error"`
+		}
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(data, &failure) == nil && failure.Error.Reason != "" {
+			if failure.Error.Details != "" {
+				return fmt.Errorf("%v: %v: %v", resp.Status, failure.Error.Reason, failure.Error.Details)
+			}
+			return fmt.Errorf("%v: %v", resp.Status, failure.Error.Reason)
+		}
+		return fmt.Errorf("%v: %v", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,33 @@
+package uploader
+
+import "time"
+
+// DefaultBackoff is the wait of RetryPolicy before the second attempt when
+// its Backoff is 0.
+const DefaultBackoff = time.Second
+
+// RetryPolicy is how many times an upload failing transiently, by the
+// Transient class of its error, is tried again and how long apart.
+type RetryPolicy struct {
+	// Attempts is the most uploads of a file or directory, 1 if 0
+	Attempts int
+	// Backoff is the wait before the second attempt, doubled before every
+	// other one, DefaultBackoff if 0
+	Backoff time.Duration
+}
+
+func (p RetryPolicy) attempts() int {
+	if p.Attempts < 1 {
+		return 1
+	}
+	return p.Attempts
+}
+
+// backoff returns the wait after the failed attempt, counting from 1.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := p.Backoff
+	if backoff <= 0 {
+		backoff = DefaultBackoff
+	}
+	return backoff << uint(attempt-1)
+}
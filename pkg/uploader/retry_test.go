@@ -0,0 +1,179 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyAPI fails the first fails uploads of the fake API with status, and
+// counts the uploads.
+type flakyAPI struct {
+	*httptest.Server
+	mu    sync.Mutex
+	adds  int
+	fails int
+}
+
+func newFlakyAPI(t *testing.T, fails, status int) *flakyAPI {
+	fake := NewFakeAPI(0)
+	t.Cleanup(fake.Close)
+	target, _ := url.Parse(fake.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	f := &flakyAPI{fails: fails}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v0/add" {
+			f.mu.Lock()
+			f.adds++
+			failed := f.adds <= f.fails
+			f.mu.Unlock()
+			if failed {
+				_, _ = io.Copy(ioutil.Discard, r.Body)
+				http.Error(w, "flaky", status)
+				return
+			}
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func TestRetry(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{"nft/1.png": "one", "nft/2.png": "two"})
+	tests := []struct {
+		name   string
+		fails  int
+		status int
+		retry  RetryPolicy
+		// attempts are the uploads of the file, err the error if it fails
+		attempts int
+		err      error
+	}{
+		{"no failure", 0, http.StatusInternalServerError, RetryPolicy{Attempts: 3, Backoff: time.Millisecond}, 1, nil},
+		{"retried", 2, http.StatusInternalServerError, RetryPolicy{Attempts: 3, Backoff: time.Millisecond}, 3, nil},
+		{"out of attempts", 3, http.StatusInternalServerError, RetryPolicy{Attempts: 3, Backoff: time.Millisecond}, 3, errors.New("flaky")},
+		{"no retry policy", 1, http.StatusInternalServerError, RetryPolicy{}, 1, errors.New("flaky")},
+		{"not transient", 1, http.StatusUnauthorized, RetryPolicy{Attempts: 3, Backoff: time.Millisecond}, 1, ErrAuthFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newFlakyAPI(t, tt.fails, tt.status)
+			log := &eventLog{}
+			up, err := New(Options{API: api.URL, Retry: tt.retry, Events: log})
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := up.UploadFile(context.Background(), filepath.Join(dir, "nft", "1.png"))
+			if api.adds != tt.attempts {
+				t.Errorf("the file was uploaded %v times, want %v", api.adds, tt.attempts)
+			}
+			if tt.err != nil {
+				if err == nil || (errors.Is(tt.err, ErrAuthFailed) && !errors.Is(err, ErrAuthFailed)) {
+					t.Errorf("UploadFile() = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Attempts != tt.attempts || !res.Cid.Defined() {
+				t.Errorf("the result has the CID %v and %v attempts, want %v", res.Cid, res.Attempts, tt.attempts)
+			}
+
+			// the files of the failed attempts are retried, and the run
+			// completes once
+			var completed int
+			for _, e := range log.events {
+				switch e := e.(type) {
+				case FileFailed:
+					if !e.Retry {
+						t.Errorf("%q failed with %v without being retried", e.Name, e.Err)
+					}
+				case RunCompleted:
+					completed++
+				}
+			}
+			if completed != 1 {
+				t.Errorf("%v runs completed, want 1", completed)
+			}
+		})
+	}
+
+	t.Run("directory", func(t *testing.T) {
+		api := newFlakyAPI(t, 1, http.StatusBadGateway)
+		up, err := New(Options{API: api.URL, Retry: RetryPolicy{Attempts: 2, Backoff: time.Millisecond}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		report, err := up.UploadDir(context.Background(), filepath.Join(dir, "nft"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Files) != 2 {
+			t.Fatalf("the report has %v files, want 2", len(report.Files))
+		}
+		for _, f := range report.Files {
+			if f.Attempts != 2 {
+				t.Errorf("%q was added in %v attempts, want 2", f.Name, f.Attempts)
+			}
+		}
+	})
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := RetryPolicy{Backoff: 100 * time.Millisecond}
+	for attempt, want := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 400 * time.Millisecond} {
+		if got := p.backoff(attempt); got != want {
+			t.Errorf("the backoff after attempt %v is %v, want %v", attempt, got, want)
+		}
+	}
+	if got := (RetryPolicy{}).backoff(1); got != DefaultBackoff {
+		t.Errorf("the default backoff is %v, want %v", got, DefaultBackoff)
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	var inFlight, most int
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > most {
+			most = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer api.Close()
+
+	up, err := New(Options{API: api.URL, Concurrency: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = up.Preflight(context.Background())
+		}()
+	}
+	wg.Wait()
+	if most != 2 {
+		t.Errorf("%v requests were in flight at once, want 2", most)
+	}
+}
@@ -0,0 +1,237 @@
+package uploader
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	ipfsFiles "github.com/ipfs/go-ipfs-files"
+)
+
+// S3Error is an error response of S3.
+type S3Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	// Key is the object requested, if any
+	Key string
+}
+
+func (e *S3Error) Error() string {
+	msg := fmt.Sprintf("S3 %v: %v", e.StatusCode, e.Code)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// IsS3URL reports whether path is an s3://bucket/prefix URL.
+func IsS3URL(path string) bool {
+	return strings.HasPrefix(path, "s3://")
+}
+
+// S3Source reads the objects under a prefix of an S3 bucket. The
+// credentials and the region come from the standard chain of the AWS SDK,
+// like the AWS CLI: the environment, the AWS_PROFILE, or default, profile of
+// the shared files with its roles and SSO, and the role of the instance or
+// container. AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL set an S3 compatible
+// endpoint, addressed with path-style URLs.
+type S3Source struct {
+	client *http.Client
+	signer *v4.Signer
+	region string
+	// endpoint is the scheme and host of the requests, the bucket being
+	// the first path segment if pathStyle
+	endpoint  *url.URL
+	pathStyle bool
+
+	bucket string
+	prefix string
+}
+
+// NewS3Source returns the S3Source of the s3://bucket/prefix URL rawURL,
+// making its requests with client, http.DefaultClient if nil, and fetching
+// the credentials with the client of the SDK.
+func NewS3Source(rawURL string, client *http.Client) (*S3Source, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("%v is not an s3://bucket/prefix URL", rawURL)
+	}
+	s := &S3Source{client: client, bucket: u.Host, prefix: strings.TrimPrefix(u.Path, "/")}
+	// the prefix is a directory, not the beginning of names
+	if s.prefix != "" && !strings.HasSuffix(s.prefix, "/") {
+		s.prefix += "/"
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{SharedConfigState: session.SharedConfigEnable})
+	if err != nil {
+		return nil, err
+	}
+	// fail before uploading anything if there are none
+	if _, err := sess.Config.Credentials.Get(); err != nil {
+		return nil, fmt.Errorf("no AWS credentials: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or AWS_PROFILE: %v", err)
+	}
+	s.signer = v4.NewSigner(sess.Config.Credentials, func(signer *v4.Signer) {
+		// the path is escaped by do, once as S3 expects
+		signer.DisableURIPathEscaping = true
+	})
+	s.region = aws.StringValue(sess.Config.Region)
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+
+	custom := os.Getenv("AWS_ENDPOINT_URL_S3")
+	if custom == "" {
+		custom = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	switch {
+	case custom != "":
+		s.endpoint, err = url.Parse(custom)
+		if err != nil || s.endpoint.Host == "" {
+			return nil, fmt.Errorf("invalid S3 endpoint %q", custom)
+		}
+		s.pathStyle = true
+	case strings.Contains(s.bucket, "."):
+		// the wildcard certificate doesn't cover the dots of the bucket
+		s.endpoint = &url.URL{Scheme: "https", Host: "s3." + s.region + ".amazonaws.com"}
+		s.pathStyle = true
+	default:
+		s.endpoint = &url.URL{Scheme: "https", Host: s.bucket + ".s3." + s.region + ".amazonaws.com"}
+	}
+	return s, nil
+}
+
+// List lists the objects under the prefix, a page of up to 1000 at a time.
+// Objects named like directories, as the S3 console creates them, are
+// directories.
+func (s *S3Source) List(ctx context.Context) (*Listing, error) {
+	var headers []*archiveHeader
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(ctx, "", query)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			IsTruncated           bool
+			NextContinuationToken string
+			Contents              []struct {
+				Key  string
+				Size int64
+			}
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("listing s3://%v/%v: %v", s.bucket, s.prefix, err)
+		}
+
+		for _, object := range page.Contents {
+			rel := strings.TrimPrefix(object.Key, s.prefix)
+			name, err := cleanEntryName(rel)
+			if err != nil {
+				return nil, err
+			}
+			if rel == "" || name == "." || archiveHidden(name) {
+				continue
+			}
+			headers = append(headers, &archiveHeader{
+				name:   name,
+				entry:  object.Key,
+				source: "s3://" + s.bucket + "/" + object.Key,
+				dir:    strings.HasSuffix(object.Key, "/"),
+				size:   object.Size,
+			})
+		}
+		if !page.IsTruncated {
+			break
+		}
+		token = page.NextContinuationToken
+	}
+	return newListing("s3://"+s.bucket+"/"+s.prefix, headers, nil, false)
+}
+
+// Open returns the directory of the objects of listing, each one read
+// when the upload gets to it.
+func (s *S3Source) Open(ctx context.Context, listing *Listing) ipfsFiles.Directory {
+	t := newTree(listing)
+	for _, f := range listing.Files {
+		key := strings.TrimPrefix(f.Source, "s3://"+s.bucket+"/")
+		t.addFile(f.Name, &lazyFile{name: f.Source, size: f.Size, open: func() (io.ReadCloser, error) {
+			resp, err := s.do(ctx, key, nil)
+			if err != nil {
+				return nil, err
+			}
+			return resp.Body, nil
+		}})
+	}
+	return t.root()
+}
+
+// do makes a signed GET request of the object key, or of the bucket if
+// empty, returning the S3Error of an error response.
+func (s *S3Source) do(ctx context.Context, key string, query url.Values) (*http.Response, error) {
+	path := "/" + key
+	if s.pathStyle {
+		path = "/" + s.bucket + path
+	}
+	u := *s.endpoint
+	u.Path = path
+	u.RawPath = s3Escape(path)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.signer.Sign(req, nil, "s3", s.region, time.Now()); err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	s3Err := &S3Error{StatusCode: resp.StatusCode, Key: key}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	_ = xml.Unmarshal(body, s3Err)
+	if s3Err.Code == "" {
+		s3Err.Code = http.StatusText(resp.StatusCode)
+	}
+	return nil, s3Err
+}
+
+// s3Escape URI encodes the path s like SigV4 does, every byte but the
+// unreserved characters and the slashes.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,166 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// setenv sets the environment variable key to value for the test.
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+	prev, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			_ = os.Setenv(key, prev)
+		} else {
+			_ = os.Unsetenv(key)
+		}
+	})
+}
+
+// countingTransport counts the requests of a client.
+type countingTransport struct {
+	requests int32
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&c.requests, 1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// newFakeS3 returns a server listing the objects of bucket two a page, and
+// serving their content, which fails the requests not signed by the access
+// key accessKey.
+func newFakeS3(t *testing.T, bucket, accessKey string, objects map[string]string) *httptest.Server {
+	t.Helper()
+	var keys []string
+	for key := range objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential="+accessKey+"/") || !strings.Contains(auth, "/s3/aws4_request") || r.Header.Get("X-Amz-Content-Sha256") == "" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "<Error><Code>AccessDenied</Code><Message>not signed</Message></Error>")
+			return
+		}
+		key := strings.TrimPrefix(r.URL.Path, "/"+bucket+"/")
+		if key != "" {
+			fmt.Fprint(w, objects[key])
+			return
+		}
+		start := 0
+		if token := r.URL.Query().Get("continuation-token"); token != "" {
+			fmt.Sscan(token, &start)
+		}
+		end := start + 2
+		if end > len(keys) {
+			end = len(keys)
+		}
+		fmt.Fprint(w, "<ListBucketResult>")
+		for _, key := range keys[start:end] {
+			fmt.Fprintf(w, "<Contents><Key>%v</Key><Size>%v</Size></Contents>", key, len(objects[key]))
+		}
+		if end < len(keys) {
+			fmt.Fprintf(w, "<IsTruncated>true</IsTruncated><NextContinuationToken>%v</NextContinuationToken>", end)
+		}
+		fmt.Fprint(w, "</ListBucketResult>")
+	}))
+}
+
+func TestS3Source(t *testing.T) {
+	objects := map[string]string{"renders/1.png": "one", "renders/2.png": "two", "renders/sub/3.png": "three"}
+	dir, err := ioutil.TempDir("", "ipfs-upload-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	credentials := filepath.Join(dir, "credentials")
+	if err := ioutil.WriteFile(credentials, []byte("[render]\naws_access_key_id = PROFILEKEY\naws_secret_access_key = secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		key  string
+	}{
+		{"environment", map[string]string{"AWS_ACCESS_KEY_ID": "ENVKEY", "AWS_SECRET_ACCESS_KEY": "secret"}, "ENVKEY"},
+		{"profile", map[string]string{"AWS_PROFILE": "render", "AWS_SHARED_CREDENTIALS_FILE": credentials}, "PROFILEKEY"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_PROFILE", "AWS_SHARED_CREDENTIALS_FILE"} {
+				setenv(t, key, "")
+			}
+			setenv(t, "AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+			setenv(t, "AWS_EC2_METADATA_DISABLED", "true")
+			setenv(t, "AWS_REGION", "eu-west-1")
+			for key, value := range tt.env {
+				setenv(t, key, value)
+			}
+			s3 := newFakeS3(t, "bucket", tt.key, objects)
+			defer s3.Close()
+			setenv(t, "AWS_ENDPOINT_URL_S3", s3.URL)
+
+			transport := &countingTransport{}
+			s, err := NewS3Source("s3://bucket/renders", &http.Client{Transport: transport})
+			if err != nil {
+				t.Fatal(err)
+			}
+			listing, err := s.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, f := range listing.Files {
+				names = append(names, fmt.Sprintf("%v %v", f.Name, f.Size))
+			}
+			if got, want := strings.Join(names, ", "), "1.png 3, 2.png 3, sub/3.png 5"; got != want {
+				t.Errorf("listed %v, want %v", got, want)
+			}
+			if n := atomic.LoadInt32(&transport.requests); n != 2 {
+				t.Errorf("the client made %v requests, want the 2 pages", n)
+			}
+
+			resp, err := s.do(context.Background(), "renders/sub/3.png", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if data, _ := ioutil.ReadAll(resp.Body); string(data) != "three" {
+				t.Errorf("read %q, want three", data)
+			}
+		})
+	}
+}
+
+func TestS3SourceNoCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-upload-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, key := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_PROFILE"} {
+		setenv(t, key, "")
+	}
+	setenv(t, "AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	setenv(t, "AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	setenv(t, "AWS_EC2_METADATA_DISABLED", "true")
+	if _, err := NewS3Source("s3://bucket/renders", nil); err == nil || !strings.Contains(err.Error(), "no AWS credentials") {
+		t.Errorf("NewS3Source without credentials returned %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	httpapi "github.com/ipfs/go-ipfs-http-client"
+)
+
+// ErrNotFound is the error of Stat and Cat for a CID the API doesn't have.
+var ErrNotFound = errors.New("not found on the node")
+
+// ObjectStat are the sizes of the DAG of a CID on the API.
+type ObjectStat struct {
+	// Blocks is the number of blocks of the DAG and Size the size of their
+	// data, as reported by dag/stat
+	Blocks int
+	Size   uint64
+	// CumulativeSize is the size of the DAG with the links of its blocks,
+	// as reported by object/stat and billed by most providers
+	CumulativeSize uint64
+}
+
+// Stat returns the sizes of the DAG of c, or ErrNotFound if the API doesn't
+// have it.
+func (u *Uploader) Stat(ctx context.Context, c cid.Cid) (ObjectStat, error) {
+	var stat ObjectStat
+	if err := u.needsIPFS("reading the stats"); err != nil {
+		return stat, err
+	}
+	// the older nodes reply with the totals, the newer ones add them per
+	// CID as DagStats
+	var dag struct {
+		Size      uint64
+		NumBlocks int
+		DagStats  []struct {
+			Size      uint64
+			NumBlocks int
+		}
+	}
+	err := u.api.Request("dag/stat", c.String()).Option("progress", false).Exec(ctx, &dag)
+	if err != nil {
+		return stat, notFoundError(err)
+	}
+	stat.Size, stat.Blocks = dag.Size, dag.NumBlocks
+	for _, s := range dag.DagStats {
+		stat.Size += s.Size
+		stat.Blocks += s.NumBlocks
+	}
+
+	var object struct {
+		CumulativeSize uint64
+	}
+	if err := u.api.Request("object/stat", c.String()).Exec(ctx, &object); err != nil {
+		return stat, notFoundError(err)
+	}
+	stat.CumulativeSize = object.CumulativeSize
+	return stat, nil
+}
+
+func notFoundError(err error) error {
+	var apiErr *httpapi.Error
+	if errors.As(err, &apiErr) && strings.Contains(apiErr.Message, "not found") {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,262 @@
+package uploader
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+
+	"github.com/INFURA/ipfs-upload-client/internal/strip"
+)
+
+// stateVersion is the version of the state file written, older files
+// being migrated by ReadState.
+const stateVersion = 1
+
+// StateLockTimeout is how long a run waits for another one to be done
+// with the state file.
+const StateLockTimeout = 30 * time.Second
+
+// stateHeader are the columns of Export.
+var stateHeader = []string{"hash", "kind", "cid", "size", "endpoints", "pinned", "first_uploaded", "last_uploaded"}
+
+// State is the state file, a record of the uploads of every run
+// by the SHA-256 of their content, see ContentHashes.
+type State struct {
+	Version int                    `json:"version"`
+	Entries map[string]*StateEntry `json:"entries"`
+}
+
+// StateEntry is the upload of a file or directory.
+type StateEntry struct {
+	Kind string `json:"kind"` // file or directory
+	CID  string `json:"cid"`
+	Size int64  `json:"size"`
+	// Endpoints are the API URLs it was uploaded to, Pinned the ones it was
+	// pinned to
+	Endpoints     []string  `json:"endpoints"`
+	Pinned        []string  `json:"pinned,omitempty"`
+	FirstUploaded time.Time `json:"first_uploaded"`
+	LastUploaded  time.Time `json:"last_uploaded"`
+}
+
+// ReadState reads the state file at path, an empty state if it doesn't
+// exist.
+func ReadState(path string) (*State, error) {
+	state := &State{Version: stateVersion, Entries: make(map[string]*StateEntry)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	switch {
+	case state.Version > stateVersion:
+		return nil, fmt.Errorf("%v was written by a newer version of the tool (state version %v)", path, state.Version)
+	case state.Version < 1:
+		return nil, fmt.Errorf("%v is not a --state file", path)
+	}
+	// the migrations of the older versions go here
+	state.Version = stateVersion
+	if state.Entries == nil {
+		state.Entries = make(map[string]*StateEntry)
+	}
+	return state, nil
+}
+
+// Lookup returns the entry of hash uploaded to endpoint, and pinned there
+// if pinned is set, or nil.
+func (s *State) Lookup(hash, endpoint string, pinned bool) *StateEntry {
+	e, ok := s.Entries[hash]
+	if !ok || !containsString(e.Endpoints, endpoint) || (pinned && !containsString(e.Pinned, endpoint)) {
+		return nil
+	}
+	return e
+}
+
+// Record records the upload of hash as c to endpoint at t.
+func (s *State) Record(hash, kind string, c cid.Cid, size int64, endpoint string, pinned bool, t time.Time) {
+	e, ok := s.Entries[hash]
+	if !ok || e.CID != c.String() {
+		// the same content gets another CID with other upload settings
+		e = &StateEntry{Kind: kind, CID: c.String(), FirstUploaded: t}
+		s.Entries[hash] = e
+	}
+	e.Size = size
+	e.LastUploaded = t
+	if !containsString(e.Endpoints, endpoint) {
+		e.Endpoints = append(e.Endpoints, endpoint)
+	}
+	if pinned && !containsString(e.Pinned, endpoint) {
+		e.Pinned = append(e.Pinned, endpoint)
+	}
+}
+
+// UpdateState applies update to the state file at path while holding its
+// lock, so that concurrent runs don't lose each other's records, and
+// replaces the file atomically.
+func UpdateState(path string, update func(s *State)) error {
+	unlock, err := LockFile(path+".lock", StateLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state, err := ReadState(path)
+	if err != nil {
+		return err
+	}
+	update(state)
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, data)
+}
+
+// ContentHashes are the SHA-256 of an upload: the one of a file is the
+// hex SHA-256 of its content, as uploaded, and the one of a directory the
+// SHA-256 of its sorted listing of relative paths and file hashes.
+type ContentHashes struct {
+	Root string
+	Size int64
+	// Files are the hashes and sizes of the files of a directory, by name
+	// relative to it
+	Files map[string]string
+	Sizes map[string]int64
+}
+
+// HashContent computes the ContentHashes of the upload of path without
+// the hidden files unless includeHidden and the excluded local paths, the
+// images being hashed without their metadata if stripped.
+func HashContent(path string, stat os.FileInfo, stripped, includeHidden bool, excluded map[string]bool) (*ContentHashes, error) {
+	hashes := &ContentHashes{Files: make(map[string]string), Sizes: make(map[string]int64)}
+	if !stat.IsDir() {
+		sum, err := HashFile(path, stripped && strip.Supported(path))
+		if err != nil {
+			return nil, err
+		}
+		hashes.Root, hashes.Size = sum, stat.Size()
+		return hashes, nil
+	}
+
+	var listing []string
+	err := Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == path {
+			return nil
+		}
+		if (!includeHidden && strings.HasPrefix(info.Name(), ".")) || excluded[filepath.Clean(p)] {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			listing = append(listing, rel+"/")
+			return nil
+		}
+		sum, err := HashFile(p, stripped && strip.Supported(p))
+		if err != nil {
+			return err
+		}
+		hashes.Files[rel], hashes.Sizes[rel] = sum, info.Size()
+		hashes.Size += info.Size()
+		listing = append(listing, rel+"\t"+sum)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(listing)
+	sum := sha256.Sum256([]byte(strings.Join(listing, "\n")))
+	hashes.Root = "dir:" + hex.EncodeToString(sum[:])
+	return hashes, nil
+}
+
+// RecordedCIDs returns the CIDs of the files of hashes uploaded to
+// endpoint by name, or nil if one of them isn't recorded.
+func (s *State) RecordedCIDs(hashes *ContentHashes, endpoint string, pinned bool) map[string]cid.Cid {
+	added := make(map[string]cid.Cid)
+	for name, hash := range hashes.Files {
+		e := s.Lookup(hash, endpoint, pinned)
+		if e == nil {
+			return nil
+		}
+		c, err := cid.Decode(e.CID)
+		if err != nil {
+			return nil
+		}
+		added[name] = c
+	}
+	return added
+}
+
+// Export writes the entries as CSV to w, sorted by hash.
+func (s *State) Export(w io.Writer) error {
+	hashes := make([]string, 0, len(s.Entries))
+	for hash := range s.Entries {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+
+	cw := csv.NewWriter(w)
+	_ = cw.Write(stateHeader)
+	for _, hash := range hashes {
+		e := s.Entries[hash]
+		_ = cw.Write([]string{
+			hash, e.Kind, e.CID, strconv.FormatInt(e.Size, 10),
+			strings.Join(e.Endpoints, " "), strings.Join(e.Pinned, " "),
+			e.FirstUploaded.Format(time.RFC3339), e.LastUploaded.Format(time.RFC3339),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Query returns the entries whose hash or CID is key.
+func (s *State) Query(key string) map[string]*StateEntry {
+	found := make(map[string]*StateEntry)
+	for hash, e := range s.Entries {
+		if hash == key || e.CID == key {
+			found[hash] = e
+		}
+	}
+	return found
+}
+
+// PinnedTo reports whether the upload was pinned to endpoint.
+func (e *StateEntry) PinnedTo(endpoint string) bool {
+	return containsString(e.Pinned, endpoint)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
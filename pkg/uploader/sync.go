@@ -0,0 +1,327 @@
+package uploader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ipfsFiles "github.com/ipfs/go-ipfs-files"
+)
+
+// Statuses of the files of a sync.
+const (
+	SyncAdded   = "added"
+	SyncChanged = "changed"
+	SyncRemoved = "removed"
+)
+
+// SyncChange is a file of a sync added, changed or removed since the
+// manifest.
+type SyncChange struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	// Cid is the CID the file is uploaded with, and Superseded the CID the
+	// manifest recorded for a changed or removed file
+	Cid        string `json:"cid,omitempty"`
+	Superseded string `json:"superseded,omitempty"`
+	// Error is the reason an added or changed file couldn't be uploaded,
+	// the manifest keeping its previous row
+	Error string `json:"error,omitempty"`
+	// Hedged is set if the file lagged and got a second attempt per
+	// Syncer.Hedge, and HedgeWon if that one completed first
+	Hedged   bool `json:"hedged,omitempty"`
+	HedgeWon bool `json:"hedge_won,omitempty"`
+}
+
+// SyncReport is the outcome of a sync.
+type SyncReport struct {
+	Added     int `json:"added"`
+	Changed   int `json:"changed"`
+	Removed   int `json:"removed"`
+	Unchanged int `json:"unchanged"`
+	Failed    int `json:"failed"`
+	// Hedged is the files given a second attempt, HedgesWon those whose
+	// second attempt completed first
+	Hedged    int          `json:"hedged"`
+	HedgesWon int          `json:"hedges_won"`
+	Changes   []SyncChange `json:"changes"`
+}
+
+// DefaultSyncWorkers is the files a Syncer uploads at once without Workers
+// nor Options.Concurrency.
+const DefaultSyncWorkers = 4
+
+// Syncer uploads the files of a directory added or changed since a
+// manifest of checksums, see ReadChecksums.
+type Syncer struct {
+	Uploader *Uploader
+	// Mode tells the unchanged files: in CacheModeMtime, the files of the
+	// recorded size not modified since the manifest, Since, aren't hashed
+	Mode  string
+	Since time.Time
+	// Wrap, if not nil, wraps the node of every file uploaded, e.g. to
+	// strip the metadata of its image
+	Wrap func(node ipfsFiles.Node, path string) ipfsFiles.Node
+	// Workers is the most files uploaded at once, Options.Concurrency of
+	// the Uploader if 0, DefaultSyncWorkers if 0 too
+	Workers int
+	// Hedge, if enabled, uploads a lagging file a second time in parallel
+	// once the workers aren't all busy
+	Hedge HedgePolicy
+	// Checkpoint, if not nil, is called with the files uploaded so far at
+	// most every CheckpointInterval, for an interrupted run to resume
+	Checkpoint         func(uploaded []*Checksum)
+	CheckpointInterval time.Duration
+}
+
+// Diff returns the files of the directory root added, changed or removed
+// since sums, the rows of the manifest, sorted by path, and the number of
+// unchanged files. The rows of files outside of root are left alone.
+func (s *Syncer) Diff(root string, stat os.FileInfo, sums []*Checksum) ([]SyncChange, int, error) {
+	listing, err := ListContent(root, stat, false, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	byPath := make(map[string]*Checksum)
+	for _, sum := range sums {
+		byPath[filepath.Clean(sum.Path)] = sum
+	}
+
+	var changes []SyncChange
+	// hashed are the files of the recorded size hashed to tell whether
+	// they changed
+	var hashed []*Checksum
+	present := make(map[string]bool)
+	for rel, info := range listing.Files {
+		p := filepath.Join(root, filepath.FromSlash(rel))
+		present[p] = true
+		sum, ok := byPath[p]
+		switch {
+		case !ok || !sum.Cid.Defined():
+			changes = append(changes, SyncChange{Path: p, Status: SyncAdded})
+		// the size of a stripped file is the one of its content uploaded
+		case !sum.Stripped && info.Size() != sum.Size:
+			changes = append(changes, SyncChange{Path: p, Status: SyncChanged, Superseded: sum.Cid.String()})
+		case s.Mode == CacheModeMtime && !sum.Stripped && !info.ModTime().After(s.Since):
+		default:
+			hashed = append(hashed, sum)
+		}
+	}
+	for p, sum := range byPath {
+		if present[p] || !sum.Cid.Defined() {
+			continue
+		}
+		if rel, err := filepath.Rel(filepath.Clean(root), p); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			changes = append(changes, SyncChange{Path: p, Status: SyncRemoved, Superseded: sum.Cid.String()})
+		}
+	}
+
+	// the files are hashed in parallel, as many as CPUs
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, runtime.NumCPU())
+	for _, sum := range hashed {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(sum *Checksum) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			hash, err := HashFile(sum.Path, sum.Stripped)
+			if err == nil && hash == sum.SHA256 {
+				return
+			}
+			c := SyncChange{Path: filepath.Clean(sum.Path), Status: SyncChanged, Superseded: sum.Cid.String()}
+			if err != nil {
+				c.Error = err.Error()
+			}
+			mu.Lock()
+			changes = append(changes, c)
+			mu.Unlock()
+		}(sum)
+	}
+	wg.Wait()
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	unchanged := len(listing.Files)
+	for _, c := range changes {
+		if c.Status != SyncRemoved {
+			unchanged--
+		}
+	}
+	return changes, unchanged, nil
+}
+
+// Upload uploads the added and changed files of changes, up to s.Workers
+// at a time, setting their CID or error, and returns their checksums. A
+// file failing transiently is uploaded again per Options.Retry, and one
+// lagging behind the others in parallel per s.Hedge, with the idle workers.
+func (s *Syncer) Upload(ctx context.Context, changes []SyncChange) []*Checksum {
+	var mu sync.Mutex
+	var uploaded []*Checksum
+	lastCheckpoint := time.Now()
+	var wg sync.WaitGroup
+	workers := s.Workers
+	if workers <= 0 {
+		workers = s.Uploader.opts.Concurrency
+	}
+	if workers <= 0 {
+		workers = DefaultSyncWorkers
+	}
+	sem := make(chan struct{}, workers)
+	// the hedges take the slots the files left to dispatch don't wait for
+	hedger := &Hedger{policy: s.Hedge, slots: sem}
+
+dispatch:
+	for i := range changes {
+		c := &changes[i]
+		if c.Status == SyncRemoved || c.Error != "" {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			for j := i; j < len(changes); j++ {
+				if changes[j].Status != SyncRemoved && changes[j].Error == "" {
+					changes[j].Error = ctx.Err().Error()
+				}
+			}
+			break dispatch
+		}
+		wg.Add(1)
+		go func(c *SyncChange) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			var sums [2]*Checksum
+			winner, hedged, err := hedger.Do(ctx, func(ctx context.Context, attempt int) error {
+				var err error
+				sums[attempt], err = s.upload(ctx, c.Path)
+				return err
+			})
+			c.Hedged = hedged
+			if err != nil {
+				c.Error = err.Error()
+				return
+			}
+			sum := sums[winner]
+			c.Cid, c.HedgeWon = sum.Cid.String(), winner == 1
+
+			mu.Lock()
+			defer mu.Unlock()
+			uploaded = append(uploaded, sum)
+			if s.Checkpoint != nil && time.Since(lastCheckpoint) >= s.CheckpointInterval {
+				s.Checkpoint(append([]*Checksum(nil), uploaded...))
+				lastCheckpoint = time.Now()
+			}
+		}(c)
+	}
+	wg.Wait()
+	return uploaded
+}
+
+// upload uploads the file at p on its own, hashing it as it is read.
+func (s *Syncer) upload(ctx context.Context, p string) (*Checksum, error) {
+	stat, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	// every attempt hashes the file again
+	var sums *Checksummer
+	var node ipfsFiles.Node
+	open := func() (ipfsFiles.Node, error) {
+		if node != nil {
+			_ = node.Close()
+		}
+		var err error
+		if node, err = NewFileNode(p, false, stat); err != nil {
+			return nil, err
+		}
+		if s.Wrap != nil {
+			node = s.Wrap(node, p)
+		}
+		sums = NewChecksummer()
+		return sums.Wrap(node, p), nil
+	}
+	res, _, err := s.Uploader.add(ctx, open, s.Uploader.opts.Retry.attempts(), nil)
+	if node != nil {
+		_ = node.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	sum, ok := sums.sums[p]
+	if !ok {
+		return nil, fmt.Errorf("%v wasn't read entirely", p)
+	}
+	sum.Cid = res.Cid()
+	return sum, nil
+}
+
+// UpdateManifest returns the rows of the manifest sums updated with the
+// uploaded ones, without the removed files. The files which failed keep
+// their previous row.
+func UpdateManifest(sums, uploaded []*Checksum, changes []SyncChange) []*Checksum {
+	rows := make(map[string]*Checksum)
+	for _, sum := range sums {
+		rows[filepath.Clean(sum.Path)] = sum
+	}
+	for _, c := range changes {
+		if c.Status == SyncRemoved {
+			delete(rows, c.Path)
+		}
+	}
+	for _, sum := range uploaded {
+		rows[filepath.Clean(sum.Path)] = sum
+	}
+	updated := make([]*Checksum, 0, len(rows))
+	for _, sum := range rows {
+		updated = append(updated, sum)
+	}
+	return updated
+}
+
+// NewSyncReport returns the report of changes with their counts.
+func NewSyncReport(changes []SyncChange, unchanged int) *SyncReport {
+	r := &SyncReport{Unchanged: unchanged, Changes: changes}
+	if r.Changes == nil {
+		r.Changes = []SyncChange{}
+	}
+	for _, c := range changes {
+		if c.Hedged {
+			r.Hedged++
+		}
+		if c.HedgeWon {
+			r.HedgesWon++
+		}
+		switch {
+		case c.Status == SyncRemoved:
+			r.Removed++
+		case c.Error != "":
+			r.Failed++
+		case c.Status == SyncAdded:
+			r.Added++
+		default:
+			r.Changed++
+		}
+	}
+	return r
+}
+
+// Write writes the report as JSON to path.
+func (r *SyncReport) Write(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, data)
+}
@@ -0,0 +1,293 @@
+package uploader
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	ipfsFiles "github.com/ipfs/go-ipfs-files"
+)
+
+// IsTar reports whether path is named like a tar archive: .tar, .tar.gz or
+// .tgz.
+func IsTar(path string) bool {
+	name := strings.ToLower(path)
+	return strings.HasSuffix(name, ".tar") || strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz")
+}
+
+// tarArchive is a tar archive being read, gzip compressed or not.
+type tarArchive struct {
+	*tar.Reader
+	file *os.File
+	gz   *gzip.Reader
+}
+
+func openTar(path string) (*tarArchive, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &tarArchive{file: f}
+	name := strings.ToLower(path)
+	if strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz") {
+		a.gz, err = gzip.NewReader(f)
+		if err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+		a.Reader = tar.NewReader(a.gz)
+	} else {
+		a.Reader = tar.NewReader(f)
+	}
+	return a, nil
+}
+
+func (a *tarArchive) Close() error {
+	if a.gz != nil {
+		_ = a.gz.Close()
+	}
+	return a.file.Close()
+}
+
+// next returns the next entry the upload keeps, skipping the hidden ones
+// and reporting the unsupported ones to skipped, or io.EOF.
+func (a *tarArchive) next(skipped func(name string, typeflag byte)) (*archiveHeader, error) {
+	for {
+		hdr, err := a.Next()
+		if err != nil {
+			return nil, err
+		}
+		name, err := cleanEntryName(hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+		if name == "." || archiveHidden(name) {
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			return &archiveHeader{name: name, entry: hdr.Name, size: hdr.Size}, nil
+		case tar.TypeDir:
+			return &archiveHeader{name: name, entry: hdr.Name, dir: true}, nil
+		case tar.TypeXGlobalHeader:
+		default:
+			if skipped != nil {
+				skipped(name, hdr.Typeflag)
+			}
+		}
+	}
+}
+
+// ListTar reads the headers of the tar archive at path, failing if the
+// entries of a directory aren't together, as they are streamed in the
+// order of the archive. The archives of tar -c always are.
+func ListTar(path string) (*Listing, error) {
+	a, err := openTar(path)
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+
+	var headers []*archiveHeader
+	var skipped []string
+	for {
+		h, err := a.next(func(name string, typeflag byte) {
+			skipped = append(skipped, fmt.Sprintf("%v (%v)", name, tarType(typeflag)))
+		})
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+		h.source = path + "!" + h.entry
+		headers = append(headers, h)
+	}
+
+	listing, err := newListing(path, headers, skipped, true)
+	if err != nil {
+		return nil, err
+	}
+	// current is the directory of the last entry, closed the directories
+	// left since
+	var current []string
+	closed := make(map[string]bool)
+	for _, h := range headers {
+		name := listing.rel(h.name)
+		if name == "" {
+			continue
+		}
+		dir := strings.Split(name, "/")
+		if !h.dir {
+			dir = dir[:len(dir)-1]
+		}
+		common := 0
+		for common < len(current) && common < len(dir) && current[common] == dir[common] {
+			common++
+		}
+		for i := common + 1; i <= len(current); i++ {
+			closed[strings.Join(current[:i], "/")] = true
+		}
+		for i := common + 1; i <= len(dir); i++ {
+			if closed[strings.Join(dir[:i], "/")] {
+				return nil, fmt.Errorf("%v: the entries of %v aren't together in the archive, extract it and upload the directory instead", path, strings.Join(dir[:i], "/"))
+			}
+		}
+		current = dir
+	}
+	return listing, nil
+}
+
+func tarType(typeflag byte) string {
+	switch typeflag {
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hard link"
+	case tar.TypeChar, tar.TypeBlock:
+		return "device"
+	case tar.TypeFifo:
+		return "fifo"
+	}
+	return fmt.Sprintf("type %q", typeflag)
+}
+
+// OpenTar returns the directory of the tar archive at path listed by
+// listing, read as it is uploaded rather than extracted, and the Closer of
+// the archive. The entries are streamed in the order of the archive, so the
+// directory must be read in order, without reading ahead.
+func OpenTar(path string, listing *Listing) (ipfsFiles.Directory, io.Closer, error) {
+	a, err := openTar(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	s := &tarStream{archive: a, listing: listing}
+	return &tarDirectory{stream: s}, a, nil
+}
+
+// tarStream is the archive shared by the directories, with the entry read
+// ahead.
+type tarStream struct {
+	archive *tarArchive
+	listing *Listing
+	peeked  *archiveHeader
+	err     error
+}
+
+// peek returns the next entry, relative to the Prefix, or nil at the end
+// of the archive or on failure.
+func (s *tarStream) peek() *archiveHeader {
+	for s.peeked == nil && s.err == nil {
+		h, err := s.archive.next(nil)
+		if err == io.EOF {
+			s.err = io.EOF
+			break
+		}
+		if err != nil {
+			s.err = err
+			break
+		}
+		h.name = s.listing.rel(h.name)
+		if h.name != "" {
+			s.peeked = h
+		}
+	}
+	return s.peeked
+}
+
+type tarDirectory struct {
+	stream *tarStream
+	// prefix is the name of the directory followed by a slash, "" for the
+	// root
+	prefix string
+}
+
+func (d *tarDirectory) Entries() ipfsFiles.DirIterator {
+	return &tarIterator{stream: d.stream, prefix: d.prefix, seen: make(map[string]bool)}
+}
+
+func (d *tarDirectory) Close() error {
+	return nil
+}
+
+func (d *tarDirectory) Size() (int64, error) {
+	return d.stream.listing.sizes[strings.TrimSuffix(d.prefix, "/")], nil
+}
+
+type tarIterator struct {
+	stream *tarStream
+	prefix string
+	seen   map[string]bool
+
+	name string
+	node ipfsFiles.Node
+	err  error
+}
+
+func (it *tarIterator) Name() string {
+	return it.name
+}
+
+func (it *tarIterator) Node() ipfsFiles.Node {
+	return it.node
+}
+
+func (it *tarIterator) Next() bool {
+	h := it.stream.peek()
+	if h == nil {
+		if it.stream.err != io.EOF {
+			it.err = it.stream.err
+		}
+		return false
+	}
+	if !strings.HasPrefix(h.name, it.prefix) {
+		// the entry is in a parent directory
+		return false
+	}
+	rest := h.name[len(it.prefix):]
+	name := strings.SplitN(rest, "/", 2)[0]
+	if it.seen[name] {
+		it.err = errors.New("the entries of " + it.prefix + name + " aren't together in the archive")
+		return false
+	}
+	it.seen[name] = true
+	it.name = name
+
+	if h.dir || strings.Contains(rest, "/") {
+		if rest == name {
+			// the entries of the directory follow its own
+			it.stream.peeked = nil
+		}
+		it.node = &tarDirectory{stream: it.stream, prefix: it.prefix + name + "/"}
+		return true
+	}
+	it.stream.peeked = nil
+	it.node = &tarFile{Reader: io.LimitReader(it.stream.archive, h.size), size: h.size}
+	return true
+}
+
+func (it *tarIterator) Err() error {
+	return it.err
+}
+
+// tarFile is the content of an entry, read from the archive.
+type tarFile struct {
+	io.Reader
+	size int64
+}
+
+func (f *tarFile) Close() error {
+	return nil
+}
+
+func (f *tarFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.New("tar entries can't be seeked")
+}
+
+func (f *tarFile) Size() (int64, error) {
+	return f.size, nil
+}
@@ -0,0 +1,47 @@
+package uploader
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+// slotTransport lets up to its slots of requests in flight at once, a
+// request holding its slot until its response is read.
+type slotTransport struct {
+	base  http.RoundTripper
+	slots chan struct{}
+}
+
+func newSlotTransport(base http.RoundTripper, n int) *slotTransport {
+	return &slotTransport{base: base, slots: make(chan struct{}, n)}
+}
+
+func (t *slotTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	select {
+	case t.slots <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	var once sync.Once
+	release := func() { once.Do(func() { <-t.slots }) }
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releaseBody releases the slot of its request once closed.
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
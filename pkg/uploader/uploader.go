@@ -0,0 +1,433 @@
+// Package uploader uploads files and directories to the IPFS API of Infura,
+// or any IPFS HTTP API, for embedding the upload in other programs. The
+// services with an API of their own, Pinata, web3.storage and NFT.Storage,
+// are stored on by the Backend of their Provider, those of your own by
+// Options.Backend, the operations they lack returning ErrUnsupported.
+//
+// An Uploader, made by New, uploads with UploadDir, UploadFile or Add, the
+// progress being reported by Options.Events. Its other methods query and
+// manage what the API stores: Stat, Cat, IsPinned, Pins, Pin, Unpin and
+// ImportCAR. NewFileNode, OpenTar, OpenZip and NewS3Source make the nodes
+// Add uploads, and WriteCAR packs them into a CAR file without network, as
+// Options.OnlyHash makes Add compute their CIDs.
+// RemotePinner pins on a service of the IPFS Pinning Service API, and
+// FakeAPI stands in for the API in tests.
+//
+// The rest of the work of the CLI on the uploads is here too. A
+// Checksummer records the hashes of what the nodes read, written with Write
+// and checked with VerifyChecksums. Cache, read by ReadCache and updated by
+// UpdateCache, holds the CIDs of unchanged directories, and State, read by
+// ReadState and updated by UpdateState, those of files by their content. A
+// Syncer uploads what changed in a directory since its checksums, a Hedger
+// uploading again in parallel the files lagging behind, and
+// Report.Durations gives the percentiles of the durations of the files.
+// WriteFileAtomic and LockFile write the files they keep.
+//
+// Every call takes a context, and the errors can be told apart with
+// errors.Is against ErrAuthFailed, ErrUnreachable, ErrTLS,
+// ErrProxyAuthFailed, ErrNotFound and ErrUnsupported, or by their
+// ErrorClass.
+package uploader
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	ipfsFiles "github.com/ipfs/go-ipfs-files"
+	httpapi "github.com/ipfs/go-ipfs-http-client"
+	coreiface "github.com/ipfs/interface-go-ipfs-core"
+	ipfsPath "github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+// DefaultAPI is the IPFS API of Infura.
+const DefaultAPI = "https://ipfs.infura.io:5001"
+
+// Options configures an Uploader.
+type Options struct {
+	// Provider is the service of the API, Infura if its name is empty
+	Provider Provider
+	// Backend stores and pins in place of the one of the Provider, for the
+	// services of your own, if not nil
+	Backend Backend
+	// API is the URL of the API of the service, the one of the Provider if empty
+	API string
+	// ProjectID and ProjectSecret authenticate the requests as the Provider
+	// takes them
+	ProjectID     string
+	ProjectSecret string
+	// Headers are sent with every request of the API, replacing the
+	// Authorization of the Provider if they have one
+	Headers http.Header
+	// HTTPClient makes the requests, http.DefaultClient if nil
+	HTTPClient *http.Client
+	// Pin pins the uploaded files, which the services without the IPFS API
+	// keep anyway
+	Pin bool
+	// OnlyHash makes Add compute the CIDs locally, like ipfs add -n,
+	// without sending anything to the API
+	OnlyHash bool
+	// DAG is how the files are chunked and hashed, the defaults of the API
+	// if zero
+	DAG DAGOptions
+	// Preflight checks the credentials and the endpoint with Preflight
+	// before UploadDir and UploadFile upload anything
+	Preflight bool
+	// Concurrency is the most requests of the API in flight at once, no
+	// limit if 0, and the files a Syncer without Workers uploads at once
+	Concurrency int
+	// Retry is how UploadDir, UploadFile and a Syncer upload again what
+	// failed transiently, once if zero
+	Retry RetryPolicy
+	// Events receives the events of every upload if not nil, EventBuffer of
+	// them being buffered, DefaultEventBuffer if 0
+	Events      Events
+	EventBuffer int
+}
+
+// Result is a file or directory added by an upload.
+type Result struct {
+	// Name is the path of the file relative to the uploaded directory, empty
+	// for the uploaded directory or file itself
+	Name string
+	Cid  cid.Cid
+	// Bytes is the number of bytes read so far, Size the size of the DAG
+	Bytes int64
+	Size  string
+	// Duration is the time from the first event of the file to its
+	// addition in its last attempt, Attempts the number of uploads of the
+	// file, more than 1 if Options.Retry tried it again
+	Duration time.Duration
+	Attempts int
+}
+
+// Report is the outcome of the upload of a directory.
+type Report struct {
+	Root cid.Cid
+	// Files are the files and directories below the root, in the order they
+	// were added
+	Files []Result
+}
+
+// Percentiles are the percentiles of the upload time of files.
+type Percentiles struct {
+	P50, P90, P99, Max time.Duration
+}
+
+// Durations returns the percentiles of the upload time of the files of the
+// report, not of the directories, or nil if there are none.
+func (r *Report) Durations() *Percentiles {
+	var durations []time.Duration
+	for _, f := range r.Files {
+		// the directories have no bytes of their own
+		if f.Bytes > 0 {
+			durations = append(durations, f.Duration)
+		}
+	}
+	return DurationPercentiles(durations)
+}
+
+// DurationPercentiles returns the percentiles of durations, or nil if
+// there are none.
+func DurationPercentiles(durations []time.Duration) *Percentiles {
+	if len(durations) == 0 {
+		return nil
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	percentile := func(p int) time.Duration {
+		return sorted[(len(sorted)-1)*p/100]
+	}
+	return &Percentiles{P50: percentile(50), P90: percentile(90), P99: percentile(99), Max: sorted[len(sorted)-1]}
+}
+
+// Uploader uploads to an IPFS API.
+type Uploader struct {
+	opts    Options
+	backend Backend
+	// api is the IPFS API of the backend, nil if the service stores with
+	// an API of its own
+	api *httpapi.HttpApi
+	dag dagSettings
+}
+
+// New returns an Uploader configured by opts.
+func New(opts Options) (*Uploader, error) {
+	if opts.Provider.Name == "" {
+		opts.Provider = Providers["infura"]
+	}
+	if opts.API == "" {
+		opts.API = opts.Provider.API
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+	if err := opts.DAG.Validate(opts.OnlyHash); err != nil {
+		return nil, err
+	}
+	dag, _ := opts.DAG.settings()
+	// the requests refused for their credentials fail with ErrAuthFailed
+	base := opts.HTTPClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if opts.Concurrency > 0 {
+		base = newSlotTransport(base, opts.Concurrency)
+	}
+	client := *opts.HTTPClient
+	client.Transport = &authTransport{base: base}
+	headers := make(http.Header)
+	if auth := opts.Provider.authorization(opts.ProjectID, opts.ProjectSecret); auth != "" {
+		headers.Add("Authorization", auth)
+	}
+	for key, values := range opts.Headers {
+		headers.Del(key)
+		for _, value := range values {
+			headers.Add(key, value)
+		}
+	}
+	backend := opts.Backend
+	if backend == nil {
+		var err error
+		if backend, err = newBackend(opts, &client, headers, dag); err != nil {
+			return nil, err
+		}
+	}
+	u := &Uploader{opts: opts, backend: backend, dag: dag}
+	if b, ok := backend.(*ipfsBackend); ok {
+		u.api = b.api
+	}
+	return u, nil
+}
+
+// Add uploads node, calling fn if not nil with every file and directory as
+// it is added. It returns the root and the CIDs of the files by name, once
+// the events of the upload are delivered to Options.Events. Credentials
+// refused and failures to connect match ErrAuthFailed, ErrProxyAuthFailed,
+// ErrTLS or ErrUnreachable with errors.Is. node is uploaded once, as it
+// can't be read again, whatever Options.Retry.
+func (u *Uploader) Add(ctx context.Context, node ipfsFiles.Node, fn func(Result)) (ipfsPath.Resolved, map[string]cid.Cid, error) {
+	return u.add(ctx, func() (ipfsFiles.Node, error) { return node, nil }, 1, fn)
+}
+
+// add uploads the node returned by open, again with a new one up to
+// attempts times in all while the upload fails transiently.
+func (u *Uploader) add(ctx context.Context, open func() (ipfsFiles.Node, error), attempts int, fn func(Result)) (ipfsPath.Resolved, map[string]cid.Cid, error) {
+	start := time.Now()
+	a := &addition{fn: fn}
+	if u.opts.Events != nil {
+		a.d = newDispatcher(u.opts.Events, u.opts.EventBuffer)
+	}
+
+	var res ipfsPath.Resolved
+	var added map[string]cid.Cid
+	var err error
+	for attempt := 1; ; attempt++ {
+		var node ipfsFiles.Node
+		if node, err = open(); err != nil {
+			break
+		}
+		res, added, err = u.attempt(ctx, node, attempt, a)
+		retry := err != nil && attempt < attempts && Transient(ErrorClass(err)) && ctx.Err() == nil
+		if a.d != nil && err != nil {
+			class := ErrorClass(err)
+			for name := range a.started {
+				a.d.send(FileFailed{Name: name, Err: err, Class: class, Retry: retry})
+			}
+		}
+		if !retry {
+			break
+		}
+		select {
+		case <-time.After(u.opts.Retry.backoff(attempt)):
+		case <-ctx.Done():
+		}
+	}
+
+	if a.d != nil {
+		done := RunCompleted{Err: err, Files: len(added), Bytes: a.bytes, Duration: time.Since(start)}
+		if err == nil {
+			done.Root = res.Cid()
+		}
+		done.DroppedProgress = a.d.dropped
+		a.d.send(done)
+		a.d.close()
+	}
+	return res, added, err
+}
+
+// addition is the state of an upload across its attempts.
+type addition struct {
+	fn func(Result)
+	d  *dispatcher
+	// started are the files in progress of the attempt, progress the bytes
+	// uploaded of every file, bytes those of every attempt
+	started  map[string]time.Time
+	progress map[string]int64
+	bytes    int64
+}
+
+// attempt uploads node once, as attempt of a.
+func (u *Uploader) attempt(ctx context.Context, node ipfsFiles.Node, attempt int, a *addition) (ipfsPath.Resolved, map[string]cid.Cid, error) {
+	var res ipfsPath.Resolved
+	errCh := make(chan error, 1)
+	events := make(chan interface{}, 8)
+	added := make(map[string]cid.Cid)
+	a.started = make(map[string]time.Time)
+	a.progress = make(map[string]int64)
+
+	go func() {
+		var err error
+		defer close(events)
+		if u.opts.OnlyHash {
+			res, err = hashNode(ctx, node, u.dag, events)
+		} else {
+			res, err = u.backend.Upload(ctx, node, events)
+		}
+		errCh <- err
+	}()
+
+	for event := range events {
+		output, ok := event.(*coreiface.AddEvent)
+		if !ok {
+			panic("unknown event type")
+		}
+		if _, ok := a.started[output.Name]; !ok {
+			a.started[output.Name] = time.Now()
+			if a.d != nil {
+				a.d.send(FileStarted{Name: output.Name})
+			}
+		}
+		if output.Path == nil {
+			if a.d != nil {
+				a.bytes += output.Bytes - a.progress[output.Name]
+				a.progress[output.Name] = output.Bytes
+				a.d.send(FileProgress{Name: output.Name, Bytes: output.Bytes})
+			}
+			continue
+		}
+		added[output.Name] = output.Path.Cid()
+		r := Result{
+			Name:     output.Name,
+			Cid:      output.Path.Cid(),
+			Bytes:    output.Bytes,
+			Size:     output.Size,
+			Duration: time.Since(a.started[output.Name]),
+			Attempts: attempt,
+		}
+		if a.fn != nil {
+			a.fn(r)
+		}
+		if a.d != nil {
+			a.d.send(FileCompleted{
+				Name:     r.Name,
+				Cid:      r.Cid,
+				Bytes:    a.progress[r.Name],
+				Size:     r.Size,
+				Duration: r.Duration,
+				Attempts: r.Attempts,
+			})
+		}
+		delete(a.started, output.Name)
+		delete(a.progress, output.Name)
+	}
+	return res, added, requestError(<-errCh)
+}
+
+// UploadDir uploads the directory at path, without its hidden files.
+func (u *Uploader) UploadDir(ctx context.Context, path string) (*Report, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !stat.IsDir() {
+		return nil, errors.New(path + " is not a directory")
+	}
+	node, err := NewFileNode(path, false, stat)
+	if err != nil {
+		return nil, err
+	}
+	if err := u.preflight(ctx); err != nil {
+		return nil, err
+	}
+
+	report := &Report{}
+	attempt := 1
+	res, _, err := u.add(ctx, reopen(node, path, stat), u.opts.Retry.attempts(), func(r Result) {
+		// the files of a failed attempt are uploaded again
+		if r.Attempts != attempt {
+			report.Files, attempt = nil, r.Attempts
+		}
+		if r.Name != "" {
+			report.Files = append(report.Files, r)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.Root = res.Cid()
+	return report, nil
+}
+
+// UploadFile uploads the file at path.
+func (u *Uploader) UploadFile(ctx context.Context, path string) (Result, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return Result{}, err
+	}
+	if stat.IsDir() {
+		return Result{}, errors.New(path + " is a directory")
+	}
+	node, err := NewFileNode(path, false, stat)
+	if err != nil {
+		return Result{}, err
+	}
+	if err := u.preflight(ctx); err != nil {
+		return Result{}, err
+	}
+
+	var result Result
+	res, _, err := u.add(ctx, reopen(node, path, stat), u.opts.Retry.attempts(), func(r Result) {
+		result = r
+	})
+	if err != nil {
+		return Result{}, err
+	}
+	result.Cid = res.Cid()
+	return result, nil
+}
+
+// reopen returns the function returning node first, and then the file or
+// directory at path again after closing the previous node.
+func reopen(node ipfsFiles.Node, path string, stat os.FileInfo) func() (ipfsFiles.Node, error) {
+	opened := false
+	return func() (ipfsFiles.Node, error) {
+		if !opened {
+			opened = true
+			return node, nil
+		}
+		_ = node.Close()
+		var err error
+		node, err = NewFileNode(path, false, stat)
+		return node, err
+	}
+}
+
+func (u *Uploader) preflight(ctx context.Context) error {
+	if !u.opts.Preflight || u.opts.OnlyHash {
+		return nil
+	}
+	_, err := u.Preflight(ctx)
+	return err
+}
+
+// BasicAuth returns the credentials of the Authorization header.
+func BasicAuth(projectID, projectSecret string) string {
+	auth := projectID + ":" + projectSecret
+	return base64.StdEncoding.EncodeToString([]byte(auth))
+}
@@ -0,0 +1,297 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cmds "github.com/ipfs/go-ipfs-cmds"
+	httpapi "github.com/ipfs/go-ipfs-http-client"
+)
+
+// writeTestFiles writes the files of content, by path relative to a new
+// directory which it returns.
+func writeTestFiles(t *testing.T, content map[string]string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "ipfs-upload-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	for name, data := range content {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// eventLog records the events of the uploads.
+type eventLog struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (l *eventLog) Event(e Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, e)
+}
+
+func TestAdd(t *testing.T) {
+	fake := NewFakeAPI(0)
+	defer fake.Close()
+	failing := NewFakeAPI(1)
+	defer failing.Close()
+	closed := httptest.NewServer(nil)
+	closed.Close()
+
+	tests := []struct {
+		name  string
+		files map[string]string
+		// path is the file or directory uploaded, relative to the files
+		path string
+		opts Options
+		// want are the names added, class the ErrorClass of the failure
+		want  []string
+		class string
+	}{
+		{"file", map[string]string{"1.png": "one"}, "1.png", Options{API: fake.URL}, []string{""}, ""},
+		{"directory", map[string]string{"nft/1.png": "one", "nft/2.png": "two", "nft/sub/3.png": "three"}, "nft", Options{API: fake.URL, Pin: true}, []string{"", "1.png", "2.png", "sub", "sub/3.png"}, ""},
+		{"hidden", map[string]string{"nft/1.png": "one", "nft/.DS_Store": "x"}, "nft", Options{API: fake.URL}, []string{"", "1.png"}, ""},
+		{"only hash", map[string]string{"nft/1.png": "one", "nft/sub/2.png": "two"}, "nft", Options{API: closed.URL, OnlyHash: true}, []string{"", "1.png", "sub", "sub/2.png"}, ""},
+		{"server error", map[string]string{"nft/1.png": "one"}, "nft", Options{API: failing.URL}, nil, ClassServer},
+		{"unreachable", map[string]string{"nft/1.png": "one"}, "nft", Options{API: closed.URL}, nil, ClassConnect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(writeTestFiles(t, tt.files), tt.path)
+			stat, err := os.Stat(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			node, err := NewFileNode(p, false, stat)
+			if err != nil {
+				t.Fatal(err)
+			}
+			up, err := New(tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var results []string
+			res, added, err := up.Add(context.Background(), node, func(r Result) {
+				if !r.Cid.Defined() || r.Attempts != 1 {
+					t.Errorf("the result of %q has the CID %v and %v attempts", r.Name, r.Cid, r.Attempts)
+				}
+				results = append(results, r.Name)
+			})
+			if tt.class != "" {
+				if err == nil || ErrorClass(err) != tt.class {
+					t.Fatalf("the upload returned %v of class %v, want class %v", err, ErrorClass(err), tt.class)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for name := range added {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			sort.Strings(results)
+			if strings.Join(names, ",") != strings.Join(tt.want, ",") || strings.Join(results, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("added %q and called fn with %q, want %q", names, results, tt.want)
+			}
+			if !res.Cid().Equals(added[""]) {
+				t.Errorf("the root is %v, and the CID of \"\" %v", res.Cid(), added[""])
+			}
+			if pinned := len(fake.Pins()) > 0; tt.opts.Pin && !pinned {
+				t.Error("nothing was pinned")
+			}
+		})
+	}
+}
+
+func TestAddEvents(t *testing.T) {
+	fake := NewFakeAPI(0)
+	defer fake.Close()
+	failing := NewFakeAPI(1)
+	defer failing.Close()
+	dir := writeTestFiles(t, map[string]string{"nft/1.png": "one", "nft/sub/2.png": "two"})
+
+	tests := []struct {
+		name string
+		api  string
+		fail bool
+	}{
+		{"success", fake.URL, false},
+		{"failure", failing.URL, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := &eventLog{}
+			up, err := New(Options{API: tt.api, Events: log})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := filepath.Join(dir, "nft")
+			stat, _ := os.Stat(p)
+			node, err := NewFileNode(p, false, stat)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, added, err := up.Add(context.Background(), node, nil)
+			if (err != nil) != tt.fail {
+				t.Fatalf("the upload returned %v", err)
+			}
+
+			// the events are delivered once Add returns
+			log.mu.Lock()
+			events := log.events
+			log.mu.Unlock()
+			if len(events) == 0 {
+				t.Fatal("no events")
+			}
+			done, ok := events[len(events)-1].(RunCompleted)
+			if !ok {
+				t.Fatalf("the last event is %T, want RunCompleted", events[len(events)-1])
+			}
+			if (done.Err != nil) != tt.fail || done.Root.Defined() == tt.fail || done.Files != len(added) {
+				t.Errorf("RunCompleted has the root %v, the error %v and %v files, want %v files", done.Root, done.Err, done.Files, len(added))
+			}
+
+			// every file starts, progresses and completes or fails in that
+			// order, a directory completing after its files
+			started := make(map[string]bool)
+			completed := make(map[string]bool)
+			for i, e := range events[:len(events)-1] {
+				switch e := e.(type) {
+				case FileStarted:
+					if started[e.Name] {
+						t.Errorf("event %v: %q started twice", i, e.Name)
+					}
+					started[e.Name] = true
+				case FileProgress:
+					if !started[e.Name] || completed[e.Name] {
+						t.Errorf("event %v: progress of %q out of its upload", i, e.Name)
+					}
+				case FileCompleted:
+					if !started[e.Name] || completed[e.Name] {
+						t.Errorf("event %v: %q completed out of its upload", i, e.Name)
+					}
+					for name := range started {
+						if strings.HasPrefix(name, e.Name+"/") || (e.Name == "" && name != "") {
+							if !completed[name] {
+								t.Errorf("event %v: the directory %q completed before %q", i, e.Name, name)
+							}
+						}
+					}
+					if !e.Cid.Equals(added[e.Name]) {
+						t.Errorf("event %v: %q completed with %v, added with %v", i, e.Name, e.Cid, added[e.Name])
+					}
+					completed[e.Name] = true
+				case FileFailed:
+					if !tt.fail || e.Class != ClassServer {
+						t.Errorf("event %v: %q failed with %v of class %v", i, e.Name, e.Err, e.Class)
+					}
+				case RunCompleted:
+					t.Errorf("event %v: RunCompleted before the last event", i)
+				}
+			}
+			if len(completed) != len(added) {
+				t.Errorf("%v files completed, %v added", len(completed), len(added))
+			}
+		})
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"canceled", context.Canceled, ClassCanceled},
+		{"deadline", fmt.Errorf("add: %w", context.DeadlineExceeded), ClassTimeout},
+		{"client timeout", &url.Error{Op: "Post", URL: "http://127.0.0.1:5001/api/v0/add", Err: timeoutError{}}, ClassTimeout},
+		{"connect", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, ClassConnect},
+		{"TLS handshake timeout", errors.New("net/http: TLS handshake timeout"), ClassConnect},
+		{"read", &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}, ClassOther},
+		{"rate limited", &httpapi.Error{Code: cmds.ErrRateLimited}, ClassRateLimited},
+		{"forbidden", &httpapi.Error{Code: cmds.ErrForbidden}, ClassForbidden},
+		{"client", &httpapi.Error{Code: cmds.ErrClient}, ClassClient},
+		{"server", &httpapi.Error{Code: cmds.ErrNormal}, ClassServer},
+		{"S3 slow down", &S3Error{StatusCode: 503, Code: "SlowDown"}, ClassRateLimited},
+		{"S3 too many requests", &S3Error{StatusCode: 429}, ClassRateLimited},
+		{"S3 forbidden", &S3Error{StatusCode: 403, Code: "AccessDenied"}, ClassForbidden},
+		{"S3 not found", &S3Error{StatusCode: 404, Code: "NoSuchKey"}, ClassClient},
+		{"S3 server", &S3Error{StatusCode: 500, Code: "InternalError"}, ClassServer},
+		{"service too many requests", &ServiceError{Service: "pinata", StatusCode: 429}, ClassRateLimited},
+		{"service forbidden", &ServiceError{Service: "pinata", StatusCode: 403}, ClassForbidden},
+		{"service bad request", &ServiceError{Service: "nftstorage", StatusCode: 400}, ClassClient},
+		{"service server", &ServiceError{Service: "web3storage", StatusCode: 502}, ClassServer},
+		{"other", errors.New("disk full"), ClassOther},
+	}
+	for _, tt := range tests {
+		if got := ErrorClass(tt.err); got != tt.want {
+			t.Errorf("%v: ErrorClass(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+// timeoutError is a net.Error timing out, like the one of http.Client.Timeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "Client.Timeout exceeded while awaiting headers" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestTransient(t *testing.T) {
+	for class, want := range map[string]bool{
+		ClassCanceled:    false,
+		ClassTimeout:     true,
+		ClassConnect:     true,
+		ClassRateLimited: true,
+		ClassForbidden:   false,
+		ClassClient:      false,
+		ClassServer:      true,
+		ClassOther:       false,
+	} {
+		if got := Transient(class); got != want {
+			t.Errorf("Transient(%v) = %v, want %v", class, got, want)
+		}
+	}
+}
+
+func TestDurationPercentiles(t *testing.T) {
+	if p := DurationPercentiles(nil); p != nil {
+		t.Errorf("the percentiles of no durations are %+v, want nil", p)
+	}
+	var durations []time.Duration
+	for i := 100; i > 0; i-- {
+		durations = append(durations, time.Duration(i)*time.Millisecond)
+	}
+	want := Percentiles{P50: 50 * time.Millisecond, P90: 90 * time.Millisecond, P99: 99 * time.Millisecond, Max: 100 * time.Millisecond}
+	if p := DurationPercentiles(durations); p == nil || *p != want {
+		t.Errorf("the percentiles are %+v, want %+v", p, want)
+	}
+	if durations[0] != 100*time.Millisecond {
+		t.Error("the durations were sorted in place")
+	}
+}
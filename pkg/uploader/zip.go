@@ -0,0 +1,112 @@
+package uploader
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	ipfsFiles "github.com/ipfs/go-ipfs-files"
+)
+
+// IsZip reports whether path is named like a zip archive.
+func IsZip(path string) bool {
+	return strings.HasSuffix(strings.ToLower(path), ".zip")
+}
+
+// zipHeader returns the header of f the upload keeps, or nil for the
+// hidden ones, reporting the unsupported ones to skipped.
+func zipHeader(f *zip.File, skipped func(name, kind string)) (*archiveHeader, error) {
+	name, err := cleanEntryName(f.Name)
+	if err != nil {
+		return nil, err
+	}
+	if name == "." || archiveHidden(name) {
+		return nil, nil
+	}
+	mode := f.Mode()
+	switch {
+	case mode.IsDir():
+		return &archiveHeader{name: name, entry: f.Name, dir: true}, nil
+	case mode&os.ModeSymlink != 0:
+		skipped(name, "symlink")
+	case !mode.IsRegular():
+		skipped(name, "special file")
+	default:
+		return &archiveHeader{name: name, entry: f.Name, size: int64(f.UncompressedSize64)}, nil
+	}
+	return nil, nil
+}
+
+// ListZip reads the central directory of the zip archive at path, failing
+// with every entry which can't be uploaded, encrypted or compressed with a
+// method other than store and deflate.
+func ListZip(path string) (*Listing, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	defer r.Close()
+
+	var headers []*archiveHeader
+	var skipped, unsupported []string
+	for _, f := range r.File {
+		h, err := zipHeader(f, func(name, kind string) {
+			skipped = append(skipped, fmt.Sprintf("%v (%v)", name, kind))
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+		if h == nil {
+			continue
+		}
+		if !h.dir {
+			switch {
+			// bit 0 of the general purpose flags
+			case f.Flags&0x1 != 0:
+				unsupported = append(unsupported, fmt.Sprintf("%v is encrypted", f.Name))
+			case f.Method != zip.Store && f.Method != zip.Deflate:
+				unsupported = append(unsupported, fmt.Sprintf("%v is compressed with the unsupported method %v", f.Name, f.Method))
+			}
+		}
+		h.source = path + "!" + h.entry
+		headers = append(headers, h)
+	}
+	if len(unsupported) > 0 {
+		return nil, fmt.Errorf("%v: %v entries can't be read:\n%v", path, len(unsupported), strings.Join(unsupported, "\n"))
+	}
+	return newListing(path, headers, skipped, true)
+}
+
+// OpenZip returns the directory of the zip archive at path listed by
+// listing, read as it is uploaded rather than extracted, and the Closer of
+// the archive.
+func OpenZip(path string, listing *Listing) (ipfsFiles.Directory, io.Closer, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%v: %v", path, err)
+	}
+
+	t := newTree(listing)
+	for _, f := range r.File {
+		h, err := zipHeader(f, func(string, string) {})
+		if err != nil {
+			_ = r.Close()
+			return nil, nil, fmt.Errorf("%v: %v", path, err)
+		}
+		if h == nil {
+			continue
+		}
+		name := listing.rel(h.name)
+		switch {
+		case name == "":
+		case h.dir:
+			t.addDir(name)
+		default:
+			f := f
+			t.addFile(name, &lazyFile{name: f.Name, size: int64(f.UncompressedSize64), open: f.Open})
+		}
+	}
+	return t.root(), r, nil
+}
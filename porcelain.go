@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// Formats of --output: the root CID for the humans, or a record per file
+// for the scripts, tab separated like --porcelain, as a JSON array written
+// once the upload completes, or as a JSON object per line as they are added.
+const (
+	outputText      = "text"
+	outputPorcelain = "porcelain"
+	outputJSON      = "json"
+	outputNDJSON    = "ndjson"
+)
+
+// porcelainHeader is the first line of --porcelain, naming the columns and
+// the version of the format. The columns of a version keep their position
+// and meaning, new ones are only appended. The exit codes are part of the
+// same contract.
+const porcelainHeader = "#porcelain-v1\tstatus\tindex\tfilename\tcid\tbytes\tattempts\tduration_ms"
+
+// porcelainNone stands for an unknown value of a column.
+const porcelainNone = "-"
+
+// porcelainEscaper escapes the separators in the file names.
+var porcelainEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+// outputRecord is a file of --output json and ndjson, the fields being
+// those of the columns of --porcelain.
+type outputRecord struct {
+	Status string `json:"status"`
+	Path   string `json:"path"`
+	// Index is nil for the files not named after a number
+	Index      *int    `json:"index"`
+	Cid        string  `json:"cid,omitempty"`
+	Size       int64   `json:"size"`
+	Attempts   int     `json:"attempts"`
+	DurationMs float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// porcelain writes the files of the upload of --porcelain, one tab
+// separated line each: added, cached or failed, the token index, the file name
+// relative to the uploaded path, the CID, the bytes uploaded, the number of
+// the attempt which succeeded and the upload time, - for the unknown ones.
+// With --output json or ndjson, the files are written as outputRecord.
+type porcelain struct {
+	// w is nil when the records are only collected, as for --manifest
+	w      io.Writer
+	format string
+	// records are the files of --output json, written on completion
+	records []outputRecord
+	// root is the name of the uploaded path itself, . for a directory
+	root string
+	// indexes are the token indexes by file name, when shuffled
+	indexes map[string]int
+	// rootFailed is whether the row of the failed upload is written
+	rootFailed bool
+}
+
+func newPorcelain(w io.Writer, format, root string) *porcelain {
+	p := &porcelain{w: w, format: format, root: root, records: []outputRecord{}}
+	if format == outputPorcelain {
+		p.line(porcelainHeader)
+	}
+	return p
+}
+
+// SetTokens makes the index of the files the one of their token.
+func (p *porcelain) SetTokens(tokens []*token) {
+	p.indexes = make(map[string]int)
+	for _, t := range tokens {
+		p.indexes[t.Path] = t.Index
+	}
+}
+
+// Event writes the row of a completed or failed file, and of the uploaded
+// path if the upload failed before it started. With --output json, the
+// rows are written once the run completes.
+func (p *porcelain) Event(e uploader.Event) {
+	switch e := e.(type) {
+	case uploader.FileCompleted:
+		status := "added"
+		if e.Cached {
+			status = "cached"
+		}
+		p.row(outputRecord{Status: status, Path: e.Name, Cid: e.Cid.String(), Size: e.Bytes, Attempts: e.Attempts, DurationMs: milliseconds(e.Duration)})
+	case uploader.FileFailed:
+		p.rootFailed = p.rootFailed || e.Name == ""
+		p.row(outputRecord{Status: "failed", Path: e.Name, Attempts: 1, Error: errorString(e.Err)})
+	case uploader.RunCompleted:
+		if e.Err != nil && !p.rootFailed {
+			p.row(outputRecord{Status: "failed", Attempts: 1, Error: e.Err.Error()})
+		}
+		if p.format == outputJSON && p.w != nil {
+			enc := p.encoder()
+			enc.SetIndent("", "  ")
+			_ = enc.Encode(p.records)
+		}
+	}
+}
+
+func (p *porcelain) row(r outputRecord) {
+	name := r.Path
+	if r.Path == "" {
+		r.Path = p.root
+	}
+	if i, ok := p.indexes[name]; ok {
+		r.Index = &i
+	} else if i, ok := tokenIndex(path.Base(r.Path)); ok && p.indexes == nil {
+		r.Index = &i
+	}
+
+	switch p.format {
+	case outputJSON:
+		p.records = append(p.records, r)
+		return
+	case outputNDJSON:
+		_ = p.encoder().Encode(r)
+		return
+	}
+	index, cid, bytes, duration := porcelainNone, porcelainNone, porcelainNone, porcelainNone
+	if r.Index != nil {
+		index = strconv.Itoa(*r.Index)
+	}
+	if r.Status != "failed" {
+		cid, bytes, duration = r.Cid, strconv.FormatInt(r.Size, 10), strconv.FormatFloat(r.DurationMs, 'f', -1, 64)
+	}
+	p.line(strings.Join([]string{r.Status, index, porcelainEscaper.Replace(r.Path), cid, bytes, strconv.Itoa(r.Attempts), duration}, "\t"))
+}
+
+// encoder returns an encoder of JSON lines to the output, leaving the URLs
+// of the errors unescaped.
+func (p *porcelain) encoder() *json.Encoder {
+	enc := json.NewEncoder(p.w)
+	enc.SetEscapeHTML(false)
+	return enc
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func (p *porcelain) line(s string) {
+	_, _ = fmt.Fprintln(p.w, s)
+}
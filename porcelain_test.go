@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	goflag "flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// update rewrites the golden files with the output of the tests, to be
+// reviewed: the formats must not change within a major version.
+var update = goflag.Bool("update", false, "rewrite the golden files of testdata")
+
+// golden compares got with the file testdata/name, or rewrites it with
+// -update.
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	p := filepath.Join("testdata", name)
+	if *update {
+		if err := ioutil.WriteFile(p, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("the output differs from %v, run go test -update if the change is intended:\n%s", p, got)
+	}
+}
+
+// testCID returns the CID of s.
+func testCID(t *testing.T, s string) cid.Cid {
+	t.Helper()
+	hash, err := mh.Sum([]byte(s), mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cid.NewCidV0(hash)
+}
+
+// outputRuns are the events of the runs whose output is locked down.
+func outputRuns(t *testing.T) map[string][]uploader.Event {
+	return map[string][]uploader.Event{
+		"added": {
+			uploader.FileCompleted{Name: "1.png", Cid: testCID(t, "one"), Bytes: 3, Size: "11", Duration: 1500 * time.Microsecond, Attempts: 1},
+			uploader.FileCompleted{Name: "sub/2.png", Cid: testCID(t, "two"), Bytes: 3, Size: "11", Duration: 2 * time.Millisecond, Attempts: 1},
+			uploader.FileCompleted{Name: "sub", Cid: testCID(t, "sub"), Size: "70", Duration: 3 * time.Millisecond, Attempts: 1},
+			uploader.FileCompleted{Name: "tab\tand\nnewline.png", Cid: testCID(t, "three"), Bytes: 5, Size: "13", Attempts: 1},
+			uploader.FileCompleted{Name: "", Cid: testCID(t, "root"), Size: "200", Duration: 4 * time.Millisecond, Attempts: 1},
+			uploader.RunCompleted{Root: testCID(t, "root"), Files: 5, Bytes: 11, Duration: 5 * time.Millisecond},
+		},
+		"cached": {
+			uploader.FileCompleted{Name: "1.png", Cid: testCID(t, "one"), Cached: true},
+			uploader.FileCompleted{Name: "", Cid: testCID(t, "root"), Cached: true},
+			uploader.RunCompleted{Root: testCID(t, "root"), Files: 2},
+		},
+		"failed": {
+			uploader.FileCompleted{Name: "1.png", Cid: testCID(t, "one"), Bytes: 3, Size: "11", Duration: time.Millisecond, Attempts: 1},
+			uploader.FileFailed{Name: "2.png", Err: errors.New("Post \"http://127.0.0.1:5001/api/v0/add?pin=true&progress=true\": EOF"), Class: uploader.ClassOther},
+			uploader.RunCompleted{Err: errors.New("Post \"http://127.0.0.1:5001/api/v0/add?pin=true&progress=true\": EOF"), Files: 1, Bytes: 3},
+		},
+	}
+}
+
+func TestOutputGolden(t *testing.T) {
+	for run, events := range outputRuns(t) {
+		for _, format := range []string{outputPorcelain, outputJSON, outputNDJSON} {
+			t.Run(run+"."+format, func(t *testing.T) {
+				var out bytes.Buffer
+				p := newPorcelain(&out, format, ".")
+				for _, e := range events {
+					p.Event(e)
+				}
+				golden(t, run+"."+format+".golden", out.Bytes())
+			})
+		}
+	}
+}
+
+func TestManifestGolden(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-upload-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for run, events := range outputRuns(t) {
+		for _, ext := range []string{".csv", ".json"} {
+			t.Run(run+ext, func(t *testing.T) {
+				p := filepath.Join(dir, run+ext)
+				m, err := newManifest(p, ".", 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, e := range events {
+					m.Event(e)
+				}
+				data, err := ioutil.ReadFile(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				golden(t, "manifest-"+run+ext+".golden", data)
+			})
+		}
+	}
+}
+
+func TestTextOutputGolden(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-upload-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{"nft/1.png": "one", "nft/sub/2.png": "two"})
+
+	// the CIDs of the fake API depend on the content only
+	out, code := runMain(t, dir, "--mock", "--no-cache", "--output", "text", "nft")
+	if code != exitSuccess {
+		t.Fatalf("exited with %v", code)
+	}
+	golden(t, "added.text.golden", []byte(out))
+	if strings.Count(out, "\n") != 1 {
+		t.Errorf("the text output has more than the root CID: %q", out)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"sync"
+
+	ipfsFiles "github.com/ipfs/go-ipfs-files"
+	"golang.org/x/sync/semaphore"
+)
+
+// prefetcher reads small files into memory ahead of the upload so that the
+// network stream doesn't wait on disk seeks. Files are read by a pool of
+// reader goroutines, bounded by a total byte budget, while the upload
+// consumes them in order. Files larger than the threshold are streamed from
+// disk as usual.
+type prefetcher struct {
+	ctx       context.Context
+	readers   chan struct{}
+	budget    *semaphore.Weighted
+	threshold int64
+}
+
+func newPrefetcher(ctx context.Context, readers int, budget, threshold int64) *prefetcher {
+	return &prefetcher{
+		ctx:       ctx,
+		readers:   make(chan struct{}, readers),
+		budget:    semaphore.NewWeighted(budget),
+		threshold: threshold,
+	}
+}
+
+// Wrap returns node with the contents of every directory below it prefetched.
+func (p *prefetcher) Wrap(node ipfsFiles.Node) ipfsFiles.Node {
+	if dir, ok := node.(ipfsFiles.Directory); ok {
+		return &prefetchDirectory{Directory: dir, prefetcher: p}
+	}
+	return node
+}
+
+type prefetchDirectory struct {
+	ipfsFiles.Directory
+	prefetcher *prefetcher
+}
+
+func (d *prefetchDirectory) Entries() ipfsFiles.DirIterator {
+	entries := make(chan *prefetchEntry, 2*cap(d.prefetcher.readers))
+	go d.prefetcher.walk(d.Directory.Entries(), entries)
+	return &prefetchIterator{entries: entries}
+}
+
+type prefetchEntry struct {
+	name string
+	node ipfsFiles.Node
+	err  error
+
+	// ready is closed once node or err is set
+	ready chan struct{}
+	// done is closed once the upload moved past a directory entry
+	done chan struct{}
+}
+
+// walk advances it ahead of the upload and sends its entries, in order.
+func (p *prefetcher) walk(it ipfsFiles.DirIterator, entries chan<- *prefetchEntry) {
+	defer close(entries)
+
+	for it.Next() {
+		entry := &prefetchEntry{name: it.Name(), ready: make(chan struct{})}
+
+		switch n := it.Node().(type) {
+		case *ipfsFiles.Symlink:
+			entry.node = n
+			close(entry.ready)
+		case ipfsFiles.Directory:
+			entry.node = p.Wrap(n)
+			entry.done = make(chan struct{})
+			close(entry.ready)
+		case ipfsFiles.File:
+			size, err := n.Size()
+			if err != nil || size > p.threshold {
+				entry.node = n
+				close(entry.ready)
+				break
+			}
+			if err := p.budget.Acquire(p.ctx, size); err != nil {
+				return
+			}
+			select {
+			case p.readers <- struct{}{}:
+			case <-p.ctx.Done():
+				return
+			}
+			go p.read(entry, n, size)
+		default:
+			entry.node = n
+			close(entry.ready)
+		}
+
+		select {
+		case entries <- entry:
+		case <-p.ctx.Done():
+			return
+		}
+
+		// Don't read further ahead while a sub-directory is being uploaded,
+		// the memory budget would otherwise be held by files the upload
+		// can't reach yet.
+		if entry.done != nil {
+			select {
+			case <-entry.done:
+			case <-p.ctx.Done():
+				return
+			}
+		}
+	}
+
+	if err := it.Err(); err != nil {
+		entry := &prefetchEntry{err: err, ready: make(chan struct{})}
+		close(entry.ready)
+		select {
+		case entries <- entry:
+		case <-p.ctx.Done():
+		}
+	}
+}
+
+func (p *prefetcher) read(entry *prefetchEntry, file ipfsFiles.File, size int64) {
+	defer func() {
+		<-p.readers
+		close(entry.ready)
+	}()
+
+	data, err := ioutil.ReadAll(file)
+	_ = file.Close()
+	if err != nil {
+		p.budget.Release(size)
+		entry.err = err
+		return
+	}
+	entry.node = &bufferedFile{
+		File:    ipfsFiles.NewBytesFile(data),
+		release: func() { p.budget.Release(size) },
+	}
+}
+
+type prefetchIterator struct {
+	entries <-chan *prefetchEntry
+	cur     *prefetchEntry
+	err     error
+}
+
+func (it *prefetchIterator) Name() string {
+	return it.cur.name
+}
+
+func (it *prefetchIterator) Node() ipfsFiles.Node {
+	return it.cur.node
+}
+
+func (it *prefetchIterator) Next() bool {
+	if it.cur != nil && it.cur.done != nil {
+		close(it.cur.done)
+	}
+	it.cur = nil
+
+	entry, ok := <-it.entries
+	if !ok {
+		return false
+	}
+	<-entry.ready
+	if entry.err != nil {
+		it.err = entry.err
+		return false
+	}
+	it.cur = entry
+	return true
+}
+
+func (it *prefetchIterator) Err() error {
+	return it.err
+}
+
+// bufferedFile is an in-memory file giving its share of the budget back
+// once the upload is done with it.
+type bufferedFile struct {
+	ipfsFiles.File
+	once    sync.Once
+	release func()
+}
+
+func (f *bufferedFile) Close() error {
+	f.once.Do(f.release)
+	return f.File.Close()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// BenchmarkPrefetch uploads a collection of 10k small files to the fake
+// API, with the files read ahead as --readers does by default and without,
+// e.g. with go test -bench Prefetch -run none. The files are in the page
+// cache after the first run, so it measures the cost of the read-ahead more
+// than the disk seeks it saves.
+func BenchmarkPrefetch(b *testing.B) {
+	dir, err := ioutil.TempDir("", "ipfs-upload-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 10k files of 1 to 8KB, spread over directories of 1000 like the
+	// layers of a generated collection
+	const files = 10000
+	r := rand.New(rand.NewSource(1))
+	var size int64
+	for i := 0; i < files; i++ {
+		p := filepath.Join(dir, fmt.Sprintf("%02d", i/1000), fmt.Sprintf("%v.png", i))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			b.Fatal(err)
+		}
+		data := make([]byte, 1<<10+r.Intn(7<<10))
+		r.Read(data)
+		if err := ioutil.WriteFile(p, data, 0644); err != nil {
+			b.Fatal(err)
+		}
+		size += int64(len(data))
+	}
+	stat, err := os.Stat(dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	fake := uploader.NewFakeAPI(0)
+	defer fake.Close()
+	up, err := uploader.New(uploader.Options{API: fake.URL})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, readers := range []int{0, 4} {
+		b.Run(fmt.Sprintf("readers=%v", readers), func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				node, err := uploader.NewFileNode(dir, false, stat)
+				if err != nil {
+					b.Fatal(err)
+				}
+				ctx, cancel := context.WithCancel(context.Background())
+				if readers > 0 {
+					// the defaults of --read-buffer and --stream-threshold
+					node = newPrefetcher(ctx, readers, 64<<20, 1<<20).Wrap(node)
+				}
+				_, added, err := up.Add(ctx, node, nil)
+				cancel()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(added) != files+files/1000+1 {
+					b.Fatalf("added %v files and directories, want %v", len(added), files+files/1000+1)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/INFURA/ipfs-upload-client/internal/preview"
+)
+
+// generatePreviews writes the previews of the images of tokens to dir with
+// preview.Write and sets the previews of tokens, an image already
+// small enough being its own preview. Files which aren't images are
+// skipped and returned.
+func generatePreviews(ctx context.Context, tokens []*token, dir string, size, workers int) (previews []*token, skipped []string, err error) {
+	paths := make([]string, len(tokens))
+	names := make([]string, len(tokens))
+	for i, t := range tokens {
+		paths[i], names[i] = t.LocalPath, strconv.Itoa(t.Index)
+	}
+	written, err := preview.Write(ctx, paths, names, dir, size, workers)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i, t := range tokens {
+		switch p := written[i]; {
+		case p.NotImage:
+			skipped = append(skipped, t.Filename)
+		case p.Path == "":
+			t.Preview = t
+		default:
+			stat, err := os.Stat(p.Path)
+			if err != nil {
+				return nil, nil, err
+			}
+			name := filepath.Base(p.Path)
+			t.Preview = &token{
+				Index:     t.Index,
+				Path:      name,
+				LocalPath: p.Path,
+				Filename:  name,
+				Size:      stat.Size(),
+				MIMEType:  detectMIMEType(p.Path),
+			}
+			previews = append(previews, t.Preview)
+		}
+	}
+	return previews, skipped, nil
+}
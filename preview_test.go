@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestGeneratePreviews(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-upload-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	previewDir := filepath.Join(dir, "previews")
+	if err := os.Mkdir(previewDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// large images get a preview, small ones are their own, and the other
+	// files are skipped
+	var tokens []*token
+	for i, width := range []int{64, 8, 0, 32, 64} {
+		tok := &token{Index: i, Filename: strconv.Itoa(i) + ".png", LocalPath: filepath.Join(dir, strconv.Itoa(i)+".png")}
+		f, err := os.Create(tok.LocalPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if width > 0 {
+			err = png.Encode(f, image.NewRGBA(image.Rect(0, 0, width, width/2)))
+		} else {
+			_, err = f.WriteString("not an image")
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, tok)
+	}
+
+	previews, skipped, err := generatePreviews(context.Background(), tokens, previewDir, 16, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(previews) != 3 || len(skipped) != 1 || skipped[0] != "2.png" {
+		t.Fatalf("got %v previews and skipped %q, want 3 and 2.png", len(previews), skipped)
+	}
+	for i, want := range []int{0, 3, 4} {
+		if previews[i].Index != want || tokens[want].Preview != previews[i] {
+			t.Errorf("the preview %v is of the token %v, want %v", i, previews[i].Index, want)
+		}
+	}
+	if tokens[1].Preview != tokens[1] {
+		t.Error("the small image isn't its own preview")
+	}
+
+	// a missing image fails the run
+	tokens = append(tokens, &token{Index: 5, Filename: "5.png", LocalPath: filepath.Join(dir, "5.png")})
+	if _, _, err := generatePreviews(context.Background(), tokens, previewDir, 16, 2); err == nil {
+		t.Error("a missing image didn't fail the previews")
+	}
+}
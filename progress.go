@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// Modes of --progress: a bar redrawn in place when the standard error is a
+// terminal and a line every --progress-interval otherwise, or forced.
+const (
+	progressAuto  = "auto"
+	progressPlain = "plain"
+	progressBar   = "bar"
+	progressNone  = "none"
+)
+
+// progressBarInterval is how often the bar is redrawn.
+const progressBarInterval = 200 * time.Millisecond
+
+// isTerminal reports whether f is a terminal rather than a file or a pipe,
+// as in CI.
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// progressMode returns the mode of --progress mode, the bar being only
+// drawn in text on a terminal.
+func progressMode(mode, logFormat string) string {
+	terminal := isTerminal(os.Stderr) && logFormat == logFormatText
+	switch {
+	case mode == progressAuto && terminal:
+		return progressBar
+	case mode == progressAuto, mode == progressBar && !terminal:
+		return progressPlain
+	}
+	return mode
+}
+
+// progress summarizes the upload of the files of sizes, by name as in the
+// events, or of an unknown number of files if nil.
+type progress struct {
+	sizes      map[string]int64
+	totalBytes int64
+	// bytes returns the bytes uploaded so far
+	bytes func() int64
+	// concurrency returns the requests allowed in flight of --concurrency
+	// auto, nil otherwise
+	concurrency func() int
+	start       time.Time
+
+	mu     sync.Mutex
+	files  int
+	failed int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newProgress(sizes map[string]int64, bytes func() int64) *progress {
+	p := &progress{sizes: sizes, bytes: bytes, start: time.Now()}
+	for _, size := range sizes {
+		p.totalBytes += size
+	}
+	return p
+}
+
+// Event counts the files completed and failed.
+func (p *progress) Event(e uploader.Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch e := e.(type) {
+	case uploader.FileCompleted:
+		if _, ok := p.sizes[e.Name]; ok || (p.sizes == nil && e.Bytes > 0) {
+			p.files++
+		}
+	case uploader.FileFailed:
+		if e.Name != "" {
+			p.failed++
+		}
+	}
+}
+
+// String returns the summary of the upload so far, e.g. uploaded 1200/3333
+// (36%), 540.0 MB at 3.1 MB/s, 4 failed, ETA 18m.
+func (p *progress) String() string {
+	p.mu.Lock()
+	files, failed := p.files, p.failed
+	p.mu.Unlock()
+	bytes := p.bytes()
+
+	s := fmt.Sprintf("uploaded %v", files)
+	if p.sizes != nil {
+		percent := 100
+		if p.totalBytes > 0 {
+			percent = int(bytes * 100 / p.totalBytes)
+		} else if len(p.sizes) > 0 {
+			percent = files * 100 / len(p.sizes)
+		}
+		if percent > 100 {
+			percent = 100
+		}
+		s = fmt.Sprintf("uploaded %v/%v (%v%%)", files, len(p.sizes), percent)
+	}
+	s += fmt.Sprintf(", %v", formatBytes(float64(bytes)))
+	elapsed := time.Since(p.start)
+	if rate := p.rate(bytes, elapsed); rate > 0 {
+		s += fmt.Sprintf(" at %v/s", formatBytes(rate))
+	}
+	if failed > 0 {
+		s += fmt.Sprintf(", %v failed", failed)
+	}
+	if p.totalBytes > 0 && bytes > 0 && bytes < p.totalBytes {
+		eta := time.Duration(float64(elapsed) * float64(p.totalBytes-bytes) / float64(bytes))
+		s += fmt.Sprintf(", ETA %v", formatETA(eta))
+	}
+	if p.concurrency != nil {
+		s += fmt.Sprintf(", concurrency %v", p.concurrency())
+	}
+	return s
+}
+
+// rate returns the bytes uploaded per second on average, 0 in the first
+// second when it would be meaningless.
+func (p *progress) rate(bytes int64, elapsed time.Duration) float64 {
+	if elapsed < time.Second {
+		return 0
+	}
+	return float64(bytes) / elapsed.Seconds()
+}
+
+// formatETA rounds d to the minute, or to the second under a minute.
+func formatETA(d time.Duration) string {
+	if d < time.Minute {
+		return d.Round(time.Second).String()
+	}
+	d = d.Round(time.Minute)
+	if d < time.Hour {
+		return fmt.Sprintf("%vm", int(d.Minutes()))
+	}
+	return fmt.Sprintf("%vh%02dm", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// Start displays the progress in mode until Stop, a line every interval
+// if plain.
+func (p *progress) Start(mode string, interval time.Duration) {
+	if mode == progressNone {
+		return
+	}
+	p.stop, p.done = make(chan struct{}), make(chan struct{})
+	tick := interval
+	if mode == progressBar {
+		tick = progressBarInterval
+	}
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if mode == progressBar {
+					logs.Status(p.String())
+				} else {
+					p.log()
+				}
+			case <-p.stop:
+				logs.Status("")
+				return
+			}
+		}
+	}()
+}
+
+func (p *progress) log() {
+	p.mu.Lock()
+	files, failed := p.files, p.failed
+	p.mu.Unlock()
+	bytes := p.bytes()
+	logs.Info(p.String(), "files", files, "total_files", len(p.sizes), "bytes", bytes, "total_bytes", p.totalBytes, "bytes_per_second", int64(p.rate(bytes, time.Since(p.start))), "failed", failed)
+}
+
+// Stop stops displaying the progress, erasing the bar.
+func (p *progress) Stop() {
+	if p == nil || p.stop == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+	p.stop = nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	"github.com/INFURA/ipfs-upload-client/internal/strip"
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// provenance is the provenance record of a collection: the SHA-256 of the
+// concatenated hex encoded SHA-256 of every file in index order.
+type provenance struct {
+	Algorithm string `json:"algorithm"`
+	// ShuffleSeed is the --shuffle-seed of the token indexes, if any
+	ShuffleSeed string `json:"shuffle_seed,omitempty"`
+	// Order is how the hashes are concatenated
+	Order      string            `json:"order"`
+	Tokens     []provenanceToken `json:"tokens"`
+	Provenance string            `json:"provenance"`
+}
+
+type provenanceToken struct {
+	Index int `json:"index"`
+	// SourceIndex is the number the file is named after, if shuffled
+	SourceIndex *int   `json:"source_index,omitempty"`
+	Path        string `json:"path"`
+	SHA256      string `json:"sha256"`
+}
+
+// newProvenance hashes the file of every token, tokens being sorted by
+// index, of its content without the image metadata if stripped, like it is
+// uploaded. The tokens were shuffled with seed unless it is empty.
+func newProvenance(tokens []*token, stripped bool, seed string) (*provenance, error) {
+	p := &provenance{
+		Algorithm:   "sha256",
+		Order:       "the lowercase hex SHA-256 of every file by increasing index, without separator, skipping the missing indexes",
+		Tokens:      make([]provenanceToken, 0, len(tokens)),
+		ShuffleSeed: seed,
+	}
+	var concatenated strings.Builder
+	for _, t := range tokens {
+		sum, err := uploader.HashFile(t.LocalPath, stripped && strip.Supported(t.LocalPath))
+		if err == strip.ErrCorruptImage {
+			// uploaded as is
+			sum, err = uploader.HashFile(t.LocalPath, false)
+		}
+		if err != nil {
+			return nil, err
+		}
+		record := provenanceToken{Index: t.Index, Path: t.Path, SHA256: sum}
+		if seed != "" {
+			source := t.SourceIndex
+			record.SourceIndex = &source
+		}
+		p.Tokens = append(p.Tokens, record)
+		concatenated.WriteString(sum)
+	}
+	final := sha256.Sum256([]byte(concatenated.String()))
+	p.Provenance = hex.EncodeToString(final[:])
+	return p, nil
+}
+
+// Write writes the record as JSON to path.
+func (p *provenance) Write(path string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return uploader.WriteFileAtomic(path, data)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProvenance(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"1.txt": "one", "2.txt": "two", "5.txt": "three", "6.png": "not a png"})
+	tok := func(index, source int, name string) *token {
+		return &token{Index: index, SourceIndex: source, Path: name, LocalPath: filepath.Join(dir, name)}
+	}
+	const (
+		one   = "7692c3ad3540bb803c020b3aee66cd8887123234ea0c6e7143c0add73ff431ed"
+		two   = "3fc4ccfe745870e2c0d99f71f30ff0656c8dedd41cc1d7d3d376b0dbe685e2f3"
+		three = "8b5b9db0c13db24256c829aa364aa90c6d2eba318b9232a4ab9313b954d3555f"
+	)
+	tests := []struct {
+		name     string
+		tokens   []*token
+		stripped bool
+		seed     string
+		// hashes are those of the tokens, want the provenance
+		hashes []string
+		want   string
+	}{
+		{
+			name:   "missing index skipped",
+			tokens: []*token{tok(1, 1, "1.txt"), tok(2, 2, "2.txt"), tok(5, 5, "5.txt")},
+			hashes: []string{one, two, three},
+			want:   "581bf126a7c8696f7a34575266bad93c477c6dd4328504ca870fb3dbd24b1fc5",
+		},
+		{
+			name:   "shuffled",
+			tokens: []*token{tok(1, 2, "2.txt"), tok(2, 1, "1.txt")},
+			seed:   "42",
+			hashes: []string{two, one},
+			want:   "7285db8f3810702a72c3f827d0639ad199741cb01f0b638b5a76910146c97801",
+		},
+		{
+			name:   "none",
+			hashes: []string{},
+			want:   "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		},
+		{
+			// an image which can't be stripped is hashed as is, as it is
+			// uploaded
+			name:     "corrupt image stripped",
+			tokens:   []*token{tok(6, 6, "6.png")},
+			stripped: true,
+			hashes:   []string{"2aade9c49b9414c70f452b226271ef5066e2894cdd0557f54857819fb7bcc782"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newProvenance(tt.tokens, tt.stripped, tt.seed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(p.Tokens) != len(tt.hashes) {
+				t.Fatalf("got %v tokens, want %v", len(p.Tokens), len(tt.hashes))
+			}
+			for i, record := range p.Tokens {
+				if record.SHA256 != tt.hashes[i] || record.Index != tt.tokens[i].Index || record.Path != tt.tokens[i].Path {
+					t.Errorf("token %v is %+v", i, record)
+				}
+				if (record.SourceIndex != nil) != (tt.seed != "") || record.SourceIndex != nil && *record.SourceIndex != tt.tokens[i].SourceIndex {
+					t.Errorf("token %v has source index %v", i, record.SourceIndex)
+				}
+			}
+			if tt.want != "" && p.Provenance != tt.want {
+				t.Errorf("provenance %v, want %v", p.Provenance, tt.want)
+			}
+		})
+	}
+
+	if _, err := newProvenance([]*token{tok(9, 9, "9.txt")}, false, ""); err == nil {
+		t.Error("no error hashing a missing file")
+	}
+}
+
+func TestProvenanceWrite(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"1.txt": "one"})
+	p, err := newProvenance([]*token{{Index: 1, SourceIndex: 1, Path: "1.txt", LocalPath: filepath.Join(dir, "1.txt")}}, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "provenance.json")
+	if err := p.Write(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"algorithm": "sha256"`, `"provenance": "`, `"path": "1.txt"`} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("no %v in %s", want, data)
+		}
+	}
+	if strings.Contains(string(data), "shuffle_seed") || strings.Contains(string(data), "source_index") {
+		t.Errorf("a seed or source index without --shuffle-seed in %s", data)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ipfs/go-cid"
+	ipfsFiles "github.com/ipfs/go-ipfs-files"
+	ipfsPath "github.com/ipfs/interface-go-ipfs-core/path"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// publish writes the outputs of the files uploaded: their metadata, its
+// upload, the URI list, the collection, the mapping, and the remote pins,
+// then ends the run.
+func (r *uploadRun) publish() error {
+	if *out != "" || *uriList != "" || *mappingPath != "" {
+		err := assignCIDs(r.tokens, r.added)
+		if err == nil {
+			err = assignCIDs(r.thumbnails, r.thumbnailsAdded)
+		}
+		if err == nil {
+			err = assignCIDs(r.previews, r.previewsAdded)
+		}
+		if err != nil {
+			logs.Error(err.Error())
+			return finish(r.start, exitCode(err, interrupted()))
+		}
+	}
+
+	var written []*token
+	if *out != "" {
+		if r.schema != nil {
+			if err := r.validateTokens(); err != nil {
+				logs.Error(err.Error())
+				return finish(r.start, exitCode(err, interrupted()))
+			}
+		}
+		written = r.tokens
+		if r.placeholderCID.Defined() {
+			written = placeholderTokens(r.tokens, r.placeholderCID)
+		}
+		if err := writeMetadata(*out, written, r.metaOpts); err != nil {
+			logs.Error(err.Error())
+			return finish(r.start, exitCode(err, interrupted()))
+		}
+		logs.Info(fmt.Sprintf("Wrote the metadata of %v files to %v", len(r.tokens), *out))
+	}
+	var err error
+	uriTokens, uriRoot := r.tokens, r.root
+	if r.individualJSON {
+		if uriTokens, err = r.uploadJSONFiles(); err != nil {
+			return err
+		}
+	}
+	if *uploadMetadata {
+		if uriTokens, uriRoot, err = r.uploadMetadataDir(written); err != nil {
+			return err
+		}
+	}
+	if *uriList != "" {
+		if *standard == erc1155 {
+			err = writeIDList(*uriList, uriTokens, uriRoot, r.formatURI, *hexIDs)
+		} else {
+			skippedIndexes := make(map[int]bool)
+			for _, t := range r.skipped {
+				skippedIndexes[t.Index] = true
+			}
+			err = writeURIList(*uriList, uriTokens, skippedIndexes, uriRoot, r.formatURI)
+		}
+		if err != nil {
+			logs.Error(err.Error())
+			return finish(r.start, exitCode(err, interrupted()))
+		}
+		logs.Info(fmt.Sprintf("Wrote the URIs of %v files to %v", len(r.tokens), *uriList))
+	}
+
+	if r.collection != nil {
+		contractURI, err := r.uploadCollection(r.collection)
+		if err != nil {
+			return r.metadataFailed(err)
+		}
+		r.summary.ContractURI = contractURI
+		logs.Info(fmt.Sprintf("Contract URI: %v", contractURI))
+	}
+	if *mappingPath != "" {
+		if err := writeMapping(*mappingPath, r.tokens, r.mappingKeys, r.metaOpts, r.summary.MetadataRoot); err != nil {
+			logs.Error(err.Error())
+			return finish(r.start, exitCode(err, interrupted()))
+		}
+		logs.Info(fmt.Sprintf("Wrote the mapping of %v files to %v", len(r.tokens), *mappingPath))
+	}
+	if len(r.skipIDs) > 0 {
+		logs.Info(fmt.Sprintf("Skipped %v tokens of --skip-ids and %v hidden files", r.summary.SkippedIDs, r.summary.SkippedHidden))
+	}
+	if *pinRemote {
+		if len(r.remotePins) == 0 {
+			logs.Warn("nothing to pin remotely, the files were neither uploaded nor their metadata")
+		} else if err := pinRemotely(r.ctx, uploader.NewRemotePinner(*pinEndpoint, *pinToken, r.httpClient), r.remotePins, *pinPoll, *pinTimeout); err != nil {
+			code := exitCode(err, interrupted())
+			logs.Error(err.Error(), "exit_code", code)
+			report.SetError(err)
+			if err := r.writeChecksums(); err != nil {
+				return err
+			}
+			r.summary.Bytes = r.payload.BytesRead()
+			r.notify.Finish(r.summary, code, err)
+			return finish(r.start, code)
+		}
+	}
+	if err := r.writeChecksums(); err != nil {
+		return err
+	}
+	r.summary.Bytes = r.payload.BytesRead()
+	r.notify.Finish(r.summary, exitSuccess, nil)
+	return finish(r.start, exitSuccess)
+}
+
+// uploadJSONFiles uploads the metadata files of --upload-json individual,
+// and returns the tokens of the URI list and of the mapping, pointing to
+// them, the metadata holding the final URLs.
+func (r *uploadRun) uploadJSONFiles() ([]*token, error) {
+	uriTokens := make([]*token, len(r.tokens))
+	for i, t := range r.tokens {
+		name := metadataName(t, r.metaOpts)
+		path := filepath.Join(*out, name)
+		stat, err := os.Stat(path)
+		if err != nil {
+			return nil, r.fail(err)
+		}
+		file, err := ipfsFiles.NewSerialFile(path, false, stat)
+		if err != nil {
+			return nil, r.fail(err)
+		}
+		var count int
+		jsonRes, _, err := r.add(file, path, "", &count)
+		if err != nil {
+			return nil, r.metadataFailed(err)
+		}
+		t.MetadataCid = jsonRes.Cid()
+		logs.Info(fmt.Sprintf("Added %v %v", filepath.Join(filepath.Base(*out), name), t.MetadataCid))
+		uriTokens[i] = &token{Index: t.Index, Path: name, Filename: name, Cid: t.MetadataCid}
+	}
+	return uriTokens, nil
+}
+
+// uploadMetadataDir uploads the directory of the metadata of --out, after
+// the one of its localized files, and returns the tokens and the root of
+// the URI list, pointing to the metadata.
+func (r *uploadRun) uploadMetadataDir(written []*token) ([]*token, cid.Cid, error) {
+	var metadataRes ipfsPath.Resolved
+	var metadataFiles map[string]cid.Cid
+	var count int
+	var dir ipfsFiles.Directory
+	var err error
+	if r.metaOpts.Localization != nil {
+		// the default metadata links to the directory of the localized
+		// files, which is uploaded first
+		var localizedRes ipfsPath.Resolved
+		dir, err = namedFiles(*out, r.metaOpts.Localization.Names(r.tokens, r.metaOpts))
+		if err == nil {
+			localizedRes, _, err = r.add(dir, *out, filepath.Base(*out)+"/", &count)
+		}
+		if err == nil {
+			logs.Info(fmt.Sprintf("Localized metadata: %v", localizedRes.Cid()))
+			r.metaOpts.Localization.Root = localizedRes.Cid().String()
+			err = writeMetadata(*out, written, r.metaOpts)
+		}
+	}
+	if err == nil {
+		dir, err = metadataDirectory(*out, r.tokens, r.metaOpts)
+	}
+	if err == nil {
+		metadataRes, metadataFiles, err = r.add(dir, *out, filepath.Base(*out)+"/", &count)
+	}
+	if err != nil {
+		return nil, cid.Undef, r.metadataFailed(err)
+	}
+	r.summary.MetadataRoot = metadataRes.Cid().String()
+	r.remotePins = append(r.remotePins, remotePin{Name: filepath.Base(*out), Cid: metadataRes.Cid()})
+	uriTokens := make([]*token, len(r.tokens))
+	for i, t := range r.tokens {
+		name := metadataName(t, r.metaOpts)
+		uriTokens[i] = &token{Index: t.Index, Path: name, Filename: name, Cid: metadataFiles[name]}
+	}
+	if *hexIDs {
+		logs.Info(fmt.Sprintf("URI: ipfs://%v/{id}%v", metadataRes.Cid(), *jsonExtension))
+	} else {
+		logs.Info(fmt.Sprintf("Base URI: ipfs://%v/", metadataRes.Cid()))
+	}
+	return uriTokens, metadataRes.Cid(), nil
+}
+
+// uploadCollection uploads the image of the collection, then its metadata
+// written to --out, and returns the contractURI.
+func (r *uploadRun) uploadCollection(c *collectionConfig) (string, error) {
+	image := c.Image
+	if image != "" && !c.HasImageURL() {
+		imageRes, err := r.addFile(c.Image)
+		if err != nil {
+			return "", err
+		}
+		image = "ipfs://" + imageRes.Cid().String()
+	}
+	data, err := c.Render(image, r.royaltyInfo, r.metaOpts.Format)
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Join(*out, collectionMetadataName)
+	if err := uploader.WriteFileAtomic(name, data); err != nil {
+		return "", err
+	}
+	res, err := r.addFile(name)
+	if err != nil {
+		return "", err
+	}
+	return "ipfs://" + res.Cid().String(), nil
+}
+
+// writeChecksums writes the checksums of --checksums, returning the
+// exitError of a failure.
+func (r *uploadRun) writeChecksums() error {
+	if r.sums == nil {
+		return nil
+	}
+	if err := r.sums.Write(*checksums); err != nil {
+		logs.Error(err.Error())
+		return finish(r.start, exitCode(err, interrupted()))
+	}
+	logs.Info(fmt.Sprintf("Wrote the checksums to %v", *checksums))
+	return nil
+}
+
+// metadataFailed ends the run on the failure of the upload of the
+// metadata, the files being uploaded so that only the metadata is to be
+// done again.
+func (r *uploadRun) metadataFailed(err error) error {
+	code := exitCode(err, interrupted())
+	class := uploader.ErrorClass(err)
+	if code == exitFailed {
+		code = exitMetadataFailed
+	}
+	if r.root.Defined() {
+		err = fmt.Errorf("uploading the metadata failed, the files were uploaded as %v: %v (%v)", r.root, err, r.requestIDs.Describe())
+	} else {
+		err = fmt.Errorf("uploading the metadata failed: %v (%v)", err, r.requestIDs.Describe())
+	}
+	logs.Error(err.Error(), "error_class", class, "request_id", r.requestIDs.LastID(), "exit_code", code)
+	report.SetError(err)
+	if err := r.writeChecksums(); err != nil {
+		return err
+	}
+	r.summary.Bytes = r.payload.BytesRead()
+	r.notify.Finish(r.summary, code, err)
+	return finish(r.start, code)
+}
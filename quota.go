@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// quotaHeaders are the names of the response headers reporting the rate
+// limit, they differ between providers.
+type quotaHeaders struct {
+	Limit     string
+	Remaining string
+	Reset     string
+}
+
+// quotaTransport records the most recent rate limit headers returned by the
+// API.
+type quotaTransport struct {
+	base    http.RoundTripper
+	headers quotaHeaders
+
+	mu        sync.Mutex
+	known     bool
+	limit     string
+	remaining string
+	reset     string
+}
+
+func (t *quotaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	remaining := resp.Header.Get(t.headers.Remaining)
+	if remaining != "" {
+		t.mu.Lock()
+		t.known = true
+		t.remaining = remaining
+		t.limit = resp.Header.Get(t.headers.Limit)
+		t.reset = resp.Header.Get(t.headers.Reset)
+		t.mu.Unlock()
+	}
+	return resp, nil
+}
+
+// String describes the remaining quota, or returns "" if the API didn't
+// report it.
+func (t *quotaTransport) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.known {
+		return ""
+	}
+	str := t.remaining
+	if t.limit != "" {
+		str += "/" + t.limit
+	}
+	if t.reset != "" {
+		str += fmt.Sprintf(" (reset %v)", t.reset)
+	}
+	return str
+}
+
+// Low reports whether the remaining quota is below percent of the limit.
+func (t *quotaTransport) Low(percent float64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	remaining, err := strconv.ParseFloat(t.remaining, 64)
+	if err != nil {
+		return false
+	}
+	limit, err := strconv.ParseFloat(t.limit, 64)
+	if err != nil || limit <= 0 {
+		return false
+	}
+	return remaining/limit*100 < percent
+}
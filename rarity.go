@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// rarityMethod scores the rarity of the tokens with the indexes, higher
+// being rarer.
+type rarityMethod func(table *attributeTable, indexes []int) map[int]float64
+
+// rarityMethods are the methods of --rarity-method by name.
+var rarityMethods = map[string]rarityMethod{
+	"statistical": statisticalRarity,
+}
+
+// statisticalRarity sums the inverse of the frequency of every trait value
+// of a token among the tokens, empty values being skipped.
+func statisticalRarity(table *attributeTable, indexes []int) map[int]float64 {
+	counts := make([]map[string]int, len(table.traits))
+	for i := range counts {
+		counts[i] = make(map[string]int)
+	}
+	for _, index := range indexes {
+		for i, value := range table.rows[index] {
+			if value != "" {
+				counts[i][value]++
+			}
+		}
+	}
+
+	scores := make(map[int]float64)
+	for _, index := range indexes {
+		var score float64
+		for i, value := range table.rows[index] {
+			if value != "" {
+				score += float64(len(indexes)) / float64(counts[i][value])
+			}
+		}
+		scores[index] = math.Round(score*100) / 100
+	}
+	return scores
+}
+
+// SetRarity scores the rarity of the tokens with a row, the tokens without
+// one being left out, and adds it to their attributes as the trait if it
+// isn't empty. It returns the tokens left out.
+func (t *attributeTable) SetRarity(tokens []*token, method rarityMethod, trait string) (missing []int) {
+	var indexes []int
+	t.rarityIndex = make(map[int]int)
+	for _, tok := range tokens {
+		if _, ok := t.rows[tok.SourceIndex]; ok {
+			indexes = append(indexes, tok.SourceIndex)
+			t.rarityIndex[tok.SourceIndex] = tok.Index
+		} else {
+			missing = append(missing, tok.SourceIndex)
+		}
+	}
+	t.rarity = method(t, indexes)
+	t.rarityTrait = trait
+	return missing
+}
+
+// WriteRarity writes the rarity score and rank of every scored token as CSV
+// to path, rarest first, ties ranked by token index.
+func (t *attributeTable) WriteRarity(path string) error {
+	indexes := make([]int, 0, len(t.rarity))
+	for index := range t.rarity {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		a, b := t.rarity[indexes[i]], t.rarity[indexes[j]]
+		if a != b {
+			return a > b
+		}
+		return t.rarityIndex[indexes[i]] < t.rarityIndex[indexes[j]]
+	})
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	_ = w.Write([]string{tokenIDColumn, "rarity_score", "rank"})
+	for rank, index := range indexes {
+		_ = w.Write([]string{strconv.Itoa(t.rarityIndex[index]), strconv.FormatFloat(t.rarity[index], 'f', 2, 64), strconv.Itoa(rank + 1)})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("writing %v: %v", path, err)
+	}
+	return uploader.WriteFileAtomic(path, buf.Bytes())
+}
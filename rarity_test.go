@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestStatisticalRarity(t *testing.T) {
+	table, err := readAttributes(writeTestFile(t, "attributes.csv", "token_id,Background,Hat\n1,Blue,Cap\n2,Blue,\n3,Red,Cap\n4,Blue,Crown\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 4 tokens, Blue 3 times, Red once, Cap twice and Crown once, the empty
+	// hat not counting
+	want := map[int]float64{1: 3.33, 2: 1.33, 3: 6, 4: 5.33}
+	got := statisticalRarity(table, []int{1, 2, 3, 4})
+	for index, score := range want {
+		if got[index] != score {
+			t.Errorf("the score of %v is %v, want %v", index, got[index], score)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %v scores, want %v", len(got), len(want))
+	}
+
+	// the frequencies are among the scored tokens only
+	got = statisticalRarity(table, []int{1, 2})
+	if got[1] != 3 || got[2] != 1 {
+		t.Errorf("the scores of 1 and 2 alone are %v and %v, want 3 and 1", got[1], got[2])
+	}
+}
+
+func TestSetRarity(t *testing.T) {
+	table, err := readAttributes(writeTestFile(t, "attributes.csv", "token_id,Background,Hat\n1,Blue,Cap\n2,Blue,\n3,Red,Cap\n4,Blue,Crown\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// shuffled, the rows being those of the files, and 5 without a row
+	tokens := []*token{{Index: 4, SourceIndex: 1}, {Index: 3, SourceIndex: 2}, {Index: 2, SourceIndex: 3}, {Index: 1, SourceIndex: 4}, {Index: 5, SourceIndex: 5}}
+	missing := table.SetRarity(tokens, statisticalRarity, "Rarity Score")
+	if formatIndexes(missing) != "5" {
+		t.Errorf("missing %v, want 5", missing)
+	}
+
+	attributes, _ := table.Attributes(3)
+	got, err := json.Marshal(attributes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `[{"trait_type":"Background","value":"Red"},{"trait_type":"Hat","value":"Cap"},{"trait_type":"Rarity Score","value":6}]`; string(got) != want {
+		t.Errorf("attributes %s, want %s", got, want)
+	}
+
+	path := filepath.Join(t.TempDir(), "rarity.csv")
+	if err := table.WriteRarity(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// by token index, rarest first
+	if want := "token_id,rarity_score,rank\n2,6.00,1\n1,5.33,2\n4,3.33,3\n3,1.33,4\n"; string(data) != want {
+		t.Errorf("got %q, want %q", data, want)
+	}
+}
+
+func TestRarityTies(t *testing.T) {
+	table, err := readAttributes(writeTestFile(t, "attributes.csv", "token_id,Eyes\n1,Green\n2,Blue\n3,Red\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := []*token{{Index: 3, SourceIndex: 1}, {Index: 1, SourceIndex: 2}, {Index: 2, SourceIndex: 3}}
+	// without a trait, the score isn't an attribute
+	table.SetRarity(tokens, statisticalRarity, "")
+	if attributes, _ := table.Attributes(1); len(attributes) != 1 {
+		t.Errorf("attributes %v, want the eyes only", attributes)
+	}
+	path := filepath.Join(t.TempDir(), "rarity.csv")
+	if err := table.WriteRarity(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "token_id,rarity_score,rank\n1,3.00,1\n2,3.00,2\n3,3.00,3\n"; string(data) != want {
+		t.Errorf("got %q, want %q", data, want)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// limitTransport bounds the requests of the run: at most concurrency of
+// them at a time, a request keeping its slot until its response is closed,
+// and a rate of requests per second, drawn from a token bucket holding a
+// second of them so that a burst doesn't exceed the rate of a plan.
+type limitTransport struct {
+	base http.RoundTripper
+	// slots are the requests in flight, nil if unlimited
+	slots chan struct{}
+	// auto bounds them instead of slots for --concurrency auto
+	auto *autoConcurrency
+	// limiter is nil if unlimited
+	limiter *rate.Limiter
+}
+
+// newLimitTransport returns base bounded to concurrency requests at a time,
+// or to those auto allows if not nil, and perSecond requests a second, 0 not
+// bounding them, or base itself if nothing does.
+func newLimitTransport(base http.RoundTripper, concurrency int, auto *autoConcurrency, perSecond float64) http.RoundTripper {
+	if concurrency <= 0 && auto == nil && perSecond <= 0 {
+		return base
+	}
+	t := &limitTransport{base: base, auto: auto}
+	if concurrency > 0 && auto == nil {
+		t.slots = make(chan struct{}, concurrency)
+	}
+	if perSecond > 0 {
+		burst := int(perSecond)
+		if burst < 1 {
+			burst = 1
+		}
+		t.limiter = rate.NewLimiter(rate.Limit(perSecond), burst)
+	}
+	return t
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	// release frees the slot of the request, answered with status or
+	// failed with err
+	release := func(status int, err error) {}
+	switch {
+	case t.auto != nil:
+		if err := t.auto.acquire(ctx); err != nil {
+			return nil, err
+		}
+		var once sync.Once
+		release = func(status int, err error) { once.Do(func() { t.auto.done(status, err) }) }
+	case t.slots != nil:
+		select {
+		case t.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		var once sync.Once
+		release = func(int, error) { once.Do(func() { <-t.slots }) }
+	}
+	if t.limiter != nil {
+		if err := t.limiter.Wait(ctx); err != nil {
+			release(0, context.Canceled)
+			return nil, err
+		}
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		release(0, err)
+		return nil, err
+	}
+	status := resp.StatusCode
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: func() { release(status, nil) }}
+	return resp, nil
+}
+
+// releaseBody releases the slot of its request once closed.
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
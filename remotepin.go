@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// remotePin is a root of the run pinned with --pin-remote.
+type remotePin struct {
+	Name string
+	Cid  cid.Cid
+}
+
+// pinRemotely asks pinner to pin pins and polls their requests every poll
+// until they are pinned, or failed, within timeout. It logs their outcome
+// and returns an error if any of them isn't pinned.
+func pinRemotely(ctx context.Context, pinner *uploader.RemotePinner, pins []remotePin, poll, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var failed int
+	var wg sync.WaitGroup
+	for _, pin := range pins {
+		wg.Add(1)
+		go func(pin remotePin) {
+			defer wg.Done()
+			status, err := pinner.Add(ctx, pin.Cid, pin.Name, nil)
+			if err == nil {
+				logs.Info(fmt.Sprintf("Remote pin of %v %v %v", pin.Name, pin.Cid, status.Status), "cid", pin.Cid, "request_id", status.RequestID, "status", status.Status)
+				status, err = pinner.Wait(ctx, status, poll, func(s uploader.PinStatus) {
+					// the failures are logged with their reason below
+					if s.Status == uploader.PinFailed {
+						return
+					}
+					logs.Info(fmt.Sprintf("Remote pin of %v %v %v", pin.Name, pin.Cid, s.Status), "cid", pin.Cid, "request_id", s.RequestID, "status", s.Status)
+				})
+			}
+			if err == context.DeadlineExceeded {
+				err = fmt.Errorf("still %v after %v", status.Status, timeout)
+			}
+			if err == nil && status.Status == uploader.PinFailed {
+				err = fmt.Errorf("the service failed to pin it%v", remotePinDetails(status))
+			}
+			if err != nil {
+				logs.Error(fmt.Sprintf("Remote pin of %v %v failed: %v", pin.Name, pin.Cid, err), "cid", pin.Cid, "request_id", status.RequestID)
+				mu.Lock()
+				failed++
+				mu.Unlock()
+			}
+		}(pin)
+	}
+	wg.Wait()
+	if failed > 0 {
+		return fmt.Errorf("%v of %v remote pins failed", failed, len(pins))
+	}
+	return nil
+}
+
+// remotePinDetails returns the reason the service gives for a failed pin,
+// if any, as ": reason".
+func remotePinDetails(status uploader.PinStatus) string {
+	if details, ok := status.Info["status_details"]; ok {
+		return fmt.Sprintf(": %v", details)
+	}
+	return ""
+}
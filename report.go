@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	flag "github.com/spf13/pflag"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// reportInterrupted is the status of a run interrupted by a signal, besides
+// the success and failure of runSummary.
+const reportInterrupted = "interrupted"
+
+// runReport is the operational record of a run written to --report: its
+// configuration, timings and every file uploaded, whatever the outcome.
+type runReport struct {
+	path string
+	// summary is the summary of the run, completed as it goes
+	summary *runSummary
+	// bytes returns the bytes uploaded, interrupted whether the run was
+	// interrupted
+	bytes       func() int64
+	interrupted func() bool
+
+	mu      sync.Mutex
+	doc     reportDocument
+	err     error
+	indexes map[string]int
+	// durations are the upload times of the files, not of the directories
+	durations []time.Duration
+}
+
+type reportDocument struct {
+	RunID    string `json:"run_id"`
+	Status   string `json:"status"`
+	ExitCode int    `json:"exit_code"`
+	Error    string `json:"error,omitempty"`
+
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished"`
+	DurationMS float64   `json:"duration_ms"`
+
+	// Config are the parameters of the run, secrets redacted
+	Config    map[string]string `json:"config"`
+	Endpoints map[string]string `json:"endpoints"`
+
+	Root         string `json:"root,omitempty"`
+	MetadataRoot string `json:"metadata_root,omitempty"`
+	ContractURI  string `json:"contract_uri,omitempty"`
+	Bytes        int64  `json:"bytes"`
+
+	Files []reportFile `json:"files"`
+	// FileDurations are the percentiles of the upload time of the files,
+	// not of the directories
+	FileDurations *reportPercentiles `json:"file_duration_ms,omitempty"`
+}
+
+// reportFile is a file or directory of the run, named after its local
+// path.
+type reportFile struct {
+	Name       string  `json:"name"`
+	Index      *int    `json:"index,omitempty"`
+	Size       int64   `json:"size"`
+	Cid        string  `json:"cid,omitempty"`
+	DurationMS float64 `json:"duration_ms"`
+	Attempts   int     `json:"attempts"`
+	// Cached is whether the CID of a previous upload was reused
+	Cached     bool   `json:"cached,omitempty"`
+	Error      string `json:"error,omitempty"`
+	ErrorClass string `json:"error_class,omitempty"`
+}
+
+type reportPercentiles struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// milliseconds returns d in milliseconds, to the microsecond.
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// newRunReport returns the report of a run writing to path, with the
+// parameters of config, redacted by reportFlags.
+func newRunReport(path string, summary *runSummary, config map[string]string, endpoints map[string]string) *runReport {
+	return &runReport{
+		path:    path,
+		summary: summary,
+		doc: reportDocument{
+			Started:   time.Now().UTC(),
+			Config:    config,
+			Endpoints: endpoints,
+			Files:     []reportFile{},
+		},
+	}
+}
+
+// reportFlags returns the flags set on fs as written to the report, every
+// value of the repeated ones redacted on its own.
+func reportFlags(fs *flag.FlagSet) map[string]string {
+	flags := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		values, ok := f.Value.(flag.SliceValue)
+		if !ok {
+			flags[f.Name] = redactFlag(f.Name, f.Value.String())
+			return
+		}
+		var redacted []string
+		for _, v := range values.GetSlice() {
+			redacted = append(redacted, redactFlag(f.Name, v))
+		}
+		flags[f.Name] = "[" + strings.Join(redacted, ",") + "]"
+	})
+	return flags
+}
+
+// redactFlag returns the value of the flag name as written to the report:
+// without the credentials, those of the URLs, the values of the headers and
+// the path of the webhooks, which are secrets of their own.
+func redactFlag(name, value string) string {
+	switch name {
+	case "id", "secret", "auth-bearer", "pin-token", "serve-token":
+		return "REDACTED"
+	case "header":
+		if i := strings.Index(value, ":"); i > 0 {
+			return value[:i] + ": REDACTED"
+		}
+		return "REDACTED"
+	case "notify-url":
+		if u, err := url.Parse(value); err == nil && u.Host != "" {
+			return u.Scheme + "://" + u.Host + "/REDACTED"
+		}
+		return "REDACTED"
+	}
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return value
+}
+
+// SetTokens sets the indexes of the files of the uploaded path.
+func (r *runReport) SetTokens(tokens []*token) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.indexes = make(map[string]int)
+	for _, t := range tokens {
+		r.indexes[t.Path] = t.Index
+	}
+}
+
+// Event records the file of e, uploaded from the local path, of the
+// uploaded path if main.
+func (r *runReport) Event(local string, main bool, e uploader.Event) {
+	var f reportFile
+	var duration time.Duration
+	switch e := e.(type) {
+	case uploader.FileCompleted:
+		duration = e.Duration
+		f = reportFile{Name: e.Name, Size: e.Bytes, Cid: e.Cid.String(), DurationMS: milliseconds(e.Duration), Attempts: e.Attempts, Cached: e.Cached}
+	case uploader.FileFailed:
+		f = reportFile{Name: e.Name, Attempts: 1, Error: e.Err.Error(), ErrorClass: e.Class}
+	default:
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// the directories have no bytes of their own
+	if f.Cid != "" && f.Size > 0 {
+		r.durations = append(r.durations, duration)
+	}
+	if i, ok := r.indexes[f.Name]; ok && main {
+		f.Index = &i
+	}
+	f.Name = filepath.ToSlash(filepath.Join(local, filepath.FromSlash(f.Name)))
+	r.doc.Files = append(r.doc.Files, f)
+}
+
+// SetError records the error the run fails with.
+func (r *runReport) SetError(err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err = err
+}
+
+// Write writes the report of the run ending with exitCode. It does nothing
+// on a nil report.
+func (r *runReport) Write(exitCode int) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	doc := r.doc
+	doc.Finished = time.Now().UTC()
+	doc.DurationMS = milliseconds(doc.Finished.Sub(doc.Started))
+	doc.ExitCode = exitCode
+	doc.Status = "success"
+	switch {
+	case r.interrupted != nil && r.interrupted():
+		doc.Status = reportInterrupted
+	case exitCode != 0:
+		doc.Status = "failure"
+	}
+	if r.err != nil {
+		doc.Error = r.err.Error()
+	}
+	if s := r.summary; s != nil {
+		doc.RunID, doc.Root, doc.MetadataRoot, doc.ContractURI = s.RunID, s.Root, s.MetadataRoot, s.ContractURI
+	}
+	if r.bytes != nil {
+		doc.Bytes = r.bytes()
+	}
+
+	if p := uploader.DurationPercentiles(r.durations); p != nil {
+		doc.FileDurations = &reportPercentiles{P50: milliseconds(p.P50), P90: milliseconds(p.P90), P99: milliseconds(p.P99), Max: milliseconds(p.Max)}
+	}
+
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return uploader.WriteFileAtomic(r.path, data)
+}
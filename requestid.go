@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// requestIDTransport tags every API call with a request ID made of a per-run
+// ID and a sequence number, and records the request ID returned by the
+// server, so that a failed call can be pointed out precisely to support.
+type requestIDTransport struct {
+	base   http.RoundTripper
+	header string
+	runID  string
+
+	mu       sync.Mutex
+	seq      int
+	lastSent string
+	lastRecv string
+}
+
+func newRequestIDTransport(base http.RoundTripper, header string) (*requestIDTransport, error) {
+	runID, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	return &requestIDTransport{base: base, header: header, runID: runID}, nil
+}
+
+func (t *requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.seq++
+	id := fmt.Sprintf("%v-%d", t.runID, t.seq)
+	t.lastSent = id
+	t.lastRecv = ""
+	t.mu.Unlock()
+
+	// a RoundTripper must not modify the caller's request
+	req = req.Clone(req.Context())
+	req.Header.Set(t.header, id)
+
+	resp, err := t.base.RoundTrip(req)
+	if resp != nil {
+		if recv := resp.Header.Get(t.header); recv != "" && recv != id {
+			t.mu.Lock()
+			if t.lastSent == id {
+				t.lastRecv = recv
+			}
+			t.mu.Unlock()
+		}
+	}
+	return resp, err
+}
+
+// RunID returns the ID shared by every request of this run.
+func (t *requestIDTransport) RunID() string {
+	return t.runID
+}
+
+// LastID returns the ID of the most recent request, empty if none was sent.
+func (t *requestIDTransport) LastID() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lastSent
+}
+
+// Describe returns the IDs of the most recent request, for error messages.
+func (t *requestIDTransport) Describe() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.lastSent == "" {
+		return fmt.Sprintf("run %v", t.runID)
+	}
+	if t.lastRecv == "" {
+		return fmt.Sprintf("request %v", t.lastSent)
+	}
+	return fmt.Sprintf("request %v, server request %v", t.lastSent, t.lastRecv)
+}
+
+func randomID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	ipfsFiles "github.com/ipfs/go-ipfs-files"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// Ways of checking a restored file, against the SHA-256 recorded by
+// --checksums or against its CID by hashing it again.
+const (
+	verifiedSHA256 = "sha256"
+	verifiedCID    = "cid"
+)
+
+// errMismatch is the error of a file whose content isn't the one uploaded.
+var errMismatch = errors.New("the content doesn't match")
+
+// restoreResult is the outcome of the restore of an entry.
+type restoreResult struct {
+	Name string `json:"name"`
+	Cid  string `json:"cid"`
+	Path string `json:"path,omitempty"`
+	// Source is where the file was downloaded from, api or gateway, and
+	// Verified how it was checked, empty if it couldn't be, Unverified
+	// being then the reason
+	Source     string `json:"source,omitempty"`
+	Verified   string `json:"verified,omitempty"`
+	Unverified string `json:"unverified,omitempty"`
+	// Skipped is whether the file already existed with the same content
+	Skipped  bool  `json:"skipped,omitempty"`
+	Attempts int   `json:"attempts"`
+	Bytes    int64 `json:"bytes"`
+	// Error is the reason the file couldn't be restored
+	Error string `json:"error,omitempty"`
+}
+
+// restoreTotals are the counts of the entries by outcome.
+type restoreTotals struct {
+	Entries    int   `json:"entries"`
+	Restored   int   `json:"restored"`
+	Skipped    int   `json:"skipped"`
+	SHA256     int   `json:"verified_sha256"`
+	CID        int   `json:"verified_cid"`
+	Unverified int   `json:"unverified"`
+	Failed     int   `json:"failed"`
+	Bytes      int64 `json:"bytes"`
+}
+
+// restoreReport is the outcome of --restore. Identical is whether every
+// entry was restored and checked, the restored tree being then the one
+// uploaded.
+type restoreReport struct {
+	Entries   []restoreResult `json:"entries"`
+	Totals    restoreTotals   `json:"totals"`
+	Identical bool            `json:"identical"`
+}
+
+// restorer downloads the entries of a manifest below dir from the API of
+// up, or from the gateway of gatewayPrefix if not empty when the API fails.
+type restorer struct {
+	up            *uploader.Uploader
+	client        *http.Client
+	gatewayPrefix string
+	dir           string
+	// retries is how many times a failed download is tried again as long as
+	// budget allows, each attempt within timeout
+	retries int
+	budget  *retryBudget
+	timeout time.Duration
+	// skipExisting keeps the files already restored with the same content
+	skipExisting bool
+}
+
+// restoreName returns the name of the file of e: the file of a directory
+// URI or the CID for an entry of a URI list, which has no file name.
+func restoreName(e *auditEntry) string {
+	if !strings.Contains(e.Name, "://") {
+		return e.Name
+	}
+	if u, err := url.Parse(e.Name); err == nil {
+		base := path.Base(u.Path)
+		if base != "." && base != "/" && base != "ipfs" && base != e.Cid.String() {
+			return base
+		}
+	}
+	return e.Cid.String()
+}
+
+// restorePath returns the path of the file name below dir, an absolute name
+// being made relative. Names going up a directory are refused, so that a
+// manifest can't write outside of dir.
+func restorePath(dir, name string) (string, error) {
+	slashed := filepath.ToSlash(strings.TrimPrefix(name, filepath.VolumeName(name)))
+	for _, elem := range strings.Split(slashed, "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("the name %v goes up a directory", name)
+		}
+	}
+	rel := strings.TrimLeft(path.Clean("/"+slashed), "/")
+	if rel == "" {
+		return "", fmt.Errorf("the name %q is not a file name", name)
+	}
+	return filepath.Join(dir, filepath.FromSlash(rel)), nil
+}
+
+// restoreEntries restores entries, up to workers at a time, in their order.
+// The entries sharing the path and CID of a previous one are left out, and
+// those sharing its path only fail.
+func restoreEntries(ctx context.Context, r *restorer, entries []*auditEntry, workers int) []restoreResult {
+	var results []restoreResult
+	var todo []*auditEntry
+	paths := make(map[string]*auditEntry)
+	for _, e := range entries {
+		res := restoreResult{Name: e.Name, Cid: e.Cid.String()}
+		p, err := restorePath(r.dir, restoreName(e))
+		if err == nil {
+			res.Path = p
+			if prev, ok := paths[p]; ok {
+				if prev.Cid.Equals(e.Cid) {
+					continue
+				}
+				err = fmt.Errorf("the path %v is also the one of %v", p, prev.Name)
+			}
+			paths[p] = e
+		}
+		if err != nil {
+			res.Error = err.Error()
+		}
+		results = append(results, res)
+		todo = append(todo, e)
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, workers)
+
+dispatch:
+	for i, e := range todo {
+		if results[i].Error != "" {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			for j := i; j < len(todo); j++ {
+				if results[j].Error == "" {
+					results[j].Error = ctx.Err().Error()
+				}
+			}
+			break dispatch
+		}
+		wg.Add(1)
+		go func(res *restoreResult, e *auditEntry) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			r.Restore(ctx, e, res)
+		}(&results[i], e)
+	}
+	wg.Wait()
+	return results
+}
+
+// Restore downloads e to res.Path, trying again up to r.retries times when
+// the download fails or its content doesn't match, and the retry budget
+// allows.
+func (r *restorer) Restore(ctx context.Context, e *auditEntry, res *restoreResult) {
+	if r.skipExisting {
+		if how, err := r.verify(ctx, e, res.Path, ""); err == nil {
+			res.Skipped, res.Verified = true, how
+			return
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(res.Path), 0755); err != nil {
+		res.Error = err.Error()
+		return
+	}
+
+	var err error
+	for attempt := 0; attempt <= r.retries; attempt++ {
+		if attempt > 0 {
+			if !r.budget.Retry() {
+				break
+			}
+			select {
+			case <-time.After(time.Duration(attempt) * time.Second):
+			case <-ctx.Done():
+				res.Error = ctx.Err().Error()
+				return
+			}
+		}
+		res.Attempts++
+		err = r.download(ctx, e, res)
+		r.budget.Attempt(err)
+		if err == nil || ctx.Err() != nil || (errors.Is(err, uploader.ErrNotFound) && r.gatewayPrefix == "") {
+			break
+		}
+	}
+	if err != nil {
+		res.Source, res.Bytes = "", 0
+		res.Error = err.Error()
+	}
+}
+
+// download downloads e to a temporary file, renamed to res.Path once its
+// content is checked.
+func (r *restorer) download(ctx context.Context, e *auditEntry, res *restoreResult) error {
+	res.Source, res.Verified = "", ""
+	tmp, err := ioutil.TempFile(filepath.Dir(res.Path), filepath.Base(res.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+
+	attemptCtx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	body, source, err := r.fetch(attemptCtx, e)
+	if err == nil {
+		h := sha256.New()
+		res.Bytes, err = io.Copy(io.MultiWriter(tmp, h), body)
+		_ = body.Close()
+		if err == nil {
+			err = tmp.Sync()
+		}
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			res.Source = source
+			res.Verified, err = r.verify(ctx, e, tmp.Name(), hex.EncodeToString(h.Sum(nil)))
+		}
+	} else {
+		_ = tmp.Close()
+	}
+	switch {
+	case errors.Is(err, errMismatch):
+		return fmt.Errorf("%v: %v", source, err)
+	case err != nil && res.Source != "":
+		// the content was downloaded but can't be checked, which doesn't
+		// make it wrong
+		res.Unverified, err = err.Error(), nil
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), res.Path)
+	}
+	if err != nil {
+		return err
+	}
+	uploader.SyncDir(filepath.Dir(res.Path))
+	return nil
+}
+
+// fetch returns the content of e from the API, or else from the gateway.
+func (r *restorer) fetch(ctx context.Context, e *auditEntry) (io.ReadCloser, string, error) {
+	body, err := r.up.Cat(ctx, e.Cid)
+	if err == nil || r.gatewayPrefix == "" {
+		return body, "api", err
+	}
+	body, gerr := httpGet(ctx, r.client, r.gatewayPrefix+e.Cid.String())
+	if gerr != nil {
+		return nil, "", fmt.Errorf("%w, and from the gateway: %v", err, gerr)
+	}
+	return body, "gateway", nil
+}
+
+// verify checks the file at p against the SHA-256 and size recorded for e,
+// or else against the CID of e, returning how it was checked. The SHA-256
+// of the file is sum, computed again if empty. The error is errMismatch if
+// the content differs, and another error if it couldn't be checked.
+func (r *restorer) verify(ctx context.Context, e *auditEntry, p, sum string) (string, error) {
+	stat, err := os.Stat(p)
+	if err != nil {
+		return "", err
+	}
+	if !stat.Mode().IsRegular() {
+		return "", fmt.Errorf("%v is not a file", p)
+	}
+	if e.Size >= 0 && stat.Size() != e.Size {
+		return "", fmt.Errorf("%w: %v bytes instead of %v", errMismatch, stat.Size(), e.Size)
+	}
+
+	if e.SHA256 != "" {
+		if sum == "" {
+			if sum, err = fileSHA256(p); err != nil {
+				return "", err
+			}
+		}
+		if sum != e.SHA256 {
+			return "", fmt.Errorf("%w: SHA-256 %v instead of %v", errMismatch, sum, e.SHA256)
+		}
+		return verifiedSHA256, nil
+	}
+
+	node, err := ipfsFiles.NewSerialFile(p, false, stat)
+	if err != nil {
+		return "", err
+	}
+	defer node.Close()
+	c, err := r.up.HashOnly(ctx, node)
+	if err != nil {
+		return "", fmt.Errorf("hashing the content: %v", err)
+	}
+	if !c.Equals(e.Cid) {
+		return "", fmt.Errorf("%w: CID %v", errMismatch, c)
+	}
+	return verifiedCID, nil
+}
+
+func fileSHA256(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// newRestoreReport returns the report of results with their totals.
+func newRestoreReport(results []restoreResult) *restoreReport {
+	r := &restoreReport{Entries: results}
+	t := &r.Totals
+	t.Entries = len(results)
+	for _, res := range results {
+		switch {
+		case res.Error != "":
+			t.Failed++
+			continue
+		case res.Skipped:
+			t.Skipped++
+		default:
+			t.Restored++
+			t.Bytes += res.Bytes
+		}
+		switch res.Verified {
+		case verifiedSHA256:
+			t.SHA256++
+		case verifiedCID:
+			t.CID++
+		default:
+			t.Unverified++
+		}
+	}
+	r.Identical = t.Failed == 0 && t.Unverified == 0
+	return r
+}
+
+// Print writes a line per entry to w: OK, SKIPPED, UNVERIFIED or FAILED with
+// the reason.
+func (r *restoreReport) Print(w io.Writer) {
+	for _, res := range r.Entries {
+		switch {
+		case res.Error != "":
+			_, _ = fmt.Fprintf(w, "FAILED %v %v: %v\n", res.Name, res.Cid, res.Error)
+		case res.Unverified != "":
+			_, _ = fmt.Fprintf(w, "UNVERIFIED %v %v: %v\n", res.Path, res.Cid, res.Unverified)
+		case res.Skipped:
+			_, _ = fmt.Fprintf(w, "SKIPPED %v %v (%v)\n", res.Path, res.Cid, res.Verified)
+		default:
+			_, _ = fmt.Fprintf(w, "OK %v %v (%v, %v)\n", res.Path, res.Cid, res.Source, res.Verified)
+		}
+	}
+}
+
+// Write writes the report as JSON to path.
+func (r *restoreReport) Write(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return uploader.WriteFileAtomic(path, data)
+}
+
+// runRestore runs restore, downloading the files of --restore.
+func runRestore(o *commonOptions) error {
+	if len(o.args) != 0 {
+		return &usageError{"parameter --restore takes no path argument"}
+	}
+	if *restoreWorkers <= 0 || *restoreTimeout <= 0 || *restoreRetries < 0 {
+		return &usageError{"parameters --restore-workers and --restore-timeout must be positive and --restore-retries not negative"}
+	}
+	keys, err := parseMappingKeys(*mappingKeysFlag)
+	if err != nil {
+		return &usageError{err.Error()}
+	}
+	entries, err := readStatManifest(*restoreManifest, keys)
+	if err == nil && *restoreChecksums != "" {
+		var sums []*auditEntry
+		sums, err = readAuditChecksums(*restoreChecksums)
+		addChecksums(entries, sums)
+	}
+	if err != nil {
+		return &usageError{err.Error()}
+	}
+	if *restoreIDs != "" {
+		var ids idList
+		if err := parseIDList(*restoreIDs, &ids); err != nil {
+			return &usageError{fmt.Sprintf("parameter --restore-ids: %v", err)}
+		}
+		var picked []*auditEntry
+		for _, e := range entries {
+			if index, ok := tokenIndex(filepath.Base(restoreName(e))); ok && ids.Contains(index) {
+				picked = append(picked, e)
+			}
+		}
+		entries = picked
+	}
+	r := &restorer{dir: *restoreDir, retries: *restoreRetries, timeout: *restoreTimeout, skipExisting: *restoreSkipExisting}
+	if *restoreGateway {
+		r.gatewayPrefix, err = gatewayPrefix(*gatewaySubdomain, *gatewayBase)
+		if err != nil {
+			return &usageError{fmt.Sprintf("parameter --restore-gateway: %v", err)}
+		}
+	}
+	ctx, cancel := signalContext()
+	defer cancel()
+	r.up, r.client, err = o.newUploaderFromFlags(ctx)
+	if err != nil {
+		return err
+	}
+
+	retries, err := parseRetryBudget(*retryBudgetFlag, len(entries))
+	if err != nil {
+		return &usageError{err.Error()}
+	}
+
+	r.budget = newRetryBudget(retries, cancel)
+	start := time.Now()
+	report := newRestoreReport(restoreEntries(ctx, r, entries, *restoreWorkers))
+	report.Print(os.Stdout)
+	if *restoreJSON != "" {
+		if err := report.Write(*restoreJSON); err != nil {
+			return err
+		}
+	}
+	t := report.Totals
+	used, denied := r.budget.Used()
+	logs.Info(fmt.Sprintf("Restored %v of %v files to %v, %v, in %v: %v skipped as already there, %v verified by SHA-256 and %v by CID, %v unverified, %v unrecoverable, %v", t.Restored, t.Entries, *restoreDir, formatBytes(float64(t.Bytes)), time.Since(start).Round(time.Millisecond), t.Skipped, t.SHA256, t.CID, t.Unverified, t.Failed, r.budget),
+		"restored", t.Restored, "entries", t.Entries, "bytes", t.Bytes, "skipped", t.Skipped, "verified_sha256", t.SHA256, "verified_cid", t.CID, "unverified", t.Unverified, "failed", t.Failed, "retries", used, "retries_denied", denied)
+	if report.Identical {
+		logs.Info("The restored files are byte-identical to the uploaded ones", "identical", true)
+	} else {
+		logs.Warn("The restored files can't be proven byte-identical to the uploaded ones", "identical", false)
+	}
+	switch err := r.budget.Err(); {
+	case err != nil:
+		return err
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case !report.Identical:
+		return &exitError{exitFailed}
+	}
+	return nil
+}
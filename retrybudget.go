@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// retryWindow is the number of attempts in a row which, all failing with an
+// authentication or connection error, make a run give up.
+const retryWindow = 50
+
+// retryBudget bounds the retries of a run across its workers, so that a dead
+// endpoint doesn't turn thousands of files into an hour of futile retrying,
+// and gives up the run once its failures are clearly systemic.
+type retryBudget struct {
+	// limit is the number of retries of the run, negative for no limit
+	limit int
+	// giveUp is called once, when the run gives up
+	giveUp func()
+
+	mu     sync.Mutex
+	used   int
+	denied int
+	// systemic is the number of the last attempts failing in a row with an
+	// authentication or connection error, last the error of the last one
+	systemic int
+	last     error
+	down     bool
+}
+
+// parseRetryBudget returns the retries of --retry-budget s for a run of
+// files: a number, a percentage of the files such as 10%, or -1 for no
+// limit if empty.
+func parseRetryBudget(s string, files int) (int, error) {
+	if s == "" {
+		return -1, nil
+	}
+	if p := strings.TrimSuffix(s, "%"); p != s {
+		percent, err := strconv.ParseFloat(p, 64)
+		if err != nil || percent < 0 {
+			return 0, fmt.Errorf("parameter --retry-budget: %v is not a percentage", s)
+		}
+		return int(float64(files) * percent / 100), nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("parameter --retry-budget: %v is not a number of retries nor a percentage", s)
+	}
+	return n, nil
+}
+
+func newRetryBudget(limit int, giveUp func()) *retryBudget {
+	return &retryBudget{limit: limit, giveUp: giveUp}
+}
+
+// Retry reports whether a failed attempt may be tried again, using a retry
+// of the budget if so.
+func (b *retryBudget) Retry() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.down || (b.limit >= 0 && b.used >= b.limit) {
+		b.denied++
+		return false
+	}
+	b.used++
+	return true
+}
+
+// Attempt records the outcome of an attempt, err being nil if it didn't
+// fail with an error, and gives up the run after retryWindow authentication
+// or connection errors in a row.
+func (b *retryBudget) Attempt(err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !systemicError(err) {
+		b.systemic = 0
+		return
+	}
+	b.systemic++
+	b.last = err
+	if b.systemic >= retryWindow && !b.down {
+		b.down = true
+		if b.giveUp != nil {
+			b.giveUp()
+		}
+	}
+}
+
+// Err returns the error of a run given up, nil otherwise.
+func (b *retryBudget) Err() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.down {
+		return nil
+	}
+	return &endpointDownError{err: b.last}
+}
+
+// Used returns the retries used and those denied.
+func (b *retryBudget) Used() (used, denied int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used, b.denied
+}
+
+// String returns the retries used, e.g. 12 of 200 retries used, 3 denied.
+func (b *retryBudget) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := fmt.Sprintf("%v retries used", b.used)
+	if b.limit >= 0 {
+		s = fmt.Sprintf("%v of %v retries used", b.used, b.limit)
+	}
+	if b.denied > 0 {
+		s += fmt.Sprintf(", %v denied", b.denied)
+	}
+	return s
+}
+
+// systemicError reports whether err is likely to fail every request of the
+// run, the credentials being rejected or the endpoint unreachable.
+func systemicError(err error) bool {
+	return err != nil && (errors.Is(err, uploader.ErrAuthFailed) || uploader.ErrorClass(err) == uploader.ClassForbidden || uploader.IsConnectError(err))
+}
+
+// endpointDownError is the error of a run given up, wrapping the last error
+// so that its exit code is the one of the failure.
+type endpointDownError struct {
+	err error
+}
+
+func (e *endpointDownError) Error() string {
+	return fmt.Sprintf("giving up, the endpoint appears down: the last %v attempts failed, the last with %v", retryWindow, e.err)
+}
+
+func (e *endpointDownError) Unwrap() error {
+	return e.err
+}
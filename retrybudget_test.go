@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+func TestParseRetryBudget(t *testing.T) {
+	tests := []struct {
+		flag  string
+		files int
+		want  int
+		err   bool
+	}{
+		{"", 1000, -1, false},
+		{"200", 1000, 200, false},
+		{"0", 1000, 0, false},
+		{"10%", 1000, 100, false},
+		{"2.5%", 1000, 25, false},
+		{"10%", 5, 0, false},
+		{"-1", 1000, 0, true},
+		{"x%", 1000, 0, true},
+		{"ten", 1000, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRetryBudget(tt.flag, tt.files)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("parseRetryBudget(%q, %v) = %v, %v, want %v and an error %v", tt.flag, tt.files, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := newRetryBudget(2, nil)
+	for i, want := range []bool{true, true, false, false} {
+		if got := b.Retry(); got != want {
+			t.Errorf("retry %v allowed %v, want %v", i+1, got, want)
+		}
+	}
+	if used, denied := b.Used(); used != 2 || denied != 2 {
+		t.Errorf("used %v and denied %v retries, want 2 and 2", used, denied)
+	}
+	if s := b.String(); s != "2 of 2 retries used, 2 denied" {
+		t.Errorf("the summary is %q", s)
+	}
+}
+
+func TestRetryBudgetGivesUp(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	tests := []struct {
+		name string
+		errs func(i int) error
+		down bool
+		code int
+	}{
+		{"connection refused", func(int) error { return refused }, true, exitUnreachable},
+		{"authentication", func(int) error { return uploader.ErrAuthFailed }, true, exitAuthFailed},
+		{"some succeeding", func(i int) error {
+			if i%10 == 9 {
+				return nil
+			}
+			return refused
+		}, false, exitSuccess},
+		{"other errors", func(int) error { return errors.New("500 Internal Server Error") }, false, exitSuccess},
+		{"canceled", func(int) error { return context.Canceled }, false, exitSuccess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gaveUp := 0
+			b := newRetryBudget(-1, func() { gaveUp++ })
+			for i := 0; i < 2*retryWindow; i++ {
+				b.Attempt(tt.errs(i))
+			}
+			err := b.Err()
+			if (err != nil) != tt.down || (tt.down && gaveUp != 1) {
+				t.Fatalf("gave up %v times with %v, want down %v", gaveUp, err, tt.down)
+			}
+			if code := exitCode(err, false); code != tt.code {
+				t.Errorf("the exit code is %v, want %v", code, tt.code)
+			}
+			if tt.down && b.Retry() {
+				t.Error("a retry was allowed after giving up")
+			}
+		})
+	}
+}
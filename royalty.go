@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+var addressRe = regexp.MustCompile(`^0x[0-9a-fA-F]{40}$`)
+
+// royalty is the seller fee of the collection, written to the fields named
+// by BPSField and RecipientField since marketplaces disagree on them.
+type royalty struct {
+	BPS            int
+	Recipient      string
+	BPSField       string
+	RecipientField string
+}
+
+// checkRoyalty returns an error if the basis points or the address are
+// invalid.
+func checkRoyalty(bps int, recipient string) error {
+	if bps < 0 || bps > 10000 {
+		return fmt.Errorf("the royalty must be between 0 and 10000 basis points, not %v", bps)
+	}
+	if recipient != "" && !addressRe.MatchString(recipient) {
+		return fmt.Errorf("invalid royalty recipient %q, must be 0x and 40 hex characters", recipient)
+	}
+	if bps > 0 && recipient == "" {
+		return fmt.Errorf("a royalty of %v basis points requires a recipient", bps)
+	}
+	return nil
+}
+
+// Set sets the royalty fields in doc, the recipient only if any.
+func (r *royalty) Set(doc *jsonObject) error {
+	if err := doc.SetPath(r.BPSField, r.BPS); err != nil {
+		return err
+	}
+	if r.Recipient == "" {
+		return nil
+	}
+	return doc.SetPath(r.RecipientField, r.Recipient)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// metadataSchema is the JSON schema of ERC-721 metadata with the fields
+// OpenSea reads, used by --validate-metadata unless --metadata-schema is set.
+const metadataSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "title": "ERC-721 metadata",
+  "type": "object",
+  "required": ["image"],
+  "properties": {
+    "name": {"type": "string"},
+    "description": {"type": "string"},
+    "image": {"type": "string", "minLength": 1},
+    "image_data": {"type": "string"},
+    "animation_url": {"type": "string", "minLength": 1},
+    "external_url": {"type": "string", "minLength": 1},
+    "youtube_url": {"type": "string"},
+    "background_color": {"type": "string", "pattern": "^[0-9a-fA-F]{6}$"},
+    "attributes": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "required": ["value"],
+        "properties": {
+          "trait_type": {"type": "string"},
+          "display_type": {"type": "string"},
+          "value": {"type": ["string", "number", "boolean"]},
+          "max_value": {"type": "number"}
+        }
+      }
+    }
+  }
+}`
+
+// loadSchema loads the JSON schema at path, or the bundled metadataSchema
+// if path is empty.
+func loadSchema(path string) (*gojsonschema.Schema, error) {
+	loader := gojsonschema.NewStringLoader(metadataSchema)
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		loader = gojsonschema.NewBytesLoader(data)
+	}
+	schema, err := gojsonschema.NewSchema(loader)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema %v: %v", path, err)
+	}
+	return schema, nil
+}
+
+// validateMetadata renders the metadata of every token and returns the
+// schema violations, e.g. "7.json: image: String length must be greater
+// than or equal to 1".
+func validateMetadata(tokens []*token, opts metadataOptions, schema *gojsonschema.Schema) ([]string, error) {
+	var violations []string
+	for _, t := range tokens {
+		data, err := renderMetadata(t, opts)
+		if err != nil {
+			return nil, err
+		}
+		result, err := schema.Validate(gojsonschema.NewBytesLoader(data))
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range result.Errors() {
+			violations = append(violations, fmt.Sprintf("%v: %v", metadataName(t, opts), e))
+		}
+	}
+	return violations, nil
+}
+
+// validateMergeInputs validates the existing metadata document of every
+// token of --merge-json as is, before its URLs are set, and returns the
+// schema violations and the indexes of the invalid documents.
+func validateMergeInputs(tokens []*token, opts metadataOptions, schema *gojsonschema.Schema) (violations []string, invalid []int, err error) {
+	for _, t := range tokens {
+		name := filepath.Join(opts.MergeDir, strconv.Itoa(t.Index)+".json")
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		result, err := schema.Validate(gojsonschema.NewBytesLoader(data))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%v: %v", name, err)
+		}
+		for _, e := range result.Errors() {
+			violations = append(violations, fmt.Sprintf("%v: %v", name, e))
+		}
+		if !result.Valid() {
+			invalid = append(invalid, t.SourceIndex)
+		}
+	}
+	return violations, invalid, nil
+}
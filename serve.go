@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ipfsFiles "github.com/ipfs/go-ipfs-files"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// Job states, part of the interface of --serve.
+const (
+	jobQueued      = "queued"
+	jobRunning     = "running"
+	jobDone        = "done"
+	jobFailed      = "failed"
+	jobInterrupted = "interrupted"
+)
+
+// serveOptions configures the server of --serve.
+type serveOptions struct {
+	Addr string
+	// Token is the bearer token of every request
+	Token string
+	// Root is the directory the paths of the jobs are relative to, which
+	// they can't leave
+	Root string
+	// Jobs is the file the jobs are kept in across restarts, none if empty
+	Jobs string
+	Pin  bool
+	// ShutdownTimeout is how long the requests and jobs in progress are
+	// waited for on shutdown before being cancelled
+	ShutdownTimeout time.Duration
+}
+
+// uploadJob is the upload of a directory or file of the Root.
+type uploadJob struct {
+	ID       string     `json:"id"`
+	Path     string     `json:"path"`
+	Status   string     `json:"status"`
+	Error    string     `json:"error,omitempty"`
+	Cid      string     `json:"cid,omitempty"`
+	Pinned   bool       `json:"pinned"`
+	Created  time.Time  `json:"created"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// Files are the CIDs of the files below the directory by relative path
+	Files map[string]string `json:"files,omitempty"`
+}
+
+// server serves the uploads of --serve.
+type server struct {
+	opts serveOptions
+	up   *uploader.Uploader
+	// ctx cancels the jobs
+	ctx context.Context
+	wg  sync.WaitGroup
+
+	mu   sync.Mutex
+	jobs map[string]*uploadJob
+}
+
+func newServer(ctx context.Context, up *uploader.Uploader, opts serveOptions) (*server, error) {
+	s := &server{opts: opts, up: up, ctx: ctx, jobs: make(map[string]*uploadJob)}
+	if opts.Jobs == "" {
+		return s, nil
+	}
+	data, err := ioutil.ReadFile(opts.Jobs)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var jobs []*uploadJob
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return nil, fmt.Errorf("%v: %v", opts.Jobs, err)
+	}
+	for _, job := range jobs {
+		// the uploads of the previous run are gone with it
+		if job.Status == jobQueued || job.Status == jobRunning {
+			job.Status = jobInterrupted
+			job.Error = "the server stopped before the upload was done, submit it again"
+		}
+		s.jobs[job.ID] = job
+	}
+	return s, s.save()
+}
+
+// Run serves until ctx is done, then waits up to ShutdownTimeout for the
+// requests and jobs in progress before cancelling them.
+func (s *server) Run(ctx context.Context, cancelJobs func()) error {
+	listener, err := net.Listen("tcp", s.opts.Addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/files", s.auth(s.postFile))
+	mux.HandleFunc("/jobs", s.auth(s.postJob))
+	mux.HandleFunc("/jobs/", s.auth(s.getJob))
+	srv := &http.Server{Handler: mux}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.Serve(listener) }()
+	logs.Info(fmt.Sprintf("Serving on %v", listener.Addr()))
+
+	select {
+	case err := <-errCh:
+		cancelJobs()
+		s.wg.Wait()
+		return err
+	case <-ctx.Done():
+	}
+
+	logs.Info("Shutting down, waiting for the uploads in progress")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.opts.ShutdownTimeout)
+	defer cancel()
+	err = srv.Shutdown(shutdownCtx)
+	jobsDone := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(jobsDone)
+	}()
+	select {
+	case <-jobsDone:
+	case <-shutdownCtx.Done():
+		cancelJobs()
+		<-jobsDone
+	}
+	if err == context.DeadlineExceeded {
+		// the requests still in progress were cancelled
+		err = nil
+	}
+	return err
+}
+
+// auth rejects the requests without the bearer token.
+func (s *server) auth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			serveError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// postFile uploads the file of the multipart request and replies with its
+// CID.
+func (s *server) postFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		serveError(w, http.StatusMethodNotAllowed, "POST a multipart file")
+		return
+	}
+	reader, err := r.MultipartReader()
+	if err != nil {
+		serveError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	part, err := reader.NextPart()
+	if err != nil {
+		serveError(w, http.StatusBadRequest, "no file in the request")
+		return
+	}
+	defer part.Close()
+
+	// the file is streamed to the API as it is received
+	res, _, err := s.up.Add(r.Context(), ipfsFiles.NewReaderFile(part), nil)
+	if err != nil {
+		serveError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	serveReply(w, http.StatusOK, map[string]interface{}{
+		"name":   part.FileName(),
+		"cid":    res.Cid().String(),
+		"pinned": s.opts.Pin,
+	})
+}
+
+// postJob starts uploading the directory or file of the JSON {"path": ...}
+// request and replies with the job.
+func (s *server) postJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		serveError(w, http.StatusMethodNotAllowed, "POST a JSON {\"path\": ...}")
+		return
+	}
+	if t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); t != "application/json" {
+		serveError(w, http.StatusUnsupportedMediaType, "the request must be application/json")
+		return
+	}
+	var req struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+		serveError(w, http.StatusBadRequest, "the request must be a JSON {\"path\": ...}")
+		return
+	}
+	path, err := s.resolve(req.Path)
+	if err != nil {
+		serveError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		serveError(w, http.StatusBadRequest, fmt.Sprintf("%v doesn't exist", req.Path))
+		return
+	}
+	id, err := randomID()
+	if err != nil {
+		serveError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	job := &uploadJob{ID: id, Path: req.Path, Status: jobQueued, Created: time.Now().UTC()}
+	s.mu.Lock()
+	s.jobs[id] = job
+	err = s.saveLocked()
+	reply := *job
+	s.mu.Unlock()
+	if err != nil {
+		logs.Warn(fmt.Sprintf("saving the jobs to %v: %v", s.opts.Jobs, err))
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.run(job, path, stat)
+	}()
+	serveReply(w, http.StatusAccepted, reply)
+}
+
+// getJob replies with the job of the /jobs/<id> request, with the CIDs of
+// its files once done.
+func (s *server) getJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		serveError(w, http.StatusMethodNotAllowed, "GET a job")
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	s.mu.Lock()
+	job, ok := s.jobs[id]
+	var reply uploadJob
+	if ok {
+		reply = *job
+	}
+	s.mu.Unlock()
+	if !ok {
+		serveError(w, http.StatusNotFound, "no such job")
+		return
+	}
+	serveReply(w, http.StatusOK, reply)
+}
+
+// resolve returns the local path of the path of a job, which must be below
+// the Root.
+func (s *server) resolve(path string) (string, error) {
+	if filepath.IsAbs(path) {
+		return "", errors.New("the path must be relative to the root of the server")
+	}
+	resolved := filepath.Join(s.opts.Root, path)
+	rel, err := filepath.Rel(s.opts.Root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New("the path must be below the root of the server")
+	}
+	return resolved, nil
+}
+
+// run uploads the path of job, recording its outcome.
+func (s *server) run(job *uploadJob, path string, stat os.FileInfo) {
+	s.update(job, func() { job.Status = jobRunning })
+
+	node, err := uploader.NewFileNode(path, false, stat)
+	if err != nil {
+		s.fail(job, err)
+		return
+	}
+	files := make(map[string]string)
+	res, _, err := s.up.Add(s.ctx, node, func(r uploader.Result) {
+		if r.Name != "" {
+			files[r.Name] = r.Cid.String()
+		}
+	})
+	if err != nil {
+		s.fail(job, err)
+		return
+	}
+	s.update(job, func() {
+		job.Status, job.Cid, job.Pinned = jobDone, res.Cid().String(), s.opts.Pin
+		if stat.IsDir() {
+			job.Files = files
+		}
+	})
+}
+
+func (s *server) fail(job *uploadJob, err error) {
+	s.update(job, func() {
+		job.Status, job.Error = jobFailed, err.Error()
+		if s.ctx.Err() != nil {
+			job.Status = jobInterrupted
+		}
+	})
+}
+
+// update applies fn to job and saves the jobs.
+func (s *server) update(job *uploadJob, fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn()
+	if job.Status != jobQueued && job.Status != jobRunning {
+		finished := time.Now().UTC()
+		job.Finished = &finished
+	}
+	if err := s.saveLocked(); err != nil {
+		logs.Warn(fmt.Sprintf("saving the jobs to %v: %v", s.opts.Jobs, err))
+	}
+}
+
+func (s *server) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.saveLocked()
+}
+
+// saveLocked writes the jobs to the Jobs file, by creation time.
+func (s *server) saveLocked() error {
+	if s.opts.Jobs == "" {
+		return nil
+	}
+	jobs := make([]*uploadJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Created.Before(jobs[j].Created) })
+	data, err := json.MarshalIndent(jobs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return uploader.WriteFileAtomic(s.opts.Jobs, data)
+}
+
+func serveReply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func serveError(w http.ResponseWriter, status int, message string) {
+	serveReply(w, status, map[string]string{"error": message})
+}
+
+// runServe runs serve, the HTTP API of --serve.
+func runServe(o *commonOptions) error {
+	if len(o.args) != 0 {
+		return &usageError{"parameter --serve takes no path argument, the jobs name their paths"}
+	}
+	if *serveToken == "" {
+		*serveToken = os.Getenv("IPFS_UPLOAD_SERVE_TOKEN")
+	}
+	if *serveToken == "" {
+		return &usageError{"parameter --serve requires --serve-token or IPFS_UPLOAD_SERVE_TOKEN"}
+	}
+	root, err := filepath.Abs(*serveRoot)
+	if err != nil {
+		return &usageError{err.Error()}
+	}
+	ctx, cancel := signalContext()
+	defer cancel()
+	up, _, err := o.newUploaderFromFlags(ctx)
+	if err != nil {
+		return err
+	}
+	// the jobs outlive the requests, and get ShutdownTimeout to finish
+	// once the server is stopped
+	jobsCtx, cancelJobs := context.WithCancel(context.Background())
+	defer cancelJobs()
+	srv, err := newServer(jobsCtx, up, serveOptions{
+		Addr:            *serveAddr,
+		Token:           *serveToken,
+		Root:            root,
+		Jobs:            *serveJobs,
+		Pin:             *pin,
+		ShutdownTimeout: *serveShutdownTimeout,
+	})
+	if err != nil {
+		return &usageError{err.Error()}
+	}
+	return srv.Run(ctx, cancelJobs)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+)
+
+// splitMix64 is the SplitMix64 generator of Steele, Lea and Flood, which is
+// simple enough to be reimplemented to check a --shuffle-seed permutation:
+//
+//	state += 0x9e3779b97f4a7c15
+//	z := state
+//	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+//	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+//	return z ^ (z >> 31)
+type splitMix64 struct {
+	state uint64
+}
+
+func (r *splitMix64) Next() uint64 {
+	r.state += 0x9e3779b97f4a7c15
+	z := r.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// Intn returns a number in [0, n) without modulo bias, rejecting the
+// numbers above the largest multiple of n.
+func (r *splitMix64) Intn(n int) int {
+	bound := uint64(n)
+	limit := ^uint64(0) - ^uint64(0)%bound
+	for {
+		if v := r.Next(); v < limit {
+			return int(v % bound)
+		}
+	}
+}
+
+// parseShuffleSeed parses a seed in decimal or 0x prefixed hex.
+func parseShuffleSeed(s string) (uint64, error) {
+	return strconv.ParseUint(s, 0, 64)
+}
+
+// shuffleTokens permutes the indexes of tokens, sorted by index, with a
+// Fisher-Yates shuffle from the last token to the second one driven by
+// splitMix64 seeded with seed, and sorts them by their new index. The
+// index of the files stays the SourceIndex of the tokens.
+func shuffleTokens(tokens []*token, seed uint64) {
+	indexes := make([]int, len(tokens))
+	for i, t := range tokens {
+		indexes[i] = t.Index
+	}
+	r := &splitMix64{state: seed}
+	for i := len(indexes) - 1; i > 0; i-- {
+		j := r.Intn(i + 1)
+		indexes[i], indexes[j] = indexes[j], indexes[i]
+	}
+	for i, t := range tokens {
+		t.Index = indexes[i]
+		for _, f := range t.Files {
+			f.File.Index = indexes[i]
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Index < tokens[j].Index })
+}
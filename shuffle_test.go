@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// The vectors below are computed by a separate implementation of SplitMix64
+// and the Fisher-Yates shuffle as documented in the Readme: they must never
+// change, or the assignments published with a seed couldn't be proven.
+
+func TestSplitMix64(t *testing.T) {
+	// the reference outputs of SplitMix64 seeded with 1234567
+	want := []uint64{6457827717110365317, 3203168211198807973, 9817491932198370423, 4593380528125082431, 16408922859458223821}
+	r := &splitMix64{state: 1234567}
+	for i, w := range want {
+		if got := r.Next(); got != w {
+			t.Errorf("output %v is %v, want %v", i, got, w)
+		}
+	}
+}
+
+func TestShuffleTokens(t *testing.T) {
+	tests := []struct {
+		seed    uint64
+		indexes []int
+		// want are the new indexes of the tokens of indexes, in order
+		want []int
+	}{
+		{0xdeadbeef, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, []int{5, 3, 2, 4, 7, 1, 10, 6, 9, 8}},
+		{0xdeadbeef, []int{1, 2, 3, 4, 5}, []int{2, 1, 4, 5, 3}},
+		{0, []int{0, 1, 2, 3, 4}, []int{2, 3, 1, 4, 0}},
+		{42, []int{1, 2, 3, 5, 8, 13}, []int{8, 5, 1, 3, 13, 2}},
+		{42, []int{7}, []int{7}},
+	}
+	for _, tt := range tests {
+		var tokens []*token
+		for _, index := range tt.indexes {
+			tokens = append(tokens, &token{Index: index, SourceIndex: index})
+		}
+		shuffleTokens(tokens, tt.seed)
+		got := make([]int, len(tokens))
+		for _, t := range tokens {
+			got[indexOf(tt.indexes, t.SourceIndex)] = t.Index
+		}
+		for i := 1; i < len(tokens); i++ {
+			if tokens[i-1].Index >= tokens[i].Index {
+				t.Errorf("seed %#x: the tokens aren't sorted by their new index", tt.seed)
+			}
+		}
+		if !equalInts(got, tt.want) {
+			t.Errorf("seed %#x: %v became %v, want %v", tt.seed, tt.indexes, got, tt.want)
+		}
+	}
+}
+
+// TestShuffleOutputs checks that the files written with a seed stay
+// byte-identical.
+func TestShuffleOutputs(t *testing.T) {
+	dir := t.TempDir()
+	files := make(map[string]string)
+	for i := 1; i <= 5; i++ {
+		files["img/"+strconv.Itoa(i)+".png"] = "image " + strconv.Itoa(i)
+	}
+	writeFiles(t, dir, files)
+
+	if _, code := runMain(t, dir, "--mock", "--shuffle-seed", "0xdeadbeef", "--out", "meta", "--uri-list", "uris.txt", "--mapping", "mapping.json", "img"); code != exitSuccess {
+		t.Fatalf("exit code %v", code)
+	}
+	var metadata bytes.Buffer
+	for i := 1; i <= 5; i++ {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "meta", strconv.Itoa(i)+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		metadata.WriteString("== " + strconv.Itoa(i) + ".json\n")
+		metadata.Write(data)
+		metadata.WriteString("\n")
+	}
+	golden(t, "shuffle-metadata.golden", metadata.Bytes())
+	for name, file := range map[string]string{"shuffle-uris.golden": "uris.txt", "shuffle-mapping.golden": "mapping.json"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		golden(t, name, data)
+	}
+}
+
+func indexOf(s []int, v int) int {
+	for i, x := range s {
+		if x == v {
+			return i
+		}
+	}
+	return -1
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
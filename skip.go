@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	ipfsFiles "github.com/ipfs/go-ipfs-files"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// skippedURI stands for a token of --skip-ids in the URI list.
+const skippedURI = "SKIPPED"
+
+// idRange is a range of token ids, first and last included.
+type idRange struct {
+	first, last int
+}
+
+// idList is a list of token ids, kept as ranges so that a wide range costs
+// no more than a single id.
+type idList []idRange
+
+// Contains returns whether id is in the list.
+func (l idList) Contains(id int) bool {
+	for _, r := range l {
+		if id >= r.first && id <= r.last {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIDList adds the token ids of a comma separated list of ids and
+// ranges, e.g. 1,7,100-110, to ids.
+func parseIDList(s string, ids *idList) error {
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "-", 2)
+		first, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		last := first
+		if err == nil && len(parts) == 2 {
+			last, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+		}
+		if err != nil || first < 0 || last < first {
+			return fmt.Errorf("invalid token id or range %q, e.g. 7 or 100-110", item)
+		}
+		*ids = append(*ids, idRange{first, last})
+	}
+	return nil
+}
+
+// readIDList adds the token ids of the file at path to ids, lists like
+// --skip-ids on any number of lines. Lines starting with # are comments.
+func readIDList(path string, ids *idList) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if err := parseIDList(text, ids); err != nil {
+			return fmt.Errorf("%v line %v: %v", path, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// skipTokens splits tokens into the ones whose index is in ids and the
+// others.
+func skipTokens(tokens []*token, ids idList) (kept, skipped []*token) {
+	for _, t := range tokens {
+		if ids.Contains(t.Index) {
+			skipped = append(skipped, t)
+		} else {
+			kept = append(kept, t)
+		}
+	}
+	return kept, skipped
+}
+
+// countHidden returns the number of hidden files and directories under
+// root, which the upload leaves out.
+func countHidden(root string) (int, error) {
+	var n int
+	err := uploader.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != root && strings.HasPrefix(info.Name(), ".") {
+			n++
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+// skipper leaves the files of the tokens of --skip-ids out of the upload.
+type skipper struct {
+	// paths are the local paths of the skipped files
+	paths map[string]bool
+}
+
+// newSkipper returns the skipper of the tokens and the excluded local
+// paths, cleaned.
+func newSkipper(skipped []*token, excluded map[string]bool) *skipper {
+	s := &skipper{paths: make(map[string]bool)}
+	for p := range excluded {
+		s.paths[p] = true
+	}
+	for _, t := range skipped {
+		s.paths[filepath.Clean(t.LocalPath)] = true
+		for _, f := range t.Files {
+			s.paths[filepath.Clean(f.File.LocalPath)] = true
+		}
+	}
+	return s
+}
+
+// Wrap returns node, read from the local path, without the skipped files
+// below it.
+func (s *skipper) Wrap(node ipfsFiles.Node, path string) ipfsFiles.Node {
+	if dir, ok := node.(ipfsFiles.Directory); ok {
+		return &skipDirectory{Directory: dir, skipper: s, path: path}
+	}
+	return node
+}
+
+type skipDirectory struct {
+	ipfsFiles.Directory
+	skipper *skipper
+	path    string
+}
+
+func (d *skipDirectory) Entries() ipfsFiles.DirIterator {
+	return &skipIterator{DirIterator: d.Directory.Entries(), skipper: d.skipper, path: d.path}
+}
+
+type skipIterator struct {
+	ipfsFiles.DirIterator
+	skipper *skipper
+	path    string
+}
+
+func (it *skipIterator) Next() bool {
+	for it.DirIterator.Next() {
+		if !it.skipper.paths[filepath.Join(it.path, it.Name())] {
+			return true
+		}
+		// the files are opened by the iterator already
+		_ = it.DirIterator.Node().Close()
+	}
+	return false
+}
+
+func (it *skipIterator) Node() ipfsFiles.Node {
+	return it.skipper.Wrap(it.DirIterator.Node(), filepath.Join(it.path, it.Name()))
+}
+
+// withoutSkipped returns the indexes which aren't the source index of a
+// skipped token.
+func withoutSkipped(indexes []int, skipped []*token) []int {
+	if len(skipped) == 0 {
+		return indexes
+	}
+	sources := make(map[int]bool)
+	for _, t := range skipped {
+		sources[t.SourceIndex] = true
+	}
+	var kept []int
+	for _, index := range indexes {
+		if !sources[index] {
+			kept = append(kept, index)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestParseIDList(t *testing.T) {
+	tests := []struct {
+		list    string
+		in, out []int
+		err     bool
+	}{
+		{list: "", out: []int{0, 1}},
+		{list: "1,7", in: []int{1, 7}, out: []int{0, 2, 6, 8}},
+		{list: " 1 , 100-110 ,", in: []int{1, 100, 105, 110}, out: []int{2, 99, 111}},
+		{list: "3-3", in: []int{3}, out: []int{2, 4}},
+		{list: "0-" + strconv.Itoa(math.MaxInt32), in: []int{0, 1, math.MaxInt32}},
+		{list: "5-1", err: true},
+		{list: "-1", err: true},
+		{list: "a", err: true},
+		{list: "1-b", err: true},
+	}
+	for _, tt := range tests {
+		var ids idList
+		err := parseIDList(tt.list, &ids)
+		if (err != nil) != tt.err {
+			t.Errorf("parseIDList(%q) error %v", tt.list, err)
+			continue
+		}
+		for _, id := range tt.in {
+			if !ids.Contains(id) {
+				t.Errorf("parseIDList(%q) doesn't contain %v", tt.list, id)
+			}
+		}
+		for _, id := range tt.out {
+			if ids.Contains(id) {
+				t.Errorf("parseIDList(%q) contains %v", tt.list, id)
+			}
+		}
+	}
+}
+
+func TestSkipTokens(t *testing.T) {
+	var tokens []*token
+	for i := 1; i <= 6; i++ {
+		tokens = append(tokens, &token{Index: i})
+	}
+	var ids idList
+	if err := parseIDList("1-2,6,100-200", &ids); err != nil {
+		t.Fatal(err)
+	}
+	kept, skipped := skipTokens(tokens, ids)
+	indexes := func(tokens []*token) (s string) {
+		for _, t := range tokens {
+			s += strconv.Itoa(t.Index)
+		}
+		return s
+	}
+	if indexes(kept) != "345" || indexes(skipped) != "126" {
+		t.Errorf("kept %v and skipped %v, want 345 and 126", indexes(kept), indexes(skipped))
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// statResult are the sizes of the DAG of an entry of --stat.
+type statResult struct {
+	Name string `json:"name"`
+	Cid  string `json:"cid"`
+	// Missing is whether the node doesn't have the CID, Error the reason
+	// of a missing entry or of a failure
+	Missing        bool   `json:"missing,omitempty"`
+	Error          string `json:"error,omitempty"`
+	Blocks         int    `json:"blocks"`
+	DagSize        uint64 `json:"dag_size"`
+	CumulativeSize uint64 `json:"cumulative_size"`
+	// LocalSize is the size of the local file, -1 if unknown
+	LocalSize int64 `json:"local_size"`
+}
+
+// statTotals are the totals of the entries found, the local size and the
+// delta being those of the entries of a known local size.
+type statTotals struct {
+	Entries        int    `json:"entries"`
+	Missing        int    `json:"missing"`
+	Failed         int    `json:"failed"`
+	Blocks         int    `json:"blocks"`
+	DagSize        uint64 `json:"dag_size"`
+	CumulativeSize uint64 `json:"cumulative_size"`
+	LocalSize      int64  `json:"local_size"`
+	Delta          int64  `json:"delta"`
+}
+
+// statReport is the outcome of --stat.
+type statReport struct {
+	Entries []statResult `json:"entries"`
+	Totals  statTotals   `json:"totals"`
+}
+
+// readStatManifest reads the entries of --stat: a --checksums CSV file, a
+// --mapping JSON file read with keys, a --manifest file, or a list of CIDs or ipfs:// URIs one
+// a line such as --uri-list.
+func readStatManifest(path string, keys []mappingKey) ([]*auditEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if trimmed := bytes.TrimSpace(data); strings.HasSuffix(strings.ToLower(path), ".csv") || bytes.HasPrefix(trimmed, []byte("{")) || bytes.HasPrefix(trimmed, []byte("[")) {
+		return readAuditManifest(path, keys)
+	}
+	var entries []*auditEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		// the missing and skipped tokens of --uri-list have no CID
+		c, ok := urlCID(line)
+		if !ok {
+			continue
+		}
+		entries = append(entries, &auditEntry{Name: line, Cid: c, Size: -1})
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%v has no CID", path)
+	}
+	return entries, scanner.Err()
+}
+
+// addLocalSizes sets the size of the entries of an unknown size named after
+// a local file.
+func addLocalSizes(entries []*auditEntry) {
+	for _, e := range entries {
+		if e.Size >= 0 {
+			continue
+		}
+		if stat, err := os.Stat(e.Name); err == nil && stat.Mode().IsRegular() {
+			e.Size = stat.Size()
+		}
+	}
+}
+
+// statEntries returns the sizes of the DAGs of entries on up, statting up
+// to workers entries at a time, each within timeout. A CID the node doesn't
+// have, or doesn't find in time, is reported as missing.
+func statEntries(ctx context.Context, up *uploader.Uploader, entries []*auditEntry, workers int, timeout time.Duration) []statResult {
+	results := make([]statResult, len(entries))
+	for i, e := range entries {
+		results[i] = statResult{Name: e.Name, Cid: e.Cid.String(), LocalSize: e.Size}
+	}
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, workers)
+
+dispatch:
+	for i, e := range entries {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			for j := i; j < len(entries); j++ {
+				results[j].Error = ctx.Err().Error()
+			}
+			break dispatch
+		}
+		wg.Add(1)
+		go func(r *statResult, e *auditEntry) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			statCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			stat, err := up.Stat(statCtx, e.Cid)
+			switch {
+			case errors.Is(err, uploader.ErrNotFound):
+				r.Missing, r.Error = true, err.Error()
+			case err != nil && statCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil:
+				r.Missing, r.Error = true, fmt.Sprintf("not found in %v", timeout)
+			case err != nil:
+				r.Error = err.Error()
+			default:
+				r.Blocks, r.DagSize, r.CumulativeSize = stat.Blocks, stat.Size, stat.CumulativeSize
+			}
+		}(&results[i], e)
+	}
+	wg.Wait()
+	return results
+}
+
+// newStatReport returns the report of results with their totals.
+func newStatReport(results []statResult) *statReport {
+	r := &statReport{Entries: results}
+	t := &r.Totals
+	t.Entries = len(results)
+	for _, res := range results {
+		switch {
+		case res.Missing:
+			t.Missing++
+		case res.Error != "":
+			t.Failed++
+		default:
+			t.Blocks += res.Blocks
+			t.DagSize += res.DagSize
+			t.CumulativeSize += res.CumulativeSize
+			if res.LocalSize >= 0 {
+				t.LocalSize += res.LocalSize
+				t.Delta += int64(res.CumulativeSize) - res.LocalSize
+			}
+		}
+	}
+	return r
+}
+
+// Print writes the report as a table to w, the sizes in bytes.
+func (r *statReport) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "Status\tName\tCID\tBlocks\tDAG size\tCumulative size\tLocal size\tDelta")
+	for _, res := range r.Entries {
+		switch {
+		case res.Missing:
+			_, _ = fmt.Fprintf(tw, "MISSING\t%v\t%v\t-\t-\t-\t%v\t-\n", res.Name, res.Cid, statSize(res.LocalSize))
+		case res.Error != "":
+			_, _ = fmt.Fprintf(tw, "FAILED\t%v\t%v\t-\t-\t-\t%v\t-\n", res.Name, res.Cid, statSize(res.LocalSize))
+		default:
+			delta := "-"
+			if res.LocalSize >= 0 {
+				delta = fmt.Sprintf("%+d", int64(res.CumulativeSize)-res.LocalSize)
+			}
+			_, _ = fmt.Fprintf(tw, "OK\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", res.Name, res.Cid, res.Blocks, res.DagSize, res.CumulativeSize, statSize(res.LocalSize), delta)
+		}
+	}
+	t := r.Totals
+	_, _ = fmt.Fprintf(tw, "TOTAL\t%v entries\t\t%v\t%v\t%v\t%v\t%+d\n", t.Entries, t.Blocks, t.DagSize, t.CumulativeSize, t.LocalSize, t.Delta)
+	_ = tw.Flush()
+}
+
+func statSize(size int64) string {
+	if size < 0 {
+		return "-"
+	}
+	return fmt.Sprint(size)
+}
+
+// Write writes the report as JSON to path.
+func (r *statReport) Write(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return uploader.WriteFileAtomic(path, data)
+}
+
+// runStat runs stat, reporting the DAGs of the CIDs of --stat.
+func runStat(o *commonOptions) error {
+	if len(o.args) != 0 {
+		return &usageError{"parameter --stat takes no path argument"}
+	}
+	if *statWorkers <= 0 || *statTimeout <= 0 {
+		return &usageError{"parameters --stat-workers and --stat-timeout must be positive"}
+	}
+	keys, err := parseMappingKeys(*mappingKeysFlag)
+	if err != nil {
+		return &usageError{err.Error()}
+	}
+	entries, err := readStatManifest(*statPath, keys)
+	if err != nil {
+		return &usageError{err.Error()}
+	}
+	addLocalSizes(entries)
+	ctx, cancel := signalContext()
+	defer cancel()
+	up, _, err := o.newUploaderFromFlags(ctx)
+	if err != nil {
+		return err
+	}
+
+	sample := sampleEntries(entries, *statSample, rand.New(rand.NewSource(time.Now().UnixNano())))
+	r := newStatReport(statEntries(ctx, up, sample, *statWorkers, *statTimeout))
+	r.Print(os.Stdout)
+	for _, res := range r.Entries {
+		if res.Error != "" {
+			logs.Info(fmt.Sprintf("%v %v: %v", res.Name, res.Cid, res.Error))
+		}
+	}
+	if *statJSON != "" {
+		if err := r.Write(*statJSON); err != nil {
+			return err
+		}
+	}
+	t := r.Totals
+	logs.Info(fmt.Sprintf("%v of %v CIDs missing and %v failed, %v cumulative for %v local, %v files in %v", t.Missing, len(sample), t.Failed, formatBytes(float64(t.CumulativeSize)), formatBytes(float64(t.LocalSize)), len(entries), *statPath))
+	switch {
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case t.Missing > 0 || t.Failed > 0:
+		return &exitError{exitFailed}
+	}
+	return nil
+}
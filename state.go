@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// runStateQuery writes the uploads recorded in --state, with --state-export
+// or --state-query.
+func runStateQuery() error {
+	if *statePath == "" {
+		return &usageError{"parameters --state-export and --state-query require --state"}
+	}
+	state, err := uploader.ReadState(*statePath)
+	if err == nil && *stateExport {
+		err = state.Export(os.Stdout)
+	} else if err == nil {
+		var data []byte
+		data, err = json.MarshalIndent(state.Query(*stateQuery), "", "  ")
+		_, _ = fmt.Fprintln(os.Stdout, string(data))
+	}
+	return err
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// stdinReader is the standard input of --stdin, streamed to the API as it
+// is read rather than buffered, as the upload doesn't need its size.
+type stdinReader struct {
+	reader *bufio.Reader
+	// n is the number of bytes read so far
+	n int64
+}
+
+// newStdinReader returns the reader of r, failing if r is empty rather than
+// uploading an empty file.
+func newStdinReader(r io.Reader) (*stdinReader, error) {
+	reader := bufio.NewReader(r)
+	if _, err := reader.Peek(1); err != nil {
+		if err == io.EOF {
+			return nil, errors.New("the standard input is empty")
+		}
+		return nil, err
+	}
+	return &stdinReader{reader: reader}, nil
+}
+
+func (r *stdinReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
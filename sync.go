@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// printSyncReport writes a line per change of r to w: ADDED, CHANGED with
+// the superseded CID, REMOVED or FAILED with the reason.
+func printSyncReport(w io.Writer, r *uploader.SyncReport) {
+	for _, c := range r.Changes {
+		switch {
+		case c.Status == uploader.SyncRemoved:
+			_, _ = fmt.Fprintf(w, "REMOVED %v (was %v)\n", c.Path, c.Superseded)
+		case c.Error != "":
+			_, _ = fmt.Fprintf(w, "FAILED %v: %v\n", c.Path, c.Error)
+		case c.Status == uploader.SyncAdded:
+			_, _ = fmt.Fprintf(w, "ADDED %v %v\n", c.Path, c.Cid)
+		default:
+			_, _ = fmt.Fprintf(w, "CHANGED %v %v (was %v)\n", c.Path, c.Cid, c.Superseded)
+		}
+	}
+}
+
+// runSync runs sync, uploading the files of path changed since the manifest
+// of --sync, and returns the manifest written.
+func runSync(o *commonOptions, path string, stat os.FileInfo) (string, error) {
+	if *checksums != "" || *cidsFrom != "" || *statePath != "" {
+		return "", &usageError{"parameter --sync can't be used with --checksums, --cids-from or --state, it updates its manifest itself"}
+	}
+	if len(*includeFlag) > 0 || len(*excludeFlag) > 0 || !*ignoreHidden {
+		return "", &usageError{"parameter --sync can't be used with --include, --exclude or --ignore-hidden, it uploads every file of the directory"}
+	}
+	if (*syncMode != uploader.CacheModeMtime && *syncMode != uploader.CacheModeHash) || *syncWorkers <= 0 || *syncCheckpoint < 0 {
+		return "", &usageError{"parameter --sync-mode must be mtime or hash, --sync-workers positive and --sync-checkpoint not negative"}
+	}
+	if *syncMetadata && *out == "" {
+		return "", &usageError{"parameter --sync-metadata requires --out"}
+	}
+	// a manifest which doesn't exist yet starts the upload of the whole
+	// directory, file by file, resumed from the manifest if interrupted
+	var since time.Time
+	var sums []*uploader.Checksum
+	manifestStat, err := os.Stat(*syncPath)
+	if err == nil {
+		since = manifestStat.ModTime()
+		sums, err = uploader.ReadChecksums(*syncPath)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return "", &usageError{err.Error()}
+	}
+	ctx, cancel := signalContext()
+	defer cancel()
+	s := &uploader.Syncer{Mode: *syncMode, Since: since, Workers: *syncWorkers}
+	if *hedgeAfter != "" {
+		if s.Hedge, err = parseHedgeAfter(*hedgeAfter); err != nil {
+			return "", &usageError{err.Error()}
+		}
+	}
+	s.Uploader, _, err = o.newUploaderFromFlags(ctx)
+	if err != nil {
+		return "", err
+	}
+	if *stripEXIF {
+		s.Wrap = newStripper().Wrap
+	}
+
+	start := time.Now()
+	changes, unchanged, err := s.Diff(path, stat, sums)
+	if err != nil {
+		return "", err
+	}
+	manifest := *syncPath
+	if *syncOut != "" {
+		manifest = *syncOut
+	}
+	if *syncCheckpoint > 0 {
+		s.CheckpointInterval = *syncCheckpoint
+		s.Checkpoint = func(uploaded []*uploader.Checksum) {
+			if err := uploader.WriteChecksums(manifest, uploader.UpdateManifest(sums, uploaded, changes)); err != nil {
+				logs.Warn(fmt.Sprintf("writing the manifest to %v: %v", manifest, err))
+			}
+		}
+	}
+	uploaded := s.Upload(ctx, changes)
+	r := uploader.NewSyncReport(changes, unchanged)
+	printSyncReport(os.Stdout, r)
+	err = uploader.WriteChecksums(manifest, uploader.UpdateManifest(sums, uploaded, changes))
+	if err == nil && *syncReportPath != "" {
+		err = r.Write(*syncReportPath)
+	}
+	if err != nil {
+		return "", err
+	}
+	logs.Info(fmt.Sprintf("Synced %v with %v in %v: %v added, %v changed, %v removed, %v unchanged, %v failed, wrote the manifest to %v", path, *syncPath, time.Since(start).Round(time.Millisecond), r.Added, r.Changed, r.Removed, r.Unchanged, r.Failed, manifest),
+		"added", r.Added, "changed", r.Changed, "removed", r.Removed, "unchanged", r.Unchanged, "failed", r.Failed)
+	if s.Hedge.Enabled() {
+		logs.Info(fmt.Sprintf("Hedged %v files, %v of them completing first on the second upload", r.Hedged, r.HedgesWon), "hedged", r.Hedged, "hedges_won", r.HedgesWon)
+	}
+	switch {
+	case ctx.Err() != nil:
+		return "", ctx.Err()
+	case r.Failed > 0:
+		return "", &exitError{exitFailed}
+	}
+	return manifest, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+
+	ipfsFiles "github.com/ipfs/go-ipfs-files"
+	"golang.org/x/time/rate"
+)
+
+// throttle counts the file contents read, and therefore uploaded, and
+// optionally limits the rate at which they are read. A single throttle is
+// shared by every file of the upload so the limit applies to the total
+// throughput.
+type throttle struct {
+	bytesRead int64 // accessed atomically, first for 64-bit alignment on 386
+
+	ctx     context.Context
+	limiter *rate.Limiter
+}
+
+// newThrottle returns a throttle limited to bytesPerSecond, or unlimited if
+// bytesPerSecond is 0.
+func newThrottle(ctx context.Context, bytesPerSecond int64) *throttle {
+	if bytesPerSecond == 0 {
+		return &throttle{ctx: ctx}
+	}
+
+	// a small burst keeps the transfer smooth instead of stop-and-go
+	burst := int(bytesPerSecond / 10)
+	if burst < 32*1024 {
+		burst = 32 * 1024
+	}
+	return &throttle{
+		ctx:     ctx,
+		limiter: rate.NewLimiter(rate.Limit(bytesPerSecond), burst),
+	}
+}
+
+// BytesRead returns the number of payload bytes read so far.
+func (t *throttle) BytesRead() int64 {
+	return atomic.LoadInt64(&t.bytesRead)
+}
+
+// Wrap returns node with every regular file below it throttled.
+func (t *throttle) Wrap(node ipfsFiles.Node) ipfsFiles.Node {
+	switch n := node.(type) {
+	case *ipfsFiles.Symlink:
+		return n
+	case ipfsFiles.Directory:
+		return &throttledDirectory{Directory: n, throttle: t}
+	case ipfsFiles.File:
+		return &throttledFile{File: n, throttle: t}
+	default:
+		return n
+	}
+}
+
+type throttledFile struct {
+	ipfsFiles.File
+	throttle *throttle
+}
+
+func (f *throttledFile) Read(p []byte) (int, error) {
+	limiter := f.throttle.limiter
+	if limiter != nil && len(p) > limiter.Burst() {
+		p = p[:limiter.Burst()]
+	}
+	n, err := f.File.Read(p)
+	if n > 0 {
+		atomic.AddInt64(&f.throttle.bytesRead, int64(n))
+		if limiter != nil {
+			if werr := limiter.WaitN(f.throttle.ctx, n); werr != nil {
+				return n, werr
+			}
+		}
+	}
+	return n, err
+}
+
+type throttledDirectory struct {
+	ipfsFiles.Directory
+	throttle *throttle
+}
+
+func (d *throttledDirectory) Entries() ipfsFiles.DirIterator {
+	return &throttledIterator{DirIterator: d.Directory.Entries(), throttle: d.throttle}
+}
+
+type throttledIterator struct {
+	ipfsFiles.DirIterator
+	throttle *throttle
+}
+
+func (it *throttledIterator) Node() ipfsFiles.Node {
+	return it.throttle.Wrap(it.DirIterator.Node())
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// traitReport is the distribution of the traits of --attributes-csv
+// written by --trait-report.
+type traitReport struct {
+	Tokens      int              `json:"tokens"`
+	Traits      []traitStats     `json:"traits"`
+	TraitCounts []valueCount     `json:"trait_counts"`
+	Anomalies   []traitAnomaly   `json:"anomalies"`
+	CountRange  *traitCountRange `json:"expected_trait_count,omitempty"`
+}
+
+// traitStats are the values of a trait type by decreasing count.
+type traitStats struct {
+	TraitType string       `json:"trait_type"`
+	Tokens    int          `json:"tokens"` // with a value
+	Values    []valueCount `json:"values"`
+}
+
+type valueCount struct {
+	Value   string  `json:"value"`
+	Count   int     `json:"count"`
+	Percent float64 `json:"percent"`
+}
+
+// traitAnomaly is a likely mistake of the CSV file, TokenID being nil for
+// the whole file.
+type traitAnomaly struct {
+	TokenID *int   `json:"token_id,omitempty"`
+	Problem string `json:"problem"`
+}
+
+// traitCountRange is the expected number of traits of a token, e.g. 3-5.
+type traitCountRange struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+// parseTraitCountRange parses a range like 3-5, or 4 for exactly 4.
+func parseTraitCountRange(s string) (*traitCountRange, error) {
+	parts := strings.SplitN(s, "-", 2)
+	min, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	max := min
+	if err == nil && len(parts) == 2 {
+		max, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+	}
+	if err != nil || min < 0 || max < min {
+		return nil, fmt.Errorf("invalid trait count range %q, e.g. 3-5", s)
+	}
+	return &traitCountRange{Min: min, Max: max}, nil
+}
+
+// newTraitReport reports on the rows of the tokens, or on every row if
+// there are no tokens.
+func newTraitReport(table *attributeTable, tokens []*token, countRange *traitCountRange) *traitReport {
+	var indexes []int
+	if len(tokens) > 0 {
+		for _, t := range tokens {
+			if _, ok := table.rows[t.SourceIndex]; ok {
+				indexes = append(indexes, t.SourceIndex)
+			}
+		}
+	} else {
+		for index := range table.rows {
+			indexes = append(indexes, index)
+		}
+		sort.Ints(indexes)
+	}
+
+	report := &traitReport{Tokens: len(indexes), CountRange: countRange, Anomalies: []traitAnomaly{}}
+	percent := func(count int) float64 {
+		if report.Tokens == 0 {
+			return 0
+		}
+		return math.Round(float64(count)*10000/float64(report.Tokens)) / 100
+	}
+
+	seen := make(map[string]bool)
+	for _, trait := range table.traits {
+		if seen[trait] {
+			report.Anomalies = append(report.Anomalies, traitAnomaly{Problem: fmt.Sprintf("duplicate trait type %v", trait)})
+		}
+		seen[trait] = true
+	}
+
+	counts := make([]map[string]int, len(table.traits))
+	for i := range counts {
+		counts[i] = make(map[string]int)
+	}
+	traitCounts := make(map[int]int)
+	for _, index := range indexes {
+		index := index
+		n := 0
+		byType := make(map[string]int)
+		for i, value := range table.rows[index] {
+			if value == "" {
+				report.Anomalies = append(report.Anomalies, traitAnomaly{TokenID: &index, Problem: fmt.Sprintf("empty %v", table.traits[i])})
+				continue
+			}
+			counts[i][value]++
+			n++
+			if byType[table.traits[i]]++; byType[table.traits[i]] == 2 {
+				report.Anomalies = append(report.Anomalies, traitAnomaly{TokenID: &index, Problem: fmt.Sprintf("several values for %v", table.traits[i])})
+			}
+		}
+		traitCounts[n]++
+		if countRange != nil && (n < countRange.Min || n > countRange.Max) {
+			report.Anomalies = append(report.Anomalies, traitAnomaly{TokenID: &index, Problem: fmt.Sprintf("%v traits", n)})
+		}
+	}
+
+	for i, trait := range table.traits {
+		stats := traitStats{TraitType: trait}
+		for value, count := range counts[i] {
+			stats.Tokens += count
+			stats.Values = append(stats.Values, valueCount{Value: value, Count: count, Percent: percent(count)})
+		}
+		sortValueCounts(stats.Values)
+		report.Traits = append(report.Traits, stats)
+	}
+	for n, count := range traitCounts {
+		report.TraitCounts = append(report.TraitCounts, valueCount{Value: strconv.Itoa(n), Count: count, Percent: percent(count)})
+	}
+	sortValueCounts(report.TraitCounts)
+	return report
+}
+
+// sortValueCounts sorts by decreasing count, then by value.
+func sortValueCounts(values []valueCount) {
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].Count != values[j].Count {
+			return values[i].Count > values[j].Count
+		}
+		return values[i].Value < values[j].Value
+	})
+}
+
+// Print writes the report as tables to w.
+func (r *traitReport) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintf(w, "Traits of %v tokens\n", r.Tokens)
+	for _, stats := range r.Traits {
+		_, _ = fmt.Fprintf(tw, "%v (%v tokens)\n", stats.TraitType, stats.Tokens)
+		for _, v := range stats.Values {
+			_, _ = fmt.Fprintf(tw, "  %v\t%v\t%.2f%%\n", v.Value, v.Count, v.Percent)
+		}
+	}
+	_, _ = fmt.Fprintf(tw, "Number of traits\n")
+	for _, v := range r.TraitCounts {
+		_, _ = fmt.Fprintf(tw, "  %v\t%v\t%.2f%%\n", v.Value, v.Count, v.Percent)
+	}
+	_ = tw.Flush()
+	if len(r.Anomalies) > 0 {
+		_, _ = fmt.Fprintf(w, "%v anomalies\n", len(r.Anomalies))
+		for _, a := range r.Anomalies {
+			if a.TokenID != nil {
+				_, _ = fmt.Fprintf(w, "  %v: %v\n", *a.TokenID, a.Problem)
+			} else {
+				_, _ = fmt.Fprintf(w, "  %v\n", a.Problem)
+			}
+		}
+	}
+}
+
+// Write writes the report as JSON to path.
+func (r *traitReport) Write(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return uploader.WriteFileAtomic(path, data)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// newConnCountingServer returns a TLS server answering every request with
+// a small body, and the number of connections made to it.
+func newConnCountingServer() (*httptest.Server, *int32) {
+	var conns int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"Version":"test"}`))
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.StartTLS()
+	return srv, &conns
+}
+
+// hammer makes rounds of concurrency requests at once to url with client.
+func hammer(t testing.TB, client *http.Client, url string, concurrency, rounds int) {
+	t.Helper()
+	for i := 0; i < rounds; i++ {
+		var wg sync.WaitGroup
+		for j := 0; j < concurrency; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp, err := client.Get(url)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				_, _ = io.Copy(ioutil.Discard, resp.Body)
+				_ = resp.Body.Close()
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// testClients are the transports compared: the default one, keeping 2 idle
+// connections a host, and the one of newHTTPClient keeping maxIdle.
+func testClients(t testing.TB, maxIdle int) map[string]*http.Client {
+	tuned, err := newHTTPClient(clientOptions{
+		InsecureSkipVerify:  true,
+		MaxIdleConnsPerHost: maxIdle,
+		IdleConnTimeout:     90 * time.Second,
+		KeepAlive:           30 * time.Second,
+		ConnectTimeout:      10 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]*http.Client{
+		"default": {Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}},
+		"tuned":   tuned,
+	}
+}
+
+func TestTransportReusesConnections(t *testing.T) {
+	const concurrency, rounds = 16, 20
+	conns := make(map[string]int32)
+	for name, client := range testClients(t, concurrency) {
+		srv, n := newConnCountingServer()
+		hammer(t, client, srv.URL, concurrency, rounds)
+		srv.Close()
+		conns[name] = atomic.LoadInt32(n)
+	}
+	// the default transport closes all but 2 of the connections of every
+	// round, and handshakes them again
+	if conns["tuned"] > 2*concurrency {
+		t.Errorf("the tuned transport made %v connections for %v requests at once", conns["tuned"], concurrency)
+	}
+	if conns["default"] <= 2*conns["tuned"] {
+		t.Errorf("the default transport made %v connections and the tuned one %v, the tuned one should make far fewer", conns["default"], conns["tuned"])
+	}
+	t.Logf("connections for %v rounds of %v requests: default %v, tuned %v", rounds, concurrency, conns["default"], conns["tuned"])
+}
+
+// BenchmarkTransport compares the throughput of the transports, e.g. with
+// go test -bench Transport -run none.
+func BenchmarkTransport(b *testing.B) {
+	const concurrency = 16
+	for name, client := range testClients(b, concurrency) {
+		b.Run(name, func(b *testing.B) {
+			srv, _ := newConnCountingServer()
+			defer srv.Close()
+			b.ResetTimer()
+			hammer(b, client, srv.URL, concurrency, b.N)
+		})
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	// a server accepting connections without ever answering the TLS
+	// handshake: the connect timeout bounds the handshake as well as the
+	// dial
+	stalled, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, c := range conns {
+				_ = c.Close()
+			}
+		}()
+		for {
+			c, err := stalled.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, c)
+		}
+	}()
+	// a server taking longer than the connect timeout to send the body
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 5; i++ {
+			_, _ = w.Write([]byte("chunk"))
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer slow.Close()
+
+	const connectTimeout = 200 * time.Millisecond
+	tests := []struct {
+		name string
+		url  string
+		// connect is whether the request fails to connect, or else
+		// succeeds
+		connect bool
+	}{
+		{"stalled TLS handshake", "https://" + stalled.Addr().String(), true},
+		// a closed port, refusing the connection at once
+		{"refused", "http://127.0.0.1:1", true},
+		{"slow transfer", slow.URL, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := newHTTPClient(clientOptions{ConnectTimeout: connectTimeout})
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			resp, err := client.Get(tt.url)
+			if err == nil {
+				_, err = io.Copy(ioutil.Discard, resp.Body)
+				_ = resp.Body.Close()
+			}
+			elapsed := time.Since(start)
+			if !tt.connect {
+				if err != nil {
+					t.Fatalf("the transfer failed after %v: %v", elapsed, err)
+				}
+				if elapsed < connectTimeout {
+					t.Fatalf("the transfer took %v, not longer than the connect timeout", elapsed)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("the request didn't fail")
+			}
+			if elapsed > 10*connectTimeout {
+				t.Errorf("the request failed after %v, the connect timeout being %v", elapsed, connectTimeout)
+			}
+			if !uploader.IsConnectError(err) || exitCode(err, false) != exitUnreachable {
+				t.Errorf("%v isn't a connection error exiting with %v", err, exitUnreachable)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+var byteUnits = []struct {
+	suffix string
+	size   float64
+}{
+	// longest suffixes first so that "KiB" isn't matched as "B"
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"KB", 1e3},
+	{"MB", 1e6},
+	{"GB", 1e9},
+	{"K", 1e3},
+	{"M", 1e6},
+	{"G", 1e9},
+	{"B", 1},
+}
+
+// parseBytes parses a human readable byte size such as "512KiB" or "20MB".
+// A bare number is a count of bytes.
+func parseBytes(s string) (int64, error) {
+	str := strings.TrimSpace(s)
+	multiplier := 1.0
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(strings.ToUpper(str), strings.ToUpper(unit.suffix)) {
+			str = strings.TrimSpace(str[:len(str)-len(unit.suffix)])
+			multiplier = unit.size
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid byte size %q", s)
+	}
+	return int64(value * multiplier), nil
+}
+
+// parseByteRate parses a rate such as "20MB/s". The "/s" suffix is optional.
+func parseByteRate(s string) (int64, error) {
+	str := strings.TrimSuffix(strings.TrimSpace(s), "/s")
+	rate, err := parseBytes(str)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return rate, nil
+}
+
+// parseHedgeAfter parses when --hedge-after hedges an upload: a multiple of
+// the median duration of the files such as "2x-median", or a duration such
+// as "1m".
+func parseHedgeAfter(s string) (uploader.HedgePolicy, error) {
+	str := strings.TrimSpace(s)
+	if factor := strings.TrimSuffix(strings.ToLower(str), "x-median"); factor != strings.ToLower(str) {
+		f, err := strconv.ParseFloat(factor, 64)
+		if err != nil || f <= 1 {
+			return uploader.HedgePolicy{}, fmt.Errorf("invalid multiple of the median %q, more than 1 such as 2x-median", s)
+		}
+		return uploader.HedgePolicy{Factor: f}, nil
+	}
+	d, err := time.ParseDuration(str)
+	if err != nil || d <= 0 {
+		return uploader.HedgePolicy{}, fmt.Errorf("invalid --hedge-after %q, a multiple of the median such as 2x-median or a duration such as 1m", s)
+	}
+	return uploader.HedgePolicy{After: d}, nil
+}
+
+// formatBytes formats n using decimal units, e.g. "19.8 MB".
+func formatBytes(n float64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	i := 0
+	for n >= 1000 && i < len(units)-1 {
+		n /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %v", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %v", n, units[i])
+}
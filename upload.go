@@ -0,0 +1,1036 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	ipfsFiles "github.com/ipfs/go-ipfs-files"
+	ipfsPath "github.com/ipfs/interface-go-ipfs-core/path"
+	flag "github.com/spf13/pflag"
+	"github.com/xeipuuv/gojsonschema"
+
+	"github.com/INFURA/ipfs-upload-client/internal/strip"
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// uploadRun is a run of runUpload, filled in by its steps one after the
+// other: the path to upload, the metadata of its files, the client of the
+// API, the upload and its outputs.
+type uploadRun struct {
+	o *commonOptions
+
+	// path is uploaded: the standard input if "-", stat being nil as for
+	// an S3 prefix, a tar or zip archive, a directory or a file
+	path           string
+	isStdin        bool
+	stat           os.FileInfo
+	s3Source       *uploader.S3Source
+	archiveListing *uploader.Listing
+	isTar          bool
+	// filtered are the files of a directory left out by --include,
+	// --exclude and its .ipfsignore, skipped like the tokens of --skip-ids
+	filtered      map[string]bool
+	filteredFiles int
+
+	rules           []fileRule
+	tokens          []*token
+	skipped         []*token
+	skipIDs         idList
+	individualJSON  bool
+	placeholderStat os.FileInfo
+	recorded        map[string]cid.Cid
+	royaltyInfo     *royalty
+	mappingKeys     []mappingKey
+	collection      *collectionConfig
+	formatURI       uriFormatter
+	thumbnails      []*token
+	thumbnailStat   os.FileInfo
+	metaOpts        metadataOptions
+	schema          *gojsonschema.Schema
+	// needAPI is false when only reusing recorded CIDs
+	needAPI bool
+
+	bytesPerSecond      int64
+	readBufferSize      int64
+	streamThresholdSize int64
+	ctx                 context.Context
+	// payload counts the uploaded bytes, and limits the rate if requested
+	payload     *throttle
+	metrics     *metrics
+	httpClient  *http.Client
+	via         string
+	quota       *quotaTransport
+	quotaWarned bool
+	requestIDs  *requestIDTransport
+	notify      *notifier
+	useCache    bool
+	start       time.Time
+	summary     runSummary
+	up          *uploader.Uploader
+
+	file          ipfsFiles.Node
+	stdinRead     *stdinReader
+	skip          *skipper
+	thumbnailFile ipfsFiles.Node
+	sums          *uploader.Checksummer
+	stripper      *strip.Stripper
+	rows          *porcelain
+	fileManifest  *manifest
+	// uploadProgress shows the progress of the upload of path
+	uploadProgress *progress
+	// the files added are printed prefixed with addLabel, and counted in
+	// addCount, addLocal being the local path uploaded and addMain whether
+	// it is the path of the run
+	addLabel, addLocal string
+	addCount           *int
+	addMain            bool
+	indexes            map[string]int
+
+	res                                   ipfsPath.Resolved
+	added, thumbnailsAdded, previewsAdded map[string]cid.Cid
+	previewDir                            string
+	previews                              []*token
+	placeholderCID                        cid.Cid
+	// remotePins are the roots uploaded, for --pin-remote
+	remotePins []remotePin
+	// root is undefined when reusing recorded CIDs
+	root cid.Cid
+}
+
+// runUpload runs upload, the default command, and the commands writing the
+// metadata of the files, packing them or syncing them.
+func runUpload(o *commonOptions) error {
+	if *stdin && len(o.args) == 0 {
+		o.args = []string{"-"}
+	}
+	if len(o.args) == 0 {
+		return &usageError{"file or directory path required as an argument"}
+	}
+	if len(o.args) > 1 {
+		return runUploadPaths(o)
+	}
+	if *hedgeAfter != "" && *syncPath == "" {
+		return &usageError{"parameter --hedge-after requires --sync or several paths, which upload the files one by one"}
+	}
+	r := &uploadRun{o: o, path: o.args[0]}
+	if err := r.openSource(); err != nil {
+		return err
+	}
+
+	if *carPath != "" {
+		if r.stat == nil || r.archiveListing != nil {
+			return &usageError{"parameter --car requires a file or a directory"}
+		}
+		return runCAR(o, r.path, r.stat, r.filtered)
+	}
+
+	if *syncPath != "" {
+		if r.stat == nil || !r.stat.IsDir() || r.archiveListing != nil {
+			return &usageError{"parameter --sync requires a directory"}
+		}
+		manifest, err := runSync(o, r.path, r.stat)
+		if err != nil || !*syncMetadata {
+			return err
+		}
+		// the metadata is written from the updated manifest as with
+		// --cids-from, without uploading the files again
+		*cidsFrom = manifest
+	}
+
+	if err := r.planMetadata(); err != nil {
+		return err
+	}
+	if flag.CommandLine.Changed("render-sample") {
+		return r.renderSample()
+	}
+	if err := r.checkMetadata(); err != nil {
+		return err
+	}
+	if err := r.checkAPI(); err != nil {
+		return err
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+	if err := r.connect(ctx); err != nil {
+		return err
+	}
+
+	// the exits from here on write the report of --report with finish
+	if err := r.startReport(); err != nil {
+		return err
+	}
+	if err := r.newUploader(); err != nil {
+		return err
+	}
+	if err := r.openFiles(); err != nil {
+		return err
+	}
+	if err := r.preflight(); err != nil {
+		return err
+	}
+	if *benchSampleCount > 0 {
+		return r.bench()
+	}
+	if err := r.prepareOutputs(); err != nil {
+		return err
+	}
+	if err := r.uploadFiles(); err != nil {
+		return err
+	}
+	if err := r.uploadExtras(); err != nil {
+		return err
+	}
+	return r.publish()
+}
+
+// openSource checks path, listing the files of an archive or S3 prefix and
+// those left out by the filters of a directory.
+func (r *uploadRun) openSource() error {
+	var err error
+	r.isStdin = r.path == "-"
+	if *stdinName != "" && !r.isStdin {
+		return &usageError{"parameter --name requires --stdin"}
+	}
+	if *stdin && !r.isStdin {
+		return &usageError{"parameter --stdin can't be used with a path"}
+	}
+
+	// an S3 prefix is uploaded as the directory of its objects, and the
+	// standard input as a file, stat being nil
+	switch {
+	case r.isStdin:
+		if *skipIDsFlag != "" || *skipIDsFile != "" || *groupByIndex || *dimensions != "" || *previewSize > 0 || *provenancePath != "" || *stripEXIF || *statePath != "" || *checksums != "" || *cidsFrom != "" || *benchSampleCount > 0 {
+			return &usageError{"parameter --stdin can't be used with --skip-ids, --group-by-index, --dimensions, --thumbnails, --provenance, --strip-exif, --state, --checksums, --cids-from or --bench, which read the files, write it to a file instead"}
+		}
+	case uploader.IsS3URL(r.path):
+		// S3 is reached with the proxy, TLS and connection settings of the
+		// API, not bound by its limits
+		s3Opts := r.o.client
+		s3Opts.Concurrency, s3Opts.AutoConcurrency, s3Opts.RequestsPerSecond = 0, nil, 0
+		var s3Client *http.Client
+		if s3Client, err = newHTTPClient(s3Opts); err == nil {
+			r.s3Source, err = uploader.NewS3Source(r.path, s3Client)
+		}
+	default:
+		r.stat, err = os.Lstat(r.path)
+	}
+	if err != nil {
+		return &usageError{err.Error()}
+	}
+
+	// a tar or zip archive is uploaded as the directory it holds, without
+	// being extracted
+	r.isTar = r.stat != nil && r.stat.Mode().IsRegular() && uploader.IsTar(r.path)
+	if r.s3Source != nil || r.isTar || (r.stat != nil && r.stat.Mode().IsRegular() && uploader.IsZip(r.path)) {
+		if *skipIDsFlag != "" || *skipIDsFile != "" || *groupByIndex || *dimensions != "" || *previewSize > 0 || *provenancePath != "" || *stripEXIF || *statePath != "" || *checksums != "" || *cidsFrom != "" || *benchSampleCount > 0 {
+			return &usageError{"an archive or S3 prefix can't be used with --skip-ids, --group-by-index, --dimensions, --thumbnails, --provenance, --strip-exif, --state, --checksums, --cids-from or --bench, which read the files, extract or download it instead"}
+		}
+		switch {
+		case r.s3Source != nil:
+			r.archiveListing, err = r.s3Source.List(context.Background())
+		case r.isTar:
+			r.archiveListing, err = uploader.ListTar(r.path)
+		default:
+			r.archiveListing, err = uploader.ListZip(r.path)
+		}
+		if err != nil {
+			return &usageError{err.Error()}
+		}
+		for _, skipped := range r.archiveListing.Skipped {
+			logs.Warn(fmt.Sprintf("skipping %v, only the regular files and directories of an archive are uploaded", skipped))
+		}
+	}
+
+	if len(*includeFlag) > 0 || len(*excludeFlag) > 0 || !*ignoreHidden {
+		if r.stat == nil || !r.stat.IsDir() || r.archiveListing != nil {
+			return &usageError{"parameters --include, --exclude and --ignore-hidden require a directory"}
+		}
+	}
+	if r.stat != nil && r.stat.IsDir() {
+		ignored, err := readIgnoreFile(filepath.Join(r.path, ignoreFile))
+		if err != nil {
+			return &usageError{err.Error()}
+		}
+		filter, err := newFileFilter(*includeFlag, append(append([]string(nil), *excludeFlag...), ignored...))
+		if err != nil {
+			return &usageError{fmt.Sprintf("parameters --include and --exclude: %v", err)}
+		}
+		if !filter.empty() || !*ignoreHidden {
+			if r.filtered, r.filteredFiles, err = filter.excludedPaths(r.path, !*ignoreHidden); err != nil {
+				return &usageError{err.Error()}
+			}
+		}
+	}
+
+	if *wrap {
+		if r.stat == nil || !r.stat.Mode().IsRegular() || r.archiveListing != nil {
+			return &usageError{"parameter --wrap requires a file, a directory being uploaded as a directory already"}
+		}
+		if *out != "" || *uriList != "" || *mappingPath != "" || *checksums != "" || *statePath != "" || *cidsFrom != "" || *syncPath != "" {
+			return &usageError{"parameter --wrap can't be used with --out, --uri-list, --mapping, --checksums, --state, --cids-from or --sync, which link to the CID of the file"}
+		}
+	}
+	return nil
+}
+
+// checkAPI checks the flags of the API, of the pinning service and of the
+// reading of the files.
+func (r *uploadRun) checkAPI() error {
+	var err error
+	if *onlyHash && (*mock || *statePath != "" || *pinRemote || *benchSampleCount > 0) {
+		return &usageError{"parameter --only-hash can't be used with --mock, --state, --pin-remote or --bench, which need an API"}
+	}
+	if *mock {
+		fake := uploader.NewFakeAPI(*mockFailRate)
+		atExit = append(atExit, fake.Close)
+		*api = fake.URL
+		// the fake is a pinning service too
+		if *pinRemote && *pinEndpoint == "" {
+			*pinEndpoint = fake.URL
+		}
+	}
+	if *pinRemote {
+		if u, err := url.Parse(*pinEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return &usageError{"parameter --pin-endpoint must be the http or https URL of the pinning service, e.g. https://api.pinata.cloud/psa"}
+		}
+		if *pinToken == "" && !*mock {
+			return &usageError{"parameter --pin-token is required by --pin-remote"}
+		}
+		if *pinPoll <= 0 || *pinTimeout <= 0 {
+			return &usageError{"parameters --pin-poll and --pin-timeout must be positive"}
+		}
+	} else if *pinEndpoint != "" || *pinToken != "" || flag.CommandLine.Changed("pin-poll") || flag.CommandLine.Changed("pin-timeout") {
+		return &usageError{"parameters --pin-endpoint, --pin-token, --pin-poll and --pin-timeout require --pin-remote"}
+	}
+	// the fake API accepts any credentials, and --only-hash makes no request
+	if r.needAPI && !*mock && !*onlyHash {
+		if msg := missingCredentials(r.o.provider, *projectId, *projectSecret); msg != "" {
+			return &usageError{msg}
+		}
+	}
+
+	if *bwLimit != "" {
+		r.bytesPerSecond, err = parseByteRate(*bwLimit)
+		if err != nil || r.bytesPerSecond == 0 {
+			return &usageError{"parameter --bwlimit must be a positive rate such as 20MB/s"}
+		}
+	}
+
+	r.readBufferSize, err = parseBytes(*readBuffer)
+	if err != nil {
+		return &usageError{fmt.Sprintf("parameter --read-buffer: %v", err)}
+	}
+	r.streamThresholdSize, err = parseBytes(*streamThreshold)
+	if err != nil {
+		return &usageError{fmt.Sprintf("parameter --stream-threshold: %v", err)}
+	}
+	if *readers > 0 && r.streamThresholdSize > r.readBufferSize {
+		return &usageError{"parameter --stream-threshold must not exceed --read-buffer"}
+	}
+	return nil
+}
+
+// connect sets up the client of the API, its metrics, the rate limit
+// quota, the request IDs, and the notifier of the run.
+func (r *uploadRun) connect(ctx context.Context) error {
+	var err error
+	r.ctx = ctx
+	r.payload = newThrottle(ctx, r.bytesPerSecond)
+
+	if *metricsAddr != "" {
+		r.metrics = newMetrics(r.payload.BytesRead)
+		if r.o.auto != nil {
+			r.metrics.watchConcurrency(r.o.auto.Limit)
+		}
+	}
+
+	r.httpClient, r.via, err = r.o.newAPIClient()
+	if err != nil {
+		return err
+	}
+
+	if r.metrics != nil {
+		r.httpClient.Transport = &metricsTransport{base: r.httpClient.Transport, metrics: r.metrics}
+	}
+	r.quota = &quotaTransport{
+		base: r.httpClient.Transport,
+		headers: quotaHeaders{
+			Limit:     *quotaLimitHeader,
+			Remaining: *quotaRemainingHeader,
+			Reset:     *quotaResetHeader,
+		},
+	}
+	r.httpClient.Transport = r.quota
+	atExit = append(atExit, func() {
+		if q := r.quota.String(); q != "" {
+			logs.Info(fmt.Sprintf("Rate limit remaining: %v", q))
+		}
+	})
+
+	r.requestIDs, err = newRequestIDTransport(r.httpClient.Transport, *requestIDHeader)
+	if err != nil {
+		return &usageError{err.Error()}
+	}
+	r.httpClient.Transport = r.requestIDs
+	logs.With("run_id", r.requestIDs.RunID())
+	if *verbose {
+		logs.Info(fmt.Sprintf("Run ID %v", r.requestIDs.RunID()))
+	}
+
+	if *notifyURL != "" {
+		notifyClient, err := newHTTPClient(r.o.client)
+		if err != nil {
+			return &usageError{err.Error()}
+		}
+		r.notify, err = newNotifier(notifyClient, *notifyURL, *notifyTemplate, *notifyOn)
+		if err != nil {
+			return &usageError{err.Error()}
+		}
+	}
+	if *cacheMode != uploader.CacheModeMtime && *cacheMode != uploader.CacheModeHash {
+		return &usageError{"parameter --cache-mode must be mtime or hash"}
+	}
+	// the cache is of the local paths, and of the endpoint of --mock only
+	// when set
+	r.useCache = !*noCache && !*wrap && r.stat != nil && r.archiveListing == nil && r.recorded == nil && (!*mock || *cacheFile != "") && !*onlyHash
+	if r.useCache && *cacheFile == "" {
+		if *cacheFile, err = uploader.DefaultCacheFile(); err != nil {
+			logs.Warn(fmt.Sprintf("not caching the CIDs: %v", err))
+			r.useCache = false
+		}
+	}
+	return nil
+}
+
+// warnQuota warns once that the rate limit is almost exhausted.
+func (r *uploadRun) warnQuota() {
+	if !r.quotaWarned && r.quota.Low(*quotaWarn) {
+		r.quotaWarned = true
+		logs.Warn(fmt.Sprintf("the rate limit is almost exhausted, remaining %v", r.quota))
+	}
+}
+
+// startReport starts the run, and the report of --report.
+func (r *uploadRun) startReport() error {
+	var err error
+	r.start = time.Now()
+	r.summary = runSummary{RunID: r.requestIDs.RunID(), SkippedIDs: len(r.skipped)}
+	if *reportPath != "" {
+		flags := reportFlags(flag.CommandLine)
+		flags["path"] = redactFlag("path", r.path)
+		endpoints := map[string]string{"api": *api, "connection": r.via}
+		if *mock {
+			endpoints["api"] = "mock"
+		}
+		if *onlyHash {
+			endpoints["api"] = "only-hash"
+		}
+		if *gatewaySubdomain != "" || *gatewayBase != "" {
+			endpoints["gateway"], _ = gatewayPrefix(*gatewaySubdomain, *gatewayBase)
+		}
+		report = newRunReport(*reportPath, &r.summary, flags, endpoints)
+		report.bytes = r.payload.BytesRead
+		report.interrupted = interrupted
+		if r.tokens != nil {
+			report.SetTokens(r.tokens)
+		}
+	}
+	if r.stat != nil && r.stat.IsDir() && *ignoreHidden {
+		if r.summary.SkippedHidden, err = countHidden(r.path); err != nil {
+			logs.Error(err.Error())
+			return finish(r.start, exitUsage)
+		}
+	}
+	if r.summary.SkippedFiltered = r.filteredFiles; r.filteredFiles > 0 {
+		logs.Info(fmt.Sprintf("Leaving out %v files of --include, --exclude and %v", r.filteredFiles, ignoreFile))
+	}
+	return nil
+}
+
+// newUploader returns the uploader of the run, its events printed by
+// printEvent.
+func (r *uploadRun) newUploader() error {
+	var err error
+	r.up, err = uploader.New(uploader.Options{
+		Provider:      r.o.provider,
+		API:           *api,
+		ProjectID:     *projectId,
+		ProjectSecret: *projectSecret,
+		Headers:       r.o.headers,
+		HTTPClient:    r.httpClient,
+		Pin:           *pin,
+		OnlyHash:      *onlyHash,
+		DAG:           r.o.dag,
+		Events:        uploader.EventsFunc(r.printEvent),
+	})
+	if err != nil {
+		logs.Error(err.Error())
+		return finish(r.start, exitUsage)
+	}
+	return nil
+}
+
+// openFiles opens the nodes of path and of --thumbnail-dir.
+func (r *uploadRun) openFiles() error {
+	var err error
+	if r.isStdin {
+		r.stdinRead, err = newStdinReader(os.Stdin)
+		if err != nil {
+			logs.Error(err.Error())
+			return finish(r.start, exitUsage)
+		}
+		r.file = ipfsFiles.NewReaderFile(r.stdinRead)
+	} else if r.s3Source != nil {
+		r.file = r.s3Source.Open(r.ctx, r.archiveListing)
+	} else if r.archiveListing != nil {
+		open := uploader.OpenZip
+		if r.isTar {
+			open = uploader.OpenTar
+		}
+		archiveDir, archive, err := open(r.path, r.archiveListing)
+		if err != nil {
+			logs.Error(err.Error())
+			return finish(r.start, exitUsage)
+		}
+		atExit = append(atExit, func() { _ = archive.Close() })
+		r.file = archiveDir
+	} else {
+		r.file, err = uploader.NewFileNode(r.path, !*ignoreHidden, r.stat)
+		if err != nil {
+			logs.Error(err.Error())
+			return finish(r.start, exitUsage)
+		}
+		if *wrap {
+			r.file = ipfsFiles.NewMapDirectory(map[string]ipfsFiles.Node{filepath.Base(r.path): r.file})
+		}
+	}
+	r.skip = newSkipper(r.skipped, r.filtered)
+	if len(r.skip.paths) > 0 {
+		r.file = r.skip.Wrap(r.file, r.path)
+	}
+
+	if *thumbnailDir != "" {
+		r.thumbnailFile, err = uploader.NewFileNode(*thumbnailDir, false, r.thumbnailStat)
+		if err != nil {
+			logs.Error(err.Error())
+			return finish(r.start, exitUsage)
+		}
+	}
+
+	if *readers > 0 {
+		prefetch := newPrefetcher(r.ctx, *readers, r.readBufferSize, r.streamThresholdSize)
+		// the entries of a tar archive can only be read in order
+		if !r.isTar {
+			r.file = prefetch.Wrap(r.file)
+		}
+		if r.thumbnailFile != nil {
+			r.thumbnailFile = prefetch.Wrap(r.thumbnailFile)
+		}
+	}
+	return nil
+}
+
+// preflight checks the API is reachable and the credentials accepted,
+// before reading the files.
+func (r *uploadRun) preflight() error {
+	if *noPreflight || !r.needAPI || *onlyHash {
+		if *verbose {
+			logs.Info(fmt.Sprintf("Using %v", r.via))
+		}
+		return nil
+	}
+	preflightCtx, cancelPreflight := context.WithTimeout(r.ctx, preflightTimeout)
+	version, err := r.up.Preflight(preflightCtx)
+	cancelPreflight()
+	if err != nil {
+		code := exitCode(err, interrupted())
+		class := uploader.ErrorClass(err)
+		err = describePreflightError(err, r.via, r.requestIDs.Describe())
+		logs.Error(err.Error(), "error_class", class, "request_id", r.requestIDs.LastID(), "exit_code", code)
+		report.SetError(err)
+		r.notify.Finish(r.summary, code, err)
+		return finish(r.start, code)
+	}
+	if *verbose {
+		logEndpoint(version, r.via)
+	}
+	r.warnQuota()
+	return nil
+}
+
+// bench runs --bench, uploading samples of the files of path instead of
+// path.
+func (r *uploadRun) bench() error {
+	levels, err := parseBenchLevels(*benchLevelsFlag)
+	if err != nil {
+		logs.Error(fmt.Sprintf("parameter --bench-levels: %v", err))
+		return finish(r.start, exitUsage)
+	}
+	samples, size, err := benchSamples(r.path, *benchSampleCount, r.filtered)
+	if err == nil && len(samples) == 0 {
+		err = fmt.Errorf("%v has no file to upload", r.path)
+	}
+	if err != nil {
+		logs.Error(err.Error())
+		return finish(r.start, exitUsage)
+	}
+	// the samples are uploaded by the same client, but not pinned
+	benchUp, err := uploader.New(uploader.Options{
+		Provider:      r.o.provider,
+		API:           *api,
+		ProjectID:     *projectId,
+		ProjectSecret: *projectSecret,
+		Headers:       r.o.headers,
+		HTTPClient:    r.httpClient,
+		DAG:           r.o.dag,
+	})
+	if err != nil {
+		logs.Error(err.Error())
+		return finish(r.start, exitUsage)
+	}
+	report, err := bench(r.ctx, benchUp, samples, size, levels)
+	if err == nil && *benchJSON != "" {
+		err = report.Write(*benchJSON)
+	}
+	if err != nil {
+		logs.Error(err.Error())
+		return finish(r.start, exitCode(err, interrupted()))
+	}
+	printBenchReport(os.Stdout, report)
+	return finish(r.start, 0)
+}
+
+// prepareOutputs serves the metrics, and opens what records the files as
+// they are uploaded: the checksums, the rows of --output and --manifest.
+func (r *uploadRun) prepareOutputs() error {
+	var err error
+	if *benchJSON != "" || flag.CommandLine.Changed("bench-levels") {
+		logs.Error("parameters --bench-levels and --bench-json require --bench")
+		return finish(r.start, exitUsage)
+	}
+
+	if r.metrics != nil {
+		stopMetrics, err := r.metrics.Serve(*metricsAddr)
+		if err != nil {
+			logs.Error(err.Error())
+			return finish(r.start, exitUsage)
+		}
+		atExit = append(atExit, stopMetrics)
+	}
+
+	r.start = time.Now()
+
+	if *checksums != "" {
+		r.sums = uploader.NewChecksummer()
+	}
+	if *stripEXIF {
+		r.stripper = newStripper()
+	}
+
+	// the files of the path are written to the standard output instead of
+	// the root with --output, and to --manifest
+	rowsRoot := "."
+	switch {
+	case r.isStdin && *stdinName != "":
+		rowsRoot = *stdinName
+	case r.isStdin:
+		rowsRoot = "-"
+	case r.stat != nil && !r.stat.IsDir() && r.archiveListing == nil && !*wrap:
+		rowsRoot = filepath.Base(r.path)
+	}
+	if *outputFormat != outputText {
+		r.rows = newPorcelain(os.Stdout, *outputFormat, rowsRoot)
+		if r.tokens != nil {
+			r.rows.SetTokens(r.tokens)
+		}
+	}
+	if *manifestPath != "" {
+		r.fileManifest, err = newManifest(*manifestPath, rowsRoot, *manifestInterval)
+		if err != nil {
+			logs.Error(fmt.Sprintf("parameter --manifest: %v", err))
+			return finish(r.start, exitUsage)
+		}
+		if r.tokens != nil {
+			r.fileManifest.rows.SetTokens(r.tokens)
+		}
+	}
+
+	r.indexes = make(map[string]int)
+	for _, t := range r.tokens {
+		r.indexes[t.Path] = t.Index
+	}
+	return nil
+}
+
+// startProgress starts showing the progress of the upload of path, with
+// the sizes of its files when known.
+func (r *uploadRun) startProgress() *progress {
+	mode := progressMode(*progressFlag, *logFormat)
+	if mode == progressNone {
+		return nil
+	}
+	var sizes map[string]int64
+	switch {
+	case r.archiveListing != nil:
+		sizes = make(map[string]int64)
+		for _, f := range r.archiveListing.Files {
+			sizes[f.Name] = f.Size
+		}
+	case r.stat != nil:
+		if l, err := uploader.ListContent(r.path, r.stat, !*ignoreHidden, r.skip.paths); err == nil {
+			sizes = make(map[string]int64)
+			for name, info := range l.Files {
+				sizes[name] = info.Size()
+			}
+		}
+	}
+	p := newProgress(sizes, r.payload.BytesRead)
+	if r.o.auto != nil {
+		p.concurrency = r.o.auto.Limit
+	}
+	p.Start(mode, *progressInterval)
+	return p
+}
+
+// printEvent prints the events of the uploads, of the files added by add.
+func (r *uploadRun) printEvent(e uploader.Event) {
+	if r.addMain && r.rows != nil {
+		r.rows.Event(e)
+	}
+	if r.addMain && r.fileManifest != nil {
+		r.fileManifest.Event(e)
+	}
+	if r.addMain && r.uploadProgress != nil {
+		r.uploadProgress.Event(e)
+	}
+	if report != nil {
+		report.Event(r.addLocal, r.addMain, e)
+	}
+	c, ok := e.(uploader.FileCompleted)
+	if !ok || c.Name == "" {
+		return
+	}
+	if c.Cached {
+		if *verbose {
+			logs.Info(fmt.Sprintf("Reused %v%v %v", r.addLabel, c.Name, ipfsPath.IpfsPath(c.Cid)), "file", r.addLabel+c.Name, "cid", c.Cid)
+		}
+		return
+	}
+	label, count := r.addLabel, r.addCount
+	line := fmt.Sprintf("Added %v%v", label, c.Name)
+	if *verbose {
+		line = fmt.Sprintf("Added %v%v %v | Bytes: %v | Size: %v | Duration: %vms | Attempt: %v", label, c.Name, ipfsPath.IpfsPath(c.Cid), c.Bytes, c.Size, milliseconds(c.Duration), c.Attempts)
+	}
+	if *gatewaySubdomain != "" {
+		line += fmt.Sprintf(" | URL: %v", gatewayURL(*gatewaySubdomain, c.Cid))
+	}
+	*count++
+	if r.metrics != nil {
+		r.metrics.filesAdded.Inc()
+		// from the first event of the file to its addition
+		r.metrics.fileDuration.Observe(c.Duration.Seconds())
+	}
+	if r.bytesPerSecond > 0 {
+		rate := float64(r.payload.BytesRead()) / time.Since(r.start).Seconds()
+		line += fmt.Sprintf(" | Rate: %v/s", formatBytes(rate))
+	}
+	if q := r.quota.String(); q != "" {
+		line += fmt.Sprintf(" | Quota: %v", q)
+	}
+	attrs := []interface{}{"file", label + c.Name, "cid", c.Cid, "bytes", c.Bytes, "duration_ms", c.Duration, "attempt", c.Attempts}
+	if i, ok := r.indexes[c.Name]; ok && r.addMain {
+		attrs = append(attrs, "index", i)
+	}
+	logs.Info(line, attrs...)
+	r.warnQuota()
+}
+
+// add uploads node, read from the local path, printing its files prefixed
+// with label as they are added, and returns the CIDs of the files by name.
+func (r *uploadRun) add(node ipfsFiles.Node, local, label string, count *int) (ipfsPath.Resolved, map[string]cid.Cid, error) {
+	if r.stripper != nil {
+		node = r.stripper.Wrap(node, local)
+	}
+	if r.sums != nil {
+		node = r.sums.Wrap(node, local)
+	}
+	node = r.payload.Wrap(node)
+	// the events are delivered by the time Add returns
+	r.addLabel, r.addLocal, r.addCount = label, local, count
+	res, added, err := r.up.Add(r.ctx, node, nil)
+	if r.sums != nil {
+		r.sums.SetCIDs(local, added)
+	}
+	return res, added, err
+}
+
+// addFile uploads the file at path, printed as added with its CID only.
+func (r *uploadRun) addFile(path string) (ipfsPath.Resolved, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := ipfsFiles.NewSerialFile(path, false, stat)
+	if err != nil {
+		return nil, err
+	}
+	var count int
+	res, _, err := r.add(file, path, "", &count)
+	return res, err
+}
+
+// reuse sends the events of the files of path whose CIDs are the ones of a
+// previous upload, as if they were added, root being undefined when
+// unknown.
+func (r *uploadRun) reuse(root cid.Cid, files map[string]cid.Cid) {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	sortAdded(names)
+	r.addLabel, r.addLocal, r.addMain = "", r.path, true
+	for _, name := range names {
+		r.printEvent(uploader.FileCompleted{Name: name, Cid: files[name], Cached: true})
+	}
+	if root.Defined() {
+		r.printEvent(uploader.FileCompleted{Cid: root, Cached: true})
+	}
+	r.printEvent(uploader.RunCompleted{Root: root, Files: len(names)})
+	r.addMain = false
+}
+
+// fail ends the run on the failure of an upload.
+func (r *uploadRun) fail(err error) error {
+	if uploader.IsConnectError(err) {
+		err = fmt.Errorf("could not connect to the API: %v", err)
+	}
+	if r.metrics != nil {
+		r.metrics.uploadFailed.Inc()
+	}
+	code := exitCode(err, interrupted())
+	class := uploader.ErrorClass(err)
+	err = fmt.Errorf("%v (%v)", err, r.requestIDs.Describe())
+	logs.Error(err.Error(), "error_class", class, "request_id", r.requestIDs.LastID(), "exit_code", code)
+	report.SetError(err)
+	r.summary.Bytes = r.payload.BytesRead()
+	r.notify.Finish(r.summary, code, err)
+	return finish(r.start, code)
+}
+
+// uploadFiles uploads path, unless its CIDs are recorded by --cids-from,
+// cached or recorded by --state, generating the previews of --thumbnails
+// first.
+func (r *uploadRun) uploadFiles() error {
+	if r.recorded != nil {
+		r.added = uploader.CIDsUnder(r.recorded, r.path)
+		if *thumbnailDir != "" {
+			r.thumbnailsAdded = uploader.CIDsUnder(r.recorded, *thumbnailDir)
+		}
+		if *placeholder != "" {
+			c, ok := r.recorded[filepath.Clean(*placeholder)]
+			if !ok {
+				logs.Error(fmt.Sprintf("%v has no CID for %v", *cidsFrom, *placeholder))
+				return finish(r.start, exitUsage)
+			}
+			r.placeholderCID = c
+		}
+		r.reuse(cid.Undef, r.added)
+		return nil
+	}
+
+	var err error
+	if *previewSize > 0 {
+		r.previewDir, err = ioutil.TempDir("", "ipfs-upload-previews")
+		if err != nil {
+			return r.fail(err)
+		}
+		previewDir := r.previewDir
+		atExit = append(atExit, func() { _ = os.RemoveAll(previewDir) })
+		var skipped []string
+		r.previews, skipped, err = generatePreviews(r.ctx, r.tokens, r.previewDir, *previewSize, *previewWorkers)
+		if err != nil {
+			return r.fail(err)
+		}
+		if len(skipped) > 0 {
+			logs.Warn(fmt.Sprintf("no thumbnail for the files which aren't images: %v", strings.Join(skipped, ", ")))
+		}
+	}
+	// the cache is of the local files, reused unless --checksums reads
+	// them
+	var listing *uploader.CacheListing
+	endpoint := *api
+	if *mock {
+		endpoint = "mock"
+	}
+	settings := uploader.CacheSettings(endpoint, *pin, *stripEXIF, r.o.dag.String())
+	if r.res == nil && r.useCache {
+		listing, err = uploader.ListContent(r.path, r.stat, !*ignoreHidden, r.skip.paths)
+		if err != nil {
+			return r.fail(err)
+		}
+		cache, err := uploader.ReadCache(*cacheFile)
+		if err != nil {
+			logs.Warn(fmt.Sprintf("ignoring the cache: %v", err))
+		}
+		if *cacheMode == uploader.CacheModeHash {
+			hashStart := time.Now()
+			hashed, err := listing.Hash(r.ctx, cache, settings, r.path, r.stat, *stripEXIF, runtime.NumCPU())
+			if err != nil {
+				return r.fail(err)
+			}
+			r.summary.CacheHashTime = time.Since(hashStart).Round(time.Millisecond).String()
+			logs.Info(fmt.Sprintf("Hashed %v of %v files in %v", hashed, len(listing.Files), r.summary.CacheHashTime))
+		}
+		if c, files := cache.Lookup(settings, r.path, listing); c.Defined() && r.sums == nil {
+			logs.Info(fmt.Sprintf("%v didn't change since its upload, reusing the CIDs cached in %v", r.path, *cacheFile))
+			r.res, r.added = ipfsPath.IpfsPath(c), files
+			r.summary.CacheHits = len(listing.Files)
+			listing = nil
+			r.reuse(r.res.Cid(), r.added)
+		}
+	}
+	var hashes *uploader.ContentHashes
+	if *statePath != "" && r.res == nil {
+		hashes, err = uploader.HashContent(r.path, r.stat, *stripEXIF, !*ignoreHidden, r.skip.paths)
+		if err != nil {
+			return r.fail(err)
+		}
+		state, err := uploader.ReadState(*statePath)
+		if err != nil {
+			return r.fail(err)
+		}
+		if e := state.Lookup(hashes.Root, *api, *pin); e != nil {
+			c, err := cid.Decode(e.CID)
+			files := state.RecordedCIDs(hashes, *api, *pin)
+			if err == nil && files != nil {
+				logs.Info(fmt.Sprintf("%v was uploaded before, reusing the CIDs recorded in %v", r.path, *statePath))
+				r.res, r.added = ipfsPath.IpfsPath(c), files
+				r.reuse(c, r.added)
+			}
+		}
+	}
+	if r.res != nil {
+		return nil
+	}
+
+	r.addMain = true
+	r.uploadProgress = r.startProgress()
+	r.res, r.added, err = r.add(r.file, r.path, "", &r.summary.Files)
+	r.uploadProgress.Stop()
+	r.addMain = false
+	if err != nil {
+		// --state only records the directories uploaded whole
+		if hashes != nil && r.stat.IsDir() {
+			logs.Info(fmt.Sprintf("--state doesn't resume the upload of a directory, --sync <manifest.csv> %v uploads it file by file and resumes from the manifest", r.path))
+		}
+		return r.fail(err)
+	}
+	if r.stdinRead != nil {
+		// the size of the standard input is known once uploaded
+		for _, t := range r.tokens {
+			t.Size = r.stdinRead.n
+		}
+	}
+	if hashes != nil {
+		err := uploader.UpdateState(*statePath, func(s *uploader.State) {
+			now := time.Now().UTC()
+			kind := "file"
+			if r.stat.IsDir() {
+				kind = "directory"
+			}
+			s.Record(hashes.Root, kind, r.res.Cid(), hashes.Size, *api, *pin, now)
+			for name, hash := range hashes.Files {
+				if c, ok := r.added[name]; ok {
+					s.Record(hash, "file", c, hashes.Sizes[name], *api, *pin, now)
+				}
+			}
+		})
+		if err != nil {
+			logs.Warn(fmt.Sprintf("recording the upload in %v: %v", *statePath, err))
+		}
+	}
+	if listing != nil {
+		err := uploader.UpdateCache(*cacheFile, func(c *uploader.Cache) error {
+			return c.Record(settings, r.path, listing, r.added)
+		})
+		if err != nil {
+			logs.Warn(fmt.Sprintf("caching the CIDs in %v: %v", *cacheFile, err))
+		}
+	}
+	return nil
+}
+
+// uploadExtras uploads the thumbnails of --thumbnail-dir, the previews of
+// --thumbnails and the --placeholder, then prints the root of path.
+func (r *uploadRun) uploadExtras() error {
+	var err error
+	if r.thumbnailFile != nil && r.recorded == nil {
+		var thumbnailRes ipfsPath.Resolved
+		label := filepath.Base(*thumbnailDir) + "/"
+		thumbnailRes, r.thumbnailsAdded, err = r.add(r.thumbnailFile, *thumbnailDir, label, &r.summary.Thumbnails)
+		if err != nil {
+			return r.fail(err)
+		}
+		logs.Info(fmt.Sprintf("Thumbnails: %v", thumbnailRes.Cid()))
+		r.remotePins = append(r.remotePins, remotePin{Name: filepath.Base(*thumbnailDir), Cid: thumbnailRes.Cid()})
+	}
+
+	if len(r.previews) > 0 {
+		previewStat, err := os.Stat(r.previewDir)
+		if err != nil {
+			return r.fail(err)
+		}
+		previewFile, err := uploader.NewFileNode(r.previewDir, false, previewStat)
+		if err != nil {
+			return r.fail(err)
+		}
+		var previewRes ipfsPath.Resolved
+		previewRes, r.previewsAdded, err = r.add(previewFile, r.previewDir, "previews/", &r.summary.Previews)
+		if err != nil {
+			return r.fail(err)
+		}
+		logs.Info(fmt.Sprintf("Previews: %v", previewRes.Cid()))
+		r.remotePins = append(r.remotePins, remotePin{Name: filepath.Base(r.previewDir), Cid: previewRes.Cid()})
+	}
+
+	if *placeholder != "" && r.recorded == nil {
+		placeholderFile, err := ipfsFiles.NewSerialFile(*placeholder, false, r.placeholderStat)
+		if err != nil {
+			return r.fail(err)
+		}
+		var count int
+		placeholderRes, _, err := r.add(placeholderFile, *placeholder, "", &count)
+		if err != nil {
+			return r.fail(err)
+		}
+		r.placeholderCID = placeholderRes.Cid()
+		logs.Info(fmt.Sprintf("Placeholder: %v", r.placeholderCID))
+	}
+
+	if r.res != nil {
+		r.root = r.res.Cid()
+		r.summary.Root = r.root.String()
+		r.remotePins = append([]remotePin{{Name: filepath.Base(r.path), Cid: r.root}}, r.remotePins...)
+		if r.rows != nil {
+			logs.Info(fmt.Sprintf("Root: %v", r.root), "root", r.root)
+		} else {
+			_, _ = fmt.Fprintln(os.Stdout, r.root.String())
+		}
+		if *gatewaySubdomain != "" {
+			logs.Info(gatewayURL(*gatewaySubdomain, r.root))
+		}
+	}
+	return nil
+}
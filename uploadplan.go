@@ -0,0 +1,501 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// planMetadata checks the flags of the metadata, and reads the tokens of
+// the files of path with their dimensions, thumbnails and attributes.
+func (r *uploadRun) planMetadata() error {
+	var err error
+	if *groupByIndex {
+		if *fileMap == "" {
+			return &usageError{"parameter --group-by-index requires --map"}
+		}
+		if *thumbnailDir != "" || flag.CommandLine.Changed("image-field") {
+			return &usageError{"parameter --group-by-index can't be used with --thumbnail-dir or --image-field, use --map instead"}
+		}
+		r.rules, err = parseFileRules(*fileMap)
+		if err != nil {
+			return &usageError{err.Error()}
+		}
+	} else if *fileMap != "" {
+		return &usageError{"parameter --map requires --group-by-index"}
+	}
+
+	switch *uploadJSON {
+	case "", "individual":
+	case "directory":
+		*uploadMetadata = true
+	default:
+		return &usageError{"parameter --upload-json must be directory or individual"}
+	}
+	r.individualJSON = *uploadJSON == "individual"
+	if r.individualJSON && (*uploadMetadata || *uriFormat == "path") {
+		return &usageError{"parameter --upload-json individual can't be used with --upload-metadata or --uri-format path"}
+	}
+	if (*uploadMetadata || r.individualJSON) && *out == "" {
+		return &usageError{"parameters --upload-metadata and --upload-json require --out"}
+	}
+
+	if *placeholder != "" {
+		if *out == "" {
+			return &usageError{"parameter --placeholder requires --out"}
+		}
+		r.placeholderStat, err = os.Stat(*placeholder)
+		if err != nil {
+			return &usageError{err.Error()}
+		}
+		if r.placeholderStat.IsDir() {
+			return &usageError{fmt.Sprintf("placeholder %v is a directory", *placeholder)}
+		}
+	}
+
+	if *cidsFrom != "" {
+		if *out == "" {
+			return &usageError{"parameter --cids-from requires --out"}
+		}
+		if *uriList != "" && *uriFormat == "path" {
+			return &usageError{"parameter --uri-format path requires uploading the files, the root CID isn't recorded by --checksums"}
+		}
+		r.recorded, err = uploader.ReadRecordedCIDs(*cidsFrom)
+		if err != nil {
+			return &usageError{err.Error()}
+		}
+	}
+	if *previewSize < 0 || *previewWorkers < 0 || !validFieldPath(*previewField) {
+		return &usageError{"parameters --thumbnails must be positive, --thumbnail-workers positive and --preview-field a field path"}
+	}
+	if *previewWorkers == 0 {
+		*previewWorkers = runtime.NumCPU()
+	}
+	if *previewSize > 0 && (*out == "" || r.recorded != nil) {
+		return &usageError{"parameter --thumbnails requires --out and can't be used with --cids-from"}
+	}
+	if flag.CommandLine.Changed("royalty-bps") || *royaltyRecipient != "" {
+		if err := checkRoyalty(*royaltyBPS, *royaltyRecipient); err != nil {
+			return &usageError{err.Error()}
+		}
+		if !validFieldPath(*royaltyBPSField) || !validFieldPath(*royaltyRecipientField) {
+			return &usageError{"parameters --royalty-bps-field and --royalty-recipient-field must be field paths"}
+		}
+		r.royaltyInfo = &royalty{
+			BPS:            *royaltyBPS,
+			Recipient:      *royaltyRecipient,
+			BPSField:       *royaltyBPSField,
+			RecipientField: *royaltyRecipientField,
+		}
+	}
+	if r.royaltyInfo == nil && *tokenRoyalty {
+		return &usageError{"parameter --token-royalty requires --royalty-bps"}
+	}
+	if *mappingPath != "" {
+		r.mappingKeys, err = parseMappingKeys(*mappingKeysFlag)
+		if err != nil {
+			return &usageError{err.Error()}
+		}
+		for _, k := range r.mappingKeys {
+			if (k.Field == "uri" && !*uploadMetadata && !r.individualJSON) || (k.Field == "metadataCid" && !r.individualJSON) {
+				return &usageError{"the uri of --mapping-keys requires --upload-metadata or --upload-json, and metadataCid --upload-json individual"}
+			}
+		}
+	}
+	if *collectionMetadata != "" {
+		if *out == "" {
+			return &usageError{"parameter --collection-metadata requires --out"}
+		}
+		r.collection, err = readCollectionConfig(*collectionMetadata)
+		if err != nil {
+			return &usageError{err.Error()}
+		}
+	}
+	r.needAPI = r.recorded == nil || *uploadMetadata || r.individualJSON
+
+	if *uriList != "" {
+		r.formatURI, err = newURIFormatter(*uriFormat, *gatewaySubdomain, *gatewayBase, *prefix)
+		if err != nil {
+			return &usageError{err.Error()}
+		}
+	}
+
+	if err := r.scanTokens(); err != nil {
+		return err
+	}
+	attributes, err := r.readAttributes()
+	if err != nil {
+		return err
+	}
+	return r.planMetadataOptions(attributes)
+}
+
+// scanTokens reads the tokens of the files of path, less those of
+// --skip-ids, with their dimensions and thumbnails.
+func (r *uploadRun) scanTokens() error {
+	var err error
+	if err := parseIDList(*skipIDsFlag, &r.skipIDs); err != nil {
+		return &usageError{fmt.Sprintf("parameter --skip-ids: %v", err)}
+	}
+	if *skipIDsFile != "" {
+		if err := readIDList(*skipIDsFile, &r.skipIDs); err != nil {
+			return &usageError{err.Error()}
+		}
+	}
+	if len(r.skipIDs) > 0 && !r.stat.IsDir() {
+		return &usageError{"parameter --skip-ids requires a directory"}
+	}
+
+	if *out != "" || *uriList != "" || *provenancePath != "" || *rarityCSV != "" || *mappingPath != "" || len(r.skipIDs) > 0 || flag.CommandLine.Changed("render-sample") {
+		if r.isStdin {
+			if *stdinName == "" {
+				return &usageError{"the metadata of --stdin requires --name"}
+			}
+			r.tokens, err = stdinTokens(*stdinName)
+		} else if r.archiveListing != nil {
+			r.tokens, err = scanListingTokens(r.archiveListing)
+		} else if *groupByIndex {
+			r.tokens, err = scanGroups(r.path, r.rules, !*ignoreHidden, r.filtered)
+		} else {
+			r.tokens, err = scanTokens(r.path, !*ignoreHidden, r.filtered)
+		}
+		if err != nil {
+			return &usageError{err.Error()}
+		}
+		if len(r.tokens) == 0 {
+			logs.Warn("no file is named after a number, no metadata will be written")
+		}
+		if *shuffleSeed != "" {
+			seed, err := parseShuffleSeed(*shuffleSeed)
+			if err != nil {
+				return &usageError{fmt.Sprintf("invalid --shuffle-seed %q, must be a 64-bit number", *shuffleSeed)}
+			}
+			shuffleTokens(r.tokens, seed)
+		}
+		// the ids are the token ids, shuffled or not
+		r.tokens, r.skipped = skipTokens(r.tokens, r.skipIDs)
+		if missing := missingFiles(r.tokens, r.rules); len(missing) > 0 {
+			msg := fmt.Sprintf("missing files: %v", strings.Join(missing, ", "))
+			if !*allowIncompleteGroups {
+				return &usageError{msg}
+			}
+			logs.Warn(msg)
+		}
+	}
+
+	if *dimensions != "" {
+		if *dimensions != "attributes" && *dimensions != "properties" {
+			return &usageError{"parameter --dimensions must be attributes or properties"}
+		}
+		// the metadata is written without them, listed with --verbose
+		failed := readDimensions(r.tokens)
+		if len(failed) > 0 && *verbose {
+			logs.Info(fmt.Sprintf("No dimensions for: %v", strings.Join(failed, ", ")))
+		}
+	}
+
+	if *thumbnailDir != "" {
+		if *out == "" && !flag.CommandLine.Changed("render-sample") {
+			return &usageError{"parameter --thumbnail-dir requires --out"}
+		}
+		r.thumbnailStat, err = os.Lstat(*thumbnailDir)
+		if err != nil {
+			return &usageError{err.Error()}
+		}
+		r.thumbnails, err = scanTokens(*thumbnailDir, false, nil)
+		if err != nil {
+			return &usageError{err.Error()}
+		}
+		if missing := attachThumbnails(r.tokens, r.thumbnails); len(missing) > 0 {
+			logs.Warn(fmt.Sprintf("%v has no thumbnail for the video and audio files: %v", *thumbnailDir, formatIndexes(missing)))
+		}
+	}
+	return nil
+}
+
+// readAttributes reads the attributes of --attributes-csv, scoring their
+// rarity and reporting their traits if requested.
+func (r *uploadRun) readAttributes() (*attributeTable, error) {
+	var attributes *attributeTable
+	var err error
+	if *attributesCSV != "" {
+		attributes, err = readAttributes(*attributesCSV)
+		if err != nil {
+			return nil, &usageError{err.Error()}
+		}
+		missing, extra := attributes.Check(r.tokens)
+		extra = withoutSkipped(extra, r.skipped)
+		if len(extra) > 0 {
+			logs.Warn(fmt.Sprintf("%v has rows for missing files: %v", *attributesCSV, formatIndexes(extra)))
+		}
+		if len(missing) > 0 {
+			msg := fmt.Sprintf("%v has no row for the files: %v", *attributesCSV, formatIndexes(missing))
+			if !*allowMissingAttributes {
+				return nil, &usageError{msg}
+			}
+			logs.Warn(msg)
+		}
+	}
+
+	if *rarityAttribute != "" || *rarityCSV != "" {
+		method, ok := rarityMethods[*rarityMethodName]
+		if !ok {
+			return nil, &usageError{"parameter --rarity-method must be statistical"}
+		}
+		if attributes == nil {
+			return nil, &usageError{"parameters --rarity-attribute and --rarity-csv require --attributes-csv"}
+		}
+		if missing := attributes.SetRarity(r.tokens, method, *rarityAttribute); len(missing) > 0 {
+			logs.Warn(fmt.Sprintf("the files without a row in %v have no rarity score: %v", *attributesCSV, formatIndexes(missing)))
+		}
+		if *rarityCSV != "" {
+			if err := attributes.WriteRarity(*rarityCSV); err != nil {
+				return nil, &usageError{err.Error()}
+			}
+		}
+	}
+	if *traitReportPath != "" {
+		if attributes == nil {
+			return nil, &usageError{"parameter --trait-report requires --attributes-csv"}
+		}
+		var countRange *traitCountRange
+		if *traitCount != "" {
+			countRange, err = parseTraitCountRange(*traitCount)
+			if err != nil {
+				return nil, &usageError{err.Error()}
+			}
+		}
+		report := newTraitReport(attributes, r.tokens, countRange)
+		report.Print(os.Stderr)
+		if err := report.Write(*traitReportPath); err != nil {
+			return nil, &usageError{err.Error()}
+		}
+	}
+	return attributes, nil
+}
+
+// planMetadataOptions sets the options the metadata is rendered with, and
+// writes the --provenance of the files.
+func (r *uploadRun) planMetadataOptions(attributes *attributeTable) error {
+	var err error
+	metadataPrefix := *prefix
+	switch *metadataURLStyle {
+	case "custom":
+	case "ipfs":
+		metadataPrefix = "ipfs://"
+	case "gateway":
+		metadataPrefix, err = gatewayPrefix(*gatewaySubdomain, *gatewayBase)
+		if err != nil {
+			return &usageError{err.Error()}
+		}
+	default:
+		return &usageError{"parameter --metadata-url-style must be ipfs, gateway or custom"}
+	}
+
+	r.metaOpts = metadataOptions{
+		Prefix:       metadataPrefix,
+		Name:         *nameTemplate,
+		Description:  *description,
+		ExternalURL:  *externalURL,
+		Attributes:   attributes,
+		ImageField:   *imageField,
+		PreviewField: *previewField,
+		MediaType:    *mediaType,
+		Dimensions:   *dimensions,
+		Standard:     *standard,
+		Decimals:     *decimals,
+		Combined:     *combinedJSON,
+		MergeDir:     *mergeJSON,
+		Extension:    *jsonExtension,
+		FileTemplate: *jsonNameTemplate,
+		Format: jsonFormat{
+			Indent:  *jsonIndent,
+			Compact: *jsonCompact,
+			Newline: *jsonNewline,
+		},
+	}
+	if !validFieldPath(*imageField) {
+		return &usageError{fmt.Sprintf("invalid --image-field %q", *imageField)}
+	}
+	if *metadataTemplate != "" && flag.CommandLine.Changed("image-field") {
+		return &usageError{"parameters --image-field and --metadata-template can't be used together"}
+	}
+	if *standard != erc721 && *standard != erc1155 {
+		return &usageError{"parameter --standard must be erc721 or erc1155"}
+	}
+	if (*hexIDs || flag.CommandLine.Changed("decimals")) && *standard != erc1155 {
+		return &usageError{"parameters --hex-ids and --decimals require --standard erc1155"}
+	}
+	if *tokenRoyalty {
+		r.metaOpts.Royalty = r.royaltyInfo
+	}
+	if *hexIDs {
+		if *jsonNameTemplate != "" {
+			return &usageError{"parameters --hex-ids and --json-name-template can't be used together"}
+		}
+		r.metaOpts.FileTemplate = "{id}" + *jsonExtension
+	}
+	if *locales != "" {
+		list := localeList(*locales)
+		if len(list) < 2 || *localizedDir == "" {
+			return &usageError{"parameter --locales requires a default and another locale, and --localized-dir"}
+		}
+		// the URI of the localized files is only known once uploaded
+		if !*hexIDs || !*uploadMetadata || *metadataTemplate != "" || *mergeJSON != "" {
+			return &usageError{"parameter --locales requires --hex-ids and --upload-metadata, and can't be used with --metadata-template or --merge-json"}
+		}
+		r.metaOpts.Localization, err = readLocalizations(*localizedDir, list)
+		if err != nil {
+			return &usageError{err.Error()}
+		}
+		for _, missing := range r.metaOpts.Localization.Missing(r.tokens, r.metaOpts) {
+			logs.Warn(fmt.Sprintf("no translation, using %v, for %v", list[0], missing))
+		}
+	}
+	if *jsonNameTemplate != "" && flag.CommandLine.Changed("json-extension") {
+		return &usageError{"parameters --json-name-template and --json-extension can't be used together"}
+	}
+	if err := checkMetadataNames(r.tokens, r.metaOpts); err != nil {
+		return &usageError{err.Error()}
+	}
+	if *jsonIndent < 0 {
+		return &usageError{"parameter --json-indent can't be negative"}
+	}
+	if *mergeJSON != "" && *out == "" {
+		return &usageError{"parameter --merge-json requires --out"}
+	}
+	if *mergeJSON != "" && *metadataTemplate != "" {
+		return &usageError{"parameters --merge-json and --metadata-template can't be used together"}
+	}
+	if (*inputSchema != "" && *mergeJSON == "") || (*inputSchemaWarn && *inputSchema == "") {
+		return &usageError{"parameter --input-schema requires --merge-json, and --input-schema-warn --input-schema"}
+	}
+	if *mergeJSON != "" {
+		if errs := checkMergeInputs(r.tokens, r.metaOpts); len(errs) > 0 {
+			for _, err := range errs {
+				logs.Error(err.Error())
+			}
+			return &exitError{exitUsage}
+		}
+	}
+	if *inputSchema != "" {
+		schema, err := loadSchema(*inputSchema)
+		if err != nil {
+			return &usageError{err.Error()}
+		}
+		violations, invalid, err := validateMergeInputs(r.tokens, r.metaOpts, schema)
+		if err != nil {
+			return &usageError{err.Error()}
+		}
+		for _, v := range violations {
+			if *inputSchemaWarn {
+				logs.Warn(v)
+			} else {
+				logs.Error(v)
+			}
+		}
+		if len(invalid) > 0 && !*inputSchemaWarn {
+			return &usageError{fmt.Sprintf("the documents of %v don't match %v: %v", *mergeJSON, *inputSchema, formatIndexes(invalid))}
+		}
+	}
+	if *metadataTemplate != "" {
+		r.metaOpts.Template, err = parseTemplate(*metadataTemplate)
+		if err != nil {
+			return &usageError{err.Error()}
+		}
+	}
+	if *extraFieldsPath != "" {
+		r.metaOpts.Extra, err = readExtraFields(*extraFieldsPath, *extraFieldsOverride)
+		if err != nil {
+			return &usageError{err.Error()}
+		}
+	} else if *extraFieldsOverride {
+		return &usageError{"parameter --extra-fields-override requires --extra-fields"}
+	}
+
+	if *provenancePath != "" {
+		record, err := newProvenance(r.tokens, *stripEXIF, *shuffleSeed)
+		if err == nil {
+			err = record.Write(*provenancePath)
+		}
+		if err != nil {
+			return &usageError{err.Error()}
+		}
+		logs.Info(fmt.Sprintf("Provenance: %v", record.Provenance))
+	}
+	return nil
+}
+
+// renderSample prints the metadata of the token of --render-sample.
+func (r *uploadRun) renderSample() error {
+	for _, t := range r.tokens {
+		if t.Index == *renderSample {
+			if *previewSize > 0 {
+				t.Preview = &token{Index: t.Index, Filename: t.Filename}
+			}
+			data, err := renderMetadata(t, r.metaOpts)
+			if err != nil {
+				return &usageError{err.Error()}
+			}
+			_, _ = fmt.Fprintln(os.Stdout, strings.TrimSpace(string(data)))
+			return nil
+		}
+	}
+	return &usageError{fmt.Sprintf("no file has the token index %v", *renderSample)}
+}
+
+// checkMetadata renders the metadata of the first token and validates the
+// metadata of all against the schema of --validate-metadata, failing fast
+// rather than after the upload.
+func (r *uploadRun) checkMetadata() error {
+	var err error
+	// fail fast on template and --extra-fields errors rather than after the
+	// upload
+	if (r.metaOpts.Template != nil || r.metaOpts.Extra != nil) && len(r.tokens) > 0 {
+		if _, err := renderMetadata(r.tokens[0], r.metaOpts); err != nil {
+			return &usageError{err.Error()}
+		}
+	}
+
+	if *validate {
+		r.schema, err = loadSchema(*schemaPath)
+		if err != nil {
+			return &usageError{err.Error()}
+		}
+	} else if *schemaPath != "" || *validateWarn {
+		return &usageError{"parameters --metadata-schema and --validate-warn require --validate-metadata"}
+	}
+	// fail fast on invalid metadata, the CIDs don't matter to the schema
+	if r.schema != nil && !*validateWarn {
+		if err := r.validateTokens(); err != nil {
+			return &usageError{err.Error()}
+		}
+	}
+	return nil
+}
+
+// validateTokens reports the schema violations of the metadata, and
+// returns an error for them unless --validate-warn is set.
+func (r *uploadRun) validateTokens() error {
+	violations, err := validateMetadata(r.tokens, r.metaOpts, r.schema)
+	if err != nil {
+		return err
+	}
+	for _, v := range violations {
+		if *validateWarn {
+			logs.Warn(v)
+		} else {
+			logs.Error(v)
+		}
+	}
+	if len(violations) > 0 && !*validateWarn {
+		return errors.New("the metadata doesn't match the schema")
+	}
+	return nil
+}
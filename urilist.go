@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/ipfs/go-cid"
+
+	"github.com/INFURA/ipfs-upload-client/pkg/uploader"
+)
+
+// missingURI stands for an index without a file in the URI list.
+const missingURI = "MISSING"
+
+// uriFormatter returns the URI of t in the upload with the root CID.
+type uriFormatter func(t *token, root cid.Cid) string
+
+// newURIFormatter returns the formatter of --uri-format: ipfs for
+// ipfs://<cid>, gateway for the gateway URL, see gatewayPrefix, path for
+// ipfs://<root>/<path> and prefix for the URL made with prefix.
+func newURIFormatter(format, subdomain, gatewayBase, prefix string) (uriFormatter, error) {
+	switch format {
+	case "ipfs":
+		return func(t *token, root cid.Cid) string {
+			return "ipfs://" + t.CID()
+		}, nil
+	case "gateway":
+		gateway, err := gatewayPrefix(subdomain, gatewayBase)
+		if err != nil {
+			return nil, err
+		}
+		return func(t *token, root cid.Cid) string {
+			return gateway + t.CID()
+		}, nil
+	case "path":
+		return func(t *token, root cid.Cid) string {
+			if t.Path == "" {
+				return "ipfs://" + root.String()
+			}
+			return "ipfs://" + root.String() + (&url.URL{Path: "/" + t.Path}).EscapedPath()
+		}, nil
+	case "prefix":
+		return func(t *token, root cid.Cid) string {
+			return t.URL(prefix)
+		}, nil
+	default:
+		return nil, fmt.Errorf("parameter --uri-format must be ipfs, gateway, path or prefix")
+	}
+}
+
+// writeURIList writes the URI of every token to path, one per line from
+// the lowest index of the tokens and the skipped ones to the highest, with
+// skippedURI for the skipped indexes and missingURI for the other gaps, so
+// that the lines follow the token ids.
+func writeURIList(path string, tokens []*token, skipped map[int]bool, root cid.Cid, format uriFormatter) error {
+	byIndex := make(map[int]*token)
+	var indexes []int
+	for _, t := range tokens {
+		byIndex[t.Index] = t
+		indexes = append(indexes, t.Index)
+	}
+	for index := range skipped {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	var buf bytes.Buffer
+	if len(indexes) > 0 {
+		for index := indexes[0]; index <= indexes[len(indexes)-1]; index++ {
+			uri := missingURI
+			if t, ok := byIndex[index]; ok {
+				uri = format(t, root)
+			} else if skipped[index] {
+				uri = skippedURI
+			}
+			buf.WriteString(uri + "\n")
+		}
+	}
+	return uploader.WriteFileAtomic(path, buf.Bytes())
+}
+
+// writeIDList writes the id and URI of every token to path as CSV lines,
+// for ERC-1155 collections whose ids needn't be contiguous. The ids are the
+// hex ids of tokenID if hex is set, the indexes otherwise.
+func writeIDList(path string, tokens []*token, root cid.Cid, format uriFormatter, hex bool) error {
+	var buf bytes.Buffer
+	for _, t := range tokens {
+		id := strconv.Itoa(t.Index)
+		if hex {
+			id = tokenID(t.Index)
+		}
+		buf.WriteString(id + "," + format(t, root) + "\n")
+	}
+	return uploader.WriteFileAtomic(path, buf.Bytes())
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+)
+
+func TestWriteURIList(t *testing.T) {
+	format := func(t *token, root cid.Cid) string { return t.Path }
+	tokens := func(indexes ...int) []*token {
+		var tokens []*token
+		for _, index := range indexes {
+			tokens = append(tokens, &token{Index: index, Path: strings.Repeat("x", index)})
+		}
+		return tokens
+	}
+	tests := []struct {
+		name    string
+		tokens  []*token
+		skipped []int
+		want    []string
+	}{
+		{"contiguous", tokens(1, 2, 3), nil, []string{"x", "xx", "xxx"}},
+		{"gap", tokens(1, 3), nil, []string{"x", missingURI, "xxx"}},
+		{"skipped inside", tokens(1, 3), []int{2}, []string{"x", skippedURI, "xxx"}},
+		{"skipped at the edges", tokens(3, 4, 5), []int{1, 2, 6}, []string{skippedURI, skippedURI, "xxx", "xxxx", "xxxxx", skippedURI}},
+		{"every token skipped", nil, []int{1, 2}, []string{skippedURI, skippedURI}},
+		{"from zero", tokens(0, 1), nil, []string{"", "x"}},
+		{"none", nil, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			skipped := make(map[int]bool)
+			for _, index := range tt.skipped {
+				skipped[index] = true
+			}
+			path := filepath.Join(t.TempDir(), "uris.txt")
+			if err := writeURIList(path, tt.tokens, skipped, cid.Undef, format); err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var lines []string
+			if len(data) > 0 {
+				lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+			}
+			if strings.Join(lines, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("got %q, want %q", lines, tt.want)
+			}
+		})
+	}
+}
+
+func TestURIListSkipIDs(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"img/1.png": "1", "img/2.png": "2", "img/3.png": "3", "img/4.png": "4", "img/5.png": "5", "img/6.png": "6"})
+
+	if _, code := runMain(t, dir, "--mock", "--skip-ids", "1,2,6", "--uri-list", "uris.txt", "img"); code != exitSuccess {
+		t.Fatalf("exit code %v", code)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "uris.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("got %v lines, want one per token id 1 to 6:\n%s", len(lines), data)
+	}
+	for i, line := range lines {
+		skipped := i == 0 || i == 1 || i == 5
+		if (line == skippedURI) != skipped || (!skipped && !strings.HasPrefix(line, "ipfs://")) {
+			t.Errorf("line %v of token %v is %q", i+1, i+1, line)
+		}
+	}
+}
+
+func TestURIListUploadMetadata(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"img/1.png": "1", "img/2.png": "2"})
+
+	out, code := runMain(t, dir, "--mock", "--out", "meta", "--upload-metadata", "--uri-format", "path", "--uri-list", "uris.txt", "img")
+	if code != exitSuccess {
+		t.Fatalf("exit code %v", code)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "uris.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %v lines, want 2:\n%s", len(lines), data)
+	}
+	// the standard output has the root of the images, not of the metadata
+	images := strings.TrimSpace(out)
+	for i, line := range lines {
+		root := strings.TrimSuffix(strings.TrimPrefix(line, "ipfs://"), "/"+strconv.Itoa(i+1)+".json")
+		if root == line || root == images {
+			t.Errorf("line %v is %q, not in the metadata directory", i+1, line)
+		}
+	}
+}